@@ -1,10 +1,33 @@
 // The `api` component implements the ESPHome native API server; this is required
 // to communicate with Home Assistant using the ESPHome protocol.
-// At this point only the unencrypted protocol is implemented.
+// Encryption is supported by setting a key; otherwise the plaintext protocol is
+// used.
+// Other components can register entities (such as the sensors from
+// `ble_sensor`), which are listed to clients, and whose states are sent to
+// clients that subscribe to them.
+//
+// For testing client robustness, faults can be injected into the connection.
+// Each rule matches a message type (or all messages) in either direction, and
+// applies with the given probability: `delay` holds the message back (and
+// everything after it on the same connection), `reorder` holds back only that
+// message so that later ones overtake it, `drop` discards it, `disconnect`
+// closes the connection abruptly, `corrupt` sends the message with an
+// undecodable payload, and `invalid_password` rejects connect requests
+// regardless of the password.  For example, to randomly disconnect and to
+// delay pings:
+//
+//	api:
+//	  faults:
+//	    - action: disconnect
+//	      probability: 0.001
+//	    - type: PingResponse
+//	      action: delay
+//	      delay: 2s
 package api
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -14,6 +37,7 @@ import (
 	"slices"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/brutella/dnssd"
 	"github.com/mook/mockesphome/api/pb"
@@ -28,13 +52,27 @@ const (
 
 // Configuration for the component.
 type Configuration struct {
-	Port     int    // The port to listen on; defaults to 6053.
-	Password string // Optional password.
+	Port       int    // The port to listen on; defaults to 6053.
+	Password   string // Optional password.
+	Record     string // Directory to record each connection's messages to (with passwords redacted), for use with `mockesphome replay`.
+	Encryption struct {
+		Key string // Base64-encoded encryption key, as in ESPHome; if unset, the plaintext protocol is used.
+	}
+	// Fault injection rules, for testing how clients cope with a misbehaving
+	// device; each message is checked against every rule in order.
+	Faults []struct {
+		Type        string        // Message type name the rule applies to, e.g. `BluetoothLEAdvertisementResponse`; if unset, all messages.
+		Action      string        // One of `delay`, `drop`, `disconnect`, `corrupt`, `reorder` or `invalid_password`.
+		Probability *float64      // Chance (between 0 and 1) of applying the rule to each matching message; defaults to 1.
+		Delay       time.Duration // How long `delay` and `reorder` hold the message back.
+	}
 }
 
 // ESPHome native API component
 type component struct {
 	config     Configuration
+	key        []byte      // Decoded encryption key, if any
+	faults     []faultRule // Parsed fault injection rules
 	listener   net.Listener
 	serverID   int
 	serverLock sync.Mutex
@@ -61,13 +99,24 @@ func (c *component) Configure(ctx context.Context, load func(any) error) error {
 		{&pb.DeviceInfoRequest{}, c.handleDeviceInfo},
 		{&pb.PingRequest{}, c.handlePing},
 		{&pb.ListEntitiesRequest{}, c.handleListEntities},
+		{&pb.SubscribeStatesRequest{}, c.handleSubscribeStates},
 	}
 	for _, handler := range handlers {
 		if err := RegisterHandler(handler.Message, handler.MessageHandler); err != nil {
 			return err
 		}
 	}
-	return load(&c.config)
+	if err := load(&c.config); err != nil {
+		return err
+	}
+	if c.config.Encryption.Key != "" {
+		key, err := base64.StdEncoding.DecodeString(c.config.Encryption.Key)
+		if err != nil {
+			return fmt.Errorf("failed to decode encryption key: %w", err)
+		}
+		c.key = key
+	}
+	return c.configureFaults()
 }
 
 func (c *component) Start(ctx context.Context) error {
@@ -121,6 +170,8 @@ func (c *component) Start(ctx context.Context) error {
 	return nil
 }
 
+// Queue a message for every connected client; each client's connection sends
+// it (subject to fault injection) without holding up the others.
 func (c *component) sendMessage(msg proto.Message) error {
 	c.serverLock.Lock()
 	servers := slices.Collect(maps.Values(c.servers))
@@ -129,7 +180,7 @@ func (c *component) sendMessage(msg proto.Message) error {
 	var errs []error
 
 	for _, server := range servers {
-		err := server.sendMessage(msg)
+		err := server.queueMessage(msg)
 		if err != nil {
 			slog.ErrorContext(server.ctx, "failed to send message", "error", err)
 			errs = append(errs, err)
@@ -44,3 +44,26 @@ var deviceInfoHandlers []func(*pb.DeviceInfoResponse) error
 func RegisterDeviceInfo(handler func(*pb.DeviceInfoResponse) error) {
 	deviceInfoHandlers = append(deviceInfoHandlers, handler)
 }
+
+// Get a sender that only sends to the client whose message is being handled;
+// the context must be the one passed to the [MessageHandler].  The context is
+// cancelled when that client disconnects.  Messages are queued and sent in
+// order by the client's own connection, so sending does not wait for it.
+func ClientSender(ctx context.Context) (MessageSender, error) {
+	s, ok := ctx.Value(contextKeyServer).(*server)
+	if !ok {
+		return nil, fmt.Errorf("failed to get server for message")
+	}
+	return s.queueMessage, nil
+}
+
+// Get an identifier for the client whose message is being handled, which stays
+// the same for the lifetime of its connection; the context must be the one
+// passed to the [MessageHandler].
+func ClientID(ctx context.Context) (int, error) {
+	s, ok := ctx.Value(contextKeyServer).(*server)
+	if !ok {
+		return 0, fmt.Errorf("failed to get server for message")
+	}
+	return s.id, nil
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// An entity description, such as a ListEntitiesSensorResponse.
+type EntityDescription interface {
+	proto.Message
+	GetKey() uint32
+	GetObjectId() string
+}
+
+// An entity state, such as a SensorStateResponse.
+type EntityState interface {
+	proto.Message
+	GetKey() uint32
+}
+
+// Entities registered by other components, and their latest states.
+var entities = struct {
+	lock         sync.Mutex // Also held while queuing states, so that they arrive in order
+	descriptions []EntityDescription
+	states       map[uint32]EntityState
+	subscribers  map[int]*server // Clients subscribed to states, by client ID
+}{
+	states:      make(map[uint32]EntityState),
+	subscribers: make(map[int]*server),
+}
+
+// Get the key for an entity, given its object ID; this is the same hash ESPHome
+// uses, so keys stay the same across restarts.
+func EntityKey(objectID string) uint32 {
+	hash := fnv.New32()
+	_, _ = hash.Write([]byte(objectID))
+	return hash.Sum32()
+}
+
+// Turn a name into an object ID: lower case, with anything other than letters
+// and digits replaced by underscores.
+func ObjectID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+}
+
+// Get a unique ID for an entity of a bluetooth device, given the device's MAC
+// address (as `AA:BB:CC:DD:EE:FF`) and the entity's own ID.
+func DeviceUniqueID(mac, id string) string {
+	return strings.ToLower(strings.ReplaceAll(mac, ":", "")) + "-" + id
+}
+
+// Format a bluetooth address, as used in the API, as a MAC address.
+func FormatAddress(address uint64) string {
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X",
+		byte(address>>40), byte(address>>32), byte(address>>24),
+		byte(address>>16), byte(address>>8), byte(address))
+}
+
+// Register an entity, to be listed to clients.  This should be called while
+// configuring the component, before any client connects.
+func RegisterEntity(description EntityDescription) error {
+	entities.lock.Lock()
+	defer entities.lock.Unlock()
+	for _, existing := range entities.descriptions {
+		if existing.GetKey() == description.GetKey() {
+			return fmt.Errorf("entity %q has the same key as %q", description.GetObjectId(), existing.GetObjectId())
+		}
+	}
+	entities.descriptions = append(entities.descriptions, description)
+	slog.Debug("registered entity", "object_id", description.GetObjectId(), "key", description.GetKey())
+	return nil
+}
+
+// Publish the state of an entity, queuing it for every client subscribed to
+// states; this does not wait for slow clients.  States that have not changed
+// are not sent again.
+func PublishState(state EntityState) {
+	entities.lock.Lock()
+	defer entities.lock.Unlock()
+	if previous, ok := entities.states[state.GetKey()]; ok && proto.Equal(previous, state) {
+		return
+	}
+	entities.states[state.GetKey()] = state
+	for id, s := range entities.subscribers {
+		if err := s.queueMessage(state); err != nil {
+			slog.Error("failed to send entity state", "client", id, "error", err)
+		}
+	}
+}
+
+// Handler for a ListEntitiesRequest; only the client asking is sent the list.
+func (c *component) handleListEntities(ctx context.Context, msg proto.Message, _ MessageSender) error {
+	if _, ok := msg.(*pb.ListEntitiesRequest); !ok {
+		return fmt.Errorf("message is not a ListEntitiesRequest")
+	}
+	send, err := ClientSender(ctx)
+	if err != nil {
+		return err
+	}
+	entities.lock.Lock()
+	descriptions := entities.descriptions
+	entities.lock.Unlock()
+	for _, description := range descriptions {
+		if err := send(description); err != nil {
+			return err
+		}
+	}
+	return send(&pb.ListEntitiesDoneResponse{})
+}
+
+// Handler for a SubscribeStatesRequest; the current state of every entity is
+// sent, followed by each change until the client disconnects.
+func (c *component) handleSubscribeStates(ctx context.Context, msg proto.Message, _ MessageSender) error {
+	if _, ok := msg.(*pb.SubscribeStatesRequest); !ok {
+		return fmt.Errorf("message is not a SubscribeStatesRequest")
+	}
+	s, ok := ctx.Value(contextKeyServer).(*server)
+	if !ok {
+		return fmt.Errorf("failed to get server for message")
+	}
+	entities.lock.Lock()
+	defer entities.lock.Unlock()
+	if _, ok := entities.subscribers[s.id]; !ok {
+		context.AfterFunc(ctx, func() {
+			entities.lock.Lock()
+			defer entities.lock.Unlock()
+			delete(entities.subscribers, s.id)
+		})
+	}
+	entities.subscribers[s.id] = s
+	for _, description := range entities.descriptions {
+		if state, ok := entities.states[description.GetKey()]; ok {
+			if err := s.queueMessage(state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+// Read the next message from the client connection, which must be of type T.
+func readMessage[T proto.Message](t *testing.T, conn *Conn) T {
+	t.Helper()
+	msg, err := conn.ReadMessage()
+	assert.NilError(t, err)
+	result, ok := msg.(T)
+	assert.Assert(t, ok, "unexpected message %T", msg)
+	return result
+}
+
+func TestEntityKey(t *testing.T) {
+	// FNV-1 32-bit, as ESPHome's fnv1_hash.
+	assert.Equal(t, EntityKey(""), uint32(0x811c9dc5))
+	assert.Equal(t, EntityKey("a"), uint32(0x050c5d7e))
+}
+
+func TestObjectID(t *testing.T) {
+	assert.Equal(t, ObjectID("Living Room-Temp 2"), "living_room_temp_2")
+	assert.Equal(t, DeviceUniqueID("A4:C1:38:00:00:01", "temperature"), "a4c138000001-temperature")
+}
+
+func TestFormatAddress(t *testing.T) {
+	assert.Equal(t, FormatAddress(0x060504030201), "06:05:04:03:02:01")
+}
+
+func TestEntities(t *testing.T) {
+	t.Cleanup(func() {
+		entities.descriptions = nil
+		clear(entities.states)
+		clear(entities.subscribers)
+	})
+	sensor := &pb.ListEntitiesSensorResponse{}
+	sensor.SetObjectId("outside_temperature")
+	sensor.SetKey(EntityKey(sensor.GetObjectId()))
+	assert.NilError(t, RegisterEntity(sensor))
+	assert.ErrorContains(t, RegisterEntity(sensor), "same key")
+
+	c := &component{}
+	s, client := faultServer(t, c)
+	ctx := context.WithValue(s.ctx, contextKeyServer, s)
+	go s.loop()
+
+	// Entities are only listed to the client that asked.
+	everyone := func(proto.Message) error {
+		t.Error("entities listed to every client")
+		return nil
+	}
+	go func() {
+		assert.Check(t, c.handleListEntities(ctx, &pb.ListEntitiesRequest{}, everyone))
+	}()
+	listed := readMessage[*pb.ListEntitiesSensorResponse](t, client)
+	assert.Equal(t, listed.GetKey(), sensor.GetKey())
+	readMessage[*pb.ListEntitiesDoneResponse](t, client)
+
+	state := &pb.SensorStateResponse{}
+	state.SetKey(sensor.GetKey())
+	state.SetState(12.5)
+	PublishState(state) // Nobody is subscribed yet
+	go func() {
+		assert.Check(t, c.handleSubscribeStates(ctx, &pb.SubscribeStatesRequest{}, s.sendMessage))
+	}()
+	assert.Equal(t, readMessage[*pb.SensorStateResponse](t, client).GetState(), float32(12.5))
+
+	go func() {
+		PublishState(state) // Unchanged, so not sent again
+		changed := &pb.SensorStateResponse{}
+		changed.SetKey(sensor.GetKey())
+		changed.SetState(13)
+		PublishState(changed)
+	}()
+	assert.Equal(t, readMessage[*pb.SensorStateResponse](t, client).GetState(), float32(13))
+
+	s.cancel()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		entities.lock.Lock()
+		defer entities.lock.Unlock()
+		if len(entities.subscribers) > 0 {
+			return poll.Continue("client is still subscribed")
+		}
+		return poll.Success()
+	}, poll.WithDelay(5*time.Millisecond))
+}
+
+func TestPublishStateStalledClient(t *testing.T) {
+	t.Cleanup(func() {
+		clear(entities.states)
+		clear(entities.subscribers)
+	})
+	s, _ := faultServer(t, &component{})
+	ctx := context.WithValue(s.ctx, contextKeyServer, s)
+	go s.loop()
+	assert.NilError(t, (&component{}).handleSubscribeStates(ctx, &pb.SubscribeStatesRequest{}, nil))
+
+	// The client never reads, so it is disconnected instead of holding up
+	// whatever publishes states.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range maxQueuedMessages + 10 {
+			state := &pb.SensorStateResponse{}
+			state.SetKey(1)
+			state.SetState(float32(i))
+			PublishState(state)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing states was blocked by a stalled client")
+	}
+	assert.Assert(t, s.ctx.Err() != nil, "stalled client was not disconnected")
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		entities.lock.Lock()
+		defer entities.lock.Unlock()
+		if len(entities.subscribers) > 0 {
+			return poll.Continue("client is still subscribed")
+		}
+		return poll.Success()
+	}, poll.WithDelay(5*time.Millisecond))
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// faultAction is something that can be done to a message to simulate a
+// misbehaving device.
+type faultAction string
+
+const (
+	faultDelay           = faultAction("delay")            // Hold the message back, blocking later ones on the same connection
+	faultDrop            = faultAction("drop")             // Silently discard the message
+	faultDisconnect      = faultAction("disconnect")       // Abruptly close the connection
+	faultCorrupt         = faultAction("corrupt")          // Send a payload that fails to decode
+	faultReorder         = faultAction("reorder")          // Hold the message back, letting later ones pass
+	faultInvalidPassword = faultAction("invalid_password") // Reject a connect request
+)
+
+var faultActions = []faultAction{
+	faultDelay, faultDrop, faultDisconnect, faultCorrupt, faultReorder, faultInvalidPassword,
+}
+
+// A parsed fault injection rule.
+type faultRule struct {
+	typeName    string // Message type name; empty to match all messages
+	action      faultAction
+	probability float64
+	delay       time.Duration
+}
+
+// Parse the fault injection rules in the configuration.
+func (c *component) configureFaults() error {
+	if err := fillMessageMap(); err != nil {
+		return err
+	}
+	var names []string
+	for _, messageType := range messageTypeMap {
+		names = append(names, string(messageType.Descriptor().Name()))
+	}
+	c.faults = nil
+	for i, config := range c.config.Faults {
+		rule := faultRule{
+			typeName:    config.Type,
+			action:      faultAction(config.Action),
+			probability: 1,
+			delay:       config.Delay,
+		}
+		if rule.typeName != "" && !slices.Contains(names, rule.typeName) {
+			return fmt.Errorf("fault rule %d: unknown message type %q", i, rule.typeName)
+		}
+		if !slices.Contains(faultActions, rule.action) {
+			return fmt.Errorf("fault rule %d: unknown action %q", i, config.Action)
+		}
+		if config.Probability != nil {
+			rule.probability = *config.Probability
+		}
+		if rule.probability < 0 || rule.probability > 1 {
+			return fmt.Errorf("fault rule %d: probability %v is not between 0 and 1", i, rule.probability)
+		}
+		c.faults = append(c.faults, rule)
+	}
+	return nil
+}
+
+// Return the rules with the given actions that should be applied to the given
+// message this time, in configuration order.
+func (c *component) triggeredFaults(msg proto.Message, actions ...faultAction) []faultRule {
+	var result []faultRule
+	name := string(msg.ProtoReflect().Descriptor().Name())
+	for _, rule := range c.faults {
+		if rule.typeName != "" && rule.typeName != name {
+			continue
+		}
+		if !slices.Contains(actions, rule.action) {
+			continue
+		}
+		if rule.probability < 1 && rand.Float64() >= rule.probability {
+			continue
+		}
+		result = append(result, rule)
+	}
+	return result
+}
+
+// Apply any fault injection rules to a message received from the client.
+// Returns true if the message should not be processed any further.
+func (s *server) injectIncomingFault(msg proto.Message) bool {
+	for _, rule := range s.component.triggeredFaults(msg, faultDelay, faultDrop, faultDisconnect) {
+		slog.InfoContext(s.ctx, "injecting fault", "direction", DirectionIn, "action", rule.action, "message", msg)
+		switch rule.action {
+		case faultDelay:
+			time.Sleep(rule.delay)
+		case faultDrop:
+			return true
+		case faultDisconnect:
+			s.disconnectAbruptly()
+			return true
+		}
+	}
+	return false
+}
+
+// Apply any fault injection rules to a message to be sent to the client.
+// Returns true if the message has been dealt with and should not be sent
+// normally.
+func (s *server) injectOutgoingFault(msg proto.Message) (bool, error) {
+	actions := []faultAction{faultDelay, faultDrop, faultDisconnect, faultCorrupt, faultReorder}
+	for _, rule := range s.component.triggeredFaults(msg, actions...) {
+		slog.InfoContext(s.ctx, "injecting fault", "direction", DirectionOut, "action", rule.action, "message", msg)
+		switch rule.action {
+		case faultDelay:
+			time.Sleep(rule.delay)
+		case faultDrop:
+			return true, nil
+		case faultDisconnect:
+			s.disconnectAbruptly()
+			return true, nil
+		case faultCorrupt:
+			s.writeLock.Lock()
+			defer s.writeLock.Unlock()
+			return true, s.conn.writeCorruptMessage(msg)
+		case faultReorder:
+			time.AfterFunc(rule.delay, func() {
+				if s.ctx.Err() != nil {
+					return
+				}
+				if err := s.writeMessage(msg); err != nil {
+					slog.ErrorContext(s.ctx, "failed to send reordered message", "error", err)
+				}
+			})
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Close the connection without the usual disconnect handshake.
+func (s *server) disconnectAbruptly() {
+	if err := s.conn.Close(); err != nil {
+		slog.DebugContext(s.ctx, "failed to close connection", "error", err)
+	}
+	s.cancel()
+}
+
+// Check whether a connect request should be rejected as if the password were
+// wrong.
+func (c *component) injectInvalidPassword(req *pb.ConnectRequest) bool {
+	return len(c.triggeredFaults(req, faultInvalidPassword)) > 0
+}
+
+// Write a message whose payload fails to decode.
+func (c *Conn) writeCorruptMessage(msg proto.Message) error {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outgoing message: %w", err)
+	}
+	// Append a truncated varint, which is never a valid field tag.
+	payload = append(payload, 0x80)
+	return c.writePayload(getTypeID(msg.ProtoReflect().Descriptor()), payload)
+}
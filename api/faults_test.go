@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+// Create a component configured from the given YAML.
+func configureFaults(config string) (*component, error) {
+	c := &component{}
+	decoder := yaml.NewDecoder(strings.NewReader(config), yaml.DisallowUnknownField())
+	if err := decoder.Decode(&c.config); err != nil {
+		return nil, err
+	}
+	return c, c.configureFaults()
+}
+
+// Create a server for the given component, connected to the returned client.
+func faultServer(t *testing.T, c *component) (*server, *Conn) {
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &server{
+		ctx:       ctx,
+		cancel:    cancel,
+		component: c,
+		conn:      NewConn(serverConn),
+		outgoing:  make(chan proto.Message, maxQueuedMessages),
+	}
+	return s, NewConn(clientConn)
+}
+
+func TestConfigureFaults(t *testing.T) {
+	c, err := configureFaults(`
+faults:
+  - type: PingResponse
+    action: delay
+    delay: 250ms
+  - action: disconnect
+    probability: 0.01
+`)
+	assert.NilError(t, err)
+	assert.Equal(t, len(c.faults), 2)
+	assert.Equal(t, c.faults[0], faultRule{typeName: "PingResponse", action: faultDelay, probability: 1, delay: 250 * time.Millisecond})
+	assert.Equal(t, c.faults[1], faultRule{action: faultDisconnect, probability: 0.01})
+
+	_, err = configureFaults("faults: [{type: NoSuchMessage, action: drop}]")
+	assert.ErrorContains(t, err, "unknown message type")
+	_, err = configureFaults("faults: [{action: explode}]")
+	assert.ErrorContains(t, err, "unknown action")
+	_, err = configureFaults("faults: [{action: drop, probability: 2}]")
+	assert.ErrorContains(t, err, "not between 0 and 1")
+}
+
+func TestOutgoingFaults(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		c, err := configureFaults("faults: [{type: PingResponse, action: drop}]")
+		assert.NilError(t, err)
+		s, client := faultServer(t, c)
+		go func() {
+			assert.Check(t, s.sendMessage(&pb.PingResponse{}))
+			assert.Check(t, s.sendMessage(&pb.ListEntitiesDoneResponse{}))
+		}()
+		msg, err := client.ReadMessage()
+		assert.NilError(t, err)
+		_, ok := msg.(*pb.ListEntitiesDoneResponse)
+		assert.Assert(t, ok, "unexpected message %T", msg)
+	})
+	t.Run("never", func(t *testing.T) {
+		c, err := configureFaults("faults: [{action: drop, probability: 0}]")
+		assert.NilError(t, err)
+		s, client := faultServer(t, c)
+		go func() { assert.Check(t, s.sendMessage(&pb.PingResponse{})) }()
+		msg, err := client.ReadMessage()
+		assert.NilError(t, err)
+		_, ok := msg.(*pb.PingResponse)
+		assert.Assert(t, ok, "unexpected message %T", msg)
+	})
+	t.Run("corrupt", func(t *testing.T) {
+		c, err := configureFaults("faults: [{action: corrupt}]")
+		assert.NilError(t, err)
+		s, client := faultServer(t, c)
+		go func() { assert.Check(t, s.sendMessage(&pb.PingResponse{})) }()
+		_, err = client.ReadMessage()
+		assert.ErrorContains(t, err, "failed to unmarshal")
+	})
+	t.Run("reorder", func(t *testing.T) {
+		c, err := configureFaults("faults: [{type: PingResponse, action: reorder, delay: 50ms}]")
+		assert.NilError(t, err)
+		s, client := faultServer(t, c)
+		go func() {
+			assert.Check(t, s.sendMessage(&pb.PingResponse{}))
+			assert.Check(t, s.sendMessage(&pb.ListEntitiesDoneResponse{}))
+		}()
+		var names []string
+		for range 2 {
+			msg, err := client.ReadMessage()
+			assert.NilError(t, err)
+			names = append(names, string(msg.ProtoReflect().Descriptor().Name()))
+		}
+		assert.DeepEqual(t, names, []string{"ListEntitiesDoneResponse", "PingResponse"})
+	})
+	t.Run("disconnect", func(t *testing.T) {
+		c, err := configureFaults("faults: [{action: disconnect}]")
+		assert.NilError(t, err)
+		s, client := faultServer(t, c)
+		assert.NilError(t, s.sendMessage(&pb.PingResponse{}))
+		assert.Assert(t, s.ctx.Err() != nil, "server was not cancelled")
+		_, err = client.ReadMessage()
+		assert.Assert(t, err != nil)
+	})
+}
+
+func TestDelayFaultPerClient(t *testing.T) {
+	c, err := configureFaults("faults: [{type: PingResponse, action: delay, delay: 200ms}]")
+	assert.NilError(t, err)
+	c.servers = make(map[int]*server)
+	var clients []*Conn
+	for id := range 2 {
+		s, client := faultServer(t, c)
+		s.id = id
+		c.servers[id] = s
+		clients = append(clients, client)
+		go s.loop()
+	}
+
+	// Sending to every client does not wait for the delays, which run on each
+	// client's own connection.
+	started := time.Now()
+	assert.NilError(t, c.sendMessage(&pb.PingResponse{}))
+	assert.Assert(t, time.Since(started) < 100*time.Millisecond, "sending waited for a delayed client")
+	for _, client := range clients {
+		msg, err := client.ReadMessage()
+		assert.NilError(t, err)
+		_, ok := msg.(*pb.PingResponse)
+		assert.Assert(t, ok, "unexpected message %T", msg)
+	}
+	elapsed := time.Since(started)
+	assert.Assert(t, elapsed >= 200*time.Millisecond && elapsed < 400*time.Millisecond, "unexpected delay %s", elapsed)
+}
+
+func TestIncomingFaults(t *testing.T) {
+	c, err := configureFaults("faults: [{type: PingRequest, action: drop}, {type: HelloRequest, action: delay, delay: 10ms}]")
+	assert.NilError(t, err)
+	s, _ := faultServer(t, c)
+	assert.Assert(t, s.injectIncomingFault(&pb.PingRequest{}))
+	started := time.Now()
+	assert.Assert(t, !s.injectIncomingFault(&pb.HelloRequest{}))
+	assert.Assert(t, time.Since(started) >= 10*time.Millisecond)
+}
+
+func TestInvalidPasswordFault(t *testing.T) {
+	c, err := configureFaults("faults: [{action: invalid_password}]")
+	assert.NilError(t, err)
+	s, client := faultServer(t, c)
+	s.state = connectionStateSetUp
+	ctx := context.WithValue(s.ctx, contextKeyServer, s)
+	go func() {
+		assert.Check(t, c.handleConnect(ctx, &pb.ConnectRequest{}, s.sendMessage))
+	}()
+	msg, err := client.ReadMessage()
+	assert.NilError(t, err)
+	assert.Assert(t, msg.(*pb.ConnectResponse).GetInvalidPassword())
+	assert.Equal(t, s.state, connectionStateSetUp)
+	// Rejecting the password is left to the connect handler.
+	assert.Assert(t, !s.injectIncomingFault(&pb.ConnectRequest{}))
+}
@@ -67,6 +67,7 @@ func (c *component) handleConnect(ctx context.Context, msg proto.Message, send M
 	}
 	expectedPassword := s.component.config.Password
 	invalidPassword := expectedPassword != "" && expectedPassword != req.GetPassword()
+	invalidPassword = invalidPassword || c.injectInvalidPassword(req)
 	if !invalidPassword {
 		s.state = connectionStateAuthed
 	}
@@ -75,7 +76,7 @@ func (c *component) handleConnect(ctx context.Context, msg proto.Message, send M
 	return send(response)
 }
 
-func (c *component) handleDisconnect(ctx context.Context, msg proto.Message, send MessageSender) error {
+func (c *component) handleDisconnect(ctx context.Context, msg proto.Message, _ MessageSender) error {
 	if _, ok := msg.(*pb.DisconnectRequest); !ok {
 		return fmt.Errorf("message is not a DisconnectRequest")
 	}
@@ -83,7 +84,9 @@ func (c *component) handleDisconnect(ctx context.Context, msg proto.Message, sen
 	if !ok {
 		return fmt.Errorf("failed to get server for message")
 	}
-	if err := send(&pb.DisconnectResponse{}); err != nil {
+	// Send the response directly, as anything queued is dropped once the
+	// connection is cancelled.
+	if err := s.sendMessage(&pb.DisconnectResponse{}); err != nil {
 		return err
 	}
 	s.cancel()
@@ -117,39 +120,7 @@ func (c *component) handleDeviceInfo(ctx context.Context, msg proto.Message, sen
 		resp.SetName("unknown")
 	}
 
-	// Get the mac addr
-	listenerAddr := c.listener.Addr().String()
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		slog.ErrorContext(ctx, "failed to enumerate interfaces", "error", err)
-	} else {
-		found := false
-		fallbackAddr := "(unknown)"
-	ifaceLoop:
-		for _, iface := range interfaces {
-			ifaceAddrs, err := iface.Addrs()
-			if err != nil {
-				slog.ErrorContext(
-					ctx, "failed to get addresses for interface",
-					"interface", iface.Name,
-					"error", err)
-				continue
-			}
-			for _, ifaceAddr := range ifaceAddrs {
-				if ifaceAddr.String() == listenerAddr {
-					resp.SetMacAddress(iface.HardwareAddr.String())
-					found = true
-					break ifaceLoop
-				}
-			}
-			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
-				fallbackAddr = iface.HardwareAddr.String()
-			}
-		}
-		if !found {
-			resp.SetMacAddress(fallbackAddr)
-		}
-	}
+	resp.SetMacAddress(c.macAddress(ctx))
 
 	if info, ok := debug.ReadBuildInfo(); ok {
 		resp.SetEsphomeVersion(info.Main.Version)
@@ -180,10 +151,32 @@ func (c *component) handlePing(ctx context.Context, msg proto.Message, send Mess
 	return send(&pb.PingResponse{})
 }
 
-func (c *component) handleListEntities(ctx context.Context, msg proto.Message, send MessageSender) error {
-	if _, ok := msg.(*pb.ListEntitiesRequest); !ok {
-		return fmt.Errorf("message is not a ListEntitiesRequest")
+// Get the MAC address of the interface the API is listening on.
+func (c *component) macAddress(ctx context.Context) string {
+	listenerAddr := c.listener.Addr().String()
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to enumerate interfaces", "error", err)
+		return ""
+	}
+	fallbackAddr := "(unknown)"
+	for _, iface := range interfaces {
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			slog.ErrorContext(
+				ctx, "failed to get addresses for interface",
+				"interface", iface.Name,
+				"error", err)
+			continue
+		}
+		for _, ifaceAddr := range ifaceAddrs {
+			if ifaceAddr.String() == listenerAddr {
+				return iface.HardwareAddr.String()
+			}
+		}
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
+			fallbackAddr = iface.HardwareAddr.String()
+		}
 	}
-	// TODO: Actually have entities to send?
-	return send(&pb.ListEntitiesDoneResponse{})
+	return fallbackAddr
 }
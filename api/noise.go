@@ -0,0 +1,373 @@
+package api
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// This implements the encrypted variant of the native API, which uses the
+// Noise_NNpsk0_25519_ChaChaPoly_SHA256 handshake pattern; see
+// https://noiseprotocol.org/noise.html for the specification.
+
+const (
+	noiseProtocolName = "Noise_NNpsk0_25519_ChaChaPoly_SHA256"
+	noisePrologue     = "NoiseAPIInit"
+	noiseIndicator    = 0x01 // First byte of each encrypted frame
+	noiseKeySize      = 32
+)
+
+// Keys for an established encrypted connection.
+type noiseState struct {
+	send *noiseCipher
+	recv *noiseCipher
+}
+
+// The Noise CipherState object.
+type noiseCipher struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipher(key []byte) (*noiseCipher, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseCipher{aead: aead}, nil
+}
+
+func (c *noiseCipher) nextNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce
+}
+
+func (c *noiseCipher) encrypt(ad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nextNonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nextNonce(), ciphertext, ad)
+}
+
+// The Noise SymmetricState object, used during the handshake.
+type noiseSymmetric struct {
+	ck     []byte
+	h      []byte
+	cipher *noiseCipher // nil until a key has been mixed in
+}
+
+func newNoiseSymmetric(prologue []byte) *noiseSymmetric {
+	h := sha256.Sum256([]byte(noiseProtocolName))
+	s := &noiseSymmetric{ck: h[:], h: h[:]}
+	s.mixHash(prologue)
+	return s
+}
+
+// The Noise HKDF function, returning the requested number of outputs.
+func noiseHKDF(chainingKey, input []byte, outputs int) [][]byte {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(input)
+	tempKey := mac.Sum(nil)
+	var results [][]byte
+	var previous []byte
+	for i := 1; i <= outputs; i++ {
+		mac = hmac.New(sha256.New, tempKey)
+		mac.Write(previous)
+		mac.Write([]byte{byte(i)})
+		previous = mac.Sum(nil)
+		results = append(results, previous)
+	}
+	return results
+}
+
+func (s *noiseSymmetric) mixHash(data []byte) {
+	sum := sha256.Sum256(append(s.h, data...))
+	s.h = sum[:]
+}
+
+func (s *noiseSymmetric) mixKey(input []byte) error {
+	out := noiseHKDF(s.ck, input, 2)
+	s.ck = out[0]
+	cipher, err := newNoiseCipher(out[1])
+	s.cipher = cipher
+	return err
+}
+
+func (s *noiseSymmetric) mixKeyAndHash(input []byte) error {
+	out := noiseHKDF(s.ck, input, 3)
+	s.ck = out[0]
+	s.mixHash(out[1])
+	cipher, err := newNoiseCipher(out[2])
+	s.cipher = cipher
+	return err
+}
+
+func (s *noiseSymmetric) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := s.cipher.encrypt(s.h, plaintext)
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (s *noiseSymmetric) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipher.decrypt(s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// Split the symmetric state into the initiator and responder cipher states.
+func (s *noiseSymmetric) split() (*noiseCipher, *noiseCipher, error) {
+	out := noiseHKDF(s.ck, nil, 2)
+	initiator, err := newNoiseCipher(out[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	responder, err := newNoiseCipher(out[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return initiator, responder, nil
+}
+
+// Read a single encrypted frame from the connection, without decrypting it.
+func (c *Conn) readNoiseFrame() ([]byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != noiseIndicator {
+		return nil, fmt.Errorf("read invalid header byte: %x", header[0])
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Write a single encrypted frame to the connection.
+func (c *Conn) writeNoiseFrame(frame []byte) error {
+	if len(frame) > 0xFFFF {
+		return fmt.Errorf("frame of %d bytes is too large", len(frame))
+	}
+	buf := []byte{noiseIndicator, byte(len(frame) >> 8), byte(len(frame))}
+	_, err := c.conn.Write(append(buf, frame...))
+	return err
+}
+
+// Read an encrypted message, returning the type ID and payload.
+func (c *Conn) readNoiseMessage() (uint64, []byte, error) {
+	frame, err := c.readNoiseFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	plaintext, err := c.noise.recv.decrypt(nil, frame)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decrypt message: %w", err)
+	}
+	if len(plaintext) < 4 {
+		return 0, nil, fmt.Errorf("decrypted message is too short")
+	}
+	typeID := binary.BigEndian.Uint16(plaintext)
+	size := binary.BigEndian.Uint16(plaintext[2:])
+	if int(size) != len(plaintext)-4 {
+		return 0, nil, fmt.Errorf("decrypted message has invalid size %d", size)
+	}
+	return uint64(typeID), plaintext[4:], nil
+}
+
+// Write an encrypted message.
+func (c *Conn) writeNoiseMessage(typeID uint64, payload []byte) error {
+	plaintext := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint16(plaintext, uint16(typeID))
+	binary.BigEndian.PutUint16(plaintext[2:], uint16(len(payload)))
+	plaintext = append(plaintext, payload...)
+	return c.writeNoiseFrame(c.noise.send.encrypt(nil, plaintext))
+}
+
+// Build the handshake prologue from the client hello frame.
+func noiseHandshakePrologue(clientHello []byte) []byte {
+	prologue := []byte(noisePrologue)
+	prologue = binary.BigEndian.AppendUint16(prologue, uint16(len(clientHello)))
+	return append(prologue, clientHello...)
+}
+
+// Perform the client side of the encrypted handshake over the given stream,
+// using the given pre-shared key.  Returns the encrypted connection, as well
+// as the device name and MAC address reported by the server.
+func NewNoiseClientConn(conn io.ReadWriter, psk []byte) (*Conn, string, string, error) {
+	if len(psk) != noiseKeySize {
+		return nil, "", "", fmt.Errorf("encryption key must be %d bytes", noiseKeySize)
+	}
+	c := NewConn(conn)
+	// We send both the client hello and the handshake before reading anything;
+	// the server may write its hello before reading our handshake, so this
+	// relies on the transport buffering these small frames (as TCP does).
+	if err := c.writeNoiseFrame(nil); err != nil {
+		return nil, "", "", fmt.Errorf("failed to send client hello: %w", err)
+	}
+
+	state := newNoiseSymmetric(noiseHandshakePrologue(nil))
+	if err := state.mixKeyAndHash(psk); err != nil {
+		return nil, "", "", err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", "", err
+	}
+	publicKey := ephemeral.PublicKey().Bytes()
+	state.mixHash(publicKey)
+	if err := state.mixKey(publicKey); err != nil {
+		return nil, "", "", err
+	}
+	handshake := append([]byte{0x00}, publicKey...)
+	handshake = append(handshake, state.encryptAndHash(nil)...)
+	if err := c.writeNoiseFrame(handshake); err != nil {
+		return nil, "", "", fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	serverHello, err := c.readNoiseFrame()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read server hello: %w", err)
+	}
+	if len(serverHello) < 1 || serverHello[0] != noiseIndicator {
+		return nil, "", "", fmt.Errorf("server does not support encryption protocol")
+	}
+	info := strings.Split(string(serverHello[1:]), "\x00")
+	name, mac := info[0], ""
+	if len(info) > 1 {
+		mac = info[1]
+	}
+
+	response, err := c.readNoiseFrame()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read handshake response: %w", err)
+	}
+	if len(response) < 1 {
+		return nil, "", "", fmt.Errorf("empty handshake response")
+	}
+	if response[0] != 0x00 {
+		return nil, "", "", fmt.Errorf("handshake failed: %s", response[1:])
+	}
+	if len(response) < 1+noiseKeySize {
+		return nil, "", "", fmt.Errorf("handshake response is too short")
+	}
+	remoteKey, err := ecdh.X25519().NewPublicKey(response[1 : 1+noiseKeySize])
+	if err != nil {
+		return nil, "", "", fmt.Errorf("invalid server key: %w", err)
+	}
+	state.mixHash(remoteKey.Bytes())
+	if err := state.mixKey(remoteKey.Bytes()); err != nil {
+		return nil, "", "", err
+	}
+	shared, err := ephemeral.ECDH(remoteKey)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := state.mixKey(shared); err != nil {
+		return nil, "", "", err
+	}
+	if _, err := state.decryptAndHash(response[1+noiseKeySize:]); err != nil {
+		return nil, "", "", fmt.Errorf("handshake MAC failure: %w", err)
+	}
+
+	send, recv, err := state.split()
+	if err != nil {
+		return nil, "", "", err
+	}
+	c.noise = &noiseState{send: send, recv: recv}
+	return c, name, mac, nil
+}
+
+// Perform the server side of the encrypted handshake over the given stream,
+// using the given pre-shared key, and reporting the given device name and MAC
+// address to the client.
+func NewNoiseServerConn(conn io.ReadWriter, psk []byte, name, mac string) (*Conn, error) {
+	if len(psk) != noiseKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes", noiseKeySize)
+	}
+	c := NewConn(conn)
+	clientHello, err := c.readNoiseFrame()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client hello: %w", err)
+	}
+	serverHello := []byte{noiseIndicator}
+	serverHello = append(serverHello, name...)
+	serverHello = append(serverHello, 0)
+	serverHello = append(serverHello, mac...)
+	serverHello = append(serverHello, 0)
+	if err := c.writeNoiseFrame(serverHello); err != nil {
+		return nil, fmt.Errorf("failed to send server hello: %w", err)
+	}
+
+	handshake, err := c.readNoiseFrame()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+	// Reject a handshake, telling the client why.
+	reject := func(reason string, err error) error {
+		_ = c.writeNoiseFrame(append([]byte{0x01}, reason...))
+		return errors.Join(errors.New(reason), err)
+	}
+	if len(handshake) < 1+noiseKeySize || handshake[0] != 0x00 {
+		return nil, reject("Bad handshake packet", nil)
+	}
+	state := newNoiseSymmetric(noiseHandshakePrologue(clientHello))
+	if err := state.mixKeyAndHash(psk); err != nil {
+		return nil, err
+	}
+	remoteKey, err := ecdh.X25519().NewPublicKey(handshake[1 : 1+noiseKeySize])
+	if err != nil {
+		return nil, reject("Bad handshake packet", err)
+	}
+	state.mixHash(remoteKey.Bytes())
+	if err := state.mixKey(remoteKey.Bytes()); err != nil {
+		return nil, err
+	}
+	if _, err := state.decryptAndHash(handshake[1+noiseKeySize:]); err != nil {
+		return nil, reject("Handshake MAC failure", err)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := ephemeral.PublicKey().Bytes()
+	state.mixHash(publicKey)
+	if err := state.mixKey(publicKey); err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(remoteKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.mixKey(shared); err != nil {
+		return nil, err
+	}
+	response := append([]byte{0x00}, publicKey...)
+	response = append(response, state.encryptAndHash(nil)...)
+	if err := c.writeNoiseFrame(response); err != nil {
+		return nil, fmt.Errorf("failed to send handshake response: %w", err)
+	}
+
+	recv, send, err := state.split()
+	if err != nil {
+		return nil, err
+	}
+	c.noise = &noiseState{send: send, recv: recv}
+	return c, nil
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+// Create a connected pair of loopback TCP connections.  Unlike [net.Pipe],
+// these are buffered, as the handshake expects.
+func loopbackPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	serverSide := <-accepted
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+		_ = serverSide.Close()
+	})
+	return clientSide, serverSide
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, noiseKeySize)
+	clientSide, serverSide := loopbackPair(t)
+
+	serverResult := make(chan error, 1)
+	go func() {
+		server, err := NewNoiseServerConn(serverSide, key, "mock", "01:02:03:04:05:06")
+		if err == nil {
+			var msg proto.Message
+			msg, err = server.ReadMessage()
+			if err == nil {
+				err = server.WriteMessage(msg)
+			}
+		}
+		serverResult <- err
+	}()
+
+	client, name, mac, err := NewNoiseClientConn(clientSide, key)
+	assert.NilError(t, err)
+	assert.Equal(t, name, "mock")
+	assert.Equal(t, mac, "01:02:03:04:05:06")
+
+	expected := &pb.HelloRequest{}
+	expected.SetClientInfo("test")
+	assert.NilError(t, client.WriteMessage(expected))
+	actual, err := client.ReadMessage()
+	assert.NilError(t, err)
+	assert.Assert(t, proto.Equal(expected, actual))
+	assert.NilError(t, <-serverResult)
+}
+
+func TestNoiseHandshakeWrongKey(t *testing.T) {
+	clientSide, serverSide := loopbackPair(t)
+
+	serverResult := make(chan error, 1)
+	go func() {
+		_, err := NewNoiseServerConn(serverSide, bytes.Repeat([]byte{1}, noiseKeySize), "mock", "")
+		serverResult <- err
+	}()
+	_, _, _, err := NewNoiseClientConn(clientSide, bytes.Repeat([]byte{2}, noiseKeySize))
+	assert.ErrorContains(t, err, "Handshake MAC failure")
+	assert.ErrorContains(t, <-serverResult, "Handshake MAC failure")
+}
@@ -5,11 +5,8 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
 	"sync"
-	"syscall"
 
-	"github.com/mook/mockesphome/utils"
 	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -41,12 +38,51 @@ func getTypeID(mt protoreflect.MessageDescriptor) uint64 {
 	return mt.Options().ProtoReflect().Get(extensionTypeDescriptor).Uint()
 }
 
+// Conn is a connection speaking the ESPHome native API protocol; it takes care
+// of framing (and, if applicable, encrypting) messages on the underlying stream.
+type Conn struct {
+	conn     io.ReadWriter // Underlying connection to send data on
+	buffer   []byte        // Buffer for partial bytes for the next message to read
+	noise    *noiseState   // If set, the connection is encrypted
+	recorder *Recorder     // If set, messages are recorded here
+}
+
+// Wrap a stream (typically a [net.Conn]) as a plaintext native API connection.
+func NewConn(conn io.ReadWriter) *Conn {
+	return &Conn{conn: conn}
+}
+
+// Record all messages read or written from now on; pass nil to stop recording.
+func (c *Conn) SetRecorder(recorder *Recorder) {
+	c.recorder = recorder
+}
+
+// Record a message, if recording is enabled.
+func (c *Conn) record(direction Direction, msg proto.Message) {
+	if c.recorder == nil {
+		return
+	}
+	if err := c.recorder.Record(direction, msg); err != nil {
+		slog.Error("failed to record message", "error", err)
+	}
+}
+
+// Record an undecoded message, if recording is enabled and its type is known.
+func (c *Conn) recordFrame(direction Direction, typeID uint64, payload []byte) {
+	if c.recorder == nil {
+		return
+	}
+	if msg, err := DecodeMessage(typeID, payload); err == nil {
+		c.record(direction, msg)
+	}
+}
+
 // Do a blocking read of a single varint from the conn, returning the value.
-func (s *server) readVarInt() (uint64, error) {
+func (c *Conn) readVarInt() (uint64, error) {
 	for {
-		v, n := protowire.ConsumeVarint(s.buffer)
+		v, n := protowire.ConsumeVarint(c.buffer)
 		if n >= 0 {
-			s.buffer = s.buffer[n:]
+			c.buffer = c.buffer[n:]
 			return v, nil
 		}
 		err := protowire.ParseError(n)
@@ -54,8 +90,8 @@ func (s *server) readVarInt() (uint64, error) {
 			return 0, err
 		}
 		buf := make([]byte, 10)
-		n, err = io.ReadAtLeast(s.conn, buf, 1)
-		s.buffer = append(s.buffer, buf[:n]...)
+		n, err = io.ReadAtLeast(c.conn, buf, 1)
+		c.buffer = append(c.buffer, buf[:n]...)
 		if err != nil {
 			if n <= 0 || !errors.Is(err, io.EOF) {
 				return 0, err
@@ -64,73 +100,139 @@ func (s *server) readVarInt() (uint64, error) {
 	}
 }
 
-// Do a blocking read of a message packet, returning the message.
-func (s *server) readMessage() (proto.Message, error) {
-	if err := fillMessageMap(); err != nil {
-		return nil, err
-	}
-	header, err := s.readVarInt()
+// Do a blocking read of a plaintext message packet, returning the type ID and
+// the payload.
+func (c *Conn) readPlaintextMessage() (uint64, []byte, error) {
+	header, err := c.readVarInt()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read header byte: %w", err)
+		return 0, nil, fmt.Errorf("failed to read header byte: %w", err)
 	}
 	if header != 0 {
-		return nil, fmt.Errorf("read invalid header byte: %x", header)
+		return 0, nil, fmt.Errorf("read invalid header byte: %x", header)
 	}
-	messageSize, err := s.readVarInt()
+	messageSize, err := c.readVarInt()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read message size: %w", err)
+		return 0, nil, fmt.Errorf("failed to read message size: %w", err)
 	}
-	messageTypeIndex, err := s.readVarInt()
+	messageTypeIndex, err := c.readVarInt()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read message type: %w", err)
-	}
-	messageType, ok := messageTypeMap[messageTypeIndex]
-	if !ok {
-		return nil, fmt.Errorf("failed to map message type %d", messageTypeIndex)
+		return 0, nil, fmt.Errorf("failed to read message type: %w", err)
 	}
 
-	for uint64(len(s.buffer)) < messageSize {
-		buf := make([]byte, messageSize-uint64(len(s.buffer)))
-		n, err := io.ReadFull(s.conn, buf)
-		s.buffer = append(s.buffer, buf[:n]...)
+	for uint64(len(c.buffer)) < messageSize {
+		buf := make([]byte, messageSize-uint64(len(c.buffer)))
+		n, err := io.ReadFull(c.conn, buf)
+		c.buffer = append(c.buffer, buf[:n]...)
 		if err != nil && !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("failed to read message: %w", err)
+			return 0, nil, fmt.Errorf("failed to read message: %w", err)
 		}
 	}
 
+	payload := c.buffer[:messageSize]
+	c.buffer = c.buffer[messageSize:]
+	return messageTypeIndex, payload, nil
+}
+
+// Do a blocking read of a message packet, returning the type ID and payload.
+func (c *Conn) readFrame() (uint64, []byte, error) {
+	if c.noise != nil {
+		return c.readNoiseMessage()
+	}
+	return c.readPlaintextMessage()
+}
+
+// Decode the payload of a message with the given type ID.
+func DecodeMessage(typeID uint64, payload []byte) (proto.Message, error) {
+	if err := fillMessageMap(); err != nil {
+		return nil, err
+	}
+	messageType, ok := messageTypeMap[typeID]
+	if !ok {
+		return nil, fmt.Errorf("failed to map message type %d", typeID)
+	}
 	message := messageType.New().Interface()
-	if err := proto.Unmarshal(s.buffer[:messageSize], message); err != nil {
-		name := messageType.Descriptor().FullName()
-		slog.ErrorContext(s.ctx, "failed to unmarshal", "name", name, "buffer", fmt.Sprintf("%+v", s.buffer), "size", messageSize)
-		return nil, fmt.Errorf("failed to unmarshal %s message: %w", name, err)
+	if err := proto.Unmarshal(payload, message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s message: %w", messageType.Descriptor().FullName(), err)
+	}
+	return message, nil
+}
+
+// Do a blocking read of a message packet, returning the message.
+func (c *Conn) ReadMessage() (proto.Message, error) {
+	typeID, payload, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	message, err := DecodeMessage(typeID, payload)
+	if err != nil {
+		slog.Error("failed to decode message", "type", typeID, "buffer", fmt.Sprintf("%+v", payload), "size", len(payload), "error", err)
+		return nil, err
 	}
-	s.buffer = s.buffer[messageSize:]
+	c.record(DirectionIn, message)
 
-	slog.DebugContext(s.ctx, "received incoming message", "message", message, "type", messageType.Descriptor().FullName())
 	return message, nil
 }
 
+// Do a blocking read of a message packet without decoding it, returning the
+// type ID and payload so that they can be passed on unchanged, even if the
+// message type is not known.  Only messages of known types are recorded.
+func (c *Conn) ReadFrame() (uint64, []byte, error) {
+	typeID, payload, err := c.readFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	c.recordFrame(DirectionIn, typeID, payload)
+	return typeID, payload, nil
+}
+
 // Send a message over the wire synchronously.
-func (s *server) sendMessage(msg proto.Message) error {
+func (c *Conn) WriteMessage(msg proto.Message) error {
+	if err := fillMessageMap(); err != nil {
+		return err
+	}
 	payload, err := proto.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal outgoing message: %w", err)
 	}
-	typeID := getTypeID(msg.ProtoReflect().Descriptor())
-	var buf []byte
-	buf = protowire.AppendVarint(buf, 0)
-	buf = protowire.AppendVarint(buf, uint64(len(payload)))
-	buf = protowire.AppendVarint(buf, typeID)
-	buf = append(buf, payload...)
-	if _, err := s.conn.Write(buf); err != nil {
-		if utils.AnyError(err, io.ErrClosedPipe, syscall.EPIPE, syscall.ECONNRESET, net.ErrClosed) {
-			// The underlying connection is dead; terminate the server.
-			s.cancel()
-			if s.state == connectionStateDisconnected {
-				return nil // If the connection is already disconnected, don't report.
-			}
-		}
+	if err := c.writePayload(getTypeID(msg.ProtoReflect().Descriptor()), payload); err != nil {
+		return err
+	}
+	c.record(DirectionOut, msg)
+	return nil
+}
+
+// Send a message as returned by [Conn.ReadFrame], without re-encoding it.
+func (c *Conn) WriteFrame(typeID uint64, payload []byte) error {
+	if err := c.writePayload(typeID, payload); err != nil {
+		return err
+	}
+	c.recordFrame(DirectionOut, typeID, payload)
+	return nil
+}
+
+// Write an already marshaled message over the wire.
+func (c *Conn) writePayload(typeID uint64, payload []byte) error {
+	var err error
+	if c.noise != nil {
+		err = c.writeNoiseMessage(typeID, payload)
+	} else {
+		var buf []byte
+		buf = protowire.AppendVarint(buf, 0)
+		buf = protowire.AppendVarint(buf, uint64(len(payload)))
+		buf = protowire.AppendVarint(buf, typeID)
+		buf = append(buf, payload...)
+		_, err = c.conn.Write(buf)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to write outgoing message: %w", err)
 	}
 	return nil
 }
+
+// Close the underlying connection, if it can be closed.
+func (c *Conn) Close() error {
+	if closer, ok := c.conn.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
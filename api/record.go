@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Direction of a recorded message, relative to the side doing the recording.
+type Direction string
+
+const (
+	DirectionIn  = Direction("in")  // The message was received
+	DirectionOut = Direction("out") // The message was sent
+)
+
+// A single recorded message; recordings are stored as one JSON-encoded entry
+// per line.
+type RecordEntry struct {
+	Time      time.Time       `json:"time"`
+	Direction Direction       `json:"direction"`
+	TypeID    uint64          `json:"type"`
+	Name      string          `json:"name"`              // Message type name, for readability
+	Payload   []byte          `json:"payload"`           // Protobuf-encoded message
+	Message   json.RawMessage `json:"message,omitempty"` // Decoded message, for readability
+}
+
+// Decode the message in the entry.
+func (e *RecordEntry) Decode() (proto.Message, error) {
+	return DecodeMessage(e.TypeID, e.Payload)
+}
+
+// Recorder writes the messages on a connection to a stream.
+type Recorder struct {
+	lock   sync.Mutex
+	writer io.Writer
+	closed bool
+}
+
+// Create a new recorder writing to the given stream.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{writer: w}
+}
+
+// Record a message.  Passwords in connect requests are redacted, so that they
+// do not end up on disk.  Messages recorded after the recorder is closed are
+// silently discarded.
+func (r *Recorder) Record(direction Direction, msg proto.Message) error {
+	if err := fillMessageMap(); err != nil {
+		return err
+	}
+	if connect, ok := msg.(*pb.ConnectRequest); ok && connect.GetPassword() != "" {
+		redacted := proto.CloneOf(connect)
+		redacted.SetPassword("")
+		msg = redacted
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recorded message: %w", err)
+	}
+	decoded, err := protojson.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to convert recorded message to JSON: %w", err)
+	}
+	descriptor := msg.ProtoReflect().Descriptor()
+	entry := RecordEntry{
+		Time:      time.Now(),
+		Direction: direction,
+		TypeID:    getTypeID(descriptor),
+		Name:      string(descriptor.Name()),
+		Payload:   payload,
+		Message:   decoded,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode recorded message: %w", err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	if _, err := r.writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write recorded message: %w", err)
+	}
+	return nil
+}
+
+// Stop recording, closing the underlying stream if it is closable.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if closer, ok := r.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Create a new recording file in the given directory, named with the given
+// prefix and the current time.  An existing file is never overwritten.
+func CreateRecording(dir, prefix string) (*os.File, error) {
+	base := fmt.Sprintf("%s-%s", prefix, time.Now().Format("20060102-150405.000000"))
+	name := base + ".jsonl"
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if !errors.Is(err, os.ErrExist) {
+			return file, err
+		}
+		name = fmt.Sprintf("%s-%d.jsonl", base, i)
+	}
+}
+
+// Read a recording, iterating through its entries.  Iteration stops after the
+// first error.
+func ReadRecording(r io.Reader) iter.Seq2[*RecordEntry, error] {
+	return func(yield func(*RecordEntry, error) bool) {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			entry := &RecordEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				yield(nil, fmt.Errorf("failed to parse line %d: %w", line, err))
+				return
+			}
+			if !yield(entry, nil) {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(nil, fmt.Errorf("failed to read recording: %w", err))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	var recording bytes.Buffer
+	var wire bytes.Buffer
+	conn := NewConn(&wire)
+	conn.SetRecorder(NewRecorder(&recording))
+
+	expected := &pb.HelloRequest{}
+	expected.SetClientInfo("test")
+	assert.NilError(t, conn.WriteMessage(expected))
+	_, err := conn.ReadMessage()
+	assert.NilError(t, err)
+
+	var entries []*RecordEntry
+	for entry, err := range ReadRecording(&recording) {
+		assert.NilError(t, err)
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, entries[0].Direction, DirectionOut)
+	assert.Equal(t, entries[1].Direction, DirectionIn)
+	for _, entry := range entries {
+		assert.Equal(t, entry.TypeID, uint64(1))
+		assert.Equal(t, entry.Name, "HelloRequest")
+		actual, err := entry.Decode()
+		assert.NilError(t, err)
+		assert.Assert(t, proto.Equal(expected, actual))
+	}
+}
+
+func TestRecordRedactsPassword(t *testing.T) {
+	var recording bytes.Buffer
+	recorder := NewRecorder(&recording)
+	msg := &pb.ConnectRequest{}
+	msg.SetPassword("hunter2")
+	assert.NilError(t, recorder.Record(DirectionIn, msg))
+	assert.Equal(t, msg.GetPassword(), "hunter2", "original message was modified")
+	assert.Assert(t, !strings.Contains(recording.String(), "hunter2"), "password leaked: %s", recording.String())
+
+	for entry, err := range ReadRecording(&recording) {
+		assert.NilError(t, err)
+		actual, err := entry.Decode()
+		assert.NilError(t, err)
+		assert.Equal(t, actual.(*pb.ConnectRequest).GetPassword(), "")
+	}
+}
+
+func TestRecorderClose(t *testing.T) {
+	file, err := CreateRecording(t.TempDir(), "test")
+	assert.NilError(t, err)
+	recorder := NewRecorder(file)
+	assert.NilError(t, recorder.Record(DirectionOut, &pb.PingRequest{}))
+	assert.NilError(t, recorder.Close())
+	// Writes after closing are dropped rather than hitting the closed file.
+	assert.NilError(t, recorder.Record(DirectionOut, &pb.PingResponse{}))
+	assert.NilError(t, recorder.Close())
+
+	contents, err := os.ReadFile(file.Name())
+	assert.NilError(t, err)
+	assert.Equal(t, strings.Count(string(contents), "\n"), 1)
+
+	// Recordings are never overwritten.
+	other, err := CreateRecording(filepath.Dir(file.Name()), "test")
+	assert.NilError(t, err)
+	defer other.Close()
+	assert.Assert(t, other.Name() != file.Name())
+}
@@ -2,15 +2,25 @@ package api
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/mook/mockesphome/api/pb"
 	"github.com/mook/mockesphome/utils"
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	handshakeTimeout  = 10 * time.Second // How long a client has to complete the encryption handshake
+	maxQueuedMessages = 100              // Messages queued for a client before it is considered stalled
+)
+
 type connectionState int
 
 const (
@@ -29,9 +39,9 @@ type server struct {
 	ctx       context.Context
 	state     connectionState
 	component *component
-	conn      io.ReadWriter      // Underlying connection to send data on
+	conn      *Conn              // Underlying connection to send data on
+	writeLock sync.Mutex         // Serializes writes to the connection
 	peer      string             // Description of the remote
-	buffer    []byte             // Buffer for partial bytes for the next message to read
 	incoming  chan proto.Message // Incoming messages to be processed
 	outgoing  chan proto.Message // Outgoing messages yet to be sent out
 	cancel    context.CancelFunc // Trigger to close the connection
@@ -46,10 +56,8 @@ func (s *server) loop() {
 			delete(s.component.servers, s.id)
 			s.component.serverLock.Unlock()
 			slog.InfoContext(s.ctx, "closing server due to context cancellation", "peer", s.peer)
-			if closer, ok := s.conn.(io.Closer); ok {
-				if err := closer.Close(); err != nil {
-					slog.DebugContext(s.ctx, "failed to close connection", "error", err)
-				}
+			if err := s.conn.Close(); err != nil {
+				slog.DebugContext(s.ctx, "failed to close connection", "error", err)
 			}
 			if err := s.sendMessage(&pb.DisconnectRequest{}); !utils.AnyError(err, nil, net.ErrClosed) {
 				slog.ErrorContext(s.ctx, "failed to disconnect", "error", err)
@@ -97,9 +105,17 @@ func (s *server) loop() {
 
 func (s *server) listen() {
 	for {
-		msg, err := s.readMessage()
+		msg, err := s.conn.ReadMessage()
 		if err == nil {
-			s.incoming <- msg
+			slog.DebugContext(s.ctx, "received incoming message", "message", msg, "type", msg.ProtoReflect().Descriptor().FullName())
+			if !s.injectIncomingFault(msg) {
+				// Nothing takes messages once the loop has finished.
+				select {
+				case s.incoming <- msg:
+				case <-s.ctx.Done():
+					return
+				}
+			}
 		} else {
 			if !utils.AnyError(err, io.EOF, net.ErrClosed) {
 				slog.ErrorContext(s.ctx, "failed to read message", "error", err)
@@ -113,14 +129,33 @@ func (s *server) listen() {
 // Serve a single connection.
 func serve(ctx context.Context, conn net.Conn, component *component) {
 	slog.InfoContext(ctx, "starting new connection", "peer", conn.RemoteAddr())
+	apiConn := NewConn(conn)
+	if component.key != nil {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+			slog.ErrorContext(ctx, "failed to set handshake deadline", "error", err)
+		}
+		apiConn, err = NewNoiseServerConn(conn, component.key, hostname, component.macAddress(ctx))
+		if err != nil {
+			slog.ErrorContext(ctx, "failed encrypted handshake", "peer", conn.RemoteAddr(), "error", err)
+			_ = conn.Close()
+			return
+		}
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			slog.ErrorContext(ctx, "failed to clear handshake deadline", "error", err)
+		}
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	server := &server{
 		state:     connectionStateInitial,
 		component: component,
-		conn:      conn,
+		conn:      apiConn,
 		peer:      conn.RemoteAddr().String(),
 		incoming:  make(chan proto.Message, 10),
-		outgoing:  make(chan proto.Message, 10),
+		outgoing:  make(chan proto.Message, maxQueuedMessages),
 		cancel:    cancel,
 	}
 	ctx = context.WithValue(ctx, contextKeyServer, server)
@@ -132,6 +167,71 @@ func serve(ctx context.Context, conn net.Conn, component *component) {
 	component.serverID++
 	component.serverLock.Unlock()
 
-	go server.listen()
+	var recorder *Recorder
+	if component.config.Record != "" {
+		file, err := CreateRecording(component.config.Record, fmt.Sprintf("session-%d", server.id))
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create recording", "error", err)
+		} else {
+			recorder = NewRecorder(file)
+			server.conn.SetRecorder(recorder)
+			slog.InfoContext(ctx, "recording connection", "peer", server.peer, "path", file.Name())
+		}
+	}
+
+	listenDone := make(chan struct{})
+	go func() {
+		defer close(listenDone)
+		server.listen()
+	}()
 	server.loop()
+	if recorder != nil {
+		// Wait for the reader to finish so that no messages are lost.
+		<-listenDone
+		if err := recorder.Close(); err != nil {
+			slog.ErrorContext(ctx, "failed to close recording", "error", err)
+		}
+	}
+}
+
+// Queue a message to be sent from the client's own loop, without waiting for it
+// to be written.  A client that falls too far behind is disconnected, rather
+// than holding up whatever is sending to it.
+func (s *server) queueMessage(msg proto.Message) error {
+	if s.ctx.Err() != nil {
+		return nil // The client is disconnecting, so nothing more is sent.
+	}
+	select {
+	case s.outgoing <- msg:
+		return nil
+	default:
+	}
+	slog.WarnContext(s.ctx, "disconnecting client that is not keeping up", "peer", s.peer)
+	s.disconnectAbruptly()
+	return fmt.Errorf("too many messages queued for %s", s.peer)
+}
+
+// Send a message over the wire synchronously, subject to fault injection.
+func (s *server) sendMessage(msg proto.Message) error {
+	if handled, err := s.injectOutgoingFault(msg); handled {
+		return err
+	}
+	return s.writeMessage(msg)
+}
+
+// Write a message to the connection.
+func (s *server) writeMessage(msg proto.Message) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := s.conn.WriteMessage(msg); err != nil {
+		if utils.AnyError(err, io.ErrClosedPipe, syscall.EPIPE, syscall.ECONNRESET, net.ErrClosed) {
+			// The underlying connection is dead; terminate the server.
+			s.cancel()
+			if s.state == connectionStateDisconnected {
+				return nil // If the connection is already disconnected, don't report.
+			}
+		}
+		return err
+	}
+	return nil
 }
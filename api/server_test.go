@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/mook/mockesphome/api/pb"
 	"google.golang.org/protobuf/proto"
@@ -20,7 +21,7 @@ func TestConnectionReadVarInt(t *testing.T) {
 	}
 	for _, c := range cases {
 		t.Run(fmt.Sprintf("%02x", c.input), func(t *testing.T) {
-			it := &server{conn: bytes.NewBuffer(c.input)}
+			it := NewConn(bytes.NewBuffer(c.input))
 			actual, err := it.readVarInt()
 			assert.NilError(t, err)
 			assert.Equal(t, c.expected, actual)
@@ -38,8 +39,25 @@ func TestConnectionReadMessage(t *testing.T) {
 		byte(len(input)), // one byte of data
 		0x04,             // id 4 = ConnectResponse
 	}
-	it := &server{conn: bytes.NewBuffer(append(header, input...))}
-	actual, err := it.readMessage()
+	it := NewConn(bytes.NewBuffer(append(header, input...)))
+	actual, err := it.ReadMessage()
 	assert.NilError(t, err)
 	assert.Assert(t, proto.Equal(expected, actual))
 }
+
+func TestListenStopsWhenCancelled(t *testing.T) {
+	s, client := faultServer(t, &component{})
+	s.incoming = make(chan proto.Message) // Nothing is processing messages.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.listen()
+	}()
+	go func() { _ = client.WriteMessage(&pb.PingRequest{}) }()
+	s.cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listening did not stop once cancelled")
+	}
+}
@@ -0,0 +1,328 @@
+// The `ble_client` component connects to bluetooth devices that only expose
+// their values over GATT (such as plant sensors), and reports those values as
+// sensor entities through the native API.  Enabling this component will also
+// enable the `bluetooth_proxy` component, whose adapter and connection slots
+// are shared.
+//
+// Each device is connected to periodically, its characteristics are read, and
+// then it is disconnected; characteristics set to `notify` instead keep the
+// device connected and report each notification (with the other
+// characteristics only read on connecting):
+//
+//	ble_client:
+//	  devices:
+//	    - address: C4:7C:8D:6A:12:34
+//	      name: Basil
+//	      interval: 15m
+//	      sensors:
+//	        - name: Moisture
+//	          service: 00001204-0000-1000-8000-00805f9b34fb
+//	          characteristic: 00001a01-0000-1000-8000-00805f9b34fb
+//	          format: uint8
+//	          offset: 7
+//	          unit: "%"
+//	        - name: Battery
+//	          service: 180f
+//	          characteristic: 2a19
+//	          format: uint8
+//	          deviceclass: battery
+//
+// Numeric formats are `uint8`, `int8`, `uint16`, `int16`, `uint32` and `int32`
+// (little-endian, or big-endian with a `be` suffix), and `float32`,
+// `float32be` and `float64`; the value is multiplied by `scale`.  The
+// `string` format makes a text sensor instead.
+//
+// Home Assistant's connections come first: `reserveslots` connection slots
+// are always left free for it, and a device is disconnected (to be retried
+// later) if Home Assistant wants to connect to it, or needs its slot.
+package ble_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"github.com/mook/mockesphome/components"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultReserveSlots = 1
+	defaultInterval     = 5 * time.Minute
+	maxRetryDelay       = 30 * time.Second // Longest wait to retry a failed connection
+)
+
+// Configuration for the component.
+type Configuration struct {
+	ReserveSlots int // Connection slots to always leave free for Home Assistant; defaults to 1.
+	Devices      []struct {
+		Address  string        // MAC address of the device.
+		Name     string        // Name to prefix the device's entities with; defaults to the address.
+		Interval time.Duration // Time between reads; defaults to 5m.
+		Sensors  []struct {
+			Name           string  // Name of the entity; required.
+			Service        string  // UUID of the service, in full or as a 16-bit short form (e.g. `180f`).
+			Characteristic string  // UUID of the characteristic, in full or as a 16-bit short form.
+			Notify         bool    // Stay connected and use notifications, rather than reading periodically.
+			Format         string  // How to decode the value, e.g. `uint16` or `string`; defaults to `uint8`.
+			Offset         int     // Offset of the value within the characteristic, in bytes.
+			Scale          float64 // Factor to multiply numeric values by; defaults to 1.
+			Unit           string  // Unit of measurement.
+			DeviceClass    string  // Home Assistant device class, e.g. `temperature`.
+			Decimals       int32   // Number of decimal places to show.
+		}
+	}
+}
+
+// A connection to a device; this is a [bluetooth_proxy.Session], except in
+// tests.
+type session interface {
+	Read(serviceUUID, characteristicUUID bluetooth.UUID) ([]byte, error)
+	Notify(serviceUUID, characteristicUUID bluetooth.UUID, callback func([]byte)) error
+	Done() <-chan struct{}
+	Close()
+}
+
+// A characteristic reported as an entity.
+type sensor struct {
+	name           string
+	service        bluetooth.UUID
+	characteristic bluetooth.UUID
+	notify         bool
+	format         *numberFormat // Nil for strings
+	offset         int
+	scale          float64
+	key            uint32
+}
+
+// A configured device.
+type polled struct {
+	address  bluetooth.MAC
+	name     string
+	interval time.Duration
+	sensors  []*sensor
+}
+
+// BLE client component.
+type component struct {
+	config  Configuration
+	devices []*polled
+	connect func(ctx context.Context, address bluetooth.MAC, reserve int) (session, error)
+}
+
+func (c *component) ID() string {
+	return "ble_client"
+}
+
+func (c *component) Dependencies() []string {
+	return []string{"bluetooth_proxy"}
+}
+
+func (c *component) Configure(ctx context.Context, load func(any) error) error {
+	c.config.ReserveSlots = defaultReserveSlots
+	if err := load(&c.config); err != nil {
+		return err
+	}
+	if c.config.ReserveSlots < 0 {
+		return fmt.Errorf("invalid number of reserved slots %d", c.config.ReserveSlots)
+	}
+	c.devices = nil
+	for _, config := range c.config.Devices {
+		mac, err := bluetooth.ParseMAC(config.Address)
+		if err != nil {
+			return fmt.Errorf("invalid device address %q: %w", config.Address, err)
+		}
+		dev := &polled{address: mac, name: config.Name, interval: config.Interval}
+		if dev.name == "" {
+			dev.name = mac.String()
+		}
+		if dev.interval == 0 {
+			dev.interval = defaultInterval
+		} else if dev.interval < 0 {
+			return fmt.Errorf("invalid interval %s for %s", dev.interval, dev.name)
+		}
+		for _, sc := range config.Sensors {
+			if sc.Name == "" {
+				return fmt.Errorf("sensor of %s has no name", dev.name)
+			}
+			s := &sensor{name: dev.name + " " + sc.Name, notify: sc.Notify, offset: sc.Offset, scale: sc.Scale}
+			if s.service, err = bluetooth_proxy.ParseUUID(sc.Service); err != nil {
+				return fmt.Errorf("invalid service for %s: %w", s.name, err)
+			}
+			if s.characteristic, err = bluetooth_proxy.ParseUUID(sc.Characteristic); err != nil {
+				return fmt.Errorf("invalid characteristic for %s: %w", s.name, err)
+			}
+			if s.offset < 0 {
+				return fmt.Errorf("invalid offset %d for %s", s.offset, s.name)
+			}
+			if s.scale == 0 {
+				s.scale = 1
+			}
+			if sc.Format == "" {
+				sc.Format = "uint8"
+			}
+			if sc.Format != stringFormat {
+				format, ok := numberFormats[sc.Format]
+				if !ok {
+					return fmt.Errorf("invalid format %q for %s", sc.Format, s.name)
+				}
+				s.format = &format
+			}
+			if err := s.registerEntity(mac, sc.Unit, sc.DeviceClass, sc.Decimals); err != nil {
+				return err
+			}
+			dev.sensors = append(dev.sensors, s)
+		}
+		c.devices = append(c.devices, dev)
+	}
+	if c.connect == nil {
+		c.connect = func(ctx context.Context, address bluetooth.MAC, reserve int) (session, error) {
+			return bluetooth_proxy.Connect(ctx, address, reserve)
+		}
+	}
+	return nil
+}
+
+func (c *component) Start(ctx context.Context) error {
+	for _, dev := range c.devices {
+		go c.poll(ctx, dev)
+	}
+	return nil
+}
+
+// Register the entity for a sensor; its state is missing until it is read.
+func (s *sensor) registerEntity(mac bluetooth.MAC, unit, deviceClass string, decimals int32) error {
+	id := api.ObjectID(s.name)
+	uniqueID := "ble_client-" + api.DeviceUniqueID(mac.String(), id)
+	s.key = api.EntityKey(id)
+	if s.format == nil {
+		entity := &pb.ListEntitiesTextSensorResponse{}
+		entity.SetObjectId(id)
+		entity.SetKey(s.key)
+		entity.SetName(s.name)
+		entity.SetUniqueId(uniqueID)
+		entity.SetDeviceClass(deviceClass)
+		if err := api.RegisterEntity(entity); err != nil {
+			return err
+		}
+		state := &pb.TextSensorStateResponse{}
+		state.SetKey(s.key)
+		state.SetMissingState(true)
+		api.PublishState(state)
+		return nil
+	}
+	entity := &pb.ListEntitiesSensorResponse{}
+	entity.SetObjectId(id)
+	entity.SetKey(s.key)
+	entity.SetName(s.name)
+	entity.SetUniqueId(uniqueID)
+	entity.SetUnitOfMeasurement(unit)
+	entity.SetDeviceClass(deviceClass)
+	entity.SetAccuracyDecimals(decimals)
+	entity.SetStateClass(pb.SensorStateClass_STATE_CLASS_MEASUREMENT)
+	if err := api.RegisterEntity(entity); err != nil {
+		return err
+	}
+	state := &pb.SensorStateResponse{}
+	state.SetKey(s.key)
+	state.SetMissingState(true)
+	api.PublishState(state)
+	return nil
+}
+
+// Decode a characteristic value and publish it.
+func (s *sensor) publish(data []byte) error {
+	if s.format == nil {
+		value, err := decodeString(data, s.offset)
+		if err != nil {
+			return err
+		}
+		state := &pb.TextSensorStateResponse{}
+		state.SetKey(s.key)
+		state.SetState(value)
+		api.PublishState(state)
+		return nil
+	}
+	value, err := decodeNumber(*s.format, data, s.offset, s.scale)
+	if err != nil {
+		return err
+	}
+	state := &pb.SensorStateResponse{}
+	state.SetKey(s.key)
+	state.SetState(float32(value))
+	api.PublishState(state)
+	return nil
+}
+
+// Poll a device until the context is done.
+func (c *component) poll(ctx context.Context, dev *polled) {
+	retryDelay := min(dev.interval, maxRetryDelay)
+	for {
+		delay := dev.interval
+		if err := c.update(ctx, dev); err != nil {
+			if errors.Is(err, bluetooth_proxy.ErrNoFreeSlots) {
+				slog.DebugContext(ctx, "waiting for a free connection slot", "device", dev.name)
+			} else if ctx.Err() == nil {
+				slog.WarnContext(ctx, "failed to update bluetooth device", "device", dev.name, "error", err)
+			}
+			delay = retryDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Connect to a device and read its sensors.  If any sensors use notifications,
+// this stays connected until the connection is lost, and then returns an
+// error so that it is retried soon.
+func (c *component) update(ctx context.Context, dev *polled) error {
+	sess, err := c.connect(ctx, dev.address, c.config.ReserveSlots)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	var errs []error
+	notifying := false
+	for _, s := range dev.sensors {
+		if s.notify {
+			err := sess.Notify(s.service, s.characteristic, func(data []byte) {
+				if err := s.publish(data); err != nil {
+					slog.WarnContext(ctx, "failed to decode bluetooth notification", "sensor", s.name, "error", err)
+				}
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to subscribe to %s: %w", s.name, err))
+			}
+			notifying = notifying || err == nil
+			continue
+		}
+		data, err := sess.Read(s.service, s.characteristic)
+		if err == nil {
+			err = s.publish(data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", s.name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil || !notifying {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-sess.Done():
+		return fmt.Errorf("lost connection")
+	}
+}
+
+func init() {
+	components.Register(&component{})
+}
@@ -0,0 +1,121 @@
+package ble_client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+// A scripted connection to a device.
+type fakeSession struct {
+	values   map[bluetooth.UUID][]byte // Characteristic values, by UUID
+	reads    []bluetooth.UUID
+	notified map[bluetooth.UUID]func([]byte)
+	done     chan struct{}
+	closed   bool
+}
+
+func (s *fakeSession) Read(_, characteristic bluetooth.UUID) ([]byte, error) {
+	s.reads = append(s.reads, characteristic)
+	value, ok := s.values[characteristic]
+	if !ok {
+		return nil, fmt.Errorf("characteristic %s not found", characteristic)
+	}
+	return value, nil
+}
+
+func (s *fakeSession) Notify(_, characteristic bluetooth.UUID, callback func([]byte)) error {
+	s.notified[characteristic] = callback
+	return nil
+}
+
+func (s *fakeSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *fakeSession) Close() {
+	s.closed = true
+}
+
+// Create a component configured from the given YAML, connecting to the
+// session.
+func configure(t *testing.T, config string, sess *fakeSession, connectErr error) (*component, error) {
+	c := &component{}
+	c.connect = func(ctx context.Context, address bluetooth.MAC, reserve int) (session, error) {
+		assert.Equal(t, reserve, c.config.ReserveSlots)
+		if connectErr != nil {
+			return nil, connectErr
+		}
+		return sess, nil
+	}
+	return c, c.Configure(t.Context(), func(input any) error {
+		return yaml.NewDecoder(strings.NewReader(config), yaml.DisallowUnknownField()).Decode(input)
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	battery := bluetooth.New16BitUUID(0x2A19)
+	temperature := bluetooth.New16BitUUID(0x2A6E)
+	sess := &fakeSession{
+		values:   map[bluetooth.UUID][]byte{battery: {0x64}},
+		notified: make(map[bluetooth.UUID]func([]byte)),
+		done:     make(chan struct{}),
+	}
+	c, err := configure(t, `
+devices:
+  - address: 11:22:33:44:55:66
+    name: Fern
+    sensors:
+      - {name: Battery, service: 180f, characteristic: 2a19}
+      - {name: Firmware, service: 180a, characteristic: 2a26, format: string}
+`, sess, nil)
+	assert.NilError(t, err)
+	dev := c.devices[0]
+	assert.Equal(t, dev.interval, defaultInterval)
+
+	// A missing characteristic is reported, but the others are still read.
+	err = c.update(t.Context(), dev)
+	assert.ErrorContains(t, err, "failed to read Fern Firmware")
+	assert.Equal(t, len(sess.reads), 2)
+	assert.Assert(t, sess.closed)
+
+	// Notifications keep the device connected until the connection is lost.
+	sess = &fakeSession{notified: make(map[bluetooth.UUID]func([]byte)), done: make(chan struct{})}
+	c, err = configure(t, `
+devices:
+  - address: 11:22:33:44:55:77
+    name: Cactus
+    sensors:
+      - {name: Temperature, service: 181a, characteristic: 2a6e, format: int16, scale: 0.01, notify: true}
+`, sess, nil)
+	assert.NilError(t, err)
+	result := make(chan error)
+	go func() { result <- c.update(t.Context(), c.devices[0]) }()
+	close(sess.done)
+	assert.ErrorContains(t, <-result, "lost connection")
+	assert.Assert(t, sess.notified[temperature] != nil)
+	assert.Assert(t, sess.closed)
+
+	c, err = configure(t, "devices: [{address: 11:22:33:44:55:88}]", nil, bluetooth_proxy.ErrNoFreeSlots)
+	assert.NilError(t, err)
+	assert.ErrorIs(t, c.update(t.Context(), c.devices[0]), bluetooth_proxy.ErrNoFreeSlots)
+}
+
+func TestConfigure(t *testing.T) {
+	_, err := configure(t, "devices: [{address: nope}]", nil, nil)
+	assert.ErrorContains(t, err, "invalid device address")
+	_, err = configure(t, "devices: [{address: 11:22:33:44:55:66, sensors: [{service: 180f, characteristic: 2a19}]}]", nil, nil)
+	assert.ErrorContains(t, err, "has no name")
+	_, err = configure(t, "devices: [{address: 11:22:33:44:55:66, sensors: [{name: x, service: 18, characteristic: 2a19}]}]", nil, nil)
+	assert.ErrorContains(t, err, "invalid service")
+	_, err = configure(t, "devices: [{address: 11:22:33:44:55:66, sensors: [{name: y, service: 180f, characteristic: 2a19, format: uint12}]}]", nil, nil)
+	assert.ErrorContains(t, err, "invalid format")
+	_, err = configure(t, "reserveslots: -1", nil, nil)
+	assert.ErrorContains(t, err, "invalid number of reserved slots")
+}
@@ -0,0 +1,51 @@
+package ble_client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// How to decode a numeric characteristic value.
+type numberFormat struct {
+	size   int
+	decode func([]byte) float64
+}
+
+// Supported numeric formats, by configured name.  Integers are little-endian
+// unless the name ends in `be`.
+var numberFormats = map[string]numberFormat{
+	"uint8":     {1, func(b []byte) float64 { return float64(b[0]) }},
+	"int8":      {1, func(b []byte) float64 { return float64(int8(b[0])) }},
+	"uint16":    {2, func(b []byte) float64 { return float64(binary.LittleEndian.Uint16(b)) }},
+	"int16":     {2, func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) }},
+	"uint32":    {4, func(b []byte) float64 { return float64(binary.LittleEndian.Uint32(b)) }},
+	"int32":     {4, func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) }},
+	"uint16be":  {2, func(b []byte) float64 { return float64(binary.BigEndian.Uint16(b)) }},
+	"int16be":   {2, func(b []byte) float64 { return float64(int16(binary.BigEndian.Uint16(b))) }},
+	"uint32be":  {4, func(b []byte) float64 { return float64(binary.BigEndian.Uint32(b)) }},
+	"int32be":   {4, func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) }},
+	"float32":   {4, func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }},
+	"float64":   {8, func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }},
+	"float32be": {4, func(b []byte) float64 { return float64(math.Float32frombits(binary.BigEndian.Uint32(b))) }},
+}
+
+// The format for text sensors.
+const stringFormat = "string"
+
+// Decode a numeric value at the given offset, then scale it.
+func decodeNumber(format numberFormat, data []byte, offset int, scale float64) (float64, error) {
+	if offset+format.size > len(data) {
+		return 0, fmt.Errorf("value of %d bytes is too short", len(data))
+	}
+	return format.decode(data[offset:offset+format.size]) * scale, nil
+}
+
+// Decode a string value at the given offset, dropping any trailing NULs.
+func decodeString(data []byte, offset int) (string, error) {
+	if offset > len(data) {
+		return "", fmt.Errorf("value of %d bytes is too short", len(data))
+	}
+	return strings.TrimRight(string(data[offset:]), "\x00"), nil
+}
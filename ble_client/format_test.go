@@ -0,0 +1,34 @@
+package ble_client
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDecodeNumber(t *testing.T) {
+	data := []byte{0x01, 0x34, 0x12, 0xFF, 0xFF}
+	value, err := decodeNumber(numberFormats["uint16"], data, 1, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, float64(0x1234))
+	value, err = decodeNumber(numberFormats["uint16be"], data, 1, 0.5)
+	assert.NilError(t, err)
+	assert.Equal(t, value, float64(0x3412)/2)
+	value, err = decodeNumber(numberFormats["int16"], data, 3, 0.1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, -0.1)
+	value, err = decodeNumber(numberFormats["float32"], []byte{0x00, 0x00, 0xC0, 0x3F}, 0, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, 1.5)
+
+	_, err = decodeNumber(numberFormats["uint32"], data, 2, 1)
+	assert.ErrorContains(t, err, "too short")
+}
+
+func TestDecodeString(t *testing.T) {
+	value, err := decodeString([]byte("\x01v1.2\x00\x00"), 1)
+	assert.NilError(t, err)
+	assert.Equal(t, value, "v1.2")
+	_, err = decodeString([]byte("v1"), 3)
+	assert.ErrorContains(t, err, "too short")
+}
@@ -0,0 +1,297 @@
+// The `ble_presence` component tracks whether configured bluetooth devices
+// are nearby, for presence detection and room tracking.  Enabling this
+// component will also enable the `bluetooth_proxy` component, which does the
+// scanning.
+//
+// Each device is matched by its MAC address, by an identity resolving key
+// (IRK) for devices such as phones that use resolvable private addresses, or
+// by iBeacon UUID (and optionally major and minor):
+//
+//	ble_presence:
+//	  timeout: 2m
+//	  devices:
+//	    - name: Keys
+//	      address: C4:7C:8D:6A:12:34
+//	    - name: Phone
+//	      irk: 0123456789abcdef0123456789abcdef
+//	      timeout: 5m
+//	    - name: Car
+//	      ibeacon: {uuid: fda50693-a4e2-4fb1-afcf-c6eb07647825, major: 1}
+//
+// Every device has a presence binary sensor, which turns off once the device
+// has not been heard from for the timeout, and sensors for its smoothed
+// signal strength and estimated distance.  The distance is estimated from how
+// much weaker the signal is than at 1m (which iBeacons advertise), so it is
+// only a rough guide; it is mostly useful to compare between proxies in
+// different rooms.
+package ble_presence
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"github.com/mook/mockesphome/components"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultTimeout   = 5 * time.Minute
+	defaultSmoothing = 0.3
+	defaultPathLoss  = 2
+	expiryInterval   = time.Second // How often to check for devices that have gone away
+)
+
+// Configuration for the component.
+type Configuration struct {
+	Timeout   time.Duration // Time without advertisements after which a device is away; defaults to 5m.
+	Smoothing float64       // Weight (above 0, up to 1) of each new RSSI in the moving average; defaults to 0.3, and 1 disables smoothing.
+	PathLoss  float64       // Path loss exponent for estimating distance, from 2 in open space to about 4 through walls; defaults to 2.
+	Devices   []struct {
+		Name    string // Name for the device's entities; required.
+		Address string // MAC address to match.
+		IRK     string // Identity resolving key to match resolvable private addresses, as hex with the most significant byte first.
+		IBeacon struct {
+			UUID  string  // iBeacon UUID to match.
+			Major *uint16 // Major value to match; unset to match any.
+			Minor *uint16 // Minor value to match; unset to match any.
+		} // iBeacon to match, instead of an address or IRK.
+		Timeout       time.Duration // Time without advertisements after which this device is away; defaults to the component's.
+		MeasuredPower int8          // RSSI at 1m (in dBm), for estimating distance; defaults to what an iBeacon advertises, or -59.
+	}
+}
+
+// A tracked device.
+type tracked struct {
+	name          string
+	matcher       matcher
+	timeout       time.Duration
+	measuredPower int8 // Configured RSSI at 1m, if not zero
+	presenceKey   uint32
+	rssiKey       uint32
+	distanceKey   uint32
+
+	// These are protected by the component lock.
+	home     bool
+	lastSeen time.Time
+	rssi     float64 // Smoothed RSSI, while home
+	distance float64 // Estimated distance in metres, while home
+}
+
+// BLE presence component.
+type component struct {
+	config  Configuration
+	lock    sync.Mutex
+	devices []*tracked
+}
+
+func (c *component) ID() string {
+	return "ble_presence"
+}
+
+func (c *component) Dependencies() []string {
+	return []string{"bluetooth_proxy"}
+}
+
+func (c *component) Configure(ctx context.Context, load func(any) error) error {
+	c.config.Timeout = defaultTimeout
+	c.config.Smoothing = defaultSmoothing
+	c.config.PathLoss = defaultPathLoss
+	if err := load(&c.config); err != nil {
+		return err
+	}
+	if c.config.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout %s", c.config.Timeout)
+	}
+	if c.config.Smoothing <= 0 || c.config.Smoothing > 1 {
+		return fmt.Errorf("invalid smoothing %v: must be above 0, up to 1", c.config.Smoothing)
+	}
+	if c.config.PathLoss <= 0 {
+		return fmt.Errorf("invalid path loss exponent %v", c.config.PathLoss)
+	}
+	c.devices = nil
+	for _, config := range c.config.Devices {
+		if config.Name == "" {
+			return fmt.Errorf("tracked device has no name")
+		}
+		dev := &tracked{name: config.Name, timeout: config.Timeout, measuredPower: config.MeasuredPower}
+		if dev.timeout == 0 {
+			dev.timeout = c.config.Timeout
+		} else if dev.timeout < 0 {
+			return fmt.Errorf("invalid timeout %s for %s", dev.timeout, dev.name)
+		}
+		var matchers []matcher
+		if config.Address != "" {
+			mac, err := bluetooth.ParseMAC(config.Address)
+			if err != nil {
+				return fmt.Errorf("invalid address %q for %s: %w", config.Address, dev.name, err)
+			}
+			matchers = append(matchers, addressMatcher(mac))
+		}
+		if config.IRK != "" {
+			m, err := newIRKMatcher(config.IRK)
+			if err != nil {
+				return fmt.Errorf("failed to track %s: %w", dev.name, err)
+			}
+			matchers = append(matchers, m)
+		}
+		if config.IBeacon.UUID != "" {
+			m, err := newIBeaconMatcher(config.IBeacon.UUID, config.IBeacon.Major, config.IBeacon.Minor)
+			if err != nil {
+				return fmt.Errorf("failed to track %s: %w", dev.name, err)
+			}
+			matchers = append(matchers, m)
+		}
+		if len(matchers) != 1 {
+			return fmt.Errorf("%s must have exactly one of an address, an IRK or an iBeacon", dev.name)
+		}
+		dev.matcher = matchers[0]
+		if err := dev.registerEntities(); err != nil {
+			return err
+		}
+		c.devices = append(c.devices, dev)
+	}
+	if len(c.devices) > 0 {
+		bluetooth_proxy.AddListener(c.handleAdvertisement)
+	}
+	return nil
+}
+
+func (c *component) Start(ctx context.Context) error {
+	if len(c.devices) == 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c.expire(now)
+			}
+		}
+	}()
+	return nil
+}
+
+// Register the entities for a device, which starts off away.
+func (dev *tracked) registerEntities() error {
+	id := api.ObjectID(dev.name)
+	presence := &pb.ListEntitiesBinarySensorResponse{}
+	presence.SetObjectId(id + "_presence")
+	presence.SetKey(api.EntityKey(presence.GetObjectId()))
+	presence.SetName(dev.name)
+	presence.SetUniqueId("ble_presence-" + presence.GetObjectId())
+	presence.SetDeviceClass("presence")
+	if err := api.RegisterEntity(presence); err != nil {
+		return err
+	}
+	dev.presenceKey = presence.GetKey()
+
+	sensors := []struct {
+		key      *uint32
+		id, name string
+		unit     string
+		class    string
+		decimals int32
+	}{
+		{&dev.rssiKey, "rssi", "RSSI", "dBm", "signal_strength", 0},
+		{&dev.distanceKey, "distance", "Distance", "m", "distance", 2},
+	}
+	for _, s := range sensors {
+		entity := &pb.ListEntitiesSensorResponse{}
+		entity.SetObjectId(id + "_" + s.id)
+		entity.SetKey(api.EntityKey(entity.GetObjectId()))
+		entity.SetName(dev.name + " " + s.name)
+		entity.SetUniqueId("ble_presence-" + entity.GetObjectId())
+		entity.SetUnitOfMeasurement(s.unit)
+		entity.SetDeviceClass(s.class)
+		entity.SetAccuracyDecimals(s.decimals)
+		entity.SetStateClass(pb.SensorStateClass_STATE_CLASS_MEASUREMENT)
+		if err := api.RegisterEntity(entity); err != nil {
+			return err
+		}
+		*s.key = entity.GetKey()
+	}
+	dev.publish()
+	return nil
+}
+
+// Publish the states of a device's entities; the component lock must be held.
+func (dev *tracked) publish() {
+	presence := &pb.BinarySensorStateResponse{}
+	presence.SetKey(dev.presenceKey)
+	presence.SetState(dev.home)
+	api.PublishState(presence)
+
+	rssi := &pb.SensorStateResponse{}
+	rssi.SetKey(dev.rssiKey)
+	dist := &pb.SensorStateResponse{}
+	dist.SetKey(dev.distanceKey)
+	if dev.home {
+		// Round to the precision shown, so that tiny changes are not sent.
+		rssi.SetState(float32(math.Round(dev.rssi)))
+		dist.SetState(float32(math.Round(dev.distance*100) / 100))
+	} else {
+		rssi.SetMissingState(true)
+		dist.SetMissingState(true)
+	}
+	api.PublishState(rssi)
+	api.PublishState(dist)
+}
+
+// Estimate the distance (in metres) to a device from its RSSI.
+func (c *component) distance(rssi float64, measuredPower int8) float64 {
+	return math.Pow(10, (float64(measuredPower)-rssi)/(10*c.config.PathLoss))
+}
+
+// Update any tracked device that sent an advertisement.
+func (c *component) handleAdvertisement(adv bluetooth_proxy.Advertisement) {
+	for _, dev := range c.devices {
+		matched, advertisedPower := dev.matcher.match(adv)
+		if !matched {
+			continue
+		}
+		power := dev.measuredPower
+		if power == 0 && advertisedPower != nil {
+			power = *advertisedPower
+		}
+		if power == 0 {
+			power = defaultMeasuredPower
+		}
+		c.lock.Lock()
+		if dev.home {
+			dev.rssi += c.config.Smoothing * (float64(adv.RSSI) - dev.rssi)
+		} else {
+			dev.home = true
+			dev.rssi = float64(adv.RSSI)
+		}
+		dev.lastSeen = adv.Time
+		dev.distance = c.distance(dev.rssi, power)
+		dev.publish()
+		c.lock.Unlock()
+	}
+}
+
+// Mark devices that have not been heard from for their timeout as away.
+func (c *component) expire(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, dev := range c.devices {
+		if dev.home && now.Sub(dev.lastSeen) >= dev.timeout {
+			dev.home = false
+			dev.publish()
+		}
+	}
+}
+
+func init() {
+	components.Register(&component{})
+}
@@ -0,0 +1,82 @@
+package ble_presence
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"gotest.tools/v3/assert"
+)
+
+// Create a component configured from the given YAML.
+func configure(t *testing.T, config string) (*component, error) {
+	c := &component{}
+	return c, c.Configure(t.Context(), func(input any) error {
+		return yaml.NewDecoder(strings.NewReader(config), yaml.DisallowUnknownField()).Decode(input)
+	})
+}
+
+func TestPresence(t *testing.T) {
+	c, err := configure(t, `
+timeout: 1m
+smoothing: 0.5
+devices:
+  - name: Keys
+    address: C4:7C:8D:6A:12:34
+  - name: Beacon
+    ibeacon: {uuid: fda50693-a4e2-4fb1-afcf-c6eb07647825}
+    timeout: 10s
+`)
+	assert.NilError(t, err)
+	keys, beacon := c.devices[0], c.devices[1]
+	assert.Equal(t, keys.timeout, time.Minute)
+	assert.Equal(t, beacon.timeout, 10*time.Second)
+	assert.Assert(t, !keys.home && !beacon.home)
+
+	start := time.Now()
+	adv := advertisement(t, "C4:7C:8D:6A:12:34", false)
+	adv.Time, adv.RSSI = start, -59
+	c.handleAdvertisement(adv)
+	assert.Assert(t, keys.home && !beacon.home)
+	assert.Equal(t, keys.rssi, -59.0)
+	assert.Assert(t, math.Abs(keys.distance-1) < 0.01, "distance %v", keys.distance)
+
+	// The RSSI is smoothed.
+	adv.Time, adv.RSSI = start.Add(time.Second), -79
+	c.handleAdvertisement(adv)
+	assert.Equal(t, keys.rssi, -69.0)
+
+	// The iBeacon's advertised power is used to estimate the distance.
+	adv = iBeacon(t, "fda50693a4e24fb1afcfc6eb07647825", 1, 1, -50)
+	adv.Time, adv.RSSI = start, -70
+	c.handleAdvertisement(adv)
+	assert.Assert(t, beacon.home)
+	assert.Assert(t, math.Abs(beacon.distance-10) < 0.01, "distance %v", beacon.distance)
+
+	c.expire(start.Add(30 * time.Second))
+	assert.Assert(t, keys.home && !beacon.home)
+	c.expire(start.Add(time.Minute + time.Second))
+	assert.Assert(t, !keys.home)
+
+	// Coming back starts the average again.
+	adv = advertisement(t, "C4:7C:8D:6A:12:34", false)
+	adv.Time, adv.RSSI = start.Add(2*time.Minute), -90
+	c.handleAdvertisement(adv)
+	assert.Assert(t, keys.home)
+	assert.Equal(t, keys.rssi, -90.0)
+}
+
+func TestConfigure(t *testing.T) {
+	_, err := configure(t, "devices: [{address: 11:22:33:44:55:66}]")
+	assert.ErrorContains(t, err, "has no name")
+	_, err = configure(t, "devices: [{name: both, address: 11:22:33:44:55:66, irk: ec0234a357c8ad05341010a60a397d9b}]")
+	assert.ErrorContains(t, err, "exactly one of")
+	_, err = configure(t, "devices: [{name: neither}]")
+	assert.ErrorContains(t, err, "exactly one of")
+	_, err = configure(t, "smoothing: 0")
+	assert.ErrorContains(t, err, "invalid smoothing")
+	_, err = configure(t, "devices: [{name: bad, address: nope}]")
+	assert.ErrorContains(t, err, "invalid address")
+}
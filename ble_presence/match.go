@@ -0,0 +1,108 @@
+package ble_presence
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	appleCompanyID       = 0x004C
+	iBeaconType          = 0x02
+	iBeaconLength        = 0x15
+	defaultMeasuredPower = -59 // Typical RSSI at 1m, in dBm
+)
+
+// Decides whether an advertisement comes from a tracked device.
+type matcher interface {
+	// Check an advertisement, returning whether it matches and the measured
+	// power (RSSI at 1m) it advertised, if any.
+	match(adv bluetooth_proxy.Advertisement) (bool, *int8)
+}
+
+// Matches a fixed address.
+type addressMatcher bluetooth.MAC
+
+func (m addressMatcher) match(adv bluetooth_proxy.Advertisement) (bool, *int8) {
+	return adv.Address == bluetooth.MAC(m), nil
+}
+
+// Matches resolvable private addresses generated from an identity resolving
+// key, as phones and watches use.
+type irkMatcher struct {
+	block cipher.Block
+}
+
+// Create a matcher for an IRK, given as hex with the most significant byte
+// first.
+func newIRKMatcher(irk string) (*irkMatcher, error) {
+	key, err := hex.DecodeString(strings.ReplaceAll(irk, ":", ""))
+	if err != nil || len(key) != 16 {
+		return nil, fmt.Errorf("invalid IRK %q: must be 32 hex digits", irk)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &irkMatcher{block: block}, nil
+}
+
+func (m *irkMatcher) match(adv bluetooth_proxy.Advertisement) (bool, *int8) {
+	// The address is stored little-endian: the top three bytes are the random
+	// part (whose top two bits mark it as resolvable), and the bottom three
+	// are its hash.
+	address := adv.Address
+	if !adv.Random || address[5]>>6 != 0b01 {
+		return false, nil
+	}
+	plaintext := make([]byte, aes.BlockSize)
+	plaintext[13], plaintext[14], plaintext[15] = address[5], address[4], address[3]
+	m.block.Encrypt(plaintext, plaintext)
+	return bytes.Equal(plaintext[13:], []byte{address[2], address[1], address[0]}), nil
+}
+
+// Matches iBeacon advertisements, by UUID and optionally major and minor.
+type iBeaconMatcher struct {
+	uuid  [16]byte
+	major *uint16
+	minor *uint16
+}
+
+// Create a matcher for an iBeacon UUID (with or without dashes).
+func newIBeaconMatcher(uuid string, major, minor *uint16) (*iBeaconMatcher, error) {
+	m := &iBeaconMatcher{major: major, minor: minor}
+	decoded, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil || len(decoded) != len(m.uuid) {
+		return nil, fmt.Errorf("invalid iBeacon UUID %q", uuid)
+	}
+	copy(m.uuid[:], decoded)
+	return m, nil
+}
+
+func (m *iBeaconMatcher) match(adv bluetooth_proxy.Advertisement) (bool, *int8) {
+	for _, md := range adv.ManufacturerData {
+		data := md.Data
+		if md.CompanyID != appleCompanyID || len(data) != 23 || data[0] != iBeaconType || data[1] != iBeaconLength {
+			continue
+		}
+		if !bytes.Equal(data[2:18], m.uuid[:]) {
+			continue
+		}
+		if m.major != nil && binary.BigEndian.Uint16(data[18:]) != *m.major {
+			continue
+		}
+		if m.minor != nil && binary.BigEndian.Uint16(data[20:]) != *m.minor {
+			continue
+		}
+		power := int8(data[22])
+		return true, &power
+	}
+	return false, nil
+}
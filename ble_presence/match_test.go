@@ -0,0 +1,65 @@
+package ble_presence
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+// Build an advertisement from an address.
+func advertisement(t *testing.T, address string, random bool) bluetooth_proxy.Advertisement {
+	t.Helper()
+	mac, err := bluetooth.ParseMAC(address)
+	assert.NilError(t, err)
+	return bluetooth_proxy.Advertisement{Address: mac, Random: random, RSSI: -70}
+}
+
+// Build an iBeacon advertisement.
+func iBeacon(t *testing.T, uuid string, major, minor uint16, power int8) bluetooth_proxy.Advertisement {
+	t.Helper()
+	adv := advertisement(t, "11:22:33:44:55:66", false)
+	data := []byte{iBeaconType, iBeaconLength}
+	decoded, err := hex.DecodeString(uuid)
+	assert.NilError(t, err)
+	data = append(data, decoded...)
+	data = append(data, byte(major>>8), byte(major), byte(minor>>8), byte(minor), byte(power))
+	adv.ManufacturerData = []bluetooth.ManufacturerDataElement{{CompanyID: appleCompanyID, Data: data}}
+	return adv
+}
+
+func TestIRKMatcher(t *testing.T) {
+	// Sample data for the ah function, from the Bluetooth core specification.
+	m, err := newIRKMatcher("ec0234a357c8ad05341010a60a397d9b")
+	assert.NilError(t, err)
+	matched, _ := m.match(advertisement(t, "70:81:94:0D:FB:AA", true))
+	assert.Assert(t, matched)
+	matched, _ = m.match(advertisement(t, "70:81:94:0D:FB:AB", true))
+	assert.Assert(t, !matched)
+	matched, _ = m.match(advertisement(t, "70:81:94:0D:FB:AA", false))
+	assert.Assert(t, !matched, "public addresses are never resolvable")
+
+	_, err = newIRKMatcher("ec02")
+	assert.ErrorContains(t, err, "must be 32 hex digits")
+}
+
+func TestIBeaconMatcher(t *testing.T) {
+	uuid := "fda50693a4e24fb1afcfc6eb07647825"
+	major := uint16(1)
+	m, err := newIBeaconMatcher("fda50693-a4e2-4fb1-afcf-c6eb07647825", &major, nil)
+	assert.NilError(t, err)
+	matched, power := m.match(iBeacon(t, uuid, 1, 7, -65))
+	assert.Assert(t, matched)
+	assert.Equal(t, *power, int8(-65))
+	matched, _ = m.match(iBeacon(t, uuid, 2, 7, -65))
+	assert.Assert(t, !matched)
+	matched, _ = m.match(iBeacon(t, "00000000000000000000000000000000", 1, 7, -65))
+	assert.Assert(t, !matched)
+	matched, _ = m.match(advertisement(t, "11:22:33:44:55:66", false))
+	assert.Assert(t, !matched)
+
+	_, err = newIBeaconMatcher("fda50693", nil, nil)
+	assert.ErrorContains(t, err, "invalid iBeacon UUID")
+}
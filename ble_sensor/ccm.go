@@ -0,0 +1,100 @@
+package ble_sensor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"fmt"
+)
+
+// AES-CCM (RFC 3610), as used to encrypt BTHome and Xiaomi advertisements.
+// The standard library has no implementation, and these devices only use it
+// with short messages.
+type ccm struct {
+	block   cipher.Block
+	tagSize int
+}
+
+// Create an AES-CCM cipher with the given key and tag size.
+func newCCM(key []byte, tagSize int) (*ccm, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, fmt.Errorf("invalid CCM tag size %d", tagSize)
+	}
+	return &ccm{block: block, tagSize: tagSize}, nil
+}
+
+// Build the first block of the MAC or the keystream: the flags, the nonce and
+// then the given value (the message length or the counter) in the remaining
+// bytes.
+func (c *ccm) block0(flags byte, nonce []byte, value int) []byte {
+	b := make([]byte, aes.BlockSize)
+	b[0] = flags
+	copy(b[1:], nonce)
+	for i := aes.BlockSize - 1; i > len(nonce); i-- {
+		b[i] = byte(value)
+		value >>= 8
+	}
+	return b
+}
+
+// Compute the CBC-MAC over the message and additional data.
+func (c *ccm) mac(nonce, plaintext, aad []byte) []byte {
+	lengthSize := aes.BlockSize - 1 - len(nonce)
+	flags := byte((c.tagSize-2)/2<<3 | (lengthSize - 1))
+	if len(aad) > 0 {
+		flags |= 0x40
+	}
+	x := c.block0(flags, nonce, len(plaintext))
+	c.block.Encrypt(x, x)
+	update := func(data []byte) {
+		for len(data) > 0 {
+			n := subtle.XORBytes(x, x, data)
+			data = data[n:]
+			c.block.Encrypt(x, x)
+		}
+	}
+	if len(aad) > 0 {
+		// Only short additional data (less than 0xFF00 bytes) is supported.
+		update(append([]byte{byte(len(aad) >> 8), byte(len(aad))}, aad...))
+	}
+	update(plaintext)
+	return x[:c.tagSize]
+}
+
+// Encrypt or decrypt the message in counter mode, returning it along with the
+// keystream block used to encrypt the tag.
+func (c *ccm) crypt(nonce, data []byte) ([]byte, []byte) {
+	flags := byte(aes.BlockSize - 2 - len(nonce)) // The size of the counter, less one
+	s0 := make([]byte, aes.BlockSize)
+	c.block.Encrypt(s0, c.block0(flags, nonce, 0))
+	out := make([]byte, len(data))
+	s := make([]byte, aes.BlockSize)
+	for i, offset := 1, 0; offset < len(data); i, offset = i+1, offset+aes.BlockSize {
+		c.block.Encrypt(s, c.block0(flags, nonce, i))
+		subtle.XORBytes(out[offset:], data[offset:], s)
+	}
+	return out, s0
+}
+
+// Encrypt a message, returning the ciphertext and the tag.
+func (c *ccm) seal(nonce, plaintext, aad []byte) ([]byte, []byte) {
+	ciphertext, s0 := c.crypt(nonce, plaintext)
+	tag := c.mac(nonce, plaintext, aad)
+	subtle.XORBytes(tag, tag, s0)
+	return ciphertext, tag
+}
+
+// Decrypt a message, checking its tag.
+func (c *ccm) open(nonce, ciphertext, tag, aad []byte) ([]byte, error) {
+	plaintext, s0 := c.crypt(nonce, ciphertext)
+	expected := c.mac(nonce, plaintext, aad)
+	subtle.XORBytes(expected, expected, s0)
+	if len(tag) != c.tagSize || subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, fmt.Errorf("message authentication failed")
+	}
+	return plaintext, nil
+}
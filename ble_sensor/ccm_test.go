@@ -0,0 +1,31 @@
+package ble_sensor
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCCM(t *testing.T) {
+	// RFC 3610, packet vector #1.
+	key, _ := hex.DecodeString("C0C1C2C3C4C5C6C7C8C9CACBCCCDCECF")
+	nonce, _ := hex.DecodeString("00000003020100A0A1A2A3A4A5")
+	aad, _ := hex.DecodeString("0001020304050607")
+	plaintext, _ := hex.DecodeString("08090A0B0C0D0E0F101112131415161718191A1B1C1D1E")
+	c, err := newCCM(key, 8)
+	assert.NilError(t, err)
+	ciphertext, tag := c.seal(nonce, plaintext, aad)
+	assert.Equal(t, hex.EncodeToString(ciphertext), "588c979a61c663d2f066d0c2c0f989806d5f6b61dac384")
+	assert.Equal(t, hex.EncodeToString(tag), "17e8d12cfdf926e0")
+
+	opened, err := c.open(nonce, ciphertext, tag, aad)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, opened, plaintext)
+	tag[0] ^= 1
+	_, err = c.open(nonce, ciphertext, tag, aad)
+	assert.ErrorContains(t, err, "authentication failed")
+
+	_, err = newCCM(key, 5)
+	assert.ErrorContains(t, err, "invalid CCM tag size")
+}
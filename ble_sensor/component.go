@@ -0,0 +1,203 @@
+// The `ble_sensor` component decodes advertisements from bluetooth sensors
+// and reports their readings as sensor entities through the native API, so
+// that they show up in Home Assistant as part of this device.  Enabling this
+// component will also enable the `bluetooth_proxy` component, which does the
+// scanning.
+//
+// Each sensor is configured by its MAC address and type; every advertisement
+// from it updates its temperature, humidity, battery (or battery voltage) and
+// signal strength, as far as the sensor reports them:
+//
+//	ble_sensor:
+//	  devices:
+//	    - address: A4:C1:38:12:34:56
+//	      type: xiaomi
+//	      name: Bedroom
+//	      bindkey: 00112233445566778899aabbccddeeff
+//
+// The supported types are `bthome` (BTHome v2, optionally encrypted), `xiaomi`
+// (MiBeacon, where encrypted advertisements need the bindkey), `govee` (such
+// as the H5075 and H5074), `inkbird` (IBS-TH1 and IBS-TH2) and `ruuvi`
+// (RuuviTag data formats 3 and 5).  Sensors that have not been heard from are
+// reported as having no state.
+package ble_sensor
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"github.com/mook/mockesphome/components"
+	"tinygo.org/x/bluetooth"
+)
+
+// Configuration for the component.
+type Configuration struct {
+	Devices []struct {
+		Address string // MAC address of the sensor.
+		Type    string // One of `bthome`, `xiaomi`, `govee`, `inkbird` or `ruuvi`.
+		Name    string // Name for the sensor's entities; defaults to the address.
+		BindKey string // Hex-encoded encryption key, for encrypted `bthome` and `xiaomi` sensors.
+	}
+}
+
+// How each measurement is described to clients.
+type measurementInfo struct {
+	id          string // Suffix of the object ID
+	name        string // Suffix of the entity name
+	unit        string
+	deviceClass string
+	decimals    int32
+}
+
+var measurements = map[measurement]measurementInfo{
+	measureTemperature: {"temperature", "Temperature", "°C", "temperature", 1},
+	measureHumidity:    {"humidity", "Humidity", "%", "humidity", 0},
+	measureBattery:     {"battery", "Battery", "%", "battery", 0},
+	measureVoltage:     {"voltage", "Battery Voltage", "V", "voltage", 3},
+}
+
+// Signal strength is reported for every sensor, but is not decoded.
+var rssiInfo = measurementInfo{"rssi", "RSSI", "dBm", "signal_strength", 0}
+
+// A configured sensor.
+type device struct {
+	name      string
+	decode    decoder
+	key       []byte
+	keys      map[measurement]uint32 // Entity keys
+	rssiKey   uint32
+	lock      sync.Mutex
+	lastError string // The last decoding error logged, so it is not repeated
+}
+
+// BLE sensor component.
+type component struct {
+	config  Configuration
+	devices map[bluetooth.MAC]*device
+}
+
+func (c *component) ID() string {
+	return "ble_sensor"
+}
+
+func (c *component) Dependencies() []string {
+	return []string{"bluetooth_proxy"}
+}
+
+func (c *component) Configure(ctx context.Context, load func(any) error) error {
+	if err := load(&c.config); err != nil {
+		return err
+	}
+	c.devices = make(map[bluetooth.MAC]*device)
+	for _, config := range c.config.Devices {
+		mac, err := bluetooth.ParseMAC(config.Address)
+		if err != nil {
+			return fmt.Errorf("invalid sensor address %q: %w", config.Address, err)
+		}
+		if _, ok := c.devices[mac]; ok {
+			return fmt.Errorf("sensor %s is configured more than once", mac)
+		}
+		kind, ok := sensorTypes[config.Type]
+		if !ok {
+			return fmt.Errorf("invalid type %q for sensor %s", config.Type, mac)
+		}
+		dev := &device{name: config.Name, decode: kind.decode, keys: make(map[measurement]uint32)}
+		if dev.name == "" {
+			dev.name = mac.String()
+		}
+		if config.BindKey != "" {
+			if kind.keySize == 0 {
+				return fmt.Errorf("sensor %s of type %s does not use a bindkey", mac, config.Type)
+			}
+			dev.key, err = hex.DecodeString(config.BindKey)
+			if err != nil || len(dev.key) != kind.keySize {
+				return fmt.Errorf("invalid bindkey for sensor %s: must be %d hex digits", mac, 2*kind.keySize)
+			}
+		}
+		for _, m := range kind.measurements {
+			if dev.keys[m], err = dev.registerEntity(mac, measurements[m]); err != nil {
+				return err
+			}
+		}
+		if dev.rssiKey, err = dev.registerEntity(mac, rssiInfo); err != nil {
+			return err
+		}
+		c.devices[mac] = dev
+	}
+	if len(c.devices) > 0 {
+		bluetooth_proxy.AddListener(c.handleAdvertisement)
+	}
+	return nil
+}
+
+func (c *component) Start(ctx context.Context) error {
+	return nil
+}
+
+// Register a sensor entity for a measurement, returning its key.  Its state is
+// missing until the sensor is heard from.
+func (dev *device) registerEntity(mac bluetooth.MAC, info measurementInfo) (uint32, error) {
+	entity := &pb.ListEntitiesSensorResponse{}
+	entity.SetObjectId(api.ObjectID(dev.name + "_" + info.id))
+	entity.SetKey(api.EntityKey(entity.GetObjectId()))
+	entity.SetName(dev.name + " " + info.name)
+	entity.SetUniqueId(api.DeviceUniqueID(mac.String(), info.id))
+	entity.SetUnitOfMeasurement(info.unit)
+	entity.SetDeviceClass(info.deviceClass)
+	entity.SetAccuracyDecimals(info.decimals)
+	entity.SetStateClass(pb.SensorStateClass_STATE_CLASS_MEASUREMENT)
+	if info == rssiInfo {
+		entity.SetEntityCategory(pb.EntityCategory_ENTITY_CATEGORY_DIAGNOSTIC)
+	}
+	if err := api.RegisterEntity(entity); err != nil {
+		return 0, err
+	}
+	state := &pb.SensorStateResponse{}
+	state.SetKey(entity.GetKey())
+	state.SetMissingState(true)
+	api.PublishState(state)
+	return entity.GetKey(), nil
+}
+
+// Publish a reading from a sensor.
+func publish(key uint32, value float64) {
+	state := &pb.SensorStateResponse{}
+	state.SetKey(key)
+	state.SetState(float32(value))
+	api.PublishState(state)
+}
+
+// Decode an advertisement, if it is from a configured sensor, and publish its
+// readings.
+func (c *component) handleAdvertisement(adv bluetooth_proxy.Advertisement) {
+	dev, ok := c.devices[adv.Address]
+	if !ok {
+		return
+	}
+	result, err := dev.decode(adv, dev.key)
+	dev.lock.Lock()
+	if err != nil && err.Error() != dev.lastError {
+		slog.Warn("failed to decode sensor advertisement", "sensor", dev.name, "error", err)
+	}
+	dev.lastError = ""
+	if err != nil {
+		dev.lastError = err.Error()
+	}
+	dev.lock.Unlock()
+	for m, value := range result {
+		if key, ok := dev.keys[m]; ok {
+			publish(key, value)
+		}
+	}
+	publish(dev.rssiKey, float64(adv.RSSI))
+}
+
+func init() {
+	components.Register(&component{})
+}
@@ -0,0 +1,363 @@
+package ble_sensor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"tinygo.org/x/bluetooth"
+)
+
+// A kind of reading a sensor can report.
+type measurement int
+
+const (
+	measureTemperature measurement = iota
+	measureHumidity
+	measureBattery
+	measureVoltage
+)
+
+// Readings decoded from an advertisement; a measurement is missing if the
+// advertisement did not include it.
+type readings map[measurement]float64
+
+// Decode an advertisement from a sensor, with its encryption key (if any).
+// Returns nil readings if the advertisement has nothing for this kind of
+// sensor.
+type decoder func(adv bluetooth_proxy.Advertisement, key []byte) (readings, error)
+
+// A supported kind of sensor.
+type sensorType struct {
+	decode       decoder
+	measurements []measurement // What the sensor can report, for listing entities
+	keySize      int           // Size of the encryption key; zero if not supported
+}
+
+// Supported sensors, by configured type.
+var sensorTypes = map[string]sensorType{
+	"bthome":  {decodeBTHome, []measurement{measureTemperature, measureHumidity, measureBattery, measureVoltage}, 16},
+	"xiaomi":  {decodeXiaomi, []measurement{measureTemperature, measureHumidity, measureBattery}, 16},
+	"govee":   {decodeGovee, []measurement{measureTemperature, measureHumidity, measureBattery}, 0},
+	"inkbird": {decodeInkbird, []measurement{measureTemperature, measureHumidity, measureBattery}, 0},
+	"ruuvi":   {decodeRuuvi, []measurement{measureTemperature, measureHumidity, measureVoltage}, 0},
+}
+
+// Service data UUIDs and company IDs used by the sensors.
+var (
+	bthomeUUID = bluetooth.New16BitUUID(0xFCD2)
+	xiaomiUUID = bluetooth.New16BitUUID(0xFE95)
+)
+
+const (
+	goveeCompanyID = 0xEC88
+	ruuviCompanyID = 0x0499
+)
+
+// Find the service data for a UUID.
+func serviceData(adv bluetooth_proxy.Advertisement, uuid bluetooth.UUID) []byte {
+	for _, sd := range adv.ServiceData {
+		if sd.UUID == uuid {
+			return sd.Data
+		}
+	}
+	return nil
+}
+
+// Find the manufacturer data for a company.
+func manufacturerData(adv bluetooth_proxy.Advertisement, companyID uint16) []byte {
+	for _, md := range adv.ManufacturerData {
+		if md.CompanyID == companyID {
+			return md.Data
+		}
+	}
+	return nil
+}
+
+// A BTHome object: its size in bytes (or -1 if the first byte is the size of
+// the rest), and how to convert it to a reading.
+type bthomeObject struct {
+	size        int
+	signed      bool
+	factor      float64
+	measurement measurement
+	measured    bool // Whether the object is reported at all
+}
+
+// BTHome v2 objects, by ID.  Objects not reported still need their size, to
+// find the objects after them.
+var bthomeObjects = map[byte]bthomeObject{
+	0x00: {size: 1}, // Packet ID
+	0x01: {size: 1, factor: 1, measurement: measureBattery, measured: true},
+	0x02: {size: 2, signed: true, factor: 0.01, measurement: measureTemperature, measured: true},
+	0x03: {size: 2, factor: 0.01, measurement: measureHumidity, measured: true},
+	0x04: {size: 3}, 0x05: {size: 3}, 0x06: {size: 2}, 0x07: {size: 2}, 0x08: {size: 2},
+	0x09: {size: 1}, 0x0A: {size: 3}, 0x0B: {size: 3},
+	0x0C: {size: 2, factor: 0.001, measurement: measureVoltage, measured: true},
+	0x0D: {size: 2}, 0x0E: {size: 2}, 0x0F: {size: 1}, 0x10: {size: 1}, 0x11: {size: 1},
+	0x12: {size: 2}, 0x13: {size: 2}, 0x14: {size: 2},
+	0x2E: {size: 1, factor: 1, measurement: measureHumidity, measured: true},
+	0x2F: {size: 1}, 0x3A: {size: 1}, 0x3C: {size: 2}, 0x3D: {size: 2}, 0x3E: {size: 4},
+	0x3F: {size: 2}, 0x40: {size: 2}, 0x41: {size: 2}, 0x42: {size: 3}, 0x43: {size: 2},
+	0x44: {size: 2},
+	0x45: {size: 2, signed: true, factor: 0.1, measurement: measureTemperature, measured: true},
+	0x46: {size: 1}, 0x47: {size: 2}, 0x48: {size: 2}, 0x49: {size: 2},
+	0x4A: {size: 2, factor: 0.1, measurement: measureVoltage, measured: true},
+	0x4B: {size: 3}, 0x4C: {size: 4}, 0x4D: {size: 4}, 0x4E: {size: 4}, 0x4F: {size: 4},
+	0x50: {size: 4}, 0x51: {size: 2}, 0x52: {size: 2}, 0x53: {size: -1}, 0x54: {size: -1},
+	0x55: {size: 4}, 0x56: {size: 2},
+	0x57: {size: 1, signed: true, factor: 1, measurement: measureTemperature, measured: true},
+	0x58: {size: 1, signed: true, factor: 0.35, measurement: measureTemperature, measured: true},
+	0x59: {size: 1}, 0x5A: {size: 2}, 0x5B: {size: 4}, 0x5C: {size: 4}, 0x5D: {size: 2},
+	0x5E: {size: 2}, 0x5F: {size: 2}, 0x60: {size: 1}, 0x61: {size: 2},
+	0xF0: {size: 2}, 0xF1: {size: 4}, 0xF2: {size: 3},
+}
+
+func init() {
+	// Binary sensors, all one byte.
+	for id := byte(0x15); id <= 0x2D; id++ {
+		bthomeObjects[id] = bthomeObject{size: 1}
+	}
+}
+
+// Read a little-endian integer of up to four bytes.
+func littleEndian(data []byte, signed bool) float64 {
+	var value uint32
+	for i := len(data) - 1; i >= 0; i-- {
+		value = value<<8 | uint32(data[i])
+	}
+	if signed {
+		shift := 32 - 8*len(data)
+		return float64(int32(value<<shift) >> shift)
+	}
+	return float64(value)
+}
+
+// Decode a BTHome v2 advertisement, which may be encrypted.
+func decodeBTHome(adv bluetooth_proxy.Advertisement, key []byte) (readings, error) {
+	data := serviceData(adv, bthomeUUID)
+	if len(data) < 1 {
+		return nil, nil
+	}
+	info := data[0]
+	if version := info >> 5; version != 2 {
+		return nil, fmt.Errorf("unsupported BTHome version %d", version)
+	}
+	payload := data[1:]
+	if info&0x01 != 0 {
+		if key == nil {
+			return nil, fmt.Errorf("encrypted BTHome advertisement, but no bindkey is set")
+		}
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("encrypted BTHome advertisement too short")
+		}
+		counter, tag := payload[len(payload)-8:len(payload)-4], payload[len(payload)-4:]
+		// The nonce uses the address in the usual (big-endian) order.
+		var nonce []byte
+		for i := len(adv.Address) - 1; i >= 0; i-- {
+			nonce = append(nonce, adv.Address[i])
+		}
+		nonce = append(nonce, 0xD2, 0xFC, info)
+		nonce = append(nonce, counter...)
+		c, err := newCCM(key, 4)
+		if err != nil {
+			return nil, err
+		}
+		payload, err = c.open(nonce, payload[:len(payload)-8], tag, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt BTHome advertisement: %w", err)
+		}
+	}
+	result := readings{}
+	for len(payload) > 0 {
+		object, ok := bthomeObjects[payload[0]]
+		if !ok {
+			// Without the size, nothing after this can be read.
+			return result, fmt.Errorf("unknown BTHome object 0x%02X", payload[0])
+		}
+		payload = payload[1:]
+		size := object.size
+		if size < 0 && len(payload) > 0 {
+			size = 1 + int(payload[0])
+		}
+		if size < 0 || size > len(payload) {
+			return result, fmt.Errorf("truncated BTHome advertisement")
+		}
+		if object.measured {
+			result[object.measurement] = littleEndian(payload[:size], object.signed) * object.factor
+		}
+		payload = payload[size:]
+	}
+	return result, nil
+}
+
+// Decode a Xiaomi MiBeacon advertisement, which may be encrypted (only
+// MiBeacon v4 and v5 encryption is supported).
+func decodeXiaomi(adv bluetooth_proxy.Advertisement, key []byte) (readings, error) {
+	data := serviceData(adv, xiaomiUUID)
+	if len(data) < 5 {
+		return nil, nil
+	}
+	frameControl := binary.LittleEndian.Uint16(data)
+	encrypted := frameControl&0x0008 != 0
+	hasMAC := frameControl&0x0010 != 0
+	hasCapability := frameControl&0x0020 != 0
+	hasObject := frameControl&0x0040 != 0
+	version := frameControl >> 12
+	if !hasObject {
+		return nil, nil // Only a beacon, with no readings
+	}
+	offset := 5 // Frame control, product ID and frame counter
+	if hasMAC {
+		offset += 6
+	}
+	if hasCapability {
+		if len(data) > offset && data[offset]&0x20 != 0 {
+			offset += 2 // I/O capability
+		}
+		offset++
+	}
+	if len(data) < offset {
+		return nil, fmt.Errorf("truncated MiBeacon advertisement")
+	}
+	payload := data[offset:]
+	if encrypted {
+		if version < 4 {
+			return nil, fmt.Errorf("unsupported MiBeacon encryption version %d", version)
+		}
+		if key == nil {
+			return nil, fmt.Errorf("encrypted MiBeacon advertisement, but no bindkey is set")
+		}
+		if len(payload) < 7 {
+			return nil, fmt.Errorf("encrypted MiBeacon advertisement too short")
+		}
+		counter, tag := payload[len(payload)-7:len(payload)-4], payload[len(payload)-4:]
+		// The nonce uses the address as sent (little-endian), which is how it
+		// is stored.
+		nonce := append([]byte(nil), adv.Address[:]...)
+		nonce = append(nonce, data[2:5]...) // Product ID and frame counter
+		nonce = append(nonce, counter...)
+		c, err := newCCM(key, 4)
+		if err != nil {
+			return nil, err
+		}
+		payload, err = c.open(nonce, payload[:len(payload)-7], tag, []byte{0x11})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt MiBeacon advertisement: %w", err)
+		}
+	}
+	result := readings{}
+	for len(payload) >= 3 {
+		objectType, size := binary.LittleEndian.Uint16(payload), int(payload[2])
+		if len(payload) < 3+size {
+			return result, fmt.Errorf("truncated MiBeacon object 0x%04X", objectType)
+		}
+		value := payload[3 : 3+size]
+		payload = payload[3+size:]
+		switch {
+		case objectType == 0x1004 && size == 2:
+			result[measureTemperature] = littleEndian(value, true) / 10
+		case objectType == 0x1006 && size == 2:
+			result[measureHumidity] = littleEndian(value, false) / 10
+		case objectType == 0x100D && size == 4:
+			result[measureTemperature] = littleEndian(value[:2], true) / 10
+			result[measureHumidity] = littleEndian(value[2:], false) / 10
+		case (objectType == 0x100A || objectType == 0x4803) && size == 1:
+			result[measureBattery] = float64(value[0])
+		case objectType == 0x4C01 && size == 4:
+			result[measureTemperature] = float64(math.Float32frombits(binary.LittleEndian.Uint32(value)))
+		case objectType == 0x4C02 && size == 1:
+			result[measureHumidity] = float64(value[0])
+		case objectType == 0x4C08 && size == 4:
+			result[measureHumidity] = float64(math.Float32frombits(binary.LittleEndian.Uint32(value)))
+		}
+	}
+	return result, nil
+}
+
+// Decode a Govee thermometer advertisement (such as the H5072, H5075, H5074
+// or H5051).
+func decodeGovee(adv bluetooth_proxy.Advertisement, _ []byte) (readings, error) {
+	data := manufacturerData(adv, goveeCompanyID)
+	switch len(data) {
+	case 6:
+		// Temperature and humidity packed into a 24-bit big-endian value, with
+		// the top bit for negative temperatures.
+		packed := uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+		negative := packed&0x800000 != 0
+		packed &^= 0x800000
+		temperature := float64(packed/1000) / 10
+		if negative {
+			temperature = -temperature
+		}
+		return readings{
+			measureTemperature: temperature,
+			measureHumidity:    float64(packed%1000) / 10,
+			measureBattery:     float64(data[4] & 0x7F),
+		}, nil
+	case 7:
+		return readings{
+			measureTemperature: littleEndian(data[1:3], true) / 100,
+			measureHumidity:    littleEndian(data[3:5], false) / 100,
+			measureBattery:     float64(data[5]),
+		}, nil
+	}
+	return nil, nil
+}
+
+// Decode an Inkbird IBS-TH1 or IBS-TH2 advertisement.  These put the
+// temperature where the company ID should be.
+func decodeInkbird(adv bluetooth_proxy.Advertisement, _ []byte) (readings, error) {
+	for _, md := range adv.ManufacturerData {
+		if len(md.Data) != 7 {
+			continue
+		}
+		return readings{
+			measureTemperature: float64(int16(md.CompanyID)) / 100,
+			measureHumidity:    littleEndian(md.Data[0:2], false) / 100,
+			measureBattery:     float64(md.Data[5]),
+		}, nil
+	}
+	return nil, nil
+}
+
+// Decode a RuuviTag advertisement, in data format 3 or 5.
+func decodeRuuvi(adv bluetooth_proxy.Advertisement, _ []byte) (readings, error) {
+	data := manufacturerData(adv, ruuviCompanyID)
+	if len(data) < 1 {
+		return nil, nil
+	}
+	switch data[0] {
+	case 3:
+		if len(data) < 14 {
+			return nil, fmt.Errorf("truncated RuuviTag advertisement")
+		}
+		temperature := float64(data[2]&0x7F) + float64(data[3])/100
+		if data[2]&0x80 != 0 {
+			temperature = -temperature
+		}
+		return readings{
+			measureTemperature: temperature,
+			measureHumidity:    float64(data[1]) / 2,
+			measureVoltage:     float64(binary.BigEndian.Uint16(data[12:])) / 1000,
+		}, nil
+	case 5:
+		if len(data) < 15 {
+			return nil, fmt.Errorf("truncated RuuviTag advertisement")
+		}
+		result := readings{}
+		// The largest value of each field means it is not available.
+		if temperature := binary.BigEndian.Uint16(data[1:]); temperature != 0x8000 {
+			result[measureTemperature] = float64(int16(temperature)) * 0.005
+		}
+		if humidity := binary.BigEndian.Uint16(data[3:]); humidity != 0xFFFF {
+			result[measureHumidity] = float64(humidity) * 0.0025
+		}
+		if voltage := binary.BigEndian.Uint16(data[13:]) >> 5; voltage != 0x7FF {
+			result[measureVoltage] = float64(voltage+1600) / 1000
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unsupported RuuviTag data format %d", data[0])
+}
@@ -0,0 +1,189 @@
+package ble_sensor
+
+import (
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/mook/mockesphome/bluetooth_proxy"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+var testAddress, _ = bluetooth.ParseMAC("54:48:E6:8F:80:A5")
+
+// Decode a hex string, ignoring spaces.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	assert.NilError(t, err)
+	return data
+}
+
+// Build an advertisement with the given service data.
+func withServiceData(uuid bluetooth.UUID, data []byte) bluetooth_proxy.Advertisement {
+	adv := bluetooth_proxy.Advertisement{Address: testAddress}
+	adv.ServiceData = []bluetooth.ServiceDataElement{{UUID: uuid, Data: data}}
+	return adv
+}
+
+// Build an advertisement with the given manufacturer data.
+func withManufacturerData(companyID uint16, data []byte) bluetooth_proxy.Advertisement {
+	adv := bluetooth_proxy.Advertisement{Address: testAddress}
+	adv.ManufacturerData = []bluetooth.ManufacturerDataElement{{CompanyID: companyID, Data: data}}
+	return adv
+}
+
+// Check decoded readings, allowing for rounding.
+func assertReadings(t *testing.T, got, want readings) {
+	t.Helper()
+	assert.Equal(t, len(got), len(want), "got %v", got)
+	for m, value := range want {
+		assert.Assert(t, math.Abs(got[m]-value) < 1e-4, "measurement %d: got %v, want %v", m, got[m], value)
+	}
+}
+
+func TestDecodeBTHome(t *testing.T) {
+	adv := withServiceData(bthomeUUID, unhex(t, "40 00 01 01 61 02 CA 09 03 BF 13"))
+	result, err := decodeBTHome(adv, nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureBattery: 97, measureTemperature: 25.06, measureHumidity: 50.55})
+
+	// Encrypted, with the nonce built from the address, UUID, device
+	// information and counter.
+	key := unhex(t, "231d39c1d7cc1ab1aee224cd096db932")
+	c, err := newCCM(key, 4)
+	assert.NilError(t, err)
+	counter := unhex(t, "00112233")
+	nonce := append(unhex(t, "5448E68F80A5 D2FC 41"), counter...)
+	ciphertext, tag := c.seal(nonce, unhex(t, "02 CA 09 0C 02 0C"), nil)
+	data := append([]byte{0x41}, ciphertext...)
+	data = append(append(data, counter...), tag...)
+	adv = withServiceData(bthomeUUID, data)
+	result, err = decodeBTHome(adv, key)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: 25.06, measureVoltage: 3.074})
+
+	_, err = decodeBTHome(adv, nil)
+	assert.ErrorContains(t, err, "no bindkey")
+	_, err = decodeBTHome(adv, make([]byte, 16))
+	assert.ErrorContains(t, err, "failed to decrypt")
+
+	// Variable length objects are skipped; unknown objects stop decoding.
+	adv = withServiceData(bthomeUUID, unhex(t, "40 53 02 68 69 01 50 FE 00"))
+	result, err = decodeBTHome(adv, nil)
+	assert.ErrorContains(t, err, "unknown BTHome object 0xFE")
+	assertReadings(t, result, readings{measureBattery: 80})
+
+	result, err = decodeBTHome(bluetooth_proxy.Advertisement{}, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, result == nil)
+}
+
+func TestDecodeXiaomi(t *testing.T) {
+	// LYWSDCGQ, with the address and a temperature and humidity object.
+	adv := withServiceData(xiaomiUUID, unhex(t, "50 20 AA 01 DA A5808FE64854 0D 10 04 FE 00 48 02"))
+	result, err := decodeXiaomi(adv, nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: 25.4, measureHumidity: 58.4})
+
+	// Encrypted (MiBeacon v5), with the nonce built from the address as sent,
+	// the product ID and frame counter, and the extended counter.
+	key := unhex(t, "e9ea895fac7cca6d30532432a516f3a8")
+	c, err := newCCM(key, 4)
+	assert.NilError(t, err)
+	header := unhex(t, "58 58 5B 05 50 A5808FE64854")
+	counter := unhex(t, "000000")
+	nonce := append(unhex(t, "A5808FE64854 5B0550"), counter...)
+	ciphertext, tag := c.seal(nonce, unhex(t, "0A 10 01 5D"), []byte{0x11})
+	data := append(header, ciphertext...)
+	data = append(append(data, counter...), tag...)
+	adv = withServiceData(xiaomiUUID, data)
+	result, err = decodeXiaomi(adv, key)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureBattery: 93})
+
+	_, err = decodeXiaomi(adv, make([]byte, 16))
+	assert.ErrorContains(t, err, "failed to decrypt")
+
+	// A beacon with no objects has no readings.
+	result, err = decodeXiaomi(withServiceData(xiaomiUUID, unhex(t, "10 20 AA 01 DA A5808FE64854")), nil)
+	assert.NilError(t, err)
+	assert.Assert(t, result == nil)
+}
+
+func TestDecodeGovee(t *testing.T) {
+	result, err := decodeGovee(withManufacturerData(goveeCompanyID, unhex(t, "00 03 49 A0 5A 00")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: 21.5, measureHumidity: 45.6, measureBattery: 90})
+
+	result, err = decodeGovee(withManufacturerData(goveeCompanyID, unhex(t, "00 80 D2 28 5A 00")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: -5.3, measureHumidity: 80, measureBattery: 90})
+
+	result, err = decodeGovee(withManufacturerData(goveeCompanyID, unhex(t, "00 66 08 70 17 64 02")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: 21.5, measureHumidity: 60, measureBattery: 100})
+}
+
+func TestDecodeInkbird(t *testing.T) {
+	result, err := decodeInkbird(withManufacturerData(0x0960, unhex(t, "88 13 00 12 34 55 08")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: 24, measureHumidity: 50, measureBattery: 85})
+
+	result, err = decodeInkbird(withManufacturerData(0xFF38, unhex(t, "88 13 00 12 34 55 08")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: -2, measureHumidity: 50, measureBattery: 85})
+}
+
+func TestDecodeRuuvi(t *testing.T) {
+	// Test vectors from the RuuviTag data format documentation.
+	result, err := decodeRuuvi(withManufacturerData(ruuviCompanyID, unhex(t, "0512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: 24.3, measureHumidity: 53.49, measureVoltage: 2.977})
+
+	result, err = decodeRuuvi(withManufacturerData(ruuviCompanyID, unhex(t, "058000FFFFFFFF800080008000FFFFFFFFFFFFFFFFFFFFFF")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{})
+
+	result, err = decodeRuuvi(withManufacturerData(ruuviCompanyID, unhex(t, "03291A1ECE1EFC18F94202CA0B53")), nil)
+	assert.NilError(t, err)
+	assertReadings(t, result, readings{measureTemperature: 26.3, measureHumidity: 20.5, measureVoltage: 2.899})
+
+	_, err = decodeRuuvi(withManufacturerData(ruuviCompanyID, unhex(t, "08")), nil)
+	assert.ErrorContains(t, err, "unsupported RuuviTag data format 8")
+}
+
+func TestConfigure(t *testing.T) {
+	configure := func(config string) (*component, error) {
+		c := &component{}
+		return c, c.Configure(t.Context(), func(input any) error {
+			return yaml.NewDecoder(strings.NewReader(config), yaml.DisallowUnknownField()).Decode(input)
+		})
+	}
+	c, err := configure(`
+devices:
+  - address: 54:48:E6:8F:80:A5
+    type: govee
+    name: Living Room
+`)
+	assert.NilError(t, err)
+	dev := c.devices[testAddress]
+	assert.Assert(t, dev != nil)
+	assert.Equal(t, len(dev.keys), 3)
+	// Readings are published without error, even with no clients.
+	c.handleAdvertisement(withManufacturerData(goveeCompanyID, unhex(t, "00 03 49 A0 5A 00")))
+
+	_, err = configure("devices: [{address: nope, type: govee}]")
+	assert.ErrorContains(t, err, "invalid sensor address")
+	_, err = configure("devices: [{address: 11:22:33:44:55:66, type: thermos}]")
+	assert.ErrorContains(t, err, "invalid type")
+	_, err = configure("devices: [{address: 11:22:33:44:55:66, type: govee, bindkey: 00}]")
+	assert.ErrorContains(t, err, "does not use a bindkey")
+	_, err = configure("devices: [{address: 11:22:33:44:55:66, type: xiaomi, bindkey: 00}]")
+	assert.ErrorContains(t, err, "must be 32 hex digits")
+	_, err = configure("devices: [{address: 11:22:33:44:55:66, type: xiaomi}, {address: 11:22:33:44:55:66, type: xiaomi}]")
+	assert.ErrorContains(t, err, "more than once")
+}
@@ -0,0 +1,160 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// A bluetooth adapter that the proxy can scan and connect with.
+type adapter interface {
+	// Prepare the adapter for use.
+	Enable() error
+	// Get the address of the adapter.
+	Address() (bluetooth.MACAddress, error)
+	// Scan for advertisements, calling the callback for each one; this blocks
+	// until scanning is stopped.
+	Scan(callback func(bluetooth.ScanResult)) error
+	// Stop an in-progress scan.
+	StopScan() error
+	// Connect to a device; this may block for a long time.
+	Connect(address bluetooth.Address) (device, error)
+}
+
+// An adapter that can also pair with devices.
+type pairingAdapter interface {
+	adapter
+	// Pair with a connected device.
+	Pair(ctx context.Context, address bluetooth.Address) error
+	// Remove the bond with a device; this may also disconnect it.
+	Unpair(ctx context.Context, address bluetooth.Address) error
+}
+
+var errPairingUnsupported = errors.New("pairing is not supported by this adapter")
+
+// An adapter that can report whether it is still usable.
+type checkingAdapter interface {
+	adapter
+	// Check that the adapter is present and powered.
+	Check(ctx context.Context) error
+}
+
+// A connected device.
+type device interface {
+	DiscoverServices() ([]service, error)
+	Disconnect() error
+}
+
+// A GATT service on a connected device.
+type service interface {
+	UUID() bluetooth.UUID
+	DiscoverCharacteristics() ([]characteristic, error)
+}
+
+// A GATT characteristic on a connected device.
+type characteristic interface {
+	UUID() bluetooth.UUID
+	// Get the characteristic properties, as GATT property bits.
+	Properties() uint32
+	Read(data []byte) (int, error)
+	WriteWithoutResponse(data []byte) (int, error)
+	// Enable notifications, or disable them if the callback is nil.
+	EnableNotifications(callback func(data []byte)) error
+}
+
+// The host's bluetooth adapter, through BlueZ.
+type hostAdapter struct {
+	adapter *bluetooth.Adapter
+	path    dbus.ObjectPath // BlueZ object path of the adapter
+
+	lock sync.Mutex
+	stop chan struct{} // Closed to stop scanning; nil if not scanning
+}
+
+// Use the host adapter with the given name or MAC address, or the default
+// adapter if unset.
+func newHostAdapter(ctx context.Context, want string) (*hostAdapter, error) {
+	name := bluezDefaultAdapter
+	if want != "" {
+		_, objects, err := getBluezObjects(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if name, err = objects.findAdapter(want); err != nil {
+			return nil, err
+		}
+	}
+	return &hostAdapter{
+		adapter: bluetooth.NewAdapter(name),
+		path:    dbus.ObjectPath("/org/bluez/" + name),
+	}, nil
+}
+
+func (a *hostAdapter) Enable() error {
+	return a.adapter.Enable()
+}
+
+func (a *hostAdapter) Address() (bluetooth.MACAddress, error) {
+	return a.adapter.Address()
+}
+
+func (a *hostAdapter) Connect(address bluetooth.Address) (device, error) {
+	d, err := a.adapter.Connect(address, bluetooth.ConnectionParams{})
+	if err != nil {
+		return nil, err
+	}
+	return &hostDevice{device: d}, nil
+}
+
+type hostDevice struct {
+	device bluetooth.Device
+}
+
+func (d *hostDevice) DiscoverServices() ([]service, error) {
+	deviceServices, err := d.device.DiscoverServices(nil)
+	if err != nil {
+		return nil, err
+	}
+	var result []service
+	for _, s := range deviceServices {
+		result = append(result, &hostService{service: s})
+	}
+	return result, nil
+}
+
+func (d *hostDevice) Disconnect() error {
+	return d.device.Disconnect()
+}
+
+type hostService struct {
+	service bluetooth.DeviceService
+}
+
+func (s *hostService) UUID() bluetooth.UUID {
+	return s.service.UUID()
+}
+
+func (s *hostService) DiscoverCharacteristics() ([]characteristic, error) {
+	deviceCharacteristics, err := s.service.DiscoverCharacteristics(nil)
+	if err != nil {
+		return nil, err
+	}
+	var result []characteristic
+	for i := range deviceCharacteristics {
+		result = append(result, &hostCharacteristic{&deviceCharacteristics[i]})
+	}
+	return result, nil
+}
+
+type hostCharacteristic struct {
+	*bluetooth.DeviceCharacteristic
+}
+
+// BlueZ does not expose the properties through the bluetooth library; claim
+// everything, and let the device reject what it must.
+func (c *hostCharacteristic) Properties() uint32 {
+	return gattPropertyRead | gattPropertyWrite | gattPropertyWriteWithoutResponse | gattPropertyNotify
+}
@@ -0,0 +1,211 @@
+package bluetooth_proxy
+
+import (
+	"encoding/binary"
+	"slices"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Advertising data types, from the Bluetooth assigned numbers.
+const (
+	adTypeIncomplete16BitUUIDs  = 0x02
+	adTypeComplete16BitUUIDs    = 0x03
+	adTypeIncomplete32BitUUIDs  = 0x04
+	adTypeComplete32BitUUIDs    = 0x05
+	adTypeIncomplete128BitUUIDs = 0x06
+	adTypeComplete128BitUUIDs   = 0x07
+	adTypeShortLocalName        = 0x08
+	adTypeCompleteLocalName     = 0x09
+	adTypeServiceData16Bit      = 0x16
+	adTypeServiceData32Bit      = 0x20
+	adTypeServiceData128Bit     = 0x21
+	adTypeManufacturerData      = 0xFF
+)
+
+// Size of the UUID at the start of each kind of service data.
+var serviceDataUUIDSizes = map[byte]int{
+	adTypeServiceData16Bit:  2,
+	adTypeServiceData32Bit:  4,
+	adTypeServiceData128Bit: 16,
+}
+
+// Read a UUID stored little-endian in advertising data; the length must be 2,
+// 4 or 16 bytes.
+func uuidFromAD(data []byte) bluetooth.UUID {
+	switch len(data) {
+	case 2:
+		return bluetooth.New16BitUUID(binary.LittleEndian.Uint16(data))
+	case 4:
+		return bluetooth.New32BitUUID(binary.LittleEndian.Uint32(data))
+	}
+	var uuid bluetooth.UUID
+	for i := range uuid {
+		uuid[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return uuid
+}
+
+// Parse raw advertising data into its fields.  Malformed or unknown structures
+// are skipped.
+func parseAdvertisingData(data []byte) bluetooth.AdvertisementFields {
+	var fields bluetooth.AdvertisementFields
+	for len(data) > 0 {
+		length := int(data[0])
+		if length == 0 || length >= len(data) {
+			break // Padding, or truncated.
+		}
+		adType, value := data[1], data[2:length+1]
+		data = data[length+1:]
+		switch adType {
+		case adTypeShortLocalName:
+			if fields.LocalName == "" {
+				fields.LocalName = string(value)
+			}
+		case adTypeCompleteLocalName:
+			fields.LocalName = string(value)
+		case adTypeIncomplete16BitUUIDs, adTypeComplete16BitUUIDs:
+			for ; len(value) >= 2; value = value[2:] {
+				fields.ServiceUUIDs = append(fields.ServiceUUIDs, uuidFromAD(value[:2]))
+			}
+		case adTypeIncomplete32BitUUIDs, adTypeComplete32BitUUIDs:
+			for ; len(value) >= 4; value = value[4:] {
+				fields.ServiceUUIDs = append(fields.ServiceUUIDs, uuidFromAD(value[:4]))
+			}
+		case adTypeIncomplete128BitUUIDs, adTypeComplete128BitUUIDs:
+			for ; len(value) >= 16; value = value[16:] {
+				fields.ServiceUUIDs = append(fields.ServiceUUIDs, uuidFromAD(value[:16]))
+			}
+		case adTypeServiceData16Bit, adTypeServiceData32Bit, adTypeServiceData128Bit:
+			size := serviceDataUUIDSizes[adType]
+			if len(value) >= size {
+				fields.ServiceData = append(fields.ServiceData, bluetooth.ServiceDataElement{
+					UUID: uuidFromAD(value[:size]),
+					Data: value[size:],
+				})
+			}
+		case adTypeManufacturerData:
+			if len(value) >= 2 {
+				fields.ManufacturerData = append(fields.ManufacturerData, bluetooth.ManufacturerDataElement{
+					CompanyID: binary.LittleEndian.Uint16(value),
+					Data:      value[2:],
+				})
+			}
+		}
+	}
+	return fields
+}
+
+// Advertising data from a device, as a scan result payload.
+type advertisementPayload struct {
+	bluetooth.AdvertisementFields
+	raw          []byte // Raw advertising data, if known
+	scanResponse bool   // Whether this is a scan response rather than an advertisement
+}
+
+func (p *advertisementPayload) LocalName() string {
+	return p.AdvertisementFields.LocalName
+}
+
+func (p *advertisementPayload) HasServiceUUID(uuid bluetooth.UUID) bool {
+	return slices.Contains(p.ServiceUUIDs, uuid)
+}
+
+func (p *advertisementPayload) Bytes() []byte {
+	return p.raw
+}
+
+func (p *advertisementPayload) ManufacturerData() []bluetooth.ManufacturerDataElement {
+	return p.AdvertisementFields.ManufacturerData
+}
+
+func (p *advertisementPayload) ServiceData() []bluetooth.ServiceDataElement {
+	return p.AdvertisementFields.ServiceData
+}
+
+// Get the parsed fields of a scan result.
+func advertisementFields(result bluetooth.ScanResult) bluetooth.AdvertisementFields {
+	if payload, ok := result.AdvertisementPayload.(*advertisementPayload); ok {
+		return payload.AdvertisementFields
+	}
+	if raw := result.Bytes(); raw != nil {
+		return parseAdvertisingData(raw)
+	}
+	// Other payloads cannot list their service UUIDs.
+	return bluetooth.AdvertisementFields{
+		LocalName:        result.LocalName(),
+		ServiceData:      result.ServiceData(),
+		ManufacturerData: result.ManufacturerData(),
+	}
+}
+
+// Check whether a scan result is a scan response.
+func isScanResponse(result bluetooth.ScanResult) bool {
+	payload, ok := result.AdvertisementPayload.(*advertisementPayload)
+	return ok && payload.scanResponse
+}
+
+// How long to remember a device's advertisement or scan response, to merge
+// with the other.
+const mergeExpiry = time.Minute
+
+// The latest advertisement and scan response from a device.
+type mergedDevice struct {
+	advertisement []byte
+	scanResponse  []byte
+	seen          time.Time
+}
+
+// Combines the advertisements and scan responses from each device, which
+// arrive separately, so that the parsed fields cover both.
+type advertisementMerger struct {
+	lock      sync.Mutex
+	devices   map[uint64]*mergedDevice
+	lastSweep time.Time
+}
+
+func newAdvertisementMerger() *advertisementMerger {
+	return &advertisementMerger{devices: make(map[uint64]*mergedDevice)}
+}
+
+// Merge a scan result received at the given time with what was last received
+// from the same device.  The raw data is left as received; only the parsed
+// fields are merged.  Results without raw data are returned as they are, as
+// BlueZ has already merged them.
+func (m *advertisementMerger) merge(result bluetooth.ScanResult, now time.Time) bluetooth.ScanResult {
+	raw := result.Bytes()
+	if raw == nil {
+		return result
+	}
+	scanResponse := isScanResponse(result)
+	address := bleAddressToUint64(result.Address.MAC)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now.Sub(m.lastSweep) >= mergeExpiry {
+		m.lastSweep = now
+		for address, device := range m.devices {
+			if now.Sub(device.seen) >= mergeExpiry {
+				delete(m.devices, address)
+			}
+		}
+	}
+	device, ok := m.devices[address]
+	if !ok {
+		device = &mergedDevice{}
+		m.devices[address] = device
+	}
+	if scanResponse {
+		device.scanResponse = raw
+	} else {
+		device.advertisement = raw
+	}
+	device.seen = now
+	result.AdvertisementPayload = &advertisementPayload{
+		AdvertisementFields: parseAdvertisingData(slices.Concat(device.advertisement, device.scanResponse)),
+		raw:                 raw,
+		scanResponse:        scanResponse,
+	}
+	return result
+}
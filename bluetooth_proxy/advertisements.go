@@ -0,0 +1,300 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	maxRawBatchSize         = 16                     // Advertisements per raw batch, as ESPHome
+	defaultRawBatchInterval = 100 * time.Millisecond // How long to wait for a raw batch to fill
+)
+
+// Address types, as used in the API.
+const (
+	addressTypePublic = 0
+	addressTypeRandom = 1
+)
+
+// An API client subscribed to advertisements.
+type subscriber struct {
+	send      api.MessageSender
+	flags     proxySubscriptionFlag
+	stopWatch func() bool // Stops watching for the client to disconnect
+
+	lock    sync.Mutex
+	pending []*pb.BluetoothLERawAdvertisement // Raw advertisements not yet sent
+	timer   *time.Timer                       // Timer to send pending advertisements
+}
+
+func (c *component) handleSubscribeBluetoothLEAdvertisements(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.SubscribeBluetoothLEAdvertisementsRequest)
+	if !ok {
+		return fmt.Errorf("message is not a SubscribeBluetoothLEAdvertisementsRequest")
+	}
+	id, err := api.ClientID(ctx)
+	if err != nil {
+		return err
+	}
+	send, err := api.ClientSender(ctx)
+	if err != nil {
+		return err
+	}
+	sub := &subscriber{send: send, flags: proxySubscriptionFlag(req.GetFlags())}
+	c.subscribersLock.Lock()
+	if existing, ok := c.subscribers[id]; ok {
+		existing.stopWatch()
+	}
+	sub.stopWatch = context.AfterFunc(ctx, func() {
+		c.removeSubscriber(id, sub)
+		if err := c.updateScanning(); err != nil {
+			slog.Error("failed to stop bluetooth scan", "error", err)
+		}
+	})
+	c.subscribers[id] = sub
+	c.subscribersLock.Unlock()
+	slog.DebugContext(ctx, "subscribed to bluetooth advertisements", "client", id, "flags", sub.flags)
+	if err := c.updateScanning(); err != nil {
+		return err
+	}
+
+	c.scannerLock.Lock()
+	defer c.scannerLock.Unlock()
+	return send(c.scannerStateResponse())
+}
+
+func (c *component) handleUnsubscribeBluetoothLEAdvertisements(ctx context.Context, msg proto.Message, send api.MessageSender) error {
+	if _, ok := msg.(*pb.UnsubscribeBluetoothLEAdvertisementsRequest); !ok {
+		return fmt.Errorf("message is not a UnsubscribeBluetoothLEAdvertisementsRequest")
+	}
+	id, err := api.ClientID(ctx)
+	if err != nil {
+		return err
+	}
+	c.subscribersLock.Lock()
+	sub, ok := c.subscribers[id]
+	c.subscribersLock.Unlock()
+	if ok {
+		sub.stopWatch()
+		c.removeSubscriber(id, sub)
+	}
+	return c.updateScanning()
+}
+
+// Stop sending advertisements to a subscriber.
+func (c *component) removeSubscriber(id int, sub *subscriber) {
+	c.subscribersLock.Lock()
+	if c.subscribers[id] == sub {
+		delete(c.subscribers, id)
+	}
+	c.subscribersLock.Unlock()
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.timer != nil {
+		sub.timer.Stop()
+		sub.timer = nil
+	}
+	sub.pending = nil
+}
+
+// Queue a raw advertisement for the subscriber, sending a batch if it is full.
+func (sub *subscriber) queueRaw(adv *pb.BluetoothLERawAdvertisement, interval time.Duration) {
+	sub.lock.Lock()
+	sub.pending = append(sub.pending, adv)
+	if len(sub.pending) < maxRawBatchSize {
+		if sub.timer == nil {
+			sub.timer = time.AfterFunc(interval, sub.flush)
+		}
+		sub.lock.Unlock()
+		return
+	}
+	sub.lock.Unlock()
+	sub.flush()
+}
+
+// Send any pending raw advertisements.
+func (sub *subscriber) flush() {
+	sub.lock.Lock()
+	batch := sub.pending
+	sub.pending = nil
+	if sub.timer != nil {
+		sub.timer.Stop()
+		sub.timer = nil
+	}
+	sub.lock.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	resp := &pb.BluetoothLERawAdvertisementsResponse{}
+	resp.SetAdvertisements(batch)
+	if err := sub.send(resp); err != nil {
+		slog.Error("failed to send raw bluetooth advertisements", "error", err)
+	}
+}
+
+// Get the address type of a scan result, in the API representation.
+func addressType(result bluetooth.ScanResult) uint32 {
+	if result.Address.IsRandom() {
+		return addressTypeRandom
+	}
+	return addressTypePublic
+}
+
+// Append a single advertising data structure.
+func appendADStructure(buf []byte, adType byte, data ...[]byte) []byte {
+	length := 1
+	for _, d := range data {
+		length += len(d)
+	}
+	buf = append(buf, byte(length), adType)
+	for _, d := range data {
+		buf = append(buf, d...)
+	}
+	return buf
+}
+
+// Get the raw advertising data of a scan result.  If the backend does not
+// provide the raw data (as with BlueZ), it is reconstructed from the parsed
+// fields.
+func rawAdvertisementData(result bluetooth.ScanResult) []byte {
+	if raw := result.Bytes(); raw != nil {
+		return raw
+	}
+	fields := advertisementFields(result)
+	var buf []byte
+	if fields.LocalName != "" {
+		buf = appendADStructure(buf, adTypeCompleteLocalName, []byte(fields.LocalName))
+	}
+	var uuids16, uuids128 []byte
+	for _, uuid := range fields.ServiceUUIDs {
+		if uuid.Is16Bit() {
+			uuids16 = binary.LittleEndian.AppendUint16(uuids16, uuid.Get16Bit())
+		} else {
+			uuidBytes := uuid.Bytes()
+			uuids128 = append(uuids128, uuidBytes[:]...)
+		}
+	}
+	if len(uuids16) > 0 {
+		buf = appendADStructure(buf, adTypeComplete16BitUUIDs, uuids16)
+	}
+	if len(uuids128) > 0 {
+		buf = appendADStructure(buf, adTypeComplete128BitUUIDs, uuids128)
+	}
+	for _, sd := range fields.ServiceData {
+		if sd.UUID.Is16Bit() {
+			uuid := binary.LittleEndian.AppendUint16(nil, sd.UUID.Get16Bit())
+			buf = appendADStructure(buf, adTypeServiceData16Bit, uuid, sd.Data)
+		} else {
+			uuid := sd.UUID.Bytes()
+			buf = appendADStructure(buf, adTypeServiceData128Bit, uuid[:], sd.Data)
+		}
+	}
+	for _, md := range fields.ManufacturerData {
+		companyID := binary.LittleEndian.AppendUint16(nil, md.CompanyID)
+		buf = appendADStructure(buf, adTypeManufacturerData, companyID, md.Data)
+	}
+	return buf
+}
+
+// Convert a scan result into a raw advertisement.
+func rawAdvertisement(result bluetooth.ScanResult) *pb.BluetoothLERawAdvertisement {
+	adv := &pb.BluetoothLERawAdvertisement{}
+	adv.SetAddress(bleAddressToUint64(result.Address.MAC))
+	adv.SetRssi(int32(result.RSSI))
+	adv.SetAddressType(addressType(result))
+	adv.SetData(rawAdvertisementData(result))
+	return adv
+}
+
+// Convert a scan result into a parsed advertisement.
+func parsedAdvertisement(result bluetooth.ScanResult) *pb.BluetoothLEAdvertisementResponse {
+	fields := advertisementFields(result)
+	resp := &pb.BluetoothLEAdvertisementResponse{}
+	resp.SetAddress(bleAddressToUint64(result.Address.MAC))
+	resp.SetAddressType(addressType(result))
+	resp.SetName(fields.LocalName)
+	resp.SetRssi(int32(result.RSSI))
+	var serviceData []*pb.BluetoothServiceData
+	for _, sd := range fields.ServiceData {
+		data := &pb.BluetoothServiceData{}
+		data.SetUuid(sd.UUID.String())
+		data.SetData(sd.Data)
+		serviceData = append(serviceData, data)
+	}
+	resp.SetServiceData(serviceData)
+	var manufacturerData []*pb.BluetoothServiceData
+	for _, md := range fields.ManufacturerData {
+		data := &pb.BluetoothServiceData{}
+		data.SetUuid(fmt.Sprintf("0x%04X", md.CompanyID))
+		data.SetData(md.Data)
+		manufacturerData = append(manufacturerData, data)
+	}
+	resp.SetManufacturerData(manufacturerData)
+	var uuids []string
+	for _, uuid := range fields.ServiceUUIDs {
+		uuids = append(uuids, uuid.String())
+	}
+	resp.SetServiceUuids(uuids)
+	return resp
+}
+
+// Send a scan result to every subscriber, in the form each one asked for.
+func (c *component) scanResultCallback(result bluetooth.ScanResult) {
+	now := time.Now()
+	c.lastResult.Store(now.UnixNano())
+	if c.recorder != nil {
+		c.recorder.record(result)
+	}
+	if c.merger != nil {
+		result = c.merger.merge(result, now)
+	}
+	if c.devices != nil {
+		c.devices.update(result, now)
+	}
+	notifyListeners(result, now)
+	c.forward(result, now)
+	verdict := forwarded
+	if c.filter != nil {
+		verdict = c.filter.check(result)
+	}
+	if verdict == forwarded && c.throttle != nil {
+		verdict = c.throttle.check(result, now)
+	}
+	advertisementCounts.Add(verdict, 1)
+	if verdict != forwarded {
+		return
+	}
+	c.subscribersLock.Lock()
+	subscribers := make([]*subscriber, 0, len(c.subscribers))
+	for _, sub := range c.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	c.subscribersLock.Unlock()
+
+	var raw *pb.BluetoothLERawAdvertisement
+	var parsed *pb.BluetoothLEAdvertisementResponse
+	for _, sub := range subscribers {
+		if sub.flags&proxySubscriptionRawAdvertisements != 0 {
+			if raw == nil {
+				raw = rawAdvertisement(result)
+			}
+			sub.queueRaw(raw, c.config.RawBatchInterval)
+			continue
+		}
+		if parsed == nil {
+			parsed = parsedAdvertisement(result)
+		}
+		if err := sub.send(parsed); err != nil {
+			slog.Error("failed to send bluetooth scan result", "error", err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package bluetooth_proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestRawAdvertisement(t *testing.T) {
+	result := bluetooth.ScanResult{
+		RSSI: -60,
+		AdvertisementPayload: &advertisementPayload{AdvertisementFields: bluetooth.AdvertisementFields{
+			LocalName:    "ab",
+			ServiceUUIDs: []bluetooth.UUID{bluetooth.New16BitUUID(0x180F)},
+			ServiceData: []bluetooth.ServiceDataElement{
+				{UUID: bluetooth.New16BitUUID(0xFCD2), Data: []byte{0x40}},
+			},
+			ManufacturerData: []bluetooth.ManufacturerDataElement{
+				{CompanyID: 0x004C, Data: []byte{0x02, 0x15}},
+			},
+		}},
+	}
+	result.Address.MAC = bluetooth.MAC{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	result.Address.SetRandom(true)
+
+	adv := rawAdvertisement(result)
+	assert.Equal(t, adv.GetAddress(), uint64(0x060504030201))
+	assert.Equal(t, adv.GetRssi(), int32(-60))
+	assert.Equal(t, adv.GetAddressType(), uint32(addressTypeRandom))
+	assert.DeepEqual(t, adv.GetData(), []byte{
+		0x03, adTypeCompleteLocalName, 'a', 'b',
+		0x03, adTypeComplete16BitUUIDs, 0x0F, 0x18,
+		0x04, adTypeServiceData16Bit, 0xD2, 0xFC, 0x40,
+		0x05, adTypeManufacturerData, 0x4C, 0x00, 0x02, 0x15,
+	})
+}
+
+func TestRawAdvertisementBatches(t *testing.T) {
+	batches := make(chan *pb.BluetoothLERawAdvertisementsResponse, 2)
+	sub := &subscriber{
+		flags: proxySubscriptionRawAdvertisements,
+		send: func(msg proto.Message) error {
+			batches <- msg.(*pb.BluetoothLERawAdvertisementsResponse)
+			return nil
+		},
+	}
+	c := &component{
+		config:      Configuration{RawBatchInterval: 50 * time.Millisecond},
+		subscribers: map[int]*subscriber{1: sub},
+	}
+	result := bluetooth.ScanResult{AdvertisementPayload: &advertisementPayload{}}
+
+	// A full batch is sent immediately.
+	for range maxRawBatchSize + 1 {
+		c.scanResultCallback(result)
+	}
+	select {
+	case batch := <-batches:
+		assert.Equal(t, len(batch.GetAdvertisements()), maxRawBatchSize)
+	default:
+		t.Fatal("full batch was not sent")
+	}
+
+	// The remainder is sent after the interval.
+	select {
+	case batch := <-batches:
+		assert.Equal(t, len(batch.GetAdvertisements()), 1)
+	case <-time.After(time.Second):
+		t.Fatal("partial batch was not sent")
+	}
+
+	// Nothing is sent once the subscriber is removed.
+	c.scanResultCallback(result)
+	c.removeSubscriber(1, sub)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, len(batches), 0)
+	assert.Equal(t, len(c.subscribers), 0)
+}
@@ -0,0 +1,299 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// The bluetooth library does not support pairing or finding adapters, so the
+// host adapter talks to BlueZ directly for those, the same way its Linux
+// backend does.
+const (
+	bluezService          = "org.bluez"
+	bluezAdapterInterface = "org.bluez.Adapter1"
+	bluezDeviceInterface  = "org.bluez.Device1"
+	bluezAlreadyExists    = "org.bluez.Error.AlreadyExists"
+	bluezDoesNotExist     = "org.bluez.Error.DoesNotExist"
+	bluezDefaultAdapter   = "hci0" // As used by the bluetooth library
+)
+
+var errUnknownDevice = errors.New("unknown bluetooth device")
+
+// The properties of each interface of each BlueZ object, by path.
+type bluezObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+// A device known to BlueZ.
+type bluezDevice struct {
+	object  dbus.BusObject
+	adapter dbus.BusObject // The adapter the device belongs to
+}
+
+// List the objects BlueZ knows about.
+func getBluezObjects(ctx context.Context) (*dbus.Conn, bluezObjects, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	var objects bluezObjects
+	err = bus.Object(bluezService, "/").
+		CallWithContext(ctx, "org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).
+		Store(&objects)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list bluetooth objects: %w", err)
+	}
+	return bus, objects, nil
+}
+
+// Find the adapter with the given name (e.g. `hci1`) or MAC address, returning
+// its name.
+func (objects bluezObjects) findAdapter(want string) (string, error) {
+	var names []string
+	for objectPath, interfaces := range objects {
+		props, ok := interfaces[bluezAdapterInterface]
+		if !ok {
+			continue
+		}
+		name := path.Base(string(objectPath))
+		if name == want {
+			return name, nil
+		}
+		if addr, ok := props["Address"].Value().(string); ok && strings.EqualFold(addr, want) {
+			return name, nil
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return "", fmt.Errorf("failed to find bluetooth adapter %q (found %s)", want, strings.Join(names, ", "))
+}
+
+// Find the BlueZ object for the device with the given address, as seen by the
+// adapter at the given path.
+func findBluezDevice(ctx context.Context, adapterPath dbus.ObjectPath, address bluetooth.Address) (*bluezDevice, error) {
+	bus, objects, err := getBluezObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	want := address.MAC.String()
+	for objectPath, interfaces := range objects {
+		props, ok := interfaces[bluezDeviceInterface]
+		if !ok {
+			continue
+		}
+		if addr, ok := props["Address"].Value().(string); !ok || !strings.EqualFold(addr, want) {
+			continue
+		}
+		if owner, ok := props["Adapter"].Value().(dbus.ObjectPath); !ok || owner != adapterPath {
+			continue
+		}
+		return &bluezDevice{
+			object:  bus.Object(bluezService, objectPath),
+			adapter: bus.Object(bluezService, adapterPath),
+		}, nil
+	}
+	return nil, fmt.Errorf("%w %s", errUnknownDevice, want)
+}
+
+// Check that the adapter is still known to BlueZ and powered on.
+func (a *hostAdapter) Check(ctx context.Context) error {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	var powered bool
+	err = bus.Object(bluezService, a.path).
+		CallWithContext(ctx, "org.freedesktop.DBus.Properties.Get", 0, bluezAdapterInterface, "Powered").
+		Store(&powered)
+	if err != nil {
+		return fmt.Errorf("failed to get state of bluetooth adapter %s: %w", path.Base(string(a.path)), err)
+	}
+	if !powered {
+		return fmt.Errorf("bluetooth adapter %s is not powered", path.Base(string(a.path)))
+	}
+	return nil
+}
+
+// Scan for advertisements through BlueZ.  The bluetooth library can do this
+// too, but does not expose the advertised service UUIDs.  BlueZ does not pass
+// on advertisements as such; instead, each device's properties are updated as
+// they arrive, and already include anything from scan responses.
+func (a *hostAdapter) Scan(callback func(bluetooth.ScanResult)) error {
+	a.lock.Lock()
+	if a.stop != nil {
+		a.lock.Unlock()
+		return fmt.Errorf("already scanning")
+	}
+	stop := make(chan struct{})
+	a.stop = stop
+	a.lock.Unlock()
+	// Allow scanning again however this returns, including on errors, as the
+	// scanner does not stop a scan that failed.
+	defer func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.stop == stop {
+			a.stop = nil
+		}
+	}()
+
+	bus, objects, err := getBluezObjects(context.Background())
+	if err != nil {
+		return err
+	}
+	adapter := bus.Object(bluezService, a.path)
+	filter := map[string]any{"Transport": "le", "DuplicateData": true}
+	if err := adapter.Call(bluezAdapterInterface+".SetDiscoveryFilter", 0, filter).Err; err != nil {
+		return fmt.Errorf("failed to set discovery filter: %w", err)
+	}
+	defer adapter.Call(bluezAdapterInterface+".SetDiscoveryFilter", 0, map[string]any{})
+
+	signals := make(chan *dbus.Signal, 16)
+	bus.Signal(signals)
+	defer bus.RemoveSignal(signals)
+	matches := [][]dbus.MatchOption{
+		{dbus.WithMatchInterface("org.freedesktop.DBus.Properties"), dbus.WithMatchMember("PropertiesChanged")},
+		{dbus.WithMatchInterface("org.freedesktop.DBus.ObjectManager"), dbus.WithMatchMember("InterfacesAdded")},
+	}
+	for _, match := range matches {
+		if err := bus.AddMatchSignal(match...); err != nil {
+			return fmt.Errorf("failed to watch bluetooth devices: %w", err)
+		}
+		defer bus.RemoveMatchSignal(match...)
+	}
+
+	// Remember the properties of known devices, as changes only include the
+	// properties that changed.
+	devices := make(map[dbus.ObjectPath]map[string]dbus.Variant)
+	for objectPath, interfaces := range objects {
+		if props, ok := interfaces[bluezDeviceInterface]; ok {
+			devices[objectPath] = props
+		}
+	}
+	if err := adapter.Call(bluezAdapterInterface+".StartDiscovery", 0).Err; err != nil {
+		return fmt.Errorf("failed to start discovery: %w", err)
+	}
+	for {
+		var sig *dbus.Signal
+		select {
+		case <-stop:
+			return adapter.Call(bluezAdapterInterface+".StopDiscovery", 0).Err
+		case sig = <-signals:
+		}
+		var props map[string]dbus.Variant
+		switch sig.Name {
+		case "org.freedesktop.DBus.ObjectManager.InterfacesAdded":
+			var objectPath dbus.ObjectPath
+			var interfaces map[string]map[string]dbus.Variant
+			if dbus.Store(sig.Body, &objectPath, &interfaces) != nil || !a.owns(objectPath) {
+				continue
+			}
+			if props = interfaces[bluezDeviceInterface]; props == nil {
+				continue
+			}
+			devices[objectPath] = props
+		case "org.freedesktop.DBus.Properties.PropertiesChanged":
+			var iface string
+			var changes map[string]dbus.Variant
+			if len(sig.Body) < 2 || dbus.Store(sig.Body[:2], &iface, &changes) != nil {
+				continue
+			}
+			if iface != bluezDeviceInterface || !a.owns(sig.Path) {
+				continue
+			}
+			advertised := slices.ContainsFunc(bluezAdvertisedProperties, func(name string) bool {
+				_, ok := changes[name]
+				return ok
+			})
+			if !advertised {
+				continue // Not from an advertisement, e.g. connection state
+			}
+			if props = devices[sig.Path]; props == nil {
+				props = make(map[string]dbus.Variant)
+				devices[sig.Path] = props
+			}
+			maps.Copy(props, changes)
+		default:
+			continue
+		}
+		if result, ok := bluezScanResult(props); ok {
+			callback(result)
+		}
+	}
+}
+
+func (a *hostAdapter) StopScan() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.stop == nil {
+		return fmt.Errorf("not scanning")
+	}
+	close(a.stop)
+	a.stop = nil
+	return nil
+}
+
+// Check whether a BlueZ object belongs to the adapter.
+func (a *hostAdapter) owns(objectPath dbus.ObjectPath) bool {
+	return strings.HasPrefix(string(objectPath), string(a.path)+"/")
+}
+
+// Device properties that change when an advertisement arrives.
+var bluezAdvertisedProperties = []string{"RSSI", "ManufacturerData", "ServiceData", "UUIDs", "Name", "TxPower"}
+
+// Convert the properties of a BlueZ device into a scan result.  Returns false
+// if the device has not been heard from.
+func bluezScanResult(props map[string]dbus.Variant) (bluetooth.ScanResult, bool) {
+	var result bluetooth.ScanResult
+	addr, _ := props["Address"].Value().(string)
+	mac, err := bluetooth.ParseMAC(addr)
+	if err != nil {
+		return result, false
+	}
+	rssi, ok := props["RSSI"].Value().(int16)
+	if !ok {
+		return result, false
+	}
+	result.Address.MAC = mac
+	addressType, _ := props["AddressType"].Value().(string)
+	result.Address.SetRandom(addressType == "random")
+	result.RSSI = rssi
+
+	var fields bluetooth.AdvertisementFields
+	fields.LocalName, _ = props["Name"].Value().(string)
+	uuids, _ := props["UUIDs"].Value().([]string)
+	for _, s := range uuids {
+		if uuid, err := bluetooth.ParseUUID(s); err == nil {
+			fields.ServiceUUIDs = append(fields.ServiceUUIDs, uuid)
+		}
+	}
+	// Sort the data from maps, so that repeated advertisements are identical.
+	serviceData, _ := props["ServiceData"].Value().(map[string]dbus.Variant)
+	for _, s := range slices.Sorted(maps.Keys(serviceData)) {
+		uuid, err := bluetooth.ParseUUID(s)
+		data, ok := serviceData[s].Value().([]byte)
+		if err == nil && ok {
+			fields.ServiceData = append(fields.ServiceData, bluetooth.ServiceDataElement{UUID: uuid, Data: data})
+		}
+	}
+	manufacturerData, _ := props["ManufacturerData"].Value().(map[uint16]dbus.Variant)
+	for _, company := range slices.Sorted(maps.Keys(manufacturerData)) {
+		if data, ok := manufacturerData[company].Value().([]byte); ok {
+			fields.ManufacturerData = append(fields.ManufacturerData, bluetooth.ManufacturerDataElement{CompanyID: company, Data: data})
+		}
+	}
+	result.AdvertisementPayload = &advertisementPayload{AdvertisementFields: fields}
+	return result, true
+}
+
+// Check whether an error from BlueZ has the given name.
+func isBluezError(err error, name string) bool {
+	var dbusErr dbus.Error
+	return errors.As(err, &dbusErr) && dbusErr.Name == name
+}
@@ -0,0 +1,80 @@
+package bluetooth_proxy
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestFindBluezAdapter(t *testing.T) {
+	adapter := func(address string) map[string]map[string]dbus.Variant {
+		return map[string]map[string]dbus.Variant{
+			bluezAdapterInterface: {"Address": dbus.MakeVariant(address)},
+		}
+	}
+	objects := bluezObjects{
+		"/org/bluez":      {},
+		"/org/bluez/hci0": adapter("B8:27:EB:00:00:01"),
+		"/org/bluez/hci1": adapter("00:1A:7D:DA:71:13"),
+		"/org/bluez/hci1/dev_11_22_33_44_55_66": {
+			bluezDeviceInterface: {"Address": dbus.MakeVariant("00:1A:7D:DA:71:13")},
+		},
+	}
+	name, err := objects.findAdapter("hci1")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "hci1")
+	name, err = objects.findAdapter("00:1a:7d:da:71:13")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "hci1")
+	_, err = objects.findAdapter("hci2")
+	assert.ErrorContains(t, err, `failed to find bluetooth adapter "hci2" (found hci0, hci1)`)
+}
+
+func TestBluezScanResult(t *testing.T) {
+	props := map[string]dbus.Variant{
+		"Address":     dbus.MakeVariant("11:22:33:44:55:66"),
+		"AddressType": dbus.MakeVariant("random"),
+		"Name":        dbus.MakeVariant("sensor"),
+		"UUIDs":       dbus.MakeVariant([]string{"0000180f-0000-1000-8000-00805f9b34fb"}),
+		"ServiceData": dbus.MakeVariant(map[string]dbus.Variant{
+			"0000fcd2-0000-1000-8000-00805f9b34fb": dbus.MakeVariant([]byte{0x40}),
+		}),
+		"ManufacturerData": dbus.MakeVariant(map[uint16]dbus.Variant{
+			0x0499: dbus.MakeVariant([]byte{0x05}),
+			0x004C: dbus.MakeVariant([]byte{0x02, 0x15}),
+		}),
+	}
+	// Devices that have not been heard from are not reported.
+	_, ok := bluezScanResult(props)
+	assert.Assert(t, !ok)
+
+	props["RSSI"] = dbus.MakeVariant(int16(-70))
+	result, ok := bluezScanResult(props)
+	assert.Assert(t, ok)
+	assert.Equal(t, result.Address.MAC.String(), "11:22:33:44:55:66")
+	assert.Assert(t, result.Address.IsRandom())
+	assert.Equal(t, result.RSSI, int16(-70))
+	assert.DeepEqual(t, advertisementFields(result), bluetooth.AdvertisementFields{
+		LocalName:    "sensor",
+		ServiceUUIDs: []bluetooth.UUID{bluetooth.New16BitUUID(0x180F)},
+		ServiceData:  []bluetooth.ServiceDataElement{{UUID: bluetooth.New16BitUUID(0xFCD2), Data: []byte{0x40}}},
+		ManufacturerData: []bluetooth.ManufacturerDataElement{
+			{CompanyID: 0x004C, Data: []byte{0x02, 0x15}},
+			{CompanyID: 0x0499, Data: []byte{0x05}},
+		},
+	})
+}
+
+func TestHostAdapterScanRetry(t *testing.T) {
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "unix:path="+filepath.Join(t.TempDir(), "missing"))
+	a := &hostAdapter{path: "/org/bluez/hci0"}
+	err := a.Scan(func(bluetooth.ScanResult) {})
+	assert.ErrorContains(t, err, "failed to connect to system bus")
+	// A failed scan does not leave the adapter scanning, so it can be retried.
+	err = a.Scan(func(bluetooth.ScanResult) {})
+	assert.ErrorContains(t, err, "failed to connect to system bus")
+	assert.ErrorContains(t, a.StopScan(), "not scanning")
+}
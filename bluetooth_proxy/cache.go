@@ -0,0 +1,79 @@
+package bluetooth_proxy
+
+import (
+	"sync"
+)
+
+// Discovered GATT services, by device address, so that clients reconnecting
+// to a device see the same attribute handles without discovering it again.
+type gattCache struct {
+	lock     sync.Mutex
+	services map[uint64][]*gattService
+}
+
+func newGATTCache() *gattCache {
+	return &gattCache{services: make(map[uint64][]*gattService)}
+}
+
+// Copy the layout of discovered services, without anything tied to a
+// particular connection.
+func cloneServices(services []*gattService) []*gattService {
+	result := make([]*gattService, 0, len(services))
+	for _, service := range services {
+		clone := &gattService{uuid: service.uuid, handle: service.handle}
+		for _, characteristic := range service.characteristics {
+			clone.characteristics = append(clone.characteristics, &gattCharacteristic{
+				uuid:       characteristic.uuid,
+				handle:     characteristic.handle,
+				properties: characteristic.properties,
+				cccdHandle: characteristic.cccdHandle,
+			})
+		}
+		result = append(result, clone)
+	}
+	return result
+}
+
+// Check whether two sets of services have the same services and
+// characteristics, in the same order.
+func sameLayout(a, b []*gattService) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].uuid != b[i].uuid || len(a[i].characteristics) != len(b[i].characteristics) {
+			return false
+		}
+		for j := range a[i].characteristics {
+			if a[i].characteristics[j].uuid != b[i].characteristics[j].uuid {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Get the cached services for a device, or nil if there are none.
+func (gc *gattCache) get(address uint64) []*gattService {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	services, ok := gc.services[address]
+	if !ok {
+		return nil
+	}
+	return cloneServices(services)
+}
+
+// Remember the services discovered on a device.
+func (gc *gattCache) put(address uint64, services []*gattService) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	gc.services[address] = cloneServices(services)
+}
+
+// Forget the services of a device.
+func (gc *gattCache) clear(address uint64) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	delete(gc.services, address)
+}
@@ -0,0 +1,60 @@
+package bluetooth_proxy
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestGATTCache(t *testing.T) {
+	services := []*gattService{
+		{
+			uuid: bluetooth.New16BitUUID(0x180F),
+			characteristics: []*gattCharacteristic{
+				{
+					uuid:           bluetooth.New16BitUUID(0x2A19),
+					properties:     gattPropertyRead,
+					characteristic: &simulatedCharacteristic{},
+					notifying:      true,
+				},
+			},
+		},
+	}
+	assignHandles(services)
+
+	cache := newGATTCache()
+	assert.Assert(t, cache.get(1) == nil)
+	cache.put(1, services)
+
+	cached := cache.get(1)
+	assert.Assert(t, sameLayout(cached, services))
+	characteristic := cached[0].characteristics[0]
+	assert.Equal(t, characteristic.handle, uint32(2))
+	assert.Equal(t, characteristic.cccdHandle, uint32(3))
+	assert.Equal(t, characteristic.properties, uint32(gattPropertyRead))
+	assert.Assert(t, characteristic.characteristic == nil, "cached characteristic is bound to a connection")
+	assert.Assert(t, !characteristic.notifying, "cached characteristic is notifying")
+
+	// Changing what we got back does not change the cache.
+	cached[0].characteristics = nil
+	assert.Assert(t, sameLayout(cache.get(1), services))
+
+	cache.clear(1)
+	assert.Assert(t, cache.get(1) == nil)
+}
+
+func TestSameLayout(t *testing.T) {
+	service := func(uuids ...uint16) *gattService {
+		s := &gattService{uuid: bluetooth.New16BitUUID(0x180F)}
+		for _, uuid := range uuids {
+			s.characteristics = append(s.characteristics, &gattCharacteristic{uuid: bluetooth.New16BitUUID(uuid)})
+		}
+		return s
+	}
+	a := []*gattService{service(0x2A19, 0x2A1A)}
+	assert.Assert(t, sameLayout(a, []*gattService{service(0x2A19, 0x2A1A)}))
+	assert.Assert(t, !sameLayout(a, []*gattService{service(0x2A1A, 0x2A19)}))
+	assert.Assert(t, !sameLayout(a, []*gattService{service(0x2A19)}))
+	assert.Assert(t, !sameLayout(a, nil))
+}
@@ -1,14 +1,54 @@
 // The `bluetooth_proxy` component implements the ESPHome bluetooth proxy
 // protocol for use with Home Assistant.  Enabling this component will also
 // automatically enable the `api` component.
-// At this time, only passive scans are implemented.
+// Both passive scanning and active connections (with GATT service discovery,
+// reads, writes, notifications, pairing and service caching) are supported.
+// As the Linux bluetooth backend does not expose characteristic properties or
+// descriptors, every characteristic is reported as readable, writable and
+// notifiable, with a single notification descriptor.  Other components (such
+// as `ble_sensor` and `ble_client`) can listen for advertisements and share
+// the connection slots; clients take priority.
+//
+// Scanning runs while anything wants advertisements, and is restarted if it
+// fails or stalls.  BlueZ picks the scan parameters itself, so the scan mode,
+// interval and window are only reported.  As BlueZ only provides parsed
+// advertisements, raw advertisements are rebuilt from the parsed fields, so
+// they may not match what the device actually sent.
+//
+// Instead of an adapter, advertisements can come from a simulation, a
+// recording, other gateways, or other ESPHome bluetooth proxies; only
+// simulated devices can be connected to.  Advertisements can be filtered and
+// throttled before they reach clients, and forwarded elsewhere.  Counts of
+// what happened to advertisements are available as
+// `bluetooth_proxy_advertisements` at `/debug/vars` when the `pprof` component
+// is enabled.
+//
+// A simulation file is YAML, or JSONL with one device per line:
+//
+//	address: 02:00:00:00:00:01        # Address of the simulated adapter
+//	devices:
+//	  - address: 11:22:33:44:55:66
+//	    name: thermometer
+//	    interval: 1s                   # Time between advertisements
+//	    service_data: [{uuid: 181a, data: "0a0b"}]
+//	    services:
+//	      - uuid: 181a
+//	        characteristics:
+//	          - {uuid: 2a6e, properties: [read, write, notify], value: "0a0b"}
+//
+// Devices may also set `rssi`, `random`, `delay`, `count`, `service_uuids`,
+// `manufacturer_data` (with `company` and `data`), raw `data` and
+// `scan_response`, and characteristics may set `notify_interval`.
 package bluetooth_proxy
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
-	"log/slog"
-	"reflect"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mook/mockesphome/api"
 	"github.com/mook/mockesphome/api/pb"
@@ -18,13 +58,143 @@ import (
 )
 
 // Configuration for the component.
-type Configuration struct{}
+type Configuration struct {
+	Adapter          string        // Name (e.g. `hci1`) or MAC address of the bluetooth adapter to use; defaults to `hci0`.
+	ConnectionSlots  int           // Number of simultaneous active connections to allow, shared with other components; defaults to 3, and 0 disables active connections.
+	RawBatchInterval time.Duration // Longest time to hold raw advertisements before sending a partial batch (of up to 16); defaults to 100ms.
+	ScanMode         string        // Scanning mode to report at first, either `active` (the default) or `passive`; BlueZ picks the actual mode.
+	ScanInterval     time.Duration // Time between the start of each scan window, as logged; defaults to 320ms.
+	ScanWindow       time.Duration // Time to listen in each scan interval, as logged; defaults to 30ms.
+	AlwaysScan       bool          // Scan even when nothing wants advertisements; otherwise scanning stops when the last client unsubscribes, unless recording, forwarding or another component is listening.
+	Simulation       string        // Path to a YAML or JSONL file of simulated devices to use instead of a bluetooth adapter.
+	Record           struct {
+		Path    string // JSONL file to record every advertisement (before filtering) to, with its address, address type, RSSI and raw data, for replaying later; unset to not record.
+		MaxSize int64  // Size in bytes at which to start a new file; defaults to 10MiB.
+		Keep    int    // Number of older files to keep; defaults to 5.
+	}
+	Replay struct {
+		Path  string  // Recording (from `record`, or a btsnoop HCI log as from `btmon -w`) to replay instead of using a bluetooth adapter; records that cannot be read are skipped and counted as `replay_invalid`.
+		Speed float64 // Playback speed relative to the recording; defaults to 1.
+	}
+	Recovery struct {
+		StallTimeout time.Duration // Restart scanning if no advertisements arrive for this long; defaults to 5m, and 0 disables.
+		MinBackoff   time.Duration // Time to wait before the first attempt to restart scanning; defaults to 1s.
+		MaxBackoff   time.Duration // Longest time to wait between attempts to restart scanning; defaults to 1m.
+	}
+	Filter struct {
+		MinRSSI int16 // Drop advertisements weaker than this (in dBm); unset to forward any strength.
+		Allow   []struct {
+			Address   string   // MAC address to match, where `*` matches any characters (e.g. `A4:C1:38:*`).
+			Name      string   // Regular expression the local name must match.
+			Services  []string // Service UUIDs, of which at least one must be advertised (including in service data).
+			Companies []uint16 // Manufacturer company IDs, of which at least one must be in the manufacturer data.
+		} // If set, only advertisements matching one of these rules are forwarded.
+		Deny []struct {
+			Address   string   // MAC address to match, where `*` matches any characters.
+			Name      string   // Regular expression the local name must match.
+			Services  []string // Service UUIDs, of which at least one must be advertised (including in service data).
+			Companies []uint16 // Manufacturer company IDs, of which at least one must be in the manufacturer data.
+		} // Advertisements matching any of these rules are dropped, even if allowed.
+	}
+	Throttle struct {
+		DuplicateWindow time.Duration // Drop advertisements with the same data as the last one forwarded for the device within this time; unset to keep duplicates.
+		RSSIThreshold   int16         // Forward duplicates anyway if the RSSI changed by at least this much (in dB); unset to drop them regardless.
+		DeviceRate      float64       // Most advertisements per second to forward for each device; unset for no limit.
+		Rate            float64       // Most advertisements per second to forward overall; unset for no limit.
+		Burst           int           // Most advertisements to forward at once before `rate` applies; defaults to one second's worth.
+	}
+	// Every device heard (before filtering) is kept in a table, with when it
+	// was first and last heard, its RSSI, name, manufacturers, services and
+	// average time between advertisements.  The table is served as JSON at
+	// `/debug/bluetooth_proxy/devices` when the `pprof` component is enabled,
+	// and the number of devices (and of those heard in the last minute) are
+	// reported as diagnostic sensors.
+	DeviceTable struct {
+		Expiry     time.Duration // Forget devices not heard from for this long; defaults to 10m.
+		MaxDevices int           // Most devices to remember, forgetting the least recently heard first; defaults to 1000.
+	}
+	// Other places to send advertisements to, besides API clients, each with
+	// its own filter and without throttling; this keeps scanning going.  Each
+	// advertisement is sent as JSON in the format of Theengs Gateway and
+	// OpenMQTTGateway (`id`, `name`, `rssi`, `manufacturerdata`, `servicedata`
+	// and so on), with `time` and the raw `data` added: published at QoS 0 to
+	// MQTT, POSTed to HTTP as JSON arrays, or sent as one UDP datagram each.
+	// A destination that falls behind has its advertisements dropped, counted
+	// as `forward_dropped`.
+	Forward []struct {
+		URL           string        // Where to send advertisements: `mqtt://` or `mqtts://` to publish to a broker (with any `user:password@`), `http://` or `https://` to POST batches, or `udp://host:port` to send datagrams.
+		Topic         string        // MQTT topic to publish under, followed by the address without colons; defaults to `home/TheengsGateway/BTtoMQTT`.
+		BatchInterval time.Duration // Longest time to hold advertisements before POSTing a partial batch; defaults to 1s.
+		BatchSize     int           // Most advertisements to POST at once; defaults to 100.
+		Filter        struct {
+			MinRSSI int16 // Drop advertisements weaker than this (in dBm); unset to forward any strength.
+			Allow   []struct {
+				Address   string   // MAC address to match, where `*` matches any characters.
+				Name      string   // Regular expression the local name must match.
+				Services  []string // Service UUIDs, of which at least one must be advertised (including in service data).
+				Companies []uint16 // Manufacturer company IDs, of which at least one must be in the manufacturer data.
+			} // If set, only advertisements matching one of these rules are forwarded.
+			Deny []struct {
+				Address   string   // MAC address to match, where `*` matches any characters.
+				Name      string   // Regular expression the local name must match.
+				Services  []string // Service UUIDs, of which at least one must be advertised (including in service data).
+				Companies []uint16 // Manufacturer company IDs, of which at least one must be in the manufacturer data.
+			} // Advertisements matching any of these rules are dropped, even if allowed.
+		} // Which advertisements to send; this is separate from the filter for clients.
+	}
+	// Sources of advertisements to relay to clients as if they had been
+	// scanned here, instead of using a bluetooth adapter.  Each advertisement
+	// is a JSON object, either as recorded (with `address`, `address_type`,
+	// `rssi` and raw `data` in hex), as forwarded, or as from Theengs Gateway
+	// and OpenMQTTGateway (the raw data is then rebuilt from `name`,
+	// `manufacturerdata`, `servicedata` and `servicedatauuid`).  Streams and
+	// datagrams carry one advertisement per line.  Advertisements that cannot
+	// be parsed are counted as `ingest_invalid`.  When several sources hear a
+	// device, only the one hearing it most strongly is relayed, until another
+	// hears it more strongly or it has not been heard for 10s; the copies
+	// dropped are counted as `ingest_duplicate`.
+	Ingest []struct {
+		URL   string // Where to receive advertisements from: `stdin:` or `unix:///path/to/socket` for JSON lines, `mqtt://` or `mqtts://` to subscribe to a broker, or `udp://:port` to listen for JSON datagrams.
+		Topic string // MQTT topic filter to subscribe to; defaults to `home/+/BTtoMQTT/#`, as published by Theengs Gateway and OpenMQTTGateway.
+	}
+	// ESPHome bluetooth proxies (with raw advertisements, as since ESPHome
+	// 2022.12) to relay advertisements from over the native API, as for
+	// `ingest`, so that several proxies appear to Home Assistant as one.
+	Upstream []struct {
+		Address    string // Address (host, or host:port) of an ESPHome bluetooth proxy.
+		Password   string // API password of the proxy, if it has one.
+		Encryption struct {
+			Key string // Base64-encoded encryption key of the proxy, if it uses encryption.
+		}
+	}
+}
 
 // Bluetooth proxy component.
 type component struct {
-	config  Configuration
-	adapter *bluetooth.Adapter
-	send    api.MessageSender
+	config          Configuration
+	ctx             context.Context // Context the component was started with
+	adapter         adapter
+	scanControlLock sync.Mutex // Held while starting or stopping scanning
+	scannerLock     sync.Mutex
+	scannerState    pb.BluetoothScannerState
+	scannerMode     pb.BluetoothScannerMode
+	scanDone        chan struct{} // Closed when the current scan stops; nil if not scanning
+	scanStarted     time.Time
+	lastResult      atomic.Int64 // When the last advertisement arrived, in Unix nanoseconds
+	subscribersLock sync.Mutex
+	subscribers     map[int]*subscriber // Advertisement subscribers, by client ID
+	connectionsLock sync.Mutex
+	connections     map[uint64]*connection    // Active connections, by address
+	slotSubscribers map[int]api.MessageSender // Clients to tell about free connection slots, by client ID
+	cache           *gattCache
+	recorder        *advertisementRecorder // Records advertisements, if configured
+	merger          *advertisementMerger
+	filter          *advertisementFilter
+	throttle        *advertisementThrottle // Nil if not throttling
+	forwarders      []*forwarder           // Other places advertisements are sent to
+	ingestSources   []ingestSource         // Where advertisements come from, if not an adapter
+	devices         *deviceTable           // Every device heard recently
+	ready           chan struct{}          // Closed once started, for other components
 }
 
 type proxyFeatureFlag uint32
@@ -54,12 +224,127 @@ func (c *component) Dependencies() []string {
 }
 
 func (c *component) Configure(ctx context.Context, load func(any) error) error {
-	return load(&c.config)
+	c.config.ConnectionSlots = defaultConnectionSlots
+	c.config.RawBatchInterval = defaultRawBatchInterval
+	c.config.ScanMode = defaultScanMode
+	c.config.ScanInterval = defaultScanInterval
+	c.config.ScanWindow = defaultScanWindow
+	c.config.Record.MaxSize = defaultRecordMaxSize
+	c.config.Record.Keep = defaultRecordKeep
+	c.config.Replay.Speed = defaultReplaySpeed
+	c.config.Recovery.StallTimeout = defaultStallTimeout
+	c.config.Recovery.MinBackoff = defaultMinBackoff
+	c.config.Recovery.MaxBackoff = defaultMaxBackoff
+	c.config.DeviceTable.Expiry = defaultDeviceExpiry
+	c.config.DeviceTable.MaxDevices = defaultMaxDevices
+	if err := load(&c.config); err != nil {
+		return err
+	}
+	if c.config.ConnectionSlots < 0 {
+		return fmt.Errorf("invalid number of connection slots %d", c.config.ConnectionSlots)
+	}
+	if c.config.RawBatchInterval <= 0 {
+		return fmt.Errorf("invalid raw batch interval %s", c.config.RawBatchInterval)
+	}
+	if c.config.Simulation != "" && c.config.Replay.Path != "" {
+		return fmt.Errorf("cannot both simulate and replay bluetooth devices")
+	}
+	if len(c.config.Ingest)+len(c.config.Upstream) > 0 && (c.config.Simulation != "" || c.config.Replay.Path != "") {
+		return fmt.Errorf("cannot both ingest and simulate or replay bluetooth devices")
+	}
+	if c.config.Record.MaxSize <= 0 || c.config.Record.Keep < 0 {
+		return fmt.Errorf("invalid recording rotation: max size %d, keeping %d", c.config.Record.MaxSize, c.config.Record.Keep)
+	}
+	if c.config.Replay.Speed <= 0 {
+		return fmt.Errorf("invalid replay speed %v", c.config.Replay.Speed)
+	}
+	if err := c.configureScanner(); err != nil {
+		return err
+	}
+	if err := c.configureRecovery(); err != nil {
+		return err
+	}
+	filter, err := newAdvertisementFilter(&c.config.Filter)
+	if err != nil {
+		return err
+	}
+	c.filter = filter
+	throttle, err := newAdvertisementThrottle(&c.config)
+	if err != nil {
+		return err
+	}
+	c.throttle = throttle
+	devices, err := newDeviceTable(c.config.DeviceTable.Expiry, c.config.DeviceTable.MaxDevices)
+	if err != nil {
+		return err
+	}
+	c.devices = devices
+	c.ingestSources = nil
+	for _, config := range c.config.Ingest {
+		source, err := newIngestSource(config.URL, config.Topic)
+		if err != nil {
+			return err
+		}
+		c.ingestSources = append(c.ingestSources, source)
+	}
+	for _, config := range c.config.Upstream {
+		if config.Address == "" {
+			return fmt.Errorf("upstream bluetooth proxy has no address")
+		}
+		source := &upstreamSource{address: config.Address, password: config.Password}
+		if config.Encryption.Key != "" {
+			key, err := base64.StdEncoding.DecodeString(config.Encryption.Key)
+			if err != nil {
+				return fmt.Errorf("failed to decode encryption key for %s: %w", config.Address, err)
+			}
+			source.key = key
+		}
+		c.ingestSources = append(c.ingestSources, source)
+	}
+	c.forwarders = nil
+	for _, config := range c.config.Forward {
+		f, err := newForwarder(config.URL, config.Topic, config.BatchInterval, config.BatchSize, &config.Filter)
+		if err != nil {
+			return err
+		}
+		c.forwarders = append(c.forwarders, f)
+	}
+	c.subscribers = make(map[int]*subscriber)
+	c.connections = make(map[uint64]*connection)
+	c.slotSubscribers = make(map[int]api.MessageSender)
+	c.cache = newGATTCache()
+	c.merger = newAdvertisementMerger()
+	return nil
 }
 
 func (c *component) Start(ctx context.Context) error {
+	c.ctx = ctx
 	if c.adapter == nil {
-		c.adapter = bluetooth.DefaultAdapter
+		if c.config.Simulation != "" {
+			simulated, err := loadSimulation(c.config.Simulation)
+			if err != nil {
+				return err
+			}
+			c.adapter = simulated
+		} else if c.config.Replay.Path != "" {
+			c.adapter = &replayAdapter{path: c.config.Replay.Path, speed: c.config.Replay.Speed}
+		} else if len(c.ingestSources) > 0 {
+			c.adapter = &ingestAdapter{ctx: ctx, sources: c.ingestSources}
+		} else {
+			host, err := newHostAdapter(ctx, c.config.Adapter)
+			if err != nil {
+				return err
+			}
+			c.adapter = host
+		}
+	}
+	if c.config.Record.Path != "" {
+		recorder, err := newAdvertisementRecorder(c.config.Record.Path, c.config.Record.MaxSize, c.config.Record.Keep)
+		if err != nil {
+			return err
+		}
+		c.recorder = recorder
+		context.AfterFunc(ctx, func() { _ = recorder.Close() })
 	}
 	if err := c.adapter.Enable(); err != nil {
 		return err
@@ -70,6 +355,15 @@ func (c *component) Start(ctx context.Context) error {
 	}{
 		{&pb.SubscribeBluetoothLEAdvertisementsRequest{}, c.handleSubscribeBluetoothLEAdvertisements},
 		{&pb.UnsubscribeBluetoothLEAdvertisementsRequest{}, c.handleUnsubscribeBluetoothLEAdvertisements},
+		{&pb.BluetoothScannerSetModeRequest{}, c.handleBluetoothScannerSetMode},
+		{&pb.SubscribeBluetoothConnectionsFreeRequest{}, c.handleSubscribeBluetoothConnectionsFree},
+		{&pb.BluetoothDeviceRequest{}, c.handleBluetoothDeviceRequest},
+		{&pb.BluetoothGATTGetServicesRequest{}, c.handleBluetoothGATTGetServices},
+		{&pb.BluetoothGATTReadRequest{}, c.handleBluetoothGATTRead},
+		{&pb.BluetoothGATTWriteRequest{}, c.handleBluetoothGATTWrite},
+		{&pb.BluetoothGATTReadDescriptorRequest{}, c.handleBluetoothGATTReadDescriptor},
+		{&pb.BluetoothGATTWriteDescriptorRequest{}, c.handleBluetoothGATTWriteDescriptor},
+		{&pb.BluetoothGATTNotifyRequest{}, c.handleBluetoothGATTNotify},
 	}
 	for _, handler := range handlers {
 		if err := api.RegisterHandler(handler.Message, handler.MessageHandler); err != nil {
@@ -77,9 +371,12 @@ func (c *component) Start(ctx context.Context) error {
 		}
 	}
 	api.RegisterDeviceInfo(func(dir *pb.DeviceInfoResponse) error {
-		dir.SetBluetoothProxyFeatureFlags(
-			uint32(proxyFeaturePassiveScan),
-		)
+		features := proxyFeaturePassiveScan | proxyFeatureRawAdvertisements | proxyFeatureStateAndMode
+		if c.config.ConnectionSlots > 0 {
+			features |= proxyFeatureActiveConnections | proxyFeatureRemoteCaching |
+				proxyFeaturePairing | proxyFeatureCacheClearing
+		}
+		dir.SetBluetoothProxyFeatureFlags(uint32(features))
 		if addr, err := c.adapter.Address(); err == nil {
 			dir.SetBluetoothMacAddress(addr.String())
 		} else {
@@ -87,20 +384,32 @@ func (c *component) Start(ctx context.Context) error {
 		}
 		return nil
 	})
+	for _, f := range c.forwarders {
+		go f.sink.run(ctx, f)
+	}
+	if err := registerDeviceCounts(); err != nil {
+		return err
+	}
 	go func() {
-		if err := c.adapter.Scan(c.scanResultCallback); err != nil {
-			slog.ErrorContext(ctx, "failed to start scanning bluetooth", "error", err)
+		ticker := time.NewTicker(deviceSweepInterval)
+		defer ticker.Stop()
+		for {
+			c.devices.publishCounts(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
-
-	return nil
-}
-
-func (c *component) handleSubscribeBluetoothLEAdvertisements(ctx context.Context, msg proto.Message, send api.MessageSender) error {
-	if _, ok := msg.(*pb.SubscribeBluetoothLEAdvertisementsRequest); !ok {
-		return fmt.Errorf("message is not a SubscribeBluetoothLEAdvertisementsRequest")
+	if err := c.updateScanning(); err != nil {
+		return err
 	}
-	c.send = send
+	go c.supervise(ctx)
+	if c.ready != nil {
+		close(c.ready)
+	}
+
 	return nil
 }
 
@@ -114,57 +423,11 @@ func bleAddressToUint64(addr bluetooth.MAC) uint64 {
 		uint64(addr[0])
 }
 
-func (c *component) scanResultCallback(a *bluetooth.Adapter, result bluetooth.ScanResult) {
-	send := c.send
-	if send == nil {
-		return
-	}
-	resp := &pb.BluetoothLEAdvertisementResponse{}
-	resp.SetAddress(bleAddressToUint64(result.Address.MAC))
-	resp.SetName(result.LocalName())
-	resp.SetRssi(int32(result.RSSI))
-	var serviceData []*pb.BluetoothServiceData
-	for _, sd := range result.ServiceData() {
-		data := &pb.BluetoothServiceData{}
-		data.SetUuid(sd.UUID.String())
-		data.SetData(sd.Data)
-		serviceData = append(serviceData, data)
-	}
-	resp.SetServiceData(serviceData)
-	var manufacturerData []*pb.BluetoothServiceData
-	for _, md := range result.ManufacturerData() {
-		data := &pb.BluetoothServiceData{}
-		data.SetUuid(fmt.Sprintf("0x%04X", md.CompanyID))
-		data.SetData(md.Data)
-		manufacturerData = append(manufacturerData, data)
-	}
-	resp.SetManufacturerData(manufacturerData)
-
-	payloadValue := reflect.ValueOf(result.AdvertisementPayload).Elem()
-	fieldsValue := payloadValue.FieldByName("AdvertisementFields")
-	fields, ok := fieldsValue.Interface().(bluetooth.AdvertisementFields)
-	if ok {
-		var serviceUuids []string
-		for _, uuid := range fields.ServiceUUIDs {
-			serviceUuids = append(serviceUuids, uuid.String())
-		}
-		resp.SetServiceUuids(serviceUuids)
-	}
-	if err := send(resp); err != nil {
-		slog.Error("failed to send bluetooth scan result", "error", err)
-	}
-}
-
-func (c *component) handleUnsubscribeBluetoothLEAdvertisements(ctx context.Context, msg proto.Message, send api.MessageSender) error {
-	if _, ok := msg.(*pb.UnsubscribeBluetoothLEAdvertisementsRequest); !ok {
-		return fmt.Errorf("message is not a UnsubscribeBluetoothLEAdvertisementsRequest")
-	}
-	if err := c.adapter.StopScan(); err != nil {
-		return err
-	}
-	return nil
-}
+// The component, for other components to use through [AddListener] and
+// [Connect], and for serving the device table.
+var instance = &component{ready: make(chan struct{})}
 
 func init() {
-	components.Register(&component{})
+	components.Register(instance)
+	http.HandleFunc(devicesPath, instance.serveDevices)
 }
@@ -0,0 +1,617 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultConnectionSlots = 3                // Same as ESPHome
+	connectTimeout         = 20 * time.Second // How long to wait for a device to connect
+	defaultMTU             = 23               // Minimum ATT MTU; BlueZ does not report the negotiated value
+	maxAttributeSize       = 512              // Maximum length of a characteristic value
+)
+
+// ESP-IDF GATT status codes, which Home Assistant knows how to describe.
+const (
+	gattErrorInvalidHandle     = 0x01
+	gattErrorConnectionTimeout = 0x08
+	gattErrorNoResources       = 0x80
+	gattErrorFailure           = 0x85
+)
+
+// GATT characteristic property bits, as used in the API.
+const (
+	gattPropertyRead                 = 0x02
+	gattPropertyWriteWithoutResponse = 0x04
+	gattPropertyWrite                = 0x08
+	gattPropertyNotify               = 0x10
+)
+
+// UUID of the client characteristic configuration descriptor, which is used to
+// enable notifications.
+var cccdUUID = bluetooth.New16BitUUID(0x2902)
+
+// A discovered GATT characteristic.  Attribute handles are assigned by us, in
+// discovery order, as the BlueZ backend does not expose the real ones.
+type gattCharacteristic struct {
+	uuid           bluetooth.UUID
+	handle         uint32
+	properties     uint32
+	cccdHandle     uint32 // Handle of the (synthesized) notification descriptor
+	characteristic characteristic
+	notifying      bool
+}
+
+// A discovered GATT service.
+type gattService struct {
+	uuid            bluetooth.UUID
+	handle          uint32
+	characteristics []*gattCharacteristic
+}
+
+// An active connection to a BLE device, made on behalf of an API client (or
+// another component).
+type connection struct {
+	address   uint64
+	send      api.MessageSender // Sends to the client that requested the connection
+	stopWatch func() bool       // Stops watching for the client to disconnect
+	cache     *gattCache        // Services discovered on earlier connections
+	shared    bool              // Made for another component, which gives way to clients
+	released  chan struct{}     // Closed when the slot is released, for shared connections
+
+	lock      sync.Mutex
+	connected bool
+	device    device
+	services  []*gattService // Discovered (or cached) services; nil until known
+	resolved  bool           // Whether the services are bound to the device's characteristics
+}
+
+// Convert an address from the API into a bluetooth address.
+func uint64ToBLEAddress(addr uint64) bluetooth.Address {
+	var mac bluetooth.MAC
+	for i := range mac {
+		mac[i] = byte(addr >> (8 * i))
+	}
+	return bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}
+}
+
+// Convert a UUID into the API representation: the high and low 64 bits.
+func uuidToProto(uuid bluetooth.UUID) []uint64 {
+	return []uint64{
+		uint64(uuid[3])<<32 | uint64(uuid[2]),
+		uint64(uuid[1])<<32 | uint64(uuid[0]),
+	}
+}
+
+// Assign handles to discovered services and characteristics.  Each service and
+// characteristic takes one handle, and each characteristic is followed by a
+// notification descriptor.
+func assignHandles(services []*gattService) {
+	handle := uint32(1)
+	for _, service := range services {
+		service.handle = handle
+		handle++
+		for _, characteristic := range service.characteristics {
+			characteristic.handle = handle
+			characteristic.cccdHandle = handle + 1
+			handle += 2
+		}
+	}
+}
+
+// Convert discovered services into the API representation.
+func servicesToProto(services []*gattService) []*pb.BluetoothGATTService {
+	var result []*pb.BluetoothGATTService
+	for _, service := range services {
+		var characteristics []*pb.BluetoothGATTCharacteristic
+		for _, characteristic := range service.characteristics {
+			cccd := &pb.BluetoothGATTDescriptor{}
+			cccd.SetUuid(uuidToProto(cccdUUID))
+			cccd.SetHandle(characteristic.cccdHandle)
+			c := &pb.BluetoothGATTCharacteristic{}
+			c.SetUuid(uuidToProto(characteristic.uuid))
+			c.SetHandle(characteristic.handle)
+			c.SetProperties(characteristic.properties)
+			c.SetDescriptors([]*pb.BluetoothGATTDescriptor{cccd})
+			characteristics = append(characteristics, c)
+		}
+		s := &pb.BluetoothGATTService{}
+		s.SetUuid(uuidToProto(service.uuid))
+		s.SetHandle(service.handle)
+		s.SetCharacteristics(characteristics)
+		result = append(result, s)
+	}
+	return result
+}
+
+// Look up the connection to the given address.
+func (c *component) connection(address uint64) (*connection, bool) {
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
+	conn, ok := c.connections[address]
+	return conn, ok
+}
+
+// Send a message to the client owning the connection, logging failures.
+func (conn *connection) reply(msg proto.Message) {
+	if err := conn.send(msg); err != nil {
+		slog.Error("failed to send bluetooth connection message", "address", api.FormatAddress(conn.address), "error", err)
+	}
+}
+
+func (conn *connection) sendConnectionState(connected bool, errorCode int32) {
+	resp := &pb.BluetoothDeviceConnectionResponse{}
+	resp.SetAddress(conn.address)
+	resp.SetConnected(connected)
+	resp.SetMtu(defaultMTU)
+	resp.SetError(errorCode)
+	conn.reply(resp)
+}
+
+func (conn *connection) sendError(handle uint32, errorCode int32) {
+	resp := &pb.BluetoothGATTErrorResponse{}
+	resp.SetAddress(conn.address)
+	resp.SetHandle(handle)
+	resp.SetError(errorCode)
+	conn.reply(resp)
+}
+
+func (c *component) handleBluetoothDeviceRequest(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothDeviceRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothDeviceRequest")
+	}
+	send, err := api.ClientSender(ctx)
+	if err != nil {
+		return err
+	}
+	switch req.GetRequestType() {
+	case pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_CONNECT,
+		pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_CONNECT_V3_WITH_CACHE:
+		c.connect(ctx, send, req.GetAddress())
+	case pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_CONNECT_V3_WITHOUT_CACHE:
+		c.cache.clear(req.GetAddress())
+		c.connect(ctx, send, req.GetAddress())
+	case pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_DISCONNECT:
+		if conn, ok := c.connection(req.GetAddress()); ok {
+			go c.disconnect(conn, true)
+		} else {
+			conn := &connection{address: req.GetAddress(), send: send}
+			conn.sendConnectionState(false, 0)
+		}
+	case pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_PAIR:
+		go c.pair(ctx, send, req.GetAddress())
+	case pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_UNPAIR:
+		go c.unpair(ctx, send, req.GetAddress())
+	case pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_CLEAR_CACHE:
+		c.cache.clear(req.GetAddress())
+		resp := &pb.BluetoothDeviceClearCacheResponse{}
+		resp.SetAddress(req.GetAddress())
+		resp.SetSuccess(true)
+		if err := send(resp); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported bluetooth device request %s", req.GetRequestType())
+	}
+	return nil
+}
+
+// Start connecting to a device; the result is reported to the client
+// asynchronously.
+func (c *component) connect(ctx context.Context, send api.MessageSender, address uint64) {
+	c.preempt(ctx, address)
+	c.connectionsLock.Lock()
+	if existing, ok := c.connections[address]; ok {
+		c.connectionsLock.Unlock()
+		existing.lock.Lock()
+		connected := existing.connected
+		existing.lock.Unlock()
+		if connected {
+			existing.sendConnectionState(true, 0)
+		}
+		return // Otherwise, the pending attempt will report back.
+	}
+	conn := &connection{address: address, send: send, cache: c.cache}
+	if len(c.connections) >= c.config.ConnectionSlots {
+		c.connectionsLock.Unlock()
+		slog.WarnContext(ctx, "no free bluetooth connection slots", "address", api.FormatAddress(address))
+		conn.sendConnectionState(false, gattErrorNoResources)
+		return
+	}
+	c.connections[address] = conn
+	// Drop the connection if the client goes away.
+	conn.stopWatch = context.AfterFunc(ctx, func() { c.disconnect(conn, false) })
+	c.notifyConnectionsFree()
+	c.connectionsLock.Unlock()
+
+	go func() {
+		if errorCode, report := c.dial(ctx, conn); report {
+			conn.sendConnectionState(errorCode == 0, errorCode)
+		}
+	}()
+}
+
+// Connect to the device for a connection that has been given a slot, giving
+// up after a while.  Returns the GATT error code (zero on success), and false
+// if the connection was released in the meantime, in which case there is
+// nothing to report.  On failure, the slot is released.
+func (c *component) dial(ctx context.Context, conn *connection) (int32, bool) {
+	address := conn.address
+	slog.InfoContext(ctx, "connecting to bluetooth device", "address", api.FormatAddress(address))
+	result := make(chan error, 1)
+	go func() {
+		device, err := c.adapter.Connect(uint64ToBLEAddress(address))
+		conn.lock.Lock()
+		abandoned := !c.isCurrent(conn)
+		if err == nil && !abandoned {
+			conn.device = device
+			conn.connected = true
+			conn.services = conn.cache.get(address)
+		}
+		conn.lock.Unlock()
+		if err == nil && abandoned {
+			// We gave up on this attempt; don't leave the device connected.
+			if err := device.Disconnect(); err != nil {
+				slog.DebugContext(ctx, "failed to disconnect abandoned device", "address", api.FormatAddress(address), "error", err)
+			}
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to connect to bluetooth device", "address", api.FormatAddress(address), "error", err)
+			return gattErrorFailure, c.release(conn)
+		}
+		if !c.isCurrent(conn) {
+			return 0, false
+		}
+		slog.InfoContext(ctx, "connected to bluetooth device", "address", api.FormatAddress(address))
+		return 0, true
+	case <-time.After(connectTimeout):
+		slog.ErrorContext(ctx, "timed out connecting to bluetooth device", "address", api.FormatAddress(address))
+		return gattErrorConnectionTimeout, c.release(conn)
+	}
+}
+
+// Check whether the given connection is still the active one for its address.
+func (c *component) isCurrent(conn *connection) bool {
+	current, ok := c.connection(conn.address)
+	return ok && current == conn
+}
+
+// Forget about a connection, freeing its slot.  Returns false if it had already
+// been released.
+func (c *component) release(conn *connection) bool {
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
+	if c.connections[conn.address] != conn {
+		return false
+	}
+	delete(c.connections, conn.address)
+	if conn.stopWatch != nil {
+		conn.stopWatch()
+	}
+	if conn.released != nil {
+		close(conn.released)
+	}
+	c.notifyConnectionsFree()
+	return true
+}
+
+// Disconnect from a device, optionally telling the client about it.
+func (c *component) disconnect(conn *connection, notify bool) {
+	if !c.release(conn) {
+		return
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	for _, service := range conn.services {
+		for _, characteristic := range service.characteristics {
+			if characteristic.notifying {
+				_ = characteristic.characteristic.EnableNotifications(nil)
+				characteristic.notifying = false
+			}
+		}
+	}
+	if conn.connected {
+		if err := conn.device.Disconnect(); err != nil {
+			slog.Error("failed to disconnect bluetooth device", "address", api.FormatAddress(conn.address), "error", err)
+		}
+		conn.connected = false
+	}
+	slog.Info("disconnected bluetooth device", "address", api.FormatAddress(conn.address))
+	if notify {
+		conn.sendConnectionState(false, 0)
+	}
+}
+
+// Discover the services on a connected device, if not done already.  Services
+// restored from the cache are bound to the device's characteristics, keeping
+// their handles; if the device has changed since then, the cache is replaced.
+// The connection lock must be held.
+func (conn *connection) discover() error {
+	if conn.resolved {
+		return nil
+	}
+	if !conn.connected {
+		return fmt.Errorf("device is not connected")
+	}
+	deviceServices, err := conn.device.DiscoverServices()
+	if err != nil {
+		return fmt.Errorf("failed to discover services: %w", err)
+	}
+	services := []*gattService{}
+	for _, deviceService := range deviceServices {
+		service := &gattService{uuid: deviceService.UUID()}
+		deviceCharacteristics, err := deviceService.DiscoverCharacteristics()
+		if err != nil {
+			return fmt.Errorf("failed to discover characteristics of %s: %w", service.uuid, err)
+		}
+		for _, deviceCharacteristic := range deviceCharacteristics {
+			service.characteristics = append(service.characteristics, &gattCharacteristic{
+				uuid:           deviceCharacteristic.UUID(),
+				properties:     deviceCharacteristic.Properties(),
+				characteristic: deviceCharacteristic,
+			})
+		}
+		services = append(services, service)
+	}
+	if conn.services != nil && sameLayout(conn.services, services) {
+		for i, service := range conn.services {
+			for j, characteristic := range service.characteristics {
+				characteristic.characteristic = services[i].characteristics[j].characteristic
+			}
+		}
+	} else {
+		if conn.services != nil {
+			slog.Warn("bluetooth device services changed since they were cached", "address", api.FormatAddress(conn.address))
+		}
+		assignHandles(services)
+		conn.services = services
+		conn.cache.put(conn.address, services)
+	}
+	conn.resolved = true
+	return nil
+}
+
+// Discover services for a GATT request, returning a GATT error code on failure.
+// The connection lock must be held.
+func (conn *connection) resolve(ctx context.Context) int32 {
+	if err := conn.discover(); err != nil {
+		slog.ErrorContext(ctx, "failed to get bluetooth services", "address", api.FormatAddress(conn.address), "error", err)
+		return gattErrorFailure
+	}
+	return 0
+}
+
+// Find the characteristic with the given handle (or whose notification
+// descriptor has the given handle).  The connection lock must be held.
+func (conn *connection) findCharacteristic(handle uint32) (*gattCharacteristic, bool) {
+	for _, service := range conn.services {
+		for _, characteristic := range service.characteristics {
+			if characteristic.handle == handle || characteristic.cccdHandle == handle {
+				return characteristic, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Handle a GATT request for a connected device.  The operation is run in the
+// background (with the connection locked) as it may block; it should return a
+// GATT error code to report, or zero on success.
+func (c *component) handleGATT(ctx context.Context, address uint64, handle uint32, op func(*connection) int32) error {
+	conn, ok := c.connection(address)
+	if !ok {
+		send, err := api.ClientSender(ctx)
+		if err != nil {
+			return err
+		}
+		conn = &connection{address: address, send: send}
+		conn.sendConnectionState(false, 0)
+		return fmt.Errorf("device %s is not connected", api.FormatAddress(address))
+	}
+	go func() {
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		if errorCode := op(conn); errorCode != 0 {
+			conn.sendError(handle, errorCode)
+		}
+	}()
+	return nil
+}
+
+func (c *component) handleBluetoothGATTGetServices(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothGATTGetServicesRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothGATTGetServicesRequest")
+	}
+	return c.handleGATT(ctx, req.GetAddress(), 0, func(conn *connection) int32 {
+		// Cached services can be sent without asking the device.
+		if conn.services == nil {
+			if errorCode := conn.resolve(ctx); errorCode != 0 {
+				return errorCode
+			}
+		}
+		// Send one service per message, as ESPHome does.
+		for _, service := range servicesToProto(conn.services) {
+			resp := &pb.BluetoothGATTGetServicesResponse{}
+			resp.SetAddress(conn.address)
+			resp.SetServices([]*pb.BluetoothGATTService{service})
+			conn.reply(resp)
+		}
+		done := &pb.BluetoothGATTGetServicesDoneResponse{}
+		done.SetAddress(conn.address)
+		conn.reply(done)
+		return 0
+	})
+}
+
+func (c *component) handleBluetoothGATTRead(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothGATTReadRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothGATTReadRequest")
+	}
+	return c.handleGATT(ctx, req.GetAddress(), req.GetHandle(), func(conn *connection) int32 {
+		if errorCode := conn.resolve(ctx); errorCode != 0 {
+			return errorCode
+		}
+		characteristic, ok := conn.findCharacteristic(req.GetHandle())
+		if !ok || characteristic.handle != req.GetHandle() {
+			return gattErrorInvalidHandle
+		}
+		buf := make([]byte, maxAttributeSize)
+		n, err := characteristic.characteristic.Read(buf)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to read characteristic", "address", api.FormatAddress(conn.address), "handle", req.GetHandle(), "error", err)
+			return gattErrorFailure
+		}
+		resp := &pb.BluetoothGATTReadResponse{}
+		resp.SetAddress(conn.address)
+		resp.SetHandle(req.GetHandle())
+		resp.SetData(buf[:min(n, len(buf))])
+		conn.reply(resp)
+		return 0
+	})
+}
+
+func (c *component) handleBluetoothGATTWrite(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothGATTWriteRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothGATTWriteRequest")
+	}
+	return c.handleGATT(ctx, req.GetAddress(), req.GetHandle(), func(conn *connection) int32 {
+		if errorCode := conn.resolve(ctx); errorCode != 0 {
+			return errorCode
+		}
+		characteristic, ok := conn.findCharacteristic(req.GetHandle())
+		if !ok || characteristic.handle != req.GetHandle() {
+			return gattErrorInvalidHandle
+		}
+		if _, err := characteristic.characteristic.WriteWithoutResponse(req.GetData()); err != nil {
+			slog.ErrorContext(ctx, "failed to write characteristic", "address", api.FormatAddress(conn.address), "handle", req.GetHandle(), "error", err)
+			return gattErrorFailure
+		}
+		if req.GetResponse() {
+			conn.sendWriteResponse(req.GetHandle())
+		}
+		return 0
+	})
+}
+
+func (conn *connection) sendWriteResponse(handle uint32) {
+	resp := &pb.BluetoothGATTWriteResponse{}
+	resp.SetAddress(conn.address)
+	resp.SetHandle(handle)
+	conn.reply(resp)
+}
+
+// Enable or disable notifications on a characteristic.  The connection lock
+// must be held.
+func (conn *connection) setNotify(characteristic *gattCharacteristic, enable bool) error {
+	if enable == characteristic.notifying {
+		return nil
+	}
+	var callback func([]byte)
+	if enable {
+		callback = func(data []byte) {
+			resp := &pb.BluetoothGATTNotifyDataResponse{}
+			resp.SetAddress(conn.address)
+			resp.SetHandle(characteristic.handle)
+			resp.SetData(data)
+			conn.reply(resp)
+		}
+	}
+	if err := characteristic.characteristic.EnableNotifications(callback); err != nil {
+		return err
+	}
+	characteristic.notifying = enable
+	return nil
+}
+
+func (c *component) handleBluetoothGATTNotify(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothGATTNotifyRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothGATTNotifyRequest")
+	}
+	return c.handleGATT(ctx, req.GetAddress(), req.GetHandle(), func(conn *connection) int32 {
+		if errorCode := conn.resolve(ctx); errorCode != 0 {
+			return errorCode
+		}
+		characteristic, ok := conn.findCharacteristic(req.GetHandle())
+		if !ok || characteristic.handle != req.GetHandle() {
+			return gattErrorInvalidHandle
+		}
+		if err := conn.setNotify(characteristic, req.GetEnable()); err != nil {
+			slog.ErrorContext(ctx, "failed to change notifications", "address", api.FormatAddress(conn.address), "handle", req.GetHandle(), "error", err)
+			return gattErrorFailure
+		}
+		resp := &pb.BluetoothGATTNotifyResponse{}
+		resp.SetAddress(conn.address)
+		resp.SetHandle(req.GetHandle())
+		conn.reply(resp)
+		return 0
+	})
+}
+
+func (c *component) handleBluetoothGATTReadDescriptor(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothGATTReadDescriptorRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothGATTReadDescriptorRequest")
+	}
+	return c.handleGATT(ctx, req.GetAddress(), req.GetHandle(), func(conn *connection) int32 {
+		if errorCode := conn.resolve(ctx); errorCode != 0 {
+			return errorCode
+		}
+		characteristic, ok := conn.findCharacteristic(req.GetHandle())
+		if !ok || characteristic.cccdHandle != req.GetHandle() {
+			return gattErrorInvalidHandle
+		}
+		value := []byte{0x00, 0x00}
+		if characteristic.notifying {
+			value[0] = 0x01
+		}
+		resp := &pb.BluetoothGATTReadResponse{}
+		resp.SetAddress(conn.address)
+		resp.SetHandle(req.GetHandle())
+		resp.SetData(value)
+		conn.reply(resp)
+		return 0
+	})
+}
+
+func (c *component) handleBluetoothGATTWriteDescriptor(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothGATTWriteDescriptorRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothGATTWriteDescriptorRequest")
+	}
+	return c.handleGATT(ctx, req.GetAddress(), req.GetHandle(), func(conn *connection) int32 {
+		if errorCode := conn.resolve(ctx); errorCode != 0 {
+			return errorCode
+		}
+		characteristic, ok := conn.findCharacteristic(req.GetHandle())
+		if !ok || characteristic.cccdHandle != req.GetHandle() {
+			return gattErrorInvalidHandle
+		}
+		// Either the notification or indication bit enables notifications.
+		data := req.GetData()
+		enable := len(data) > 0 && data[0]&0x03 != 0
+		if err := conn.setNotify(characteristic, enable); err != nil {
+			slog.ErrorContext(ctx, "failed to change notifications", "address", api.FormatAddress(conn.address), "handle", req.GetHandle(), "error", err)
+			return gattErrorFailure
+		}
+		conn.sendWriteResponse(req.GetHandle())
+		return 0
+	})
+}
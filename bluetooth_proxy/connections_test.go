@@ -0,0 +1,60 @@
+package bluetooth_proxy
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestUint64ToBLEAddress(t *testing.T) {
+	input := uint64(0x060504030201)
+	actual := uint64ToBLEAddress(input)
+	assert.Equal(t, actual.MAC.String(), "06:05:04:03:02:01")
+	assert.Equal(t, bleAddressToUint64(actual.MAC), input)
+}
+
+func TestUUIDToProto(t *testing.T) {
+	battery := bluetooth.New16BitUUID(0x180F)
+	assert.DeepEqual(t, uuidToProto(battery), []uint64{0x0000180F_00001000, 0x80000080_5F9B34FB})
+}
+
+func TestServicesToProto(t *testing.T) {
+	services := []*gattService{
+		{
+			uuid: bluetooth.New16BitUUID(0x180F),
+			characteristics: []*gattCharacteristic{
+				{uuid: bluetooth.New16BitUUID(0x2A19), properties: gattPropertyRead},
+			},
+		},
+		{
+			uuid: bluetooth.New16BitUUID(0x181A),
+			characteristics: []*gattCharacteristic{
+				{uuid: bluetooth.New16BitUUID(0x2A6E), properties: gattPropertyNotify},
+				{uuid: bluetooth.New16BitUUID(0x2A6F), properties: gattPropertyNotify},
+			},
+		},
+	}
+	assignHandles(services)
+	result := servicesToProto(services)
+	assert.Equal(t, len(result), 2)
+
+	assert.Equal(t, result[0].GetHandle(), uint32(1))
+	assert.Equal(t, result[0].GetCharacteristics()[0].GetHandle(), uint32(2))
+	assert.Equal(t, result[0].GetCharacteristics()[0].GetDescriptors()[0].GetHandle(), uint32(3))
+	assert.Equal(t, result[0].GetCharacteristics()[0].GetProperties(), uint32(gattPropertyRead))
+
+	assert.Equal(t, result[1].GetHandle(), uint32(4))
+	characteristics := result[1].GetCharacteristics()
+	assert.Equal(t, len(characteristics), 2)
+	assert.Equal(t, characteristics[0].GetHandle(), uint32(5))
+	assert.Equal(t, characteristics[1].GetHandle(), uint32(7))
+	assert.DeepEqual(t, characteristics[1].GetDescriptors()[0].GetUuid(), uuidToProto(cccdUUID))
+
+	conn := &connection{services: services}
+	found, ok := conn.findCharacteristic(8)
+	assert.Assert(t, ok)
+	assert.Equal(t, found, services[1].characteristics[1])
+	_, ok = conn.findCharacteristic(4)
+	assert.Assert(t, !ok, "service handle matched a characteristic")
+}
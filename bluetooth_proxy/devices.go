@@ -0,0 +1,223 @@
+package bluetooth_proxy
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultDeviceExpiry = 10 * time.Minute
+	defaultMaxDevices   = 1000
+	maxDeviceUUIDs      = 16               // Most services or manufacturers to remember for each device
+	deviceSweepInterval = 10 * time.Second // Time between checks for expired devices
+	activeDeviceWindow  = time.Minute      // Devices heard within this are counted as active
+	devicesPath         = "/debug/bluetooth_proxy/devices"
+)
+
+// Object IDs of the device count sensors.
+const (
+	knownDevicesID  = "bluetooth_devices"
+	activeDevicesID = "bluetooth_devices_active"
+)
+
+// What is known about a device that has been heard, as served over HTTP.
+type knownDevice struct {
+	Address       string    `json:"address"`
+	AddressType   uint32    `json:"address_type"`
+	Name          string    `json:"name,omitempty"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	Count         int64     `json:"count"` // Advertisements received
+	MinRSSI       int16     `json:"min_rssi"`
+	MaxRSSI       int16     `json:"max_rssi"`
+	AverageRSSI   float64   `json:"average_rssi"`
+	Interval      float64   `json:"interval"`                // Average time between advertisements, in seconds
+	Manufacturers []uint16  `json:"manufacturers,omitempty"` // Company IDs
+	Services      []string  `json:"services,omitempty"`      // Service UUIDs, including from service data
+	rssiSum       int64
+}
+
+// Every device heard recently, before filtering and throttling.
+type deviceTable struct {
+	expiry     time.Duration
+	maxDevices int
+
+	lock      sync.Mutex
+	devices   map[uint64]*knownDevice
+	lastSweep time.Time
+}
+
+func newDeviceTable(expiry time.Duration, maxDevices int) (*deviceTable, error) {
+	if expiry <= 0 {
+		return nil, fmt.Errorf("invalid device expiry %s", expiry)
+	}
+	if maxDevices <= 0 {
+		return nil, fmt.Errorf("invalid maximum number of devices %d", maxDevices)
+	}
+	return &deviceTable{expiry: expiry, maxDevices: maxDevices, devices: make(map[uint64]*knownDevice)}, nil
+}
+
+// Record a scan result received at the given time.
+func (t *deviceTable) update(result bluetooth.ScanResult, now time.Time) {
+	address := bleAddressToUint64(result.Address.MAC)
+	fields := advertisementFields(result)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if now.Sub(t.lastSweep) >= deviceSweepInterval {
+		t.lastSweep = now
+		t.sweep(now)
+	}
+	device, ok := t.devices[address]
+	if !ok {
+		if len(t.devices) >= t.maxDevices {
+			t.evict()
+		}
+		device = &knownDevice{
+			Address:   result.Address.MAC.String(),
+			FirstSeen: now,
+			MinRSSI:   result.RSSI,
+			MaxRSSI:   result.RSSI,
+		}
+		t.devices[address] = device
+	}
+	device.AddressType = addressType(result)
+	device.LastSeen = now
+	device.Count++
+	device.MinRSSI = min(device.MinRSSI, result.RSSI)
+	device.MaxRSSI = max(device.MaxRSSI, result.RSSI)
+	device.rssiSum += int64(result.RSSI)
+	if fields.LocalName != "" {
+		device.Name = fields.LocalName
+	}
+	for _, md := range fields.ManufacturerData {
+		if !slices.Contains(device.Manufacturers, md.CompanyID) && len(device.Manufacturers) < maxDeviceUUIDs {
+			device.Manufacturers = append(device.Manufacturers, md.CompanyID)
+		}
+	}
+	addService := func(uuid bluetooth.UUID) {
+		s := uuid.String()
+		if !slices.Contains(device.Services, s) && len(device.Services) < maxDeviceUUIDs {
+			device.Services = append(device.Services, s)
+		}
+	}
+	for _, uuid := range fields.ServiceUUIDs {
+		addService(uuid)
+	}
+	for _, sd := range fields.ServiceData {
+		addService(sd.UUID)
+	}
+}
+
+// Forget devices not heard from within the expiry.  The lock must be held.
+func (t *deviceTable) sweep(now time.Time) {
+	for address, device := range t.devices {
+		if now.Sub(device.LastSeen) >= t.expiry {
+			delete(t.devices, address)
+		}
+	}
+}
+
+// Forget the device heard from least recently.  The lock must be held.
+func (t *deviceTable) evict() {
+	var oldest uint64
+	var oldestSeen time.Time
+	for address, device := range t.devices {
+		if oldestSeen.IsZero() || device.LastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = address, device.LastSeen
+		}
+	}
+	delete(t.devices, oldest)
+}
+
+// Get a copy of every device heard within the expiry, sorted by address.
+func (t *deviceTable) list(now time.Time) []knownDevice {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := make([]knownDevice, 0, len(t.devices))
+	for _, device := range t.devices {
+		if now.Sub(device.LastSeen) >= t.expiry {
+			continue
+		}
+		d := *device
+		d.Manufacturers = slices.Clone(d.Manufacturers)
+		d.Services = slices.Clone(d.Services)
+		d.AverageRSSI = float64(d.rssiSum) / float64(d.Count)
+		if d.Count > 1 {
+			d.Interval = d.LastSeen.Sub(d.FirstSeen).Seconds() / float64(d.Count-1)
+		}
+		result = append(result, d)
+	}
+	slices.SortFunc(result, func(a, b knownDevice) int {
+		return cmp.Compare(a.Address, b.Address)
+	})
+	return result
+}
+
+// Count the devices heard within the expiry, and within the active window.
+func (t *deviceTable) counts(now time.Time) (known, active int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, device := range t.devices {
+		if since := now.Sub(device.LastSeen); since < t.expiry {
+			known++
+			if since < activeDeviceWindow {
+				active++
+			}
+		}
+	}
+	return known, active
+}
+
+// Serve the table as JSON.
+func (c *component) serveDevices(w http.ResponseWriter, r *http.Request) {
+	if c.devices == nil {
+		http.Error(w, "bluetooth proxy is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(c.devices.list(time.Now())); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Register the device count sensors.
+func registerDeviceCounts() error {
+	for _, sensor := range []struct{ id, name string }{
+		{knownDevicesID, "Bluetooth devices"},
+		{activeDevicesID, "Active bluetooth devices"},
+	} {
+		entity := &pb.ListEntitiesSensorResponse{}
+		entity.SetObjectId(sensor.id)
+		entity.SetKey(api.EntityKey(sensor.id))
+		entity.SetName(sensor.name)
+		entity.SetUniqueId("bluetooth_proxy-" + sensor.id)
+		entity.SetStateClass(pb.SensorStateClass_STATE_CLASS_MEASUREMENT)
+		entity.SetEntityCategory(pb.EntityCategory_ENTITY_CATEGORY_DIAGNOSTIC)
+		if err := api.RegisterEntity(entity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publish the device counts.
+func (t *deviceTable) publishCounts(now time.Time) {
+	known, active := t.counts(now)
+	for id, value := range map[string]int{knownDevicesID: known, activeDevicesID: active} {
+		state := &pb.SensorStateResponse{}
+		state.SetKey(api.EntityKey(id))
+		state.SetState(float32(value))
+		api.PublishState(state)
+	}
+}
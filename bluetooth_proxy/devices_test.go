@@ -0,0 +1,84 @@
+package bluetooth_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestDeviceTable(t *testing.T) {
+	table, err := newDeviceTable(10*time.Minute, 2)
+	assert.NilError(t, err)
+	start := time.Now()
+	table.update(filterResult(t, "11:22:33:44:55:66", -70, bluetooth.AdvertisementFields{
+		ServiceData: []bluetooth.ServiceDataElement{{UUID: bluetooth.New16BitUUID(0xFCD2)}},
+	}), start)
+	table.update(filterResult(t, "11:22:33:44:55:66", -50, bluetooth.AdvertisementFields{
+		LocalName:        "thermometer",
+		ManufacturerData: []bluetooth.ManufacturerDataElement{{CompanyID: 0x0499}},
+	}), start.Add(2*time.Second))
+	table.update(filterResult(t, "11:22:33:44:55:66", -90, bluetooth.AdvertisementFields{}), start.Add(4*time.Second))
+
+	devices := table.list(start.Add(4 * time.Second))
+	assert.Equal(t, len(devices), 1)
+	d := devices[0]
+	assert.Equal(t, d.Address, "11:22:33:44:55:66")
+	assert.Equal(t, d.Name, "thermometer")
+	assert.Equal(t, d.Count, int64(3))
+	assert.Equal(t, d.MinRSSI, int16(-90))
+	assert.Equal(t, d.MaxRSSI, int16(-50))
+	assert.Equal(t, d.AverageRSSI, -70.0)
+	assert.Equal(t, d.Interval, 2.0)
+	assert.DeepEqual(t, d.Manufacturers, []uint16{0x0499})
+	assert.DeepEqual(t, d.Services, []string{bluetooth.New16BitUUID(0xFCD2).String()})
+	assert.Assert(t, d.FirstSeen.Equal(start))
+
+	// The least recently heard device makes way once the table is full.
+	table.update(filterResult(t, "11:22:33:44:55:77", -60, bluetooth.AdvertisementFields{}), start.Add(5*time.Second))
+	table.update(filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{}), start.Add(6*time.Second))
+	table.update(filterResult(t, "11:22:33:44:55:88", -60, bluetooth.AdvertisementFields{}), start.Add(7*time.Second))
+	devices = table.list(start.Add(7 * time.Second))
+	assert.Equal(t, len(devices), 2)
+	assert.Equal(t, devices[0].Address, "11:22:33:44:55:66")
+	assert.Equal(t, devices[1].Address, "11:22:33:44:55:88")
+
+	known, active := table.counts(start.Add(6500*time.Millisecond + activeDeviceWindow))
+	assert.Equal(t, known, 2)
+	assert.Equal(t, active, 1)
+
+	// Devices not heard within the expiry are dropped.
+	assert.Equal(t, len(table.list(start.Add(7*time.Second+10*time.Minute))), 0)
+	table.update(filterResult(t, "11:22:33:44:55:99", -60, bluetooth.AdvertisementFields{}), start.Add(20*time.Minute))
+	assert.Equal(t, len(table.devices), 1)
+
+	_, err = newDeviceTable(0, 1)
+	assert.ErrorContains(t, err, "invalid device expiry")
+	_, err = newDeviceTable(time.Minute, 0)
+	assert.ErrorContains(t, err, "invalid maximum number of devices")
+}
+
+func TestServeDevices(t *testing.T) {
+	c := &component{}
+	recorder := httptest.NewRecorder()
+	c.serveDevices(recorder, httptest.NewRequest(http.MethodGet, devicesPath, nil))
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+
+	table, err := newDeviceTable(time.Minute, 10)
+	assert.NilError(t, err)
+	c.devices = table
+	c.scanResultCallback(filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{LocalName: "thermometer"}))
+	recorder = httptest.NewRecorder()
+	c.serveDevices(recorder, httptest.NewRequest(http.MethodGet, devicesPath, nil))
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Header().Get("Content-Type"), "application/json")
+	var devices []knownDevice
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &devices))
+	assert.Equal(t, len(devices), 1)
+	assert.Equal(t, devices[0].Name, "thermometer")
+	assert.Equal(t, devices[0].AverageRSSI, -60.0)
+}
@@ -0,0 +1,162 @@
+package bluetooth_proxy
+
+import (
+	"expvar"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Counts of forwarded and filtered advertisements, served at /debug/vars
+// (for example, by the `pprof` component).
+var advertisementCounts = expvar.NewMap("bluetooth_proxy_advertisements")
+
+// Reasons an advertisement was filtered, as used in the counters.
+const (
+	filteredRSSI  = "filtered_rssi"  // Weaker than the minimum RSSI
+	filteredDeny  = "filtered_deny"  // Matched a deny rule
+	filteredAllow = "filtered_allow" // Did not match any allow rule
+	forwarded     = "forwarded"
+)
+
+// An allow or deny rule; it matches an advertisement if every criterion it
+// sets matches.
+type filterRule struct {
+	address   string         // Upper case wildcard pattern, if set
+	name      *regexp.Regexp // If set
+	services  []bluetooth.UUID
+	companies []uint16
+}
+
+// Decides which advertisements are forwarded to clients.
+type advertisementFilter struct {
+	minRSSI int16 // Zero to accept any strength
+	allow   []*filterRule
+	deny    []*filterRule
+}
+
+// Filter configuration, as used both for clients and for each place
+// advertisements are forwarded to.
+type filterConfig = struct {
+	MinRSSI int16
+	Allow   []filterRuleConfig
+	Deny    []filterRuleConfig
+}
+
+// An allow or deny rule's configuration.
+type filterRuleConfig = struct {
+	Address   string
+	Name      string
+	Services  []string
+	Companies []uint16
+}
+
+// Build the filter from its configuration.
+func newAdvertisementFilter(config *filterConfig) (*advertisementFilter, error) {
+	f := &advertisementFilter{minRSSI: config.MinRSSI}
+	if f.minRSSI > 0 {
+		return nil, fmt.Errorf("invalid minimum RSSI %d", f.minRSSI)
+	}
+	for _, rule := range config.Allow {
+		compiled, err := newFilterRule(rule.Address, rule.Name, rule.Services, rule.Companies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow rule: %w", err)
+		}
+		f.allow = append(f.allow, compiled)
+	}
+	for _, rule := range config.Deny {
+		compiled, err := newFilterRule(rule.Address, rule.Name, rule.Services, rule.Companies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny rule: %w", err)
+		}
+		f.deny = append(f.deny, compiled)
+	}
+	return f, nil
+}
+
+func newFilterRule(address, name string, services []string, companies []uint16) (*filterRule, error) {
+	rule := &filterRule{address: strings.ToUpper(address), companies: companies}
+	if address == "" && name == "" && len(services) == 0 && len(companies) == 0 {
+		return nil, fmt.Errorf("rule has nothing to match")
+	}
+	if _, err := path.Match(rule.address, ""); err != nil {
+		return nil, fmt.Errorf("invalid address pattern %q: %w", address, err)
+	}
+	if name != "" {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %w", name, err)
+		}
+		rule.name = re
+	}
+	for _, s := range services {
+		uuid, err := ParseUUID(s)
+		if err != nil {
+			return nil, err
+		}
+		rule.services = append(rule.services, uuid)
+	}
+	return rule, nil
+}
+
+// Check whether the rule matches a scan result.
+func (r *filterRule) matches(result bluetooth.ScanResult) bool {
+	if r.address != "" {
+		if ok, _ := path.Match(r.address, result.Address.MAC.String()); !ok {
+			return false
+		}
+	}
+	fields := advertisementFields(result)
+	if r.name != nil && !r.name.MatchString(fields.LocalName) {
+		return false
+	}
+	if len(r.services) > 0 {
+		advertised := slices.ContainsFunc(fields.ServiceUUIDs, func(uuid bluetooth.UUID) bool {
+			return slices.Contains(r.services, uuid)
+		})
+		if !advertised {
+			advertised = slices.ContainsFunc(fields.ServiceData, func(sd bluetooth.ServiceDataElement) bool {
+				return slices.Contains(r.services, sd.UUID)
+			})
+		}
+		if !advertised {
+			return false
+		}
+	}
+	if len(r.companies) > 0 {
+		advertised := slices.ContainsFunc(fields.ManufacturerData, func(md bluetooth.ManufacturerDataElement) bool {
+			return slices.Contains(r.companies, md.CompanyID)
+		})
+		if !advertised {
+			return false
+		}
+	}
+	return true
+}
+
+// Check a scan result, returning the reason it should be filtered, or
+// `forwarded` if it should be sent on.  Deny rules take precedence over allow
+// rules; if there are no allow rules, everything not denied is allowed.
+func (f *advertisementFilter) check(result bluetooth.ScanResult) string {
+	if f.minRSSI != 0 && result.RSSI < f.minRSSI {
+		return filteredRSSI
+	}
+	for _, rule := range f.deny {
+		if rule.matches(result) {
+			return filteredDeny
+		}
+	}
+	if len(f.allow) == 0 {
+		return forwarded
+	}
+	for _, rule := range f.allow {
+		if rule.matches(result) {
+			return forwarded
+		}
+	}
+	return filteredAllow
+}
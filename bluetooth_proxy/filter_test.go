@@ -0,0 +1,114 @@
+package bluetooth_proxy
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+// Build a scan result for filtering.
+func filterResult(t *testing.T, address string, rssi int16, fields bluetooth.AdvertisementFields) bluetooth.ScanResult {
+	mac, err := bluetooth.ParseMAC(address)
+	assert.NilError(t, err)
+	result := bluetooth.ScanResult{RSSI: rssi, AdvertisementPayload: &advertisementPayload{AdvertisementFields: fields}}
+	result.Address.MAC = mac
+	return result
+}
+
+func TestAdvertisementFilter(t *testing.T) {
+	var config Configuration
+	err := yaml.UnmarshalWithOptions([]byte(`
+filter:
+  minrssi: -90
+  allow:
+    - address: "a4:c1:38:*"
+    - services: [fcd2]
+    - companies: [0x0499]
+      name: ^Ruuvi
+  deny:
+    - address: A4:C1:38:00:00:01
+`), &config, yaml.DisallowUnknownField())
+	assert.NilError(t, err)
+	filter, err := newAdvertisementFilter(&config.Filter)
+	assert.NilError(t, err)
+
+	cases := []struct {
+		name    string
+		result  bluetooth.ScanResult
+		verdict string
+	}{
+		{"address", filterResult(t, "A4:C1:38:12:34:56", -60, bluetooth.AdvertisementFields{}), forwarded},
+		{"weak", filterResult(t, "A4:C1:38:12:34:56", -95, bluetooth.AdvertisementFields{}), filteredRSSI},
+		{"denied", filterResult(t, "A4:C1:38:00:00:01", -60, bluetooth.AdvertisementFields{}), filteredDeny},
+		{"unknown", filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{}), filteredAllow},
+		{"service", filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{
+			ServiceUUIDs: []bluetooth.UUID{bluetooth.New16BitUUID(0xFCD2)},
+		}), forwarded},
+		{"service data", filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{
+			ServiceData: []bluetooth.ServiceDataElement{{UUID: bluetooth.New16BitUUID(0xFCD2)}},
+		}), forwarded},
+		{"company and name", filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{
+			LocalName:        "Ruuvi 1234",
+			ManufacturerData: []bluetooth.ManufacturerDataElement{{CompanyID: 0x0499}},
+		}), forwarded},
+		{"company without name", filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{
+			ManufacturerData: []bluetooth.ManufacturerDataElement{{CompanyID: 0x0499}},
+		}), filteredAllow},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, filter.check(tc.result), tc.verdict)
+		})
+	}
+
+	// Without allow rules, anything not denied is forwarded.
+	config.Filter.Allow = nil
+	filter, err = newAdvertisementFilter(&config.Filter)
+	assert.NilError(t, err)
+	assert.Equal(t, filter.check(cases[3].result), forwarded)
+}
+
+func TestAdvertisementFilterErrors(t *testing.T) {
+	for _, tc := range []struct{ config, err string }{
+		{"filter: {minrssi: 10}", "invalid minimum RSSI"},
+		{"filter: {allow: [{}]}", "nothing to match"},
+		{"filter: {deny: [{address: '['}]}", "invalid address pattern"},
+		{"filter: {deny: [{name: '('}]}", "invalid name pattern"},
+		{"filter: {allow: [{services: [xyz]}]}", "invalid UUID"},
+	} {
+		var config Configuration
+		assert.NilError(t, yaml.UnmarshalWithOptions([]byte(tc.config), &config, yaml.DisallowUnknownField()))
+		_, err := newAdvertisementFilter(&config.Filter)
+		assert.ErrorContains(t, err, tc.err, tc.config)
+	}
+}
+
+func TestFilteredScanResult(t *testing.T) {
+	var sent int
+	sub := &subscriber{send: func(msg proto.Message) error {
+		sent++
+		return nil
+	}}
+	var config Configuration
+	config.Filter.MinRSSI = -80
+	filter, err := newAdvertisementFilter(&config.Filter)
+	assert.NilError(t, err)
+	c := &component{filter: filter, subscribers: map[int]*subscriber{1: sub}}
+
+	count := func(name string) int64 {
+		if v, ok := advertisementCounts.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	forwardedBefore, filteredBefore := count(forwarded), count(filteredRSSI)
+	c.scanResultCallback(filterResult(t, "11:22:33:44:55:66", -90, bluetooth.AdvertisementFields{}))
+	c.scanResultCallback(filterResult(t, "11:22:33:44:55:66", -70, bluetooth.AdvertisementFields{}))
+	assert.Equal(t, sent, 1)
+	assert.Equal(t, count(forwarded)-forwardedBefore, int64(1))
+	assert.Equal(t, count(filteredRSSI)-filteredBefore, int64(1))
+}
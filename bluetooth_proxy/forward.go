@@ -0,0 +1,347 @@
+package bluetooth_proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mook/mockesphome/mqtt"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultForwardTopic         = "home/TheengsGateway/BTtoMQTT" // As Theengs Gateway
+	defaultForwardBatchInterval = time.Second
+	defaultForwardBatchSize     = 100
+	forwardQueueSize            = 1024 // Advertisements to hold while a sink is slow
+	forwardTimeout              = 10 * time.Second
+	retryMinBackoff             = time.Second // Wait before reconnecting to a sink or source
+	retryMaxBackoff             = time.Minute
+)
+
+// Advertisements dropped because a forwarder's queue was full, as used in the
+// counters.
+const forwardDropped = "forward_dropped"
+
+// An advertisement as forwarded, in the JSON format of Theengs Gateway and
+// OpenMQTTGateway, with the time and raw data added.  Only the first
+// manufacturer data and service data are included.
+type forwardedAdvertisement struct {
+	ID               string    `json:"id"`
+	MACType          int       `json:"mac_type"`
+	Name             string    `json:"name,omitempty"`
+	RSSI             int16     `json:"rssi"`
+	ManufacturerData string    `json:"manufacturerdata,omitempty"` // Hex, starting with the little-endian company ID
+	ServiceData      string    `json:"servicedata,omitempty"`      // Hex
+	ServiceDataUUID  string    `json:"servicedatauuid,omitempty"`  // e.g. `0x181a`
+	Data             string    `json:"data,omitempty"`             // Raw advertising data, in hex
+	Time             time.Time `json:"time"`
+}
+
+// Convert an advertisement into its forwarded form.
+func newForwardedAdvertisement(adv Advertisement) forwardedAdvertisement {
+	fwd := forwardedAdvertisement{
+		ID:   adv.Address.String(),
+		Name: adv.LocalName,
+		RSSI: adv.RSSI,
+		Data: hex.EncodeToString(adv.Data),
+		Time: adv.Time,
+	}
+	if adv.Random {
+		fwd.MACType = addressTypeRandom
+	}
+	if len(adv.ManufacturerData) > 0 {
+		md := adv.ManufacturerData[0]
+		fwd.ManufacturerData = hex.EncodeToString([]byte{byte(md.CompanyID), byte(md.CompanyID >> 8)}) +
+			hex.EncodeToString(md.Data)
+	}
+	if len(adv.ServiceData) > 0 {
+		sd := adv.ServiceData[0]
+		fwd.ServiceData = hex.EncodeToString(sd.Data)
+		if sd.UUID.Is16Bit() {
+			fwd.ServiceDataUUID = fmt.Sprintf("0x%04x", sd.UUID.Get16Bit())
+		} else {
+			fwd.ServiceDataUUID = sd.UUID.String()
+		}
+	}
+	return fwd
+}
+
+// Somewhere advertisements are forwarded to, besides API clients.
+type sink interface {
+	// Send advertisements from the forwarder's queue until the context is
+	// done, reporting whether each attempt succeeded.
+	run(ctx context.Context, f *forwarder)
+}
+
+// Forwards advertisements that pass its filter to a sink.
+type forwarder struct {
+	url     string // Redacted, for logging
+	filter  *advertisementFilter
+	queue   chan Advertisement
+	sink    sink
+	failing bool // Whether the last attempt failed; only used by the sink
+}
+
+// Build a forwarder from its URL and settings.
+func newForwarder(rawURL, topic string, batchInterval time.Duration, batchSize int, filter *filterConfig) (*forwarder, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarding URL: %w", err)
+	}
+	f := &forwarder{url: u.Redacted(), queue: make(chan Advertisement, forwardQueueSize)}
+	if f.filter, err = newAdvertisementFilter(filter); err != nil {
+		return nil, fmt.Errorf("invalid filter for %s: %w", f.url, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("forwarding URL %s has no host", f.url)
+	}
+	switch u.Scheme {
+	case "mqtt", "mqtts":
+		s := &mqttSink{topic: strings.TrimSuffix(topic, "/")}
+		if s.topic == "" {
+			s.topic = defaultForwardTopic
+		}
+		s.address, s.options = mqttOptions(u)
+		f.sink = s
+	case "http", "https":
+		if batchInterval == 0 {
+			batchInterval = defaultForwardBatchInterval
+		}
+		if batchSize == 0 {
+			batchSize = defaultForwardBatchSize
+		}
+		if batchInterval < 0 || batchSize < 0 {
+			return nil, fmt.Errorf("invalid batching for %s: %s, %d advertisements", f.url, batchInterval, batchSize)
+		}
+		f.sink = &httpSink{
+			url:      u.String(),
+			interval: batchInterval,
+			size:     batchSize,
+			client:   &http.Client{Timeout: forwardTimeout},
+		}
+	case "udp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("forwarding URL %s has no port", f.url)
+		}
+		f.sink = &udpSink{address: u.Host}
+	default:
+		return nil, fmt.Errorf("unsupported forwarding URL %s", f.url)
+	}
+	return f, nil
+}
+
+// Queue a scan result for each forwarder whose filter it passes.  If a sink
+// has fallen behind, the advertisement is dropped for it.
+func (c *component) forward(result bluetooth.ScanResult, now time.Time) {
+	var adv *Advertisement
+	for _, f := range c.forwarders {
+		if f.filter.check(result) != forwarded {
+			continue
+		}
+		if adv == nil {
+			converted := newAdvertisement(result, now)
+			adv = &converted
+		}
+		select {
+		case f.queue <- *adv:
+		default:
+			advertisementCounts.Add(forwardDropped, 1)
+		}
+	}
+}
+
+// Get the broker address and connection options from an `mqtt://` or
+// `mqtts://` URL.
+func mqttOptions(u *url.URL) (string, mqtt.Options) {
+	var options mqtt.Options
+	port := "1883"
+	if u.Scheme == "mqtts" {
+		options.TLS = &tls.Config{ServerName: u.Hostname()}
+		port = "8883"
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	options.Username = u.User.Username()
+	options.Password, _ = u.User.Password()
+	return net.JoinHostPort(u.Hostname(), port), options
+}
+
+// Log when the sink starts failing, and when it recovers.
+func (f *forwarder) report(ctx context.Context, err error) {
+	if err != nil {
+		if !f.failing {
+			slog.WarnContext(ctx, "failed to forward bluetooth advertisements", "url", f.url, "error", err)
+		}
+		f.failing = true
+		return
+	}
+	if f.failing {
+		slog.InfoContext(ctx, "forwarding bluetooth advertisements again", "url", f.url)
+	}
+	f.failing = false
+}
+
+// Wait before trying again, returning the next delay, or false if the context
+// is done.
+func retryBackoff(ctx context.Context, delay time.Duration) (time.Duration, bool) {
+	select {
+	case <-ctx.Done():
+		return delay, false
+	case <-time.After(delay):
+		return min(delay*2, retryMaxBackoff), true
+	}
+}
+
+// Publishes each advertisement to an MQTT topic named after its address.
+type mqttSink struct {
+	address string
+	topic   string
+	options mqtt.Options
+}
+
+func (s *mqttSink) run(ctx context.Context, f *forwarder) {
+	delay := retryMinBackoff
+	for ctx.Err() == nil {
+		client, err := mqtt.Dial(ctx, s.address, s.options)
+		if err == nil {
+			delay = retryMinBackoff
+			err = s.publish(ctx, client, f)
+			_ = client.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		f.report(ctx, err)
+		var ok bool
+		if delay, ok = retryBackoff(ctx, delay); !ok {
+			return
+		}
+	}
+}
+
+// Publish advertisements until the connection is lost or the context is done.
+func (s *mqttSink) publish(ctx context.Context, client *mqtt.Client, f *forwarder) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-client.Done():
+			return client.Err()
+		case adv := <-f.queue:
+			payload, err := json.Marshal(newForwardedAdvertisement(adv))
+			if err != nil {
+				return err
+			}
+			topic := s.topic + "/" + strings.ReplaceAll(adv.Address.String(), ":", "")
+			if err := client.Publish(topic, payload); err != nil {
+				return err
+			}
+			f.report(ctx, nil)
+		}
+	}
+}
+
+// POSTs batches of advertisements as a JSON array.
+type httpSink struct {
+	url      string
+	interval time.Duration
+	size     int
+	client   *http.Client
+}
+
+func (s *httpSink) run(ctx context.Context, f *forwarder) {
+	var batch []forwardedAdvertisement
+	var timeout <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case adv := <-f.queue:
+			batch = append(batch, newForwardedAdvertisement(adv))
+			if len(batch) == 1 {
+				timeout = time.After(s.interval)
+			}
+			if len(batch) < s.size {
+				continue
+			}
+		case <-timeout:
+		}
+		err := s.post(ctx, batch)
+		if ctx.Err() != nil {
+			return
+		}
+		f.report(ctx, err)
+		batch, timeout = nil, nil
+	}
+}
+
+// Send a batch; it is dropped if it cannot be sent.
+func (s *httpSink) post(ctx context.Context, batch []forwardedAdvertisement) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sends each advertisement as a JSON datagram.
+type udpSink struct {
+	address string
+}
+
+func (s *udpSink) run(ctx context.Context, f *forwarder) {
+	delay := retryMinBackoff
+	var dialer net.Dialer
+	var conn net.Conn
+	for {
+		var err error
+		if conn, err = dialer.DialContext(ctx, "udp", s.address); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		f.report(ctx, err)
+		var ok bool
+		if delay, ok = retryBackoff(ctx, delay); !ok {
+			return
+		}
+	}
+	defer func() { _ = conn.Close() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case adv := <-f.queue:
+			payload, err := json.Marshal(newForwardedAdvertisement(adv))
+			if err == nil {
+				_, err = conn.Write(payload)
+			}
+			f.report(ctx, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package bluetooth_proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/mook/mockesphome/mqtt/mqtttest"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+// Build forwarders from YAML configuration.
+func configureForwarders(t *testing.T, config string) (*component, error) {
+	c := &component{}
+	if err := yaml.UnmarshalWithOptions([]byte(config), &c.config, yaml.DisallowUnknownField()); err != nil {
+		return nil, err
+	}
+	for _, fc := range c.config.Forward {
+		f, err := newForwarder(fc.URL, fc.Topic, fc.BatchInterval, fc.BatchSize, &fc.Filter)
+		if err != nil {
+			return nil, err
+		}
+		c.forwarders = append(c.forwarders, f)
+	}
+	return c, nil
+}
+
+func TestForwardedAdvertisement(t *testing.T) {
+	mac, err := bluetooth.ParseMAC("A4:C1:38:12:34:56")
+	assert.NilError(t, err)
+	adv := Advertisement{
+		AdvertisementFields: bluetooth.AdvertisementFields{
+			LocalName:        "ATC_123456",
+			ServiceData:      []bluetooth.ServiceDataElement{{UUID: bluetooth.New16BitUUID(0x181A), Data: []byte{0x01, 0x02}}},
+			ManufacturerData: []bluetooth.ManufacturerDataElement{{CompanyID: 0x004C, Data: []byte{0x02, 0x15}}},
+		},
+		Address: mac,
+		Random:  true,
+		RSSI:    -70,
+		Data:    []byte{0x02, 0x01, 0x06},
+		Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	encoded, err := json.Marshal(newForwardedAdvertisement(adv))
+	assert.NilError(t, err)
+	assert.Equal(t, string(encoded), `{"id":"A4:C1:38:12:34:56","mac_type":1,"name":"ATC_123456","rssi":-70,`+
+		`"manufacturerdata":"4c000215","servicedata":"0102","servicedatauuid":"0x181a","data":"020106",`+
+		`"time":"2024-01-02T03:04:05Z"}`)
+}
+
+func TestForward(t *testing.T) {
+	broker := mqtttest.NewBroker(t)
+	batches := make(chan []forwardedAdvertisement, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []forwardedAdvertisement
+		body, _ := io.ReadAll(r.Body)
+		assert.Check(t, json.Unmarshal(body, &batch))
+		assert.Check(t, r.Header.Get("Content-Type") == "application/json")
+		batches <- batch
+	}))
+	defer server.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer udp.Close()
+
+	c, err := configureForwarders(t, `
+forward:
+  - url: mqtt://user:secret@`+broker.Addr()+`
+    topic: ble/
+    filter: {allow: [{address: "11:*"}]}
+  - url: `+server.URL+`
+    batchsize: 2
+    batchinterval: 1h
+  - url: udp://`+udp.LocalAddr().String()+`
+    filter: {minrssi: -80}
+`)
+	assert.NilError(t, err)
+	for _, f := range c.forwarders {
+		go f.sink.run(t.Context(), f)
+	}
+	now := time.Now()
+	c.forward(filterResult(t, "11:22:33:44:55:66", -90, bluetooth.AdvertisementFields{LocalName: "first"}), now)
+	c.forward(filterResult(t, "22:33:44:55:66:77", -60, bluetooth.AdvertisementFields{LocalName: "second"}), now)
+
+	msg := <-broker.Messages()
+	assert.Equal(t, msg.Topic, "ble/112233445566")
+	var fwd forwardedAdvertisement
+	assert.NilError(t, json.Unmarshal(msg.Payload, &fwd))
+	assert.Equal(t, fwd.Name, "first")
+	assert.DeepEqual(t, broker.Connects(), []mqtttest.Connect{{Username: "user", Password: "secret"}})
+
+	batch := <-batches
+	assert.Equal(t, len(batch), 2)
+	assert.Equal(t, batch[0].Name, "first")
+	assert.Equal(t, batch[1].ID, "22:33:44:55:66:77")
+
+	buf := make([]byte, 1500)
+	assert.NilError(t, udp.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := udp.ReadFrom(buf)
+	assert.NilError(t, err)
+	assert.NilError(t, json.Unmarshal(buf[:n], &fwd))
+	assert.Equal(t, fwd.Name, "second")
+	assert.Equal(t, fwd.RSSI, int16(-60))
+}
+
+func TestForwardErrors(t *testing.T) {
+	for _, tc := range []struct{ config, err string }{
+		{"forward: [{url: 'ftp://example.com'}]", "unsupported forwarding URL"},
+		{"forward: [{url: 'udp://example.com'}]", "has no port"},
+		{"forward: [{url: 'mqtt:///topic'}]", "has no host"},
+		{"forward: [{url: 'http://example.com', batchsize: -1}]", "invalid batching"},
+		{"forward: [{url: 'http://example.com', filter: {minrssi: 10}}]", "invalid minimum RSSI"},
+	} {
+		_, err := configureForwarders(t, tc.config)
+		assert.ErrorContains(t, err, tc.err, tc.config)
+	}
+}
@@ -0,0 +1,364 @@
+package bluetooth_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/mqtt"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultIngestTopic = "home/+/BTtoMQTT/#" // As published by Theengs Gateway and OpenMQTTGateway
+	maxDatagramSize    = 65535
+)
+
+// Received advertisements that could not be parsed, as used in the counters.
+const ingestInvalid = "ingest_invalid"
+
+// An advertisement received from another gateway.  Both our own recording
+// format (which has the raw data) and the JSON of Theengs Gateway and
+// OpenMQTTGateway (which only has some parsed fields) are accepted, as is
+// what we forward, which has both.
+type ingestedAdvertisement struct {
+	recordedAdvertisement
+	ID               string   `json:"id"`       // Address, as Theengs
+	MACType          *uint32  `json:"mac_type"` // Address type, as Theengs
+	Name             string   `json:"name"`
+	ManufacturerData hexBytes `json:"manufacturerdata"` // Starting with the little-endian company ID
+	ServiceData      hexBytes `json:"servicedata"`
+	ServiceDataUUID  string   `json:"servicedatauuid"`
+}
+
+// Parse a received advertisement.  If it has no address, the last level of
+// the MQTT topic it came from is used, as Theengs Gateway and OpenMQTTGateway
+// put the address (without colons) there.
+func parseIngested(data []byte, topic string) (bluetooth.ScanResult, error) {
+	var adv ingestedAdvertisement
+	if err := json.Unmarshal(data, &adv); err != nil {
+		return bluetooth.ScanResult{}, err
+	}
+	if adv.Address == "" {
+		adv.Address = adv.ID
+	}
+	if last := topic[strings.LastIndex(topic, "/")+1:]; adv.Address == "" && len(last) == 12 {
+		var parts []string
+		for i := 0; i < len(last); i += 2 {
+			parts = append(parts, last[i:i+2])
+		}
+		adv.Address = strings.Join(parts, ":")
+	}
+	if adv.MACType != nil {
+		adv.AddressType = *adv.MACType
+	}
+	if len(adv.Data) == 0 {
+		// Rebuild the raw data from the parsed fields.
+		fields := bluetooth.AdvertisementFields{LocalName: adv.Name}
+		if len(adv.ManufacturerData) >= 2 {
+			fields.ManufacturerData = []bluetooth.ManufacturerDataElement{{
+				CompanyID: binary.LittleEndian.Uint16(adv.ManufacturerData),
+				Data:      adv.ManufacturerData[2:],
+			}}
+		}
+		if adv.ServiceDataUUID != "" {
+			uuid, err := ParseUUID(strings.TrimPrefix(strings.ToLower(adv.ServiceDataUUID), "0x"))
+			if err != nil {
+				return bluetooth.ScanResult{}, err
+			}
+			fields.ServiceData = []bluetooth.ServiceDataElement{{UUID: uuid, Data: adv.ServiceData}}
+		}
+		adv.Data = rawAdvertisementData(bluetooth.ScanResult{
+			AdvertisementPayload: &advertisementPayload{AdvertisementFields: fields},
+		})
+	}
+	return adv.scanResult()
+}
+
+// Somewhere advertisements are received from, instead of a radio.
+type ingestSource interface {
+	// Start receiving advertisements in the background until the context
+	// is done, passing them to the adapter.
+	start(ctx context.Context, a *ingestAdapter) error
+}
+
+// Build a source from its URL and MQTT topic filter.
+func newIngestSource(rawURL, topic string) (ingestSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ingest URL: %w", err)
+	}
+	switch u.Scheme {
+	case "stdin":
+		return &stdinSource{}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("ingest URL %s has no path", u.Redacted())
+		}
+		return &unixSource{path: u.Path}, nil
+	case "mqtt", "mqtts":
+		if u.Host == "" {
+			return nil, fmt.Errorf("ingest URL %s has no host", u.Redacted())
+		}
+		s := &mqttSource{url: u.Redacted(), topic: topic}
+		if s.topic == "" {
+			s.topic = defaultIngestTopic
+		}
+		s.address, s.options = mqttOptions(u)
+		return s, nil
+	case "udp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("ingest URL %s has no port", u.Redacted())
+		}
+		return &udpSource{address: u.Host}, nil
+	}
+	return nil, fmt.Errorf("unsupported ingest URL %s", u.Redacted())
+}
+
+// An adapter that relays advertisements from other gateways, received as
+// JSON, as if they had been scanned locally.  Nothing can be connected to.
+type ingestAdapter struct {
+	ctx     context.Context // Sources run until this is done
+	sources []ingestSource
+	stdin   io.Reader
+
+	selector sourceSelector
+
+	lock     sync.Mutex
+	started  bool
+	callback func(bluetooth.ScanResult) // Nil if not scanning
+	stop     chan struct{}              // Closed to stop scanning; nil if not scanning
+}
+
+// Start the sources; they keep running while not scanning, but what they
+// receive is dropped.
+func (a *ingestAdapter) Enable() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.started {
+		return nil
+	}
+	for _, source := range a.sources {
+		if err := source.start(a.ctx, a); err != nil {
+			return err
+		}
+	}
+	a.started = true
+	return nil
+}
+
+func (a *ingestAdapter) Address() (bluetooth.MACAddress, error) {
+	mac, err := bluetooth.ParseMAC(defaultSimulatedAddress)
+	return bluetooth.MACAddress{MAC: mac}, err
+}
+
+func (a *ingestAdapter) Scan(callback func(bluetooth.ScanResult)) error {
+	a.lock.Lock()
+	if a.stop != nil {
+		a.lock.Unlock()
+		return fmt.Errorf("already scanning")
+	}
+	stop := make(chan struct{})
+	a.stop = stop
+	a.callback = callback
+	a.lock.Unlock()
+	<-stop
+	return nil
+}
+
+func (a *ingestAdapter) StopScan() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.stop == nil {
+		return fmt.Errorf("not scanning")
+	}
+	close(a.stop)
+	a.stop = nil
+	a.callback = nil
+	return nil
+}
+
+func (a *ingestAdapter) Connect(address bluetooth.Address) (device, error) {
+	return nil, fmt.Errorf("cannot connect to remote device %s", address.MAC)
+}
+
+// Handle data received from a source, which has one advertisement per line.
+func (a *ingestAdapter) receive(data []byte, source, topic string) {
+	for line := range bytes.Lines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		result, err := parseIngested(line, topic)
+		if err != nil {
+			advertisementCounts.Add(ingestInvalid, 1)
+			slog.Debug("failed to parse received advertisement", "error", err, "data", string(line))
+			continue
+		}
+		a.relay(result, source)
+	}
+}
+
+// Pass an advertisement from a source on while scanning, unless another source
+// is relaying the device.
+func (a *ingestAdapter) relay(result bluetooth.ScanResult, source string) {
+	a.lock.Lock()
+	callback := a.callback
+	a.lock.Unlock()
+	if callback == nil {
+		return
+	}
+	if !a.selector.check(bleAddressToUint64(result.Address.MAC), source, result.RSSI, time.Now()) {
+		advertisementCounts.Add(ingestDuplicate, 1)
+		return
+	}
+	callback(result)
+}
+
+// Read lines of advertisements from a source until the reader runs out.
+func (a *ingestAdapter) receiveLines(reader io.Reader, source string) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		a.receive(scanner.Bytes(), source, "")
+	}
+	return scanner.Err()
+}
+
+// Reads JSON lines from standard input.
+type stdinSource struct{}
+
+func (s *stdinSource) start(ctx context.Context, a *ingestAdapter) error {
+	stdin := a.stdin
+	if stdin == nil {
+		stdin = os.Stdin
+	}
+	go func() {
+		if err := a.receiveLines(stdin, "stdin"); err != nil {
+			slog.ErrorContext(ctx, "failed to read advertisements from stdin", "error", err)
+		} else {
+			slog.InfoContext(ctx, "no more advertisements on stdin")
+		}
+	}()
+	return nil
+}
+
+// Listens on a Unix socket, reading JSON lines from each connection.
+type unixSource struct {
+	path string
+}
+
+func (s *unixSource) start(ctx context.Context, a *ingestAdapter) error {
+	// Remove any socket left behind by an earlier run.
+	if info, err := os.Lstat(s.path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(s.path)
+	}
+	var config net.ListenConfig
+	listener, err := config.Listen(ctx, "unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen for advertisements: %w", err)
+	}
+	context.AfterFunc(ctx, func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.ErrorContext(ctx, "failed to accept advertisement connection", "error", err)
+				}
+				return
+			}
+			stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+			go func() {
+				defer stop()
+				defer conn.Close()
+				if err := a.receiveLines(conn, s.path); err != nil && ctx.Err() == nil {
+					slog.WarnContext(ctx, "failed to read advertisements", "path", s.path, "error", err)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// Subscribes to an MQTT topic, reconnecting whenever the connection is lost.
+type mqttSource struct {
+	url     string // Redacted, for logging
+	address string
+	topic   string
+	options mqtt.Options
+}
+
+func (s *mqttSource) start(ctx context.Context, a *ingestAdapter) error {
+	options := s.options
+	options.OnMessage = func(topic string, payload []byte) {
+		// Each gateway publishes under its own topic.
+		a.receive(payload, s.url+" "+topic[:max(strings.LastIndex(topic, "/"), 0)], topic)
+	}
+	go func() {
+		delay := retryMinBackoff
+		for ctx.Err() == nil {
+			client, err := mqtt.Dial(ctx, s.address, options)
+			if err == nil {
+				err = client.Subscribe(ctx, s.topic)
+				if err == nil {
+					delay = retryMinBackoff
+					select {
+					case <-ctx.Done():
+					case <-client.Done():
+						err = client.Err()
+					}
+				}
+				_ = client.Close()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			slog.WarnContext(ctx, "lost connection for advertisements", "url", s.url, "error", err)
+			var ok bool
+			if delay, ok = retryBackoff(ctx, delay); !ok {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Listens for datagrams, each with one or more lines of JSON.
+type udpSource struct {
+	address string
+}
+
+func (s *udpSource) start(ctx context.Context, a *ingestAdapter) error {
+	var config net.ListenConfig
+	conn, err := config.ListenPacket(ctx, "udp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen for advertisements: %w", err)
+	}
+	context.AfterFunc(ctx, func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, sender, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.ErrorContext(ctx, "failed to receive advertisements", "error", err)
+				}
+				return
+			}
+			a.receive(buf[:n], sender.String(), "")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,141 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/mqtt/mqtttest"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestParseIngested(t *testing.T) {
+	// As recorded.
+	result, err := parseIngested([]byte(`{"address":"11:22:33:44:55:66","address_type":1,"rssi":-60,"data":"0201060303aafe"}`), "")
+	assert.NilError(t, err)
+	assert.Equal(t, result.Address.MAC.String(), "11:22:33:44:55:66")
+	assert.Assert(t, result.Address.IsRandom())
+	assert.Equal(t, result.RSSI, int16(-60))
+	assert.DeepEqual(t, result.Bytes(), []byte{0x02, 0x01, 0x06, 0x03, 0x03, 0xAA, 0xFE})
+
+	// As from Theengs Gateway, with the raw data rebuilt.
+	result, err = parseIngested([]byte(`{"id":"A4:C1:38:12:34:56","mac_type":0,"name":"ATC","rssi":-70,`+
+		`"manufacturerdata":"4c000215","servicedata":"0102","servicedatauuid":"0x181a"}`), "")
+	assert.NilError(t, err)
+	assert.Equal(t, result.Address.MAC.String(), "A4:C1:38:12:34:56")
+	assert.Assert(t, !result.Address.IsRandom())
+	fields := advertisementFields(result)
+	assert.Equal(t, fields.LocalName, "ATC")
+	assert.DeepEqual(t, fields.ManufacturerData, []bluetooth.ManufacturerDataElement{{CompanyID: 0x004C, Data: []byte{0x02, 0x15}}})
+	assert.DeepEqual(t, fields.ServiceData, []bluetooth.ServiceDataElement{{UUID: bluetooth.New16BitUUID(0x181A), Data: []byte{0x01, 0x02}}})
+
+	// The address can come from the topic.
+	result, err = parseIngested([]byte(`{"rssi":-80}`), "home/OMG_ESP32_BLE/BTtoMQTT/AABBCCDDEEFF")
+	assert.NilError(t, err)
+	assert.Equal(t, result.Address.MAC.String(), "AA:BB:CC:DD:EE:FF")
+
+	_, err = parseIngested([]byte(`{"rssi":-80}`), "")
+	assert.ErrorContains(t, err, "invalid address")
+	_, err = parseIngested([]byte(`{"id":"11:22:33:44:55:66","servicedatauuid":"xyz"}`), "")
+	assert.ErrorContains(t, err, "invalid UUID")
+	_, err = parseIngested([]byte(`nope`), "")
+	assert.Assert(t, err != nil)
+}
+
+func TestIngestAdapter(t *testing.T) {
+	broker := mqtttest.NewBroker(t)
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	udpAddress := udp.LocalAddr().String()
+	assert.NilError(t, udp.Close())
+	socket := filepath.Join(t.TempDir(), "ble.sock")
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	a := &ingestAdapter{ctx: ctx, stdin: stdin}
+	for _, u := range []string{"stdin:", "unix://" + socket, "mqtt://" + broker.Addr(), "udp://" + udpAddress} {
+		source, err := newIngestSource(u, "")
+		assert.NilError(t, err, u)
+		a.sources = append(a.sources, source)
+	}
+	assert.NilError(t, a.Enable())
+	assert.NilError(t, a.Enable()) // Enabling again does nothing
+
+	results := make(chan bluetooth.ScanResult, 10)
+	go func() { assert.Check(t, a.Scan(func(result bluetooth.ScanResult) { results <- result })) }()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.callback == nil {
+			return poll.Continue("not scanning")
+		}
+		return poll.Success()
+	})
+	received := func() string {
+		select {
+		case result := <-results:
+			return result.Address.MAC.String()
+		case <-time.After(5 * time.Second):
+			t.Fatal("no advertisement received")
+			return ""
+		}
+	}
+
+	_, err = io.WriteString(stdinWriter, "\n"+`{"id":"11:22:33:44:55:01","rssi":-60}`+"\n")
+	assert.NilError(t, err)
+	assert.Equal(t, received(), "11:22:33:44:55:01")
+
+	conn, err := net.Dial("unix", socket)
+	assert.NilError(t, err)
+	_, err = io.WriteString(conn, `{"id":"11:22:33:44:55:02","rssi":-60}`+"\n"+`bad`+"\n"+`{"id":"11:22:33:44:55:03","rssi":-60}`+"\n")
+	assert.NilError(t, err)
+	assert.Equal(t, received(), "11:22:33:44:55:02")
+	assert.Equal(t, received(), "11:22:33:44:55:03")
+	assert.NilError(t, conn.Close())
+
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if broker.Publish("home/TheengsGateway/BTtoMQTT/112233445504", []byte(`{"rssi":-60}`)) == 0 {
+			return poll.Continue("not subscribed")
+		}
+		return poll.Success()
+	})
+	assert.Equal(t, received(), "11:22:33:44:55:04")
+
+	conn, err = net.Dial("udp", udpAddress)
+	assert.NilError(t, err)
+	_, err = io.WriteString(conn, `{"id":"11:22:33:44:55:05","rssi":-60}`)
+	assert.NilError(t, err)
+	assert.Equal(t, received(), "11:22:33:44:55:05")
+	assert.NilError(t, conn.Close())
+
+	// Nothing is relayed while not scanning.
+	assert.NilError(t, a.StopScan())
+	_, err = io.WriteString(stdinWriter, `{"id":"11:22:33:44:55:06","rssi":-60}`+"\n")
+	assert.NilError(t, err)
+	select {
+	case result := <-results:
+		t.Fatalf("received %s while not scanning", result.Address.MAC)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = a.Connect(bluetooth.Address{})
+	assert.ErrorContains(t, err, "cannot connect")
+}
+
+func TestIngestSourceErrors(t *testing.T) {
+	for _, tc := range []struct{ url, err string }{
+		{"ftp://example.com", "unsupported ingest URL"},
+		{"udp://example.com", "has no port"},
+		{"mqtt:///topic", "has no host"},
+		{"unix://", "has no path"},
+	} {
+		_, err := newIngestSource(tc.url, "")
+		assert.ErrorContains(t, err, tc.err, tc.url)
+	}
+}
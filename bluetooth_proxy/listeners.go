@@ -0,0 +1,68 @@
+package bluetooth_proxy
+
+import (
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// An advertisement, as given to listeners.  Each device's advertisement and
+// scan response are merged where possible, as for clients.
+type Advertisement struct {
+	bluetooth.AdvertisementFields
+	Address bluetooth.MAC
+	Random  bool   // Whether the address is random rather than public
+	RSSI    int16  // Signal strength, in dBm
+	Data    []byte // Raw advertising data (rebuilt from the fields if not known)
+	Time    time.Time
+}
+
+// Convert a scan result received at the given time.
+func newAdvertisement(result bluetooth.ScanResult, now time.Time) Advertisement {
+	return Advertisement{
+		AdvertisementFields: advertisementFields(result),
+		Address:             result.Address.MAC,
+		Random:              result.Address.IsRandom(),
+		RSSI:                result.RSSI,
+		Data:                rawAdvertisementData(result),
+		Time:                now,
+	}
+}
+
+// Functions to call with every advertisement, for other components.
+var listeners struct {
+	lock  sync.Mutex
+	funcs []func(Advertisement)
+}
+
+// Add a function to be called (synchronously, so it should be quick) with
+// every advertisement received, before filtering and throttling.  Scanning
+// continues for as long as there are listeners; this should be called while
+// configuring the component that needs advertisements.
+func AddListener(listener func(Advertisement)) {
+	listeners.lock.Lock()
+	defer listeners.lock.Unlock()
+	listeners.funcs = append(listeners.funcs, listener)
+}
+
+// Check whether any component is listening for advertisements.
+func haveListeners() bool {
+	listeners.lock.Lock()
+	defer listeners.lock.Unlock()
+	return len(listeners.funcs) > 0
+}
+
+// Pass a scan result to every listener.
+func notifyListeners(result bluetooth.ScanResult, now time.Time) {
+	listeners.lock.Lock()
+	funcs := listeners.funcs
+	listeners.lock.Unlock()
+	if len(funcs) == 0 {
+		return
+	}
+	adv := newAdvertisement(result, now)
+	for _, listener := range funcs {
+		listener(adv)
+	}
+}
@@ -0,0 +1,102 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"tinygo.org/x/bluetooth"
+)
+
+func (a *hostAdapter) Pair(ctx context.Context, address bluetooth.Address) error {
+	device, err := findBluezDevice(ctx, a.path, address)
+	if err != nil {
+		return err
+	}
+	err = device.object.CallWithContext(ctx, bluezDeviceInterface+".Pair", 0).Err
+	if err != nil && !isBluezError(err, bluezAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// BlueZ can only remove a bond by forgetting the device entirely, which also
+// disconnects it.
+func (a *hostAdapter) Unpair(ctx context.Context, address bluetooth.Address) error {
+	device, err := findBluezDevice(ctx, a.path, address)
+	if errors.Is(err, errUnknownDevice) {
+		return nil // Nothing to forget.
+	} else if err != nil {
+		return err
+	}
+	err = device.adapter.CallWithContext(ctx, "org.bluez.Adapter1.RemoveDevice", 0, device.object.Path()).Err
+	if err != nil && !isBluezError(err, bluezDoesNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Pair with a connected device, reporting the result to the client.
+func (c *component) pair(ctx context.Context, send api.MessageSender, address uint64) {
+	resp := &pb.BluetoothDevicePairingResponse{}
+	resp.SetAddress(address)
+	err := func() error {
+		pairer, ok := c.adapter.(pairingAdapter)
+		if !ok {
+			return errPairingUnsupported
+		}
+		conn, ok := c.connection(address)
+		if !ok {
+			return fmt.Errorf("device is not connected")
+		}
+		conn.lock.Lock()
+		connected := conn.connected
+		conn.lock.Unlock()
+		if !connected {
+			return fmt.Errorf("device is not connected")
+		}
+		ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
+		return pairer.Pair(ctx, uint64ToBLEAddress(address))
+	}()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to pair bluetooth device", "address", api.FormatAddress(address), "error", err)
+		resp.SetError(gattErrorFailure)
+	} else {
+		slog.InfoContext(ctx, "paired bluetooth device", "address", api.FormatAddress(address))
+		resp.SetPaired(true)
+	}
+	if err := send(resp); err != nil {
+		slog.ErrorContext(ctx, "failed to send bluetooth pairing result", "address", api.FormatAddress(address), "error", err)
+	}
+}
+
+// Remove the bond with a device, reporting the result to the client.  The
+// device is disconnected and its services dropped from the cache.
+func (c *component) unpair(ctx context.Context, send api.MessageSender, address uint64) {
+	resp := &pb.BluetoothDeviceUnpairingResponse{}
+	resp.SetAddress(address)
+	if conn, ok := c.connection(address); ok {
+		c.disconnect(conn, true)
+	}
+	c.cache.clear(address)
+	var err error
+	if pairer, ok := c.adapter.(pairingAdapter); ok {
+		err = pairer.Unpair(ctx, uint64ToBLEAddress(address))
+	} else {
+		err = errPairingUnsupported
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to unpair bluetooth device", "address", api.FormatAddress(address), "error", err)
+		resp.SetError(gattErrorFailure)
+	} else {
+		slog.InfoContext(ctx, "unpaired bluetooth device", "address", api.FormatAddress(address))
+		resp.SetSuccess(true)
+	}
+	if err := send(resp); err != nil {
+		slog.ErrorContext(ctx, "failed to send bluetooth unpairing result", "address", api.FormatAddress(address), "error", err)
+	}
+}
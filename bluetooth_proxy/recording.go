@@ -0,0 +1,184 @@
+package bluetooth_proxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultRecordMaxSize = 10 << 20 // Bytes
+	defaultRecordKeep    = 5
+)
+
+func (b hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+// A recorded advertisement, as one line of a recording.
+type recordedAdvertisement struct {
+	Time         time.Time `json:"time"`
+	Address      string    `json:"address"`
+	AddressType  uint32    `json:"address_type"`
+	RSSI         int16     `json:"rssi"`
+	Data         hexBytes  `json:"data"` // Raw advertising data
+	ScanResponse bool      `json:"scan_response,omitempty"`
+}
+
+// Convert a recorded advertisement back into a scan result.
+func (r *recordedAdvertisement) scanResult() (bluetooth.ScanResult, error) {
+	mac, err := bluetooth.ParseMAC(r.Address)
+	if err != nil {
+		return bluetooth.ScanResult{}, fmt.Errorf("invalid address %q: %w", r.Address, err)
+	}
+	result := bluetooth.ScanResult{
+		RSSI: r.RSSI,
+		AdvertisementPayload: &advertisementPayload{
+			AdvertisementFields: parseAdvertisingData(r.Data),
+			raw:                 r.Data,
+			scanResponse:        r.ScanResponse,
+		},
+	}
+	result.Address.MAC = mac
+	result.Address.SetRandom(r.AddressType == addressTypeRandom)
+	return result, nil
+}
+
+// Writes advertisements to a JSONL file, starting a new one when it gets too
+// big.  Older files are renamed with a numeric suffix, with `.1` the newest.
+type advertisementRecorder struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAdvertisementRecorder(path string, maxSize int64, keep int) (*advertisementRecorder, error) {
+	r := &advertisementRecorder{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Open the current file, appending to it.  The lock must be held.
+func (r *advertisementRecorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open advertisement recording: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to open advertisement recording: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Move the current file aside and start a new one.  The lock must be held.
+func (r *advertisementRecorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	if r.keep < 1 {
+		if err := os.Remove(r.path); err != nil {
+			return err
+		}
+	} else {
+		for i := r.keep - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// Record a scan result.
+func (r *advertisementRecorder) record(result bluetooth.ScanResult) {
+	line, err := json.Marshal(&recordedAdvertisement{
+		Time:         time.Now(),
+		Address:      result.Address.MAC.String(),
+		AddressType:  addressType(result),
+		RSSI:         result.RSSI,
+		Data:         rawAdvertisementData(result),
+		ScanResponse: isScanResponse(result),
+	})
+	if err != nil {
+		slog.Error("failed to encode advertisement", "error", err)
+		return
+	}
+	line = append(line, '\n')
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return // Closed, or failed to rotate.
+	}
+	if r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			slog.Error("failed to rotate advertisement recording", "path", r.path, "error", err)
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		slog.Error("failed to record advertisement", "path", r.path, "error", err)
+	}
+}
+
+func (r *advertisementRecorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Read the advertisements in a JSONL recording.  Lines that cannot be parsed
+// yield an error, and reading carries on with the next line.
+func readRecording(reader io.Reader) iter.Seq2[*recordedAdvertisement, error] {
+	return func(yield func(*recordedAdvertisement, error) bool) {
+		scanner := bufio.NewScanner(reader)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var adv recordedAdvertisement
+			if err := json.Unmarshal(scanner.Bytes(), &adv); err != nil {
+				if !yield(nil, fmt.Errorf("failed to parse recording line %d: %w", line, err)) {
+					return
+				}
+				continue
+			}
+			if !yield(&adv, nil) {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(nil, fmt.Errorf("failed to read recording: %w", err))
+		}
+	}
+}
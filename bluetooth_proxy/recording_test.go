@@ -0,0 +1,108 @@
+package bluetooth_proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestParseAdvertisingData(t *testing.T) {
+	fields := bluetooth.AdvertisementFields{
+		LocalName:    "ab",
+		ServiceUUIDs: []bluetooth.UUID{bluetooth.New16BitUUID(0x180F), bluetooth.ServiceUUIDNordicUART},
+		ServiceData: []bluetooth.ServiceDataElement{
+			{UUID: bluetooth.New16BitUUID(0xFCD2), Data: []byte{0x40}},
+		},
+		ManufacturerData: []bluetooth.ManufacturerDataElement{
+			{CompanyID: 0x004C, Data: []byte{0x02, 0x15}},
+		},
+	}
+	data := rawAdvertisementData(bluetooth.ScanResult{AdvertisementPayload: &advertisementPayload{AdvertisementFields: fields}})
+	assert.DeepEqual(t, parseAdvertisingData(data), fields)
+
+	// Truncated structures are ignored.
+	assert.DeepEqual(t, parseAdvertisingData([]byte{0x02, 0x01, 0x06, 0x05, 0x09, 'a'}), bluetooth.AdvertisementFields{})
+}
+
+func TestAdvertisementRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "adverts.jsonl")
+	recorder, err := newAdvertisementRecorder(path, 200, 2)
+	assert.NilError(t, err)
+	result := bluetooth.ScanResult{
+		RSSI: -70,
+		AdvertisementPayload: &advertisementPayload{
+			AdvertisementFields: bluetooth.AdvertisementFields{LocalName: "sensor"},
+		},
+	}
+	result.Address.MAC = bluetooth.MAC{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	result.Address.SetRandom(true)
+	// Each line is about 120 bytes, so each file holds one advertisement.
+	for range 4 {
+		recorder.record(result)
+	}
+	assert.NilError(t, recorder.Close())
+	recorder.record(result) // Ignored once closed.
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		file, err := os.Open(name)
+		assert.NilError(t, err)
+		defer file.Close()
+		var count int
+		for adv, err := range readRecording(file) {
+			assert.NilError(t, err)
+			count++
+			assert.Equal(t, adv.Address, "06:05:04:03:02:01")
+			replayed, err := adv.scanResult()
+			assert.NilError(t, err)
+			assert.Equal(t, replayed.Address, result.Address)
+			assert.Equal(t, replayed.RSSI, result.RSSI)
+			assert.Equal(t, replayed.LocalName(), "sensor")
+		}
+		assert.Equal(t, count, 1, "unexpected number of advertisements in %s", name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.Assert(t, os.IsNotExist(err), "too many files kept")
+}
+
+func TestAdvertisementMerger(t *testing.T) {
+	merger := newAdvertisementMerger()
+	now := time.Now()
+	result := func(raw []byte, scanResponse bool) bluetooth.ScanResult {
+		result := bluetooth.ScanResult{AdvertisementPayload: &advertisementPayload{
+			AdvertisementFields: parseAdvertisingData(raw),
+			raw:                 raw,
+			scanResponse:        scanResponse,
+		}}
+		result.Address.MAC = bluetooth.MAC{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+		result.Address.SetRandom(true)
+		return result
+	}
+	advertisement := []byte{0x03, adTypeComplete16BitUUIDs, 0x0F, 0x18}
+	scanResponse := []byte{0x03, adTypeCompleteLocalName, 'h', 'i'}
+
+	// Until the scan response arrives, there is only the advertisement.
+	merged := merger.merge(result(advertisement, false), now)
+	assert.Equal(t, merged.LocalName(), "")
+	merged = merger.merge(result(scanResponse, true), now)
+	assert.Assert(t, isScanResponse(merged))
+	assert.DeepEqual(t, merged.Bytes(), scanResponse)
+	resp := parsedAdvertisement(merged)
+	assert.Equal(t, resp.GetName(), "hi")
+	assert.DeepEqual(t, resp.GetServiceUuids(), []string{bluetooth.New16BitUUID(0x180F).String()})
+	assert.Equal(t, resp.GetAddressType(), uint32(addressTypeRandom))
+
+	// Later advertisements keep the name from the scan response.
+	merged = merger.merge(result(advertisement, false), now.Add(time.Second))
+	assert.Assert(t, !isScanResponse(merged))
+	assert.DeepEqual(t, merged.Bytes(), advertisement)
+	assert.Equal(t, merged.LocalName(), "hi")
+
+	// Devices are forgotten after a while.
+	merged = merger.merge(result(advertisement, false), now.Add(time.Second+mergeExpiry))
+	assert.Equal(t, merged.LocalName(), "")
+	assert.Equal(t, len(merger.devices), 1)
+}
@@ -0,0 +1,264 @@
+package bluetooth_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+const defaultReplaySpeed = 1
+
+// Recorded advertisements that could not be replayed, as used in the counters.
+const replayInvalid = "replay_invalid"
+
+// btsnoop file format constants.
+var btsnoopMagic = []byte("btsnoop\x00")
+
+const (
+	btsnoopDatalinkH1   = 1001               // Unencapsulated HCI; the packet type is in the flags
+	btsnoopDatalinkH4   = 1002               // HCI UART; the packet type is the first byte
+	btsnoopMonitor      = 2001               // Linux monitor, as from btmon; the opcode is in the flags
+	btsnoopMonitorEvent = 0x0003             // Monitor opcode for an event
+	btsnoopEpochDelta   = 0x00dcddb30f2f8000 // Microseconds from year 0 to the Unix epoch
+	btsnoopFlagEvent    = 0x03               // Flags for a received command or event
+	hciPacketEvent      = 0x04
+	hciEventLEMeta      = 0x3E
+	hciLEAdvReport      = 0x02
+	hciLEExtAdvReport   = 0x0D
+	hciLegacyScanRsp    = 0x04   // Legacy report event type for a scan response
+	hciExtScanRsp       = 0x0008 // Extended report event type bit for a scan response
+)
+
+// An adapter that replays recorded advertisements.
+type replayAdapter struct {
+	path  string
+	speed float64
+
+	lock sync.Mutex
+	stop chan struct{} // Closed to stop scanning; nil if not scanning
+}
+
+func (a *replayAdapter) Enable() error {
+	if _, err := os.Stat(a.path); err != nil {
+		return fmt.Errorf("failed to find recording: %w", err)
+	}
+	return nil
+}
+
+func (a *replayAdapter) Address() (bluetooth.MACAddress, error) {
+	mac, err := bluetooth.ParseMAC(defaultSimulatedAddress)
+	return bluetooth.MACAddress{MAC: mac}, err
+}
+
+// Replay the recording from the start, keeping the original spacing between
+// advertisements (adjusted for the speed).  Once it runs out, nothing more is
+// reported until scanning is stopped.
+func (a *replayAdapter) Scan(callback func(bluetooth.ScanResult)) error {
+	a.lock.Lock()
+	if a.stop != nil {
+		a.lock.Unlock()
+		return fmt.Errorf("already scanning")
+	}
+	stop := make(chan struct{})
+	a.stop = stop
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.stop == stop {
+			a.stop = nil
+		}
+	}()
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var records iter.Seq2[*recordedAdvertisement, error]
+	if magic, _ := reader.Peek(len(btsnoopMagic)); bytes.Equal(magic, btsnoopMagic) {
+		records = readBtsnoop(reader)
+	} else {
+		records = readRecording(reader)
+	}
+
+	started := time.Now()
+	var first time.Time
+	for adv, err := range records {
+		if err != nil {
+			// Skip anything that cannot be read; a truncated recording
+			// ends the records, but what came before is still replayed.
+			advertisementCounts.Add(replayInvalid, 1)
+			slog.Warn("failed to read recorded advertisement", "path", a.path, "error", err)
+			continue
+		}
+		if first.IsZero() {
+			first = adv.Time
+		}
+		due := started.Add(time.Duration(float64(adv.Time.Sub(first)) / a.speed))
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(time.Until(due)):
+		}
+		result, err := adv.scanResult()
+		if err != nil {
+			advertisementCounts.Add(replayInvalid, 1)
+			slog.Warn("failed to replay recorded advertisement", "path", a.path, "error", err)
+			continue
+		}
+		callback(result)
+	}
+	<-stop
+	return nil
+}
+
+func (a *replayAdapter) StopScan() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.stop == nil {
+		return fmt.Errorf("not scanning")
+	}
+	close(a.stop)
+	a.stop = nil
+	return nil
+}
+
+func (a *replayAdapter) Connect(address bluetooth.Address) (device, error) {
+	return nil, fmt.Errorf("cannot connect to replayed device %s", address.MAC)
+}
+
+// Read the advertising reports in a btsnoop HCI log; other packets are
+// skipped.
+func readBtsnoop(reader io.Reader) iter.Seq2[*recordedAdvertisement, error] {
+	return func(yield func(*recordedAdvertisement, error) bool) {
+		var header struct {
+			Magic    [8]byte
+			Version  uint32
+			Datalink uint32
+		}
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			yield(nil, fmt.Errorf("failed to read btsnoop header: %w", err))
+			return
+		}
+		if header.Datalink != btsnoopDatalinkH1 && header.Datalink != btsnoopDatalinkH4 && header.Datalink != btsnoopMonitor {
+			yield(nil, fmt.Errorf("unsupported btsnoop datalink type %d", header.Datalink))
+			return
+		}
+		for {
+			var record struct {
+				OriginalLength uint32
+				IncludedLength uint32
+				Flags          uint32
+				Drops          uint32
+				Timestamp      int64
+			}
+			if err := binary.Read(reader, binary.BigEndian, &record); errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				yield(nil, fmt.Errorf("failed to read btsnoop record: %w", err))
+				return
+			}
+			packet := make([]byte, record.IncludedLength)
+			if _, err := io.ReadFull(reader, packet); err != nil {
+				yield(nil, fmt.Errorf("failed to read btsnoop record: %w", err))
+				return
+			}
+			switch header.Datalink {
+			case btsnoopDatalinkH1:
+				if record.Flags&btsnoopFlagEvent != btsnoopFlagEvent {
+					continue
+				}
+			case btsnoopDatalinkH4:
+				if len(packet) == 0 || packet[0] != hciPacketEvent {
+					continue
+				}
+				packet = packet[1:]
+			case btsnoopMonitor:
+				if record.Flags&0xFFFF != btsnoopMonitorEvent {
+					continue
+				}
+			}
+			timestamp := time.UnixMicro(record.Timestamp - btsnoopEpochDelta)
+			for _, adv := range parseHCIEvent(packet) {
+				adv.Time = timestamp
+				if !yield(adv, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Extract the advertisements from an HCI event; anything else (including
+// malformed reports) yields nothing.
+func parseHCIEvent(event []byte) []*recordedAdvertisement {
+	if len(event) < 4 || event[0] != hciEventLEMeta || int(event[1]) != len(event)-2 {
+		return nil
+	}
+	subevent, count, params := event[2], int(event[3]), event[4:]
+	var result []*recordedAdvertisement
+	address := func(b []byte) string {
+		var mac bluetooth.MAC
+		copy(mac[:], b)
+		return mac.String()
+	}
+	switch subevent {
+	case hciLEAdvReport:
+		// Each field is an array, with one entry per report.
+		if len(params) < count*10 {
+			return nil
+		}
+		addressTypes := params[count : 2*count]
+		addresses := params[2*count : 8*count]
+		lengths := params[8*count : 9*count]
+		data := params[9*count:]
+		for i := range count {
+			length := int(lengths[i])
+			if len(data) < length {
+				return nil
+			}
+			result = append(result, &recordedAdvertisement{
+				Address:      address(addresses[6*i : 6*i+6]),
+				AddressType:  uint32(addressTypes[i] & 0x01),
+				Data:         data[:length],
+				ScanResponse: params[i] == hciLegacyScanRsp,
+			})
+			data = data[length:]
+		}
+		if len(data) != count {
+			return nil
+		}
+		for i, rssi := range data {
+			result[i].RSSI = int16(int8(rssi))
+		}
+	case hciLEExtAdvReport:
+		// Each report is complete in itself.
+		for range count {
+			if len(params) < 24 || len(params) < 24+int(params[23]) {
+				return nil
+			}
+			length := int(params[23])
+			result = append(result, &recordedAdvertisement{
+				Address:      address(params[3:9]),
+				AddressType:  uint32(params[2] & 0x01),
+				RSSI:         int16(int8(params[13])),
+				Data:         params[24 : 24+length],
+				ScanResponse: binary.LittleEndian.Uint16(params)&hciExtScanRsp != 0,
+			})
+			params = params[24+length:]
+		}
+	}
+	return result
+}
@@ -0,0 +1,143 @@
+package bluetooth_proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+// Replay a recording, returning the results and when they arrived.
+func replay(t *testing.T, a *replayAdapter, count int) ([]bluetooth.ScanResult, []time.Duration) {
+	assert.NilError(t, a.Enable())
+	type arrival struct {
+		result bluetooth.ScanResult
+		at     time.Time
+	}
+	arrivals := make(chan arrival, count)
+	done := make(chan error)
+	started := time.Now()
+	go func() {
+		done <- a.Scan(func(result bluetooth.ScanResult) { arrivals <- arrival{result, time.Now()} })
+	}()
+	var results []bluetooth.ScanResult
+	var offsets []time.Duration
+	for range count {
+		select {
+		case arrival := <-arrivals:
+			results = append(results, arrival.result)
+			offsets = append(offsets, arrival.at.Sub(started))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for replayed advertisement")
+		}
+	}
+	assert.NilError(t, a.StopScan())
+	assert.NilError(t, <-done)
+	return results, offsets
+}
+
+func TestReplayRecording(t *testing.T) {
+	recording := `{"time":"2025-01-01T00:00:00Z","address":"11:22:33:44:55:66","address_type":1,"rssi":-50,"data":"0409616263"}
+{"time":"2025-01-01T00:00:01Z","address":"11:22:33:44:55:77","address_type":0,"rssi":-60,"data":""}
+`
+	path := filepath.Join(t.TempDir(), "adverts.jsonl")
+	assert.NilError(t, os.WriteFile(path, []byte(recording), 0o644))
+
+	// A second apart in the recording, a tenth of a second apart at 10x.
+	results, offsets := replay(t, &replayAdapter{path: path, speed: 10}, 2)
+	assert.Equal(t, results[0].Address.MAC.String(), "11:22:33:44:55:66")
+	assert.Assert(t, results[0].Address.IsRandom())
+	assert.Equal(t, results[0].RSSI, int16(-50))
+	assert.Equal(t, results[0].LocalName(), "abc")
+	assert.Equal(t, results[1].Address.MAC.String(), "11:22:33:44:55:77")
+	assert.Assert(t, !results[1].Address.IsRandom())
+	gap := offsets[1] - offsets[0]
+	assert.Assert(t, gap >= 90*time.Millisecond && gap < 500*time.Millisecond, "unexpected gap %s", gap)
+
+	err := (&replayAdapter{path: filepath.Join(t.TempDir(), "missing")}).Enable()
+	assert.ErrorContains(t, err, "failed to find recording")
+}
+
+func TestReplayBtsnoop(t *testing.T) {
+	var buf bytes.Buffer
+	write := func(v any) { assert.NilError(t, binary.Write(&buf, binary.BigEndian, v)) }
+	buf.Write(btsnoopMagic)
+	write(uint32(1))
+	write(uint32(btsnoopDatalinkH4))
+	packet := func(flags uint32, timestamp time.Time, data ...byte) {
+		write(uint32(len(data)))
+		write(uint32(len(data)))
+		write(flags)
+		write(uint32(0))
+		write(timestamp.UnixMicro() + btsnoopEpochDelta)
+		buf.Write(data)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	// An HCI command, which is skipped.
+	packet(0x02, start, 0x01, 0x0C, 0x20, 0x02, 0x00, 0x00)
+	// A legacy advertising report.
+	packet(0x03, start, hciPacketEvent, hciEventLEMeta, 15, hciLEAdvReport, 1,
+		0x04,                               // Event type (scan response)
+		0x01,                               // Address type
+		0x66, 0x55, 0x44, 0x33, 0x22, 0x11, // Address
+		3,                // Data length
+		0x02, 0x01, 0x06, // Data
+		0xC4, // RSSI
+	)
+	// An extended advertising report.
+	ext := []byte{hciPacketEvent, hciEventLEMeta, 28, hciLEExtAdvReport, 1,
+		0x13, 0x00, // Event type
+		0x00,                               // Address type
+		0x77, 0x55, 0x44, 0x33, 0x22, 0x11, // Address
+		0x01, 0x00, 0xFF, 0x7F, // PHYs, SID, TX power
+		0xB0,       // RSSI
+		0x00, 0x00, // Periodic advertising interval
+		0x00, 0, 0, 0, 0, 0, 0, // Direct address
+		2,          // Data length
+		0x01, 0x09, // Data (an empty name)
+	}
+	packet(0x03, start.Add(500*time.Millisecond), ext...)
+
+	path := filepath.Join(t.TempDir(), "hci.log")
+	assert.NilError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+	results, _ := replay(t, &replayAdapter{path: path, speed: 100}, 2)
+	assert.Equal(t, results[0].Address.MAC.String(), "11:22:33:44:55:66")
+	assert.Assert(t, results[0].Address.IsRandom())
+	assert.Equal(t, results[0].RSSI, int16(-60))
+	assert.DeepEqual(t, results[0].Bytes(), []byte{0x02, 0x01, 0x06})
+	assert.Assert(t, isScanResponse(results[0]))
+	assert.Equal(t, results[1].Address.MAC.String(), "11:22:33:44:55:77")
+	assert.Assert(t, !results[1].Address.IsRandom())
+	assert.Equal(t, results[1].RSSI, int16(-80))
+	assert.DeepEqual(t, results[1].Bytes(), []byte{0x01, 0x09})
+	assert.Assert(t, !isScanResponse(results[1]))
+}
+
+func TestReplayInvalid(t *testing.T) {
+	recording := `{"time":"2025-01-01T00:00:00Z","address":"11:22:33:44:55:66","address_type":1,"rssi":-50,"data":""}
+not json
+{"time":"2025-01-01T00:00:00Z","address":"bogus","rssi":-50,"data":""}
+{"time":"2025-01-01T00:00:00Z","address":"11:22:33:44:55:77","address_type":0,"rssi":-60,"data":""}
+`
+	path := filepath.Join(t.TempDir(), "adverts.jsonl")
+	assert.NilError(t, os.WriteFile(path, []byte(recording), 0o644))
+	advertisementCounts.Add(replayInvalid, 0)
+	invalid := advertisementCounts.Get(replayInvalid).(*expvar.Int)
+	before := invalid.Value()
+	results, _ := replay(t, &replayAdapter{path: path, speed: 1}, 2)
+	assert.Equal(t, results[0].Address.MAC.String(), "11:22:33:44:55:66")
+	assert.Equal(t, results[1].Address.MAC.String(), "11:22:33:44:55:77")
+	assert.Equal(t, invalid.Value()-before, int64(2))
+
+	// A failed replay does not leave the adapter scanning.
+	a := &replayAdapter{path: path, speed: 1}
+	assert.NilError(t, os.Remove(path))
+	assert.ErrorContains(t, a.Scan(func(bluetooth.ScanResult) {}), "failed to open recording")
+	assert.ErrorContains(t, a.StopScan(), "not scanning")
+}
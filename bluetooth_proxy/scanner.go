@@ -0,0 +1,184 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultScanMode     = "active"
+	defaultScanInterval = 320 * time.Millisecond // As ESPHome
+	defaultScanWindow   = 30 * time.Millisecond  // As ESPHome
+	stopScanAttempts    = 10
+	stopScanRetryDelay  = 10 * time.Millisecond
+)
+
+// Scanner modes, as used in the configuration.
+var scanModes = map[string]pb.BluetoothScannerMode{
+	"active":  pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_ACTIVE,
+	"passive": pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_PASSIVE,
+}
+
+// Parse the scanner configuration.
+func (c *component) configureScanner() error {
+	mode, ok := scanModes[c.config.ScanMode]
+	if !ok {
+		return fmt.Errorf("invalid scan mode %q", c.config.ScanMode)
+	}
+	if c.config.ScanInterval <= 0 {
+		return fmt.Errorf("invalid scan interval %s", c.config.ScanInterval)
+	}
+	if c.config.ScanWindow <= 0 || c.config.ScanWindow > c.config.ScanInterval {
+		return fmt.Errorf("invalid scan window %s for interval %s", c.config.ScanWindow, c.config.ScanInterval)
+	}
+	c.scannerState = pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_IDLE
+	c.scannerMode = mode
+	return nil
+}
+
+// Get the current scanner state.  This must be called with the scanner lock
+// held.
+func (c *component) scannerStateResponse() *pb.BluetoothScannerStateResponse {
+	resp := &pb.BluetoothScannerStateResponse{}
+	resp.SetState(c.scannerState)
+	resp.SetMode(c.scannerMode)
+	return resp
+}
+
+// Send the current scanner state to every subscriber.  This must be called
+// with the scanner lock held, so that subscribers see the changes in order.
+func (c *component) broadcastScannerState() {
+	resp := c.scannerStateResponse()
+	c.subscribersLock.Lock()
+	subscribers := make([]*subscriber, 0, len(c.subscribers))
+	for _, sub := range c.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	c.subscribersLock.Unlock()
+	for _, sub := range subscribers {
+		if err := sub.send(resp); err != nil {
+			slog.Error("failed to send bluetooth scanner state", "error", err)
+		}
+	}
+}
+
+// Change the scanner state and tell subscribers about it.
+func (c *component) setScannerState(state pb.BluetoothScannerState) {
+	c.scannerLock.Lock()
+	defer c.scannerLock.Unlock()
+	c.scannerState = state
+	c.broadcastScannerState()
+}
+
+// Check whether anything needs advertisements.
+func (c *component) scanWanted() bool {
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+	return c.config.AlwaysScan || c.recorder != nil || len(c.subscribers) > 0 || len(c.forwarders) > 0 || haveListeners()
+}
+
+// Start or stop scanning, depending on whether anything needs advertisements.
+func (c *component) updateScanning() error {
+	c.scanControlLock.Lock()
+	defer c.scanControlLock.Unlock()
+	if c.scanWanted() {
+		c.startScanning(c.ctx)
+		return nil
+	}
+	return c.stopScanning()
+}
+
+// Start scanning in the background, if not already scanning.  This must be
+// called with the scan control lock held.
+func (c *component) startScanning(ctx context.Context) {
+	c.scannerLock.Lock()
+	defer c.scannerLock.Unlock()
+	if c.scanDone != nil {
+		return
+	}
+	done := make(chan struct{})
+	c.scanDone = done
+	c.scanStarted = time.Now()
+	c.scannerState = pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_STARTING
+	c.broadcastScannerState()
+	slog.DebugContext(ctx, "starting bluetooth scan",
+		"mode", c.scannerMode, "interval", c.config.ScanInterval, "window", c.config.ScanWindow)
+	go func() {
+		defer close(done)
+		c.setScannerState(pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_RUNNING)
+		err := c.adapter.Scan(c.scanResultCallback)
+		c.scannerLock.Lock()
+		defer c.scannerLock.Unlock()
+		c.scanDone = nil
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to scan bluetooth", "error", err)
+			c.scannerState = pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_FAILED
+		} else {
+			c.scannerState = pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_STOPPED
+		}
+		c.broadcastScannerState()
+	}()
+}
+
+// Stop scanning, waiting for the scan to finish.  This must be called with the
+// scan control lock held.
+func (c *component) stopScanning() error {
+	c.scannerLock.Lock()
+	done := c.scanDone
+	if done == nil {
+		c.scannerLock.Unlock()
+		return nil
+	}
+	previous := c.scannerState
+	c.scannerState = pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_STOPPING
+	c.broadcastScannerState()
+	c.scannerLock.Unlock()
+	// The scan may only just have been started, in which case the adapter may
+	// not consider itself to be scanning yet.
+	for attempt := 1; ; attempt++ {
+		err := c.adapter.StopScan()
+		if err == nil {
+			break
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(stopScanRetryDelay):
+		}
+		if attempt == stopScanAttempts {
+			c.setScannerState(previous)
+			return err
+		}
+	}
+	<-done
+	return nil
+}
+
+// Handler for a BluetoothScannerSetModeRequest.  BlueZ picks the scan
+// parameters itself, so the mode is only recorded and reported to subscribers;
+// scanning carries on uninterrupted.
+func (c *component) handleBluetoothScannerSetMode(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	req, ok := msg.(*pb.BluetoothScannerSetModeRequest)
+	if !ok {
+		return fmt.Errorf("message is not a BluetoothScannerSetModeRequest")
+	}
+	mode := req.GetMode()
+	if _, ok := pb.BluetoothScannerMode_name[int32(mode)]; !ok {
+		return fmt.Errorf("invalid bluetooth scanner mode %d", mode)
+	}
+	c.scannerLock.Lock()
+	defer c.scannerLock.Unlock()
+	if mode == c.scannerMode {
+		return nil
+	}
+	slog.InfoContext(ctx, "changing reported bluetooth scanner mode", "mode", mode)
+	c.scannerMode = mode
+	c.broadcastScannerState()
+	return nil
+}
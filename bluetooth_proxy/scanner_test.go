@@ -0,0 +1,103 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+func TestConfigureScanner(t *testing.T) {
+	c := &component{config: Configuration{
+		ScanMode:     "passive",
+		ScanInterval: defaultScanInterval,
+		ScanWindow:   defaultScanWindow,
+	}}
+	assert.NilError(t, c.configureScanner())
+	assert.Equal(t, c.scannerMode, pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_PASSIVE)
+	assert.Equal(t, c.scannerState, pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_IDLE)
+
+	c.config.ScanMode = "loud"
+	assert.ErrorContains(t, c.configureScanner(), "invalid scan mode")
+	c.config.ScanMode = "active"
+	c.config.ScanWindow = time.Second
+	assert.ErrorContains(t, c.configureScanner(), "invalid scan window")
+}
+
+func TestBluetoothScannerSetMode(t *testing.T) {
+	var states []*pb.BluetoothScannerStateResponse
+	sub := &subscriber{send: func(msg proto.Message) error {
+		states = append(states, msg.(*pb.BluetoothScannerStateResponse))
+		return nil
+	}}
+	c := &component{
+		scannerMode: pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_ACTIVE,
+		subscribers: map[int]*subscriber{1: sub},
+	}
+	req := &pb.BluetoothScannerSetModeRequest{}
+	req.SetMode(pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_PASSIVE)
+	assert.NilError(t, c.handleBluetoothScannerSetMode(context.Background(), req, nil))
+	assert.Equal(t, len(states), 1)
+	assert.Equal(t, states[0].GetMode(), pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_PASSIVE)
+
+	// Setting the same mode again does nothing.
+	assert.NilError(t, c.handleBluetoothScannerSetMode(context.Background(), req, nil))
+	assert.Equal(t, len(states), 1)
+
+	// Changing the mode while scanning does not interrupt the scan.
+	scanDone := make(chan struct{})
+	c.scanDone = scanDone
+	req.SetMode(pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_ACTIVE)
+	assert.NilError(t, c.handleBluetoothScannerSetMode(context.Background(), req, nil))
+	assert.Equal(t, len(states), 2)
+	assert.Equal(t, states[1].GetMode(), pb.BluetoothScannerMode_BLUETOOTH_SCANNER_MODE_ACTIVE)
+	assert.Equal(t, c.scanDone, scanDone)
+
+	req.SetMode(pb.BluetoothScannerMode(7))
+	assert.ErrorContains(t, c.handleBluetoothScannerSetMode(context.Background(), req, nil), "invalid")
+}
+
+func TestScanningReferenceCounted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	noop := func(proto.Message) error { return nil }
+	c := &component{ctx: ctx, adapter: &failingAdapter{}, subscribers: make(map[int]*subscriber)}
+	scanning := func() bool {
+		c.scannerLock.Lock()
+		defer c.scannerLock.Unlock()
+		return c.scanDone != nil
+	}
+	subscribe := func(id int) *subscriber {
+		sub := &subscriber{send: noop}
+		c.subscribersLock.Lock()
+		c.subscribers[id] = sub
+		c.subscribersLock.Unlock()
+		assert.NilError(t, c.updateScanning())
+		return sub
+	}
+	unsubscribe := func(id int, sub *subscriber) {
+		c.removeSubscriber(id, sub)
+		assert.NilError(t, c.updateScanning())
+	}
+
+	assert.NilError(t, c.updateScanning())
+	assert.Assert(t, !scanning(), "scanning without subscribers")
+	first := subscribe(1)
+	assert.Assert(t, scanning())
+	second := subscribe(2)
+	unsubscribe(1, first)
+	assert.Assert(t, scanning(), "stopped scanning with a subscriber left")
+	unsubscribe(2, second)
+	assert.Assert(t, !scanning(), "still scanning without subscribers")
+	assert.Equal(t, c.scannerState, pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_STOPPED)
+	first = subscribe(1)
+	assert.Assert(t, scanning(), "did not resume scanning")
+	unsubscribe(1, first)
+
+	c.config.AlwaysScan = true
+	assert.NilError(t, c.updateScanning())
+	assert.Assert(t, scanning(), "not scanning despite alwaysscan")
+}
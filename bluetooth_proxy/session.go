@@ -0,0 +1,152 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/mook/mockesphome/api"
+	"google.golang.org/protobuf/proto"
+	"tinygo.org/x/bluetooth"
+)
+
+// ErrNoFreeSlots is returned when a session cannot be opened without taking
+// connection slots needed by clients.
+var ErrNoFreeSlots = errors.New("no free bluetooth connection slots")
+
+// A connection to a device for another component (such as `ble_client`),
+// sharing the adapter and connection slots with API clients.  Clients take
+// priority: the session is closed if a client connects to the same device, or
+// needs its slot.
+type Session struct {
+	c    *component
+	conn *connection
+}
+
+// Connect to a device for another component, waiting for the proxy to start
+// first.  At least the given number of slots are left free for clients.  The
+// session is closed when the context is done.
+func Connect(ctx context.Context, address bluetooth.MAC, reserve int) (*Session, error) {
+	select {
+	case <-instance.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return instance.openSession(ctx, address, reserve)
+}
+
+// Open a session, if there are enough free connection slots.
+func (c *component) openSession(ctx context.Context, address bluetooth.MAC, reserve int) (*Session, error) {
+	conn := &connection{
+		address:  bleAddressToUint64(address),
+		send:     func(proto.Message) error { return nil }, // Nobody to tell
+		cache:    c.cache,
+		shared:   true,
+		released: make(chan struct{}),
+	}
+	c.connectionsLock.Lock()
+	if _, ok := c.connections[conn.address]; ok {
+		c.connectionsLock.Unlock()
+		return nil, fmt.Errorf("device %s is already connected", address)
+	}
+	if c.config.ConnectionSlots-len(c.connections) <= reserve {
+		c.connectionsLock.Unlock()
+		return nil, ErrNoFreeSlots
+	}
+	c.connections[conn.address] = conn
+	conn.stopWatch = context.AfterFunc(ctx, func() { c.disconnect(conn, false) })
+	c.notifyConnectionsFree()
+	c.connectionsLock.Unlock()
+
+	if errorCode, current := c.dial(ctx, conn); errorCode != 0 || !current {
+		return nil, fmt.Errorf("failed to connect to %s", address)
+	}
+	return &Session{c: c, conn: conn}, nil
+}
+
+// Make way for a client to connect to a device, by closing a shared
+// connection: the one to the same device, or else any one if there are no
+// free slots.
+func (c *component) preempt(ctx context.Context, address uint64) {
+	c.connectionsLock.Lock()
+	victim := c.connections[address]
+	if victim == nil || !victim.shared {
+		victim = nil
+		if len(c.connections) >= c.config.ConnectionSlots {
+			for _, conn := range c.connections {
+				if conn.shared {
+					victim = conn
+					break
+				}
+			}
+		}
+	}
+	c.connectionsLock.Unlock()
+	if victim != nil {
+		slog.InfoContext(ctx, "closing shared bluetooth connection for a client", "address", api.FormatAddress(victim.address))
+		c.disconnect(victim, false)
+	}
+}
+
+// Find a characteristic, discovering services if needed.  The connection lock
+// must be held.
+func (s *Session) find(serviceUUID, characteristicUUID bluetooth.UUID) (*gattCharacteristic, error) {
+	if err := s.conn.discover(); err != nil {
+		return nil, err
+	}
+	for _, service := range s.conn.services {
+		if service.uuid != serviceUUID {
+			continue
+		}
+		for _, characteristic := range service.characteristics {
+			if characteristic.uuid == characteristicUUID {
+				return characteristic, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("characteristic %s of service %s not found", characteristicUUID, serviceUUID)
+}
+
+// Read the value of a characteristic.
+func (s *Session) Read(serviceUUID, characteristicUUID bluetooth.UUID) ([]byte, error) {
+	s.conn.lock.Lock()
+	defer s.conn.lock.Unlock()
+	characteristic, err := s.find(serviceUUID, characteristicUUID)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxAttributeSize)
+	n, err := characteristic.characteristic.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Call the callback with each new value of a characteristic, until the
+// session is closed.
+func (s *Session) Notify(serviceUUID, characteristicUUID bluetooth.UUID, callback func([]byte)) error {
+	s.conn.lock.Lock()
+	defer s.conn.lock.Unlock()
+	characteristic, err := s.find(serviceUUID, characteristicUUID)
+	if err != nil {
+		return err
+	}
+	if err := characteristic.characteristic.EnableNotifications(callback); err != nil {
+		return err
+	}
+	characteristic.notifying = true
+	return nil
+}
+
+// Get a channel that is closed when the session is closed, including when a
+// client takes over the connection.
+func (s *Session) Done() <-chan struct{} {
+	return s.conn.released
+}
+
+// Disconnect from the device, if not already done.
+func (s *Session) Close() {
+	s.c.disconnect(s.conn, false)
+}
@@ -0,0 +1,62 @@
+package bluetooth_proxy
+
+import (
+	"testing"
+
+	"github.com/mook/mockesphome/api"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestSession(t *testing.T) {
+	simulated, err := loadSimulation(writeSimulation(t, "simulation.yaml", testSimulation))
+	assert.NilError(t, err)
+	c := &component{
+		config:          Configuration{ConnectionSlots: 2},
+		adapter:         simulated,
+		connections:     make(map[uint64]*connection),
+		slotSubscribers: make(map[int]api.MessageSender),
+		cache:           newGATTCache(),
+	}
+	address, err := bluetooth.ParseMAC("11:22:33:44:55:66")
+	assert.NilError(t, err)
+	other, err := bluetooth.ParseMAC("11:22:33:44:55:77")
+	assert.NilError(t, err)
+
+	sess, err := c.openSession(t.Context(), address, 0)
+	assert.NilError(t, err)
+	value, err := sess.Read(bluetooth.New16BitUUID(0x180F), bluetooth.New16BitUUID(0x2A19))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, value, []byte{0x64})
+	_, err = sess.Read(bluetooth.New16BitUUID(0x180F), bluetooth.New16BitUUID(0x2A1A))
+	assert.ErrorContains(t, err, "not found")
+
+	// Only one slot is free, and it is reserved for clients.
+	_, err = c.openSession(t.Context(), other, 1)
+	assert.ErrorIs(t, err, ErrNoFreeSlots)
+	_, err = c.openSession(t.Context(), address, 0)
+	assert.ErrorContains(t, err, "already connected")
+
+	// A client connecting to the same device takes over.
+	c.preempt(t.Context(), bleAddressToUint64(address))
+	select {
+	case <-sess.Done():
+	default:
+		t.Fatal("session was not closed")
+	}
+	assert.Equal(t, len(c.connections), 0)
+	_, err = sess.Read(bluetooth.New16BitUUID(0x180F), bluetooth.New16BitUUID(0x2A19))
+	assert.ErrorContains(t, err, "not connected")
+
+	// So does a client needing a slot, once they are all taken.
+	sess, err = c.openSession(t.Context(), address, 0)
+	assert.NilError(t, err)
+	c.preempt(t.Context(), bleAddressToUint64(other))
+	assert.Equal(t, len(c.connections), 1, "session closed with a free slot")
+	c.connections[0x1234] = &connection{address: 0x1234}
+	c.preempt(t.Context(), bleAddressToUint64(other))
+	assert.Equal(t, len(c.connections), 1)
+	_, ok := c.connections[0x1234]
+	assert.Assert(t, ok, "client connection was closed")
+	sess.Close() // Closing again does nothing
+}
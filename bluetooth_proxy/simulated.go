@@ -0,0 +1,515 @@
+package bluetooth_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	defaultSimulatedAddress  = "02:00:00:00:00:01" // Locally administered
+	defaultSimulatedRSSI     = -60
+	defaultSimulatedInterval = time.Second
+)
+
+var errNotConnected = errors.New("device is not connected")
+
+// Binary data, written as a hex string in simulation files.
+type hexBytes []byte
+
+func (b *hexBytes) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// A simulated device, as described in a simulation file.
+type simulatedDeviceConfig struct {
+	Address      string        `yaml:"address"`
+	Random       bool          `yaml:"random"` // Whether the address is a random one
+	Name         string        `yaml:"name"`
+	RSSI         *int16        `yaml:"rssi"`
+	Interval     time.Duration `yaml:"interval"` // Time between advertisements
+	Delay        time.Duration `yaml:"delay"`    // Time before the first advertisement
+	Count        int           `yaml:"count"`    // Number of advertisements to send; 0 for no limit
+	ServiceUUIDs []string      `yaml:"service_uuids"`
+	ServiceData  []struct {
+		UUID string   `yaml:"uuid"`
+		Data hexBytes `yaml:"data"`
+	} `yaml:"service_data"`
+	ManufacturerData []struct {
+		Company uint16   `yaml:"company"`
+		Data    hexBytes `yaml:"data"`
+	} `yaml:"manufacturer_data"`
+	Data         hexBytes `yaml:"data"`          // Raw advertising data, instead of the fields above
+	ScanResponse hexBytes `yaml:"scan_response"` // Raw scan response data, sent after each advertisement
+	Services     []struct {
+		UUID            string `yaml:"uuid"`
+		Characteristics []struct {
+			UUID           string        `yaml:"uuid"`
+			Properties     []string      `yaml:"properties"`
+			Value          hexBytes      `yaml:"value"`
+			NotifyInterval time.Duration `yaml:"notify_interval"` // Time between notifications of the current value
+		} `yaml:"characteristics"`
+	} `yaml:"services"`
+}
+
+// The contents of a YAML simulation file.
+type simulationConfig struct {
+	Address string                  `yaml:"address"` // Address of the simulated adapter
+	Devices []simulatedDeviceConfig `yaml:"devices"`
+}
+
+// Characteristic property names used in simulation files.
+var simulatedProperties = map[string]uint32{
+	"read":                   gattPropertyRead,
+	"write_without_response": gattPropertyWriteWithoutResponse,
+	"write":                  gattPropertyWrite,
+	"notify":                 gattPropertyNotify,
+}
+
+// An adapter with scripted devices, for use without bluetooth hardware.
+type simulatedAdapter struct {
+	address bluetooth.MACAddress
+	devices []*simulatedDevice
+
+	lock   sync.Mutex
+	stop   chan struct{} // Closed to stop scanning; nil if not scanning
+	paired map[bluetooth.MAC]bool
+}
+
+// A simulated device, which advertises periodically and may be connected to.
+type simulatedDevice struct {
+	address      bluetooth.Address
+	rssi         int16
+	interval     time.Duration
+	delay        time.Duration
+	count        int
+	payload      *advertisementPayload
+	scanResponse *advertisementPayload // Nil if the device has no scan response
+	services     []*simulatedService
+
+	lock      sync.Mutex
+	connected bool
+}
+
+type simulatedService struct {
+	uuid            bluetooth.UUID
+	characteristics []*simulatedCharacteristic
+}
+
+type simulatedCharacteristic struct {
+	device         *simulatedDevice
+	uuid           bluetooth.UUID
+	properties     uint32
+	notifyInterval time.Duration
+
+	lock       sync.Mutex
+	value      []byte
+	notify     func([]byte)  // Notification callback, if enabled
+	stopNotify chan struct{} // Closed to stop periodic notifications
+}
+
+// Parse a UUID, which may be a 16 or 32 bit short form.
+func ParseUUID(s string) (bluetooth.UUID, error) {
+	switch len(s) {
+	case 4, 8:
+		short, err := strconv.ParseUint(s, 16, 32)
+		if err != nil {
+			return bluetooth.UUID{}, fmt.Errorf("invalid UUID %q: %w", s, err)
+		}
+		return bluetooth.New32BitUUID(uint32(short)), nil
+	}
+	uuid, err := bluetooth.ParseUUID(s)
+	if err != nil {
+		return bluetooth.UUID{}, fmt.Errorf("invalid UUID %q: %w", s, err)
+	}
+	return uuid, nil
+}
+
+// Read a simulation file: either YAML describing the adapter and its devices,
+// or (if the name ends in `.jsonl`) one JSON device per line.
+func loadSimulation(path string) (*simulatedAdapter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read simulation: %w", err)
+	}
+	var config simulationConfig
+	if filepath.Ext(path) == ".jsonl" {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var device simulatedDeviceConfig
+			if err := yaml.UnmarshalWithOptions(scanner.Bytes(), &device, yaml.DisallowUnknownField()); err != nil {
+				return nil, fmt.Errorf("failed to parse simulation line %d: %w", line, err)
+			}
+			config.Devices = append(config.Devices, device)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read simulation: %w", err)
+		}
+	} else if err := yaml.UnmarshalWithOptions(data, &config, yaml.DisallowUnknownField()); err != nil {
+		return nil, fmt.Errorf("failed to parse simulation: %w", err)
+	}
+	return newSimulatedAdapter(config)
+}
+
+// Create a simulated adapter from its description.
+func newSimulatedAdapter(config simulationConfig) (*simulatedAdapter, error) {
+	if config.Address == "" {
+		config.Address = defaultSimulatedAddress
+	}
+	mac, err := bluetooth.ParseMAC(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid simulated adapter address %q: %w", config.Address, err)
+	}
+	a := &simulatedAdapter{
+		address: bluetooth.MACAddress{MAC: mac},
+		paired:  make(map[bluetooth.MAC]bool),
+	}
+	for i, deviceConfig := range config.Devices {
+		device, err := newSimulatedDevice(deviceConfig)
+		if err != nil {
+			return nil, fmt.Errorf("simulated device %d: %w", i, err)
+		}
+		a.devices = append(a.devices, device)
+	}
+	return a, nil
+}
+
+func newSimulatedDevice(config simulatedDeviceConfig) (*simulatedDevice, error) {
+	mac, err := bluetooth.ParseMAC(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", config.Address, err)
+	}
+	d := &simulatedDevice{
+		rssi:     defaultSimulatedRSSI,
+		interval: config.Interval,
+		delay:    config.Delay,
+		count:    config.Count,
+		payload:  &advertisementPayload{},
+	}
+	d.address.MAC = mac
+	d.address.SetRandom(config.Random)
+	if config.RSSI != nil {
+		d.rssi = *config.RSSI
+	}
+	if d.interval <= 0 {
+		d.interval = defaultSimulatedInterval
+	}
+	d.payload.AdvertisementFields.LocalName = config.Name
+	for _, s := range config.ServiceUUIDs {
+		uuid, err := ParseUUID(s)
+		if err != nil {
+			return nil, err
+		}
+		d.payload.ServiceUUIDs = append(d.payload.ServiceUUIDs, uuid)
+	}
+	for _, sd := range config.ServiceData {
+		uuid, err := ParseUUID(sd.UUID)
+		if err != nil {
+			return nil, err
+		}
+		d.payload.AdvertisementFields.ServiceData = append(d.payload.AdvertisementFields.ServiceData, bluetooth.ServiceDataElement{UUID: uuid, Data: sd.Data})
+	}
+	for _, md := range config.ManufacturerData {
+		d.payload.AdvertisementFields.ManufacturerData = append(d.payload.AdvertisementFields.ManufacturerData,
+			bluetooth.ManufacturerDataElement{CompanyID: md.Company, Data: md.Data})
+	}
+	if config.Data != nil {
+		d.payload.AdvertisementFields = parseAdvertisingData(config.Data)
+		d.payload.raw = config.Data
+	} else {
+		d.payload.raw = rawAdvertisementData(bluetooth.ScanResult{AdvertisementPayload: d.payload})
+	}
+	if config.ScanResponse != nil {
+		d.scanResponse = &advertisementPayload{
+			AdvertisementFields: parseAdvertisingData(config.ScanResponse),
+			raw:                 config.ScanResponse,
+			scanResponse:        true,
+		}
+	}
+	for _, serviceConfig := range config.Services {
+		uuid, err := ParseUUID(serviceConfig.UUID)
+		if err != nil {
+			return nil, err
+		}
+		s := &simulatedService{uuid: uuid}
+		for _, characteristicConfig := range serviceConfig.Characteristics {
+			uuid, err := ParseUUID(characteristicConfig.UUID)
+			if err != nil {
+				return nil, err
+			}
+			c := &simulatedCharacteristic{
+				device:         d,
+				uuid:           uuid,
+				value:          characteristicConfig.Value,
+				notifyInterval: characteristicConfig.NotifyInterval,
+			}
+			for _, name := range characteristicConfig.Properties {
+				property, ok := simulatedProperties[name]
+				if !ok {
+					return nil, fmt.Errorf("characteristic %s: unknown property %q", uuid, name)
+				}
+				c.properties |= property
+			}
+			s.characteristics = append(s.characteristics, c)
+		}
+		d.services = append(d.services, s)
+	}
+	return d, nil
+}
+
+func (a *simulatedAdapter) Enable() error {
+	return nil
+}
+
+func (a *simulatedAdapter) Address() (bluetooth.MACAddress, error) {
+	return a.address, nil
+}
+
+// Send each device's advertisements on its schedule until stopped.
+func (a *simulatedAdapter) Scan(callback func(bluetooth.ScanResult)) error {
+	a.lock.Lock()
+	if a.stop != nil {
+		a.lock.Unlock()
+		return fmt.Errorf("already scanning")
+	}
+	stop := make(chan struct{})
+	a.stop = stop
+	a.lock.Unlock()
+
+	started := time.Now()
+	next := make([]time.Time, len(a.devices))
+	remaining := make([]int, len(a.devices))
+	for i, device := range a.devices {
+		next[i] = started.Add(device.delay)
+		remaining[i] = device.count
+	}
+	for {
+		// Find the device due to advertise next.
+		due := -1
+		for i := range a.devices {
+			if a.devices[i].count > 0 && remaining[i] == 0 {
+				continue
+			}
+			if due < 0 || next[i].Before(next[due]) {
+				due = i
+			}
+		}
+		var timer <-chan time.Time
+		if due >= 0 {
+			timer = time.After(time.Until(next[due]))
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-timer:
+		}
+		device := a.devices[due]
+		callback(bluetooth.ScanResult{
+			Address:              device.address,
+			RSSI:                 device.rssi,
+			AdvertisementPayload: device.payload,
+		})
+		if device.scanResponse != nil {
+			callback(bluetooth.ScanResult{
+				Address:              device.address,
+				RSSI:                 device.rssi,
+				AdvertisementPayload: device.scanResponse,
+			})
+		}
+		next[due] = next[due].Add(device.interval)
+		remaining[due]--
+	}
+}
+
+func (a *simulatedAdapter) StopScan() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.stop == nil {
+		return fmt.Errorf("not scanning")
+	}
+	close(a.stop)
+	a.stop = nil
+	return nil
+}
+
+// Find the simulated device with the given address.
+func (a *simulatedAdapter) device(address bluetooth.Address) (*simulatedDevice, error) {
+	for _, device := range a.devices {
+		if device.address.MAC == address.MAC {
+			return device, nil
+		}
+	}
+	return nil, fmt.Errorf("no simulated device %s", address.MAC)
+}
+
+func (a *simulatedAdapter) Connect(address bluetooth.Address) (device, error) {
+	d, err := a.device(address)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.connected {
+		return nil, fmt.Errorf("device %s is already connected", address.MAC)
+	}
+	d.connected = true
+	return d, nil
+}
+
+func (a *simulatedAdapter) Pair(ctx context.Context, address bluetooth.Address) error {
+	d, err := a.device(address)
+	if err != nil {
+		return err
+	}
+	if !d.isConnected() {
+		return errNotConnected
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.paired[address.MAC] = true
+	return nil
+}
+
+func (a *simulatedAdapter) Unpair(ctx context.Context, address bluetooth.Address) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.paired, address.MAC)
+	return nil
+}
+
+func (d *simulatedDevice) isConnected() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.connected
+}
+
+func (d *simulatedDevice) DiscoverServices() ([]service, error) {
+	if !d.isConnected() {
+		return nil, errNotConnected
+	}
+	var result []service
+	for _, s := range d.services {
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+func (d *simulatedDevice) Disconnect() error {
+	d.lock.Lock()
+	if !d.connected {
+		d.lock.Unlock()
+		return errNotConnected
+	}
+	d.connected = false
+	d.lock.Unlock()
+	for _, s := range d.services {
+		for _, c := range s.characteristics {
+			_ = c.EnableNotifications(nil)
+		}
+	}
+	return nil
+}
+
+func (s *simulatedService) UUID() bluetooth.UUID {
+	return s.uuid
+}
+
+func (s *simulatedService) DiscoverCharacteristics() ([]characteristic, error) {
+	var result []characteristic
+	for _, c := range s.characteristics {
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func (c *simulatedCharacteristic) UUID() bluetooth.UUID {
+	return c.uuid
+}
+
+func (c *simulatedCharacteristic) Properties() uint32 {
+	return c.properties
+}
+
+func (c *simulatedCharacteristic) Read(data []byte) (int, error) {
+	if !c.device.isConnected() {
+		return 0, errNotConnected
+	}
+	if c.properties&gattPropertyRead == 0 {
+		return 0, fmt.Errorf("characteristic %s is not readable", c.uuid)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return copy(data, c.value), nil
+}
+
+// Replace the value; if notifications are enabled, the new value is sent.
+func (c *simulatedCharacteristic) WriteWithoutResponse(data []byte) (int, error) {
+	if !c.device.isConnected() {
+		return 0, errNotConnected
+	}
+	if c.properties&(gattPropertyWrite|gattPropertyWriteWithoutResponse) == 0 {
+		return 0, fmt.Errorf("characteristic %s is not writable", c.uuid)
+	}
+	c.lock.Lock()
+	c.value = slices.Clone(data)
+	notify := c.notify
+	c.lock.Unlock()
+	if notify != nil {
+		notify(slices.Clone(data))
+	}
+	return len(data), nil
+}
+
+func (c *simulatedCharacteristic) EnableNotifications(callback func(data []byte)) error {
+	if callback != nil && c.properties&gattPropertyNotify == 0 {
+		return fmt.Errorf("characteristic %s does not support notifications", c.uuid)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopNotify != nil {
+		close(c.stopNotify)
+		c.stopNotify = nil
+	}
+	c.notify = callback
+	if callback == nil || c.notifyInterval <= 0 {
+		return nil
+	}
+	stop := make(chan struct{})
+	c.stopNotify = stop
+	go func() {
+		ticker := time.NewTicker(c.notifyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			c.lock.Lock()
+			value := slices.Clone(c.value)
+			c.lock.Unlock()
+			callback(value)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,235 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"github.com/mook/mockesphome/client"
+	"github.com/mook/mockesphome/components"
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+const testSimulation = `
+address: 02:00:00:00:00:99
+devices:
+  - address: 11:22:33:44:55:66
+    name: thermometer
+    rssi: -42
+    interval: 20ms
+    service_uuids: [180f]
+    manufacturer_data:
+      - company: 0x004c
+        data: "0215"
+    services:
+      - uuid: 180f
+        characteristics:
+          - uuid: 2a19
+            properties: [read, notify]
+            value: "64"
+          - uuid: 2a6e
+            properties: [read, write, notify]
+            value: "0000"
+`
+
+// Write a simulation file, returning its path.
+func writeSimulation(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NilError(t, os.WriteFile(path, []byte(contents), 0o644))
+	return path
+}
+
+func TestLoadSimulation(t *testing.T) {
+	a, err := loadSimulation(writeSimulation(t, "simulation.yaml", testSimulation))
+	assert.NilError(t, err)
+	address, err := a.Address()
+	assert.NilError(t, err)
+	assert.Equal(t, address.String(), "02:00:00:00:00:99")
+	assert.Equal(t, len(a.devices), 1)
+	device := a.devices[0]
+	assert.Equal(t, device.address.MAC.String(), "11:22:33:44:55:66")
+	assert.Equal(t, device.rssi, int16(-42))
+	assert.Equal(t, device.interval, 20*time.Millisecond)
+	assert.Equal(t, device.payload.LocalName(), "thermometer")
+	assert.DeepEqual(t, device.payload.ServiceUUIDs, []bluetooth.UUID{bluetooth.New16BitUUID(0x180F)})
+	assert.DeepEqual(t, device.payload.ManufacturerData(), []bluetooth.ManufacturerDataElement{{CompanyID: 0x004C, Data: []byte{0x02, 0x15}}})
+	assert.Equal(t, len(device.services), 1)
+	characteristics := device.services[0].characteristics
+	assert.Equal(t, len(characteristics), 2)
+	assert.Equal(t, characteristics[0].properties, uint32(gattPropertyRead|gattPropertyNotify))
+	assert.DeepEqual(t, characteristics[0].value, []byte{0x64})
+
+	jsonl := `{"address": "11:22:33:44:55:66", "random": true, "interval": "1s", "count": 2}
+
+{"address": "11:22:33:44:55:77", "data": "020106", "scan_response": "03096869"}
+`
+	a, err = loadSimulation(writeSimulation(t, "simulation.jsonl", jsonl))
+	assert.NilError(t, err)
+	assert.Equal(t, len(a.devices), 2)
+	assert.Assert(t, a.devices[0].address.IsRandom())
+	assert.Equal(t, a.devices[0].count, 2)
+	assert.DeepEqual(t, a.devices[1].payload.Bytes(), []byte{0x02, 0x01, 0x06})
+	assert.Equal(t, a.devices[1].scanResponse.LocalName(), "hi")
+	assert.Assert(t, a.devices[1].scanResponse.scanResponse)
+
+	_, err = loadSimulation(writeSimulation(t, "bad.jsonl", `{"address": "11:22:33:44:55:66", "colour": "red"}`))
+	assert.ErrorContains(t, err, "line 1")
+	_, err = loadSimulation(writeSimulation(t, "bad.yaml", "devices: [{address: nope}]"))
+	assert.ErrorContains(t, err, "invalid address")
+}
+
+func TestSimulatedScan(t *testing.T) {
+	a, err := newSimulatedAdapter(simulationConfig{Devices: []simulatedDeviceConfig{
+		{Address: "11:22:33:44:55:66", Interval: 10 * time.Millisecond, Count: 3},
+		{Address: "11:22:33:44:55:77", Delay: time.Hour},
+	}})
+	assert.NilError(t, err)
+	results := make(chan bluetooth.ScanResult, 10)
+	done := make(chan error)
+	go func() { done <- a.Scan(func(result bluetooth.ScanResult) { results <- result }) }()
+	for range 3 {
+		result := <-results
+		assert.Equal(t, result.Address.MAC.String(), "11:22:33:44:55:66")
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, len(results), 0, "too many advertisements")
+	assert.NilError(t, a.StopScan())
+	assert.NilError(t, <-done)
+}
+
+// Run the whole proxy against a simulated adapter, talking to it as Home
+// Assistant would.
+func TestSimulatedProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	assert.NilError(t, listener.Close())
+	simulation := writeSimulation(t, "simulation.yaml", testSimulation)
+	config := fmt.Sprintf("api:\n  port: %d\nbluetooth_proxy:\n  simulation: %s\n", port, simulation)
+	assert.NilError(t, components.LoadConfiguration(ctx, strings.NewReader(config)))
+	assert.NilError(t, components.StartComponents(ctx))
+
+	conn, err := client.Dial(ctx, fmt.Sprintf("127.0.0.1:%d", port), "", nil)
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	info, err := conn.DeviceInfo()
+	assert.NilError(t, err)
+	assert.Equal(t, info.GetBluetoothMacAddress(), "02:00:00:00:00:99")
+	assert.Assert(t, info.GetBluetoothProxyFeatureFlags()&uint32(proxyFeatureActiveConnections) != 0)
+
+	// Advertisements
+	subscribe := &pb.SubscribeBluetoothLEAdvertisementsRequest{}
+	subscribe.SetFlags(uint32(proxySubscriptionRawAdvertisements))
+	assert.NilError(t, conn.Send(subscribe))
+	batch, err := client.Receive[*pb.BluetoothLERawAdvertisementsResponse](conn)
+	assert.NilError(t, err)
+	adv := batch.GetAdvertisements()[0]
+	assert.Equal(t, adv.GetAddress(), uint64(0x112233445566))
+	assert.Equal(t, adv.GetRssi(), int32(-42))
+
+	// Unsubscribing only affects that client, and later subscriptions still
+	// get advertisements.
+	other, err := client.Dial(ctx, fmt.Sprintf("127.0.0.1:%d", port), "", nil)
+	assert.NilError(t, err)
+	defer other.Close()
+	assert.NilError(t, other.Send(&pb.SubscribeBluetoothLEAdvertisementsRequest{}))
+	assert.NilError(t, conn.Send(&pb.UnsubscribeBluetoothLEAdvertisementsRequest{}))
+	parsed, err := client.Receive[*pb.BluetoothLEAdvertisementResponse](other)
+	assert.NilError(t, err)
+	assert.Equal(t, parsed.GetName(), "thermometer")
+	assert.NilError(t, other.Send(&pb.UnsubscribeBluetoothLEAdvertisementsRequest{}))
+	assert.NilError(t, conn.Send(subscribe))
+	_, err = client.Receive[*pb.BluetoothLERawAdvertisementsResponse](conn)
+	assert.NilError(t, err)
+	assert.NilError(t, conn.Send(&pb.UnsubscribeBluetoothLEAdvertisementsRequest{}))
+
+	// Connection slots
+	assert.NilError(t, conn.Send(&pb.SubscribeBluetoothConnectionsFreeRequest{}))
+	free, err := client.Receive[*pb.BluetoothConnectionsFreeResponse](conn)
+	assert.NilError(t, err)
+	assert.Equal(t, free.GetFree(), uint32(defaultConnectionSlots))
+
+	// Connecting
+	connect := &pb.BluetoothDeviceRequest{}
+	connect.SetAddress(0x112233445566)
+	connect.SetRequestType(pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_CONNECT_V3_WITH_CACHE)
+	assert.NilError(t, conn.Send(connect))
+	free, err = client.Receive[*pb.BluetoothConnectionsFreeResponse](conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, free.GetAllocated(), []uint64{0x112233445566})
+	connected, err := client.Receive[*pb.BluetoothDeviceConnectionResponse](conn)
+	assert.NilError(t, err)
+	assert.Assert(t, connected.GetConnected())
+
+	// Services
+	getServices := &pb.BluetoothGATTGetServicesRequest{}
+	getServices.SetAddress(0x112233445566)
+	assert.NilError(t, conn.Send(getServices))
+	services, err := client.Receive[*pb.BluetoothGATTGetServicesResponse](conn)
+	assert.NilError(t, err)
+	characteristics := services.GetServices()[0].GetCharacteristics()
+	assert.Equal(t, len(characteristics), 2)
+	battery, temperature := characteristics[0].GetHandle(), characteristics[1].GetHandle()
+	_, err = client.Receive[*pb.BluetoothGATTGetServicesDoneResponse](conn)
+	assert.NilError(t, err)
+
+	read := &pb.BluetoothGATTReadRequest{}
+	read.SetAddress(0x112233445566)
+	read.SetHandle(battery)
+	assert.NilError(t, conn.Send(read))
+	value, err := client.Receive[*pb.BluetoothGATTReadResponse](conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, value.GetData(), []byte{0x64})
+
+	notify := &pb.BluetoothGATTNotifyRequest{}
+	notify.SetAddress(0x112233445566)
+	notify.SetHandle(temperature)
+	notify.SetEnable(true)
+	assert.NilError(t, conn.Send(notify))
+	_, err = client.Receive[*pb.BluetoothGATTNotifyResponse](conn)
+	assert.NilError(t, err)
+
+	write := &pb.BluetoothGATTWriteRequest{}
+	write.SetAddress(0x112233445566)
+	write.SetHandle(temperature)
+	write.SetData([]byte{0x12, 0x34})
+	write.SetResponse(true)
+	assert.NilError(t, conn.Send(write))
+	data, err := client.Receive[*pb.BluetoothGATTNotifyDataResponse](conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, data.GetData(), []byte{0x12, 0x34})
+	_, err = client.Receive[*pb.BluetoothGATTWriteResponse](conn)
+	assert.NilError(t, err)
+
+	// Pairing
+	pair := &pb.BluetoothDeviceRequest{}
+	pair.SetAddress(0x112233445566)
+	pair.SetRequestType(pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_PAIR)
+	assert.NilError(t, conn.Send(pair))
+	paired, err := client.Receive[*pb.BluetoothDevicePairingResponse](conn)
+	assert.NilError(t, err)
+	assert.Assert(t, paired.GetPaired())
+
+	// Disconnecting
+	disconnect := &pb.BluetoothDeviceRequest{}
+	disconnect.SetAddress(0x112233445566)
+	disconnect.SetRequestType(pb.BluetoothDeviceRequestType_BLUETOOTH_DEVICE_REQUEST_TYPE_DISCONNECT)
+	assert.NilError(t, conn.Send(disconnect))
+	free, err = client.Receive[*pb.BluetoothConnectionsFreeResponse](conn)
+	assert.NilError(t, err)
+	assert.Equal(t, free.GetFree(), uint32(defaultConnectionSlots))
+	connected, err = client.Receive[*pb.BluetoothDeviceConnectionResponse](conn)
+	assert.NilError(t, err)
+	assert.Assert(t, !connected.GetConnected())
+}
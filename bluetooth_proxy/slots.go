@@ -0,0 +1,59 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Describe the connection slots in use.  The connections lock must be held.
+func (c *component) connectionsFreeResponse() *pb.BluetoothConnectionsFreeResponse {
+	resp := &pb.BluetoothConnectionsFreeResponse{}
+	resp.SetLimit(uint32(c.config.ConnectionSlots))
+	resp.SetFree(uint32(max(c.config.ConnectionSlots-len(c.connections), 0)))
+	resp.SetAllocated(slices.Sorted(maps.Keys(c.connections)))
+	return resp
+}
+
+// Tell every interested client about the connection slots in use.  This must
+// be called with the connections lock held, whenever a slot is allocated or
+// released, so that clients see the changes in order.
+func (c *component) notifyConnectionsFree() {
+	resp := c.connectionsFreeResponse()
+	for _, send := range c.slotSubscribers {
+		if err := send(resp); err != nil {
+			slog.Error("failed to send bluetooth connection slots", "error", err)
+		}
+	}
+}
+
+func (c *component) handleSubscribeBluetoothConnectionsFree(ctx context.Context, msg proto.Message, _ api.MessageSender) error {
+	if _, ok := msg.(*pb.SubscribeBluetoothConnectionsFreeRequest); !ok {
+		return fmt.Errorf("message is not a SubscribeBluetoothConnectionsFreeRequest")
+	}
+	id, err := api.ClientID(ctx)
+	if err != nil {
+		return err
+	}
+	send, err := api.ClientSender(ctx)
+	if err != nil {
+		return err
+	}
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
+	if _, ok := c.slotSubscribers[id]; !ok {
+		context.AfterFunc(ctx, func() {
+			c.connectionsLock.Lock()
+			defer c.connectionsLock.Unlock()
+			delete(c.slotSubscribers, id)
+		})
+	}
+	c.slotSubscribers[id] = send
+	return send(c.connectionsFreeResponse())
+}
@@ -0,0 +1,39 @@
+package bluetooth_proxy
+
+import (
+	"testing"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+func TestConnectionsFree(t *testing.T) {
+	var updates []*pb.BluetoothConnectionsFreeResponse
+	first := &connection{address: 0x2000}
+	c := &component{
+		config:      Configuration{ConnectionSlots: 3},
+		connections: map[uint64]*connection{0x2000: first, 0x1000: {address: 0x1000}},
+		slotSubscribers: map[int]api.MessageSender{
+			1: func(msg proto.Message) error {
+				updates = append(updates, msg.(*pb.BluetoothConnectionsFreeResponse))
+				return nil
+			},
+		},
+	}
+
+	resp := c.connectionsFreeResponse()
+	assert.Equal(t, resp.GetLimit(), uint32(3))
+	assert.Equal(t, resp.GetFree(), uint32(1))
+	assert.DeepEqual(t, resp.GetAllocated(), []uint64{0x1000, 0x2000})
+
+	assert.Assert(t, c.release(first))
+	assert.Equal(t, len(updates), 1)
+	assert.Equal(t, updates[0].GetFree(), uint32(2))
+	assert.DeepEqual(t, updates[0].GetAllocated(), []uint64{0x1000})
+
+	// Releasing again does not free another slot.
+	assert.Assert(t, !c.release(first))
+	assert.Equal(t, len(updates), 1)
+}
@@ -0,0 +1,125 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+)
+
+const (
+	defaultStallTimeout = 5 * time.Minute
+	defaultMinBackoff   = time.Second
+	defaultMaxBackoff   = time.Minute
+	supervisorInterval  = time.Second // Longest time between checks on the scanner
+	adapterCheckTimeout = 5 * time.Second
+)
+
+// Check the recovery configuration.
+func (c *component) configureRecovery() error {
+	r := &c.config.Recovery
+	if r.StallTimeout < 0 {
+		return fmt.Errorf("invalid stall timeout %s", r.StallTimeout)
+	}
+	if r.MinBackoff <= 0 || r.MaxBackoff < r.MinBackoff {
+		return fmt.Errorf("invalid recovery backoff %s to %s", r.MinBackoff, r.MaxBackoff)
+	}
+	return nil
+}
+
+// Find out whether scanning needs to be restarted, returning the reason if
+// so.  Scans that were stopped on purpose, or that nothing needs, are left
+// alone.
+func (c *component) scanProblem(ctx context.Context, now time.Time) string {
+	if !c.scanWanted() {
+		return ""
+	}
+	c.scannerLock.Lock()
+	state, started := c.scannerState, c.scanStarted
+	c.scannerLock.Unlock()
+	switch state {
+	case pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_FAILED:
+		return "scan failed"
+	case pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_RUNNING:
+	default:
+		return ""
+	}
+	if checker, ok := c.adapter.(checkingAdapter); ok {
+		ctx, cancel := context.WithTimeout(ctx, adapterCheckTimeout)
+		defer cancel()
+		if err := checker.Check(ctx); err != nil {
+			return err.Error()
+		}
+	}
+	if timeout := c.config.Recovery.StallTimeout; timeout > 0 {
+		last := time.Unix(0, c.lastResult.Load())
+		if last.Before(started) {
+			last = started
+		}
+		if now.Sub(last) >= timeout {
+			return fmt.Sprintf("no advertisements for %s", timeout)
+		}
+	}
+	return ""
+}
+
+// Watch the scanner until the context is done, restarting it (re-enabling
+// the adapter first) whenever it fails or stalls.  Retries back off
+// exponentially until an advertisement is received again.
+func (c *component) supervise(ctx context.Context) {
+	recovery := c.config.Recovery
+	ticker := time.NewTicker(min(supervisorInterval, recovery.MinBackoff))
+	defer ticker.Stop()
+	backoff := recovery.MinBackoff
+	var failed time.Time // When scanning stopped working, if not yet recovered
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		problem := c.scanProblem(ctx, now)
+		if problem == "" {
+			if !failed.IsZero() && time.Unix(0, c.lastResult.Load()).After(failed) {
+				slog.InfoContext(ctx, "bluetooth scanning recovered", "downtime", now.Sub(failed).Round(time.Millisecond))
+				failed = time.Time{}
+				backoff = recovery.MinBackoff
+			}
+			continue
+		}
+		if failed.IsZero() {
+			failed = now
+		}
+		slog.WarnContext(ctx, "bluetooth scanning stopped working, restarting", "reason", problem, "backoff", backoff)
+		c.scanControlLock.Lock()
+		if err := c.stopScanning(); err != nil {
+			slog.ErrorContext(ctx, "failed to stop bluetooth scan", "error", err)
+		}
+		c.scannerLock.Lock()
+		if c.scannerState != pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_FAILED {
+			c.scannerState = pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_FAILED
+			c.broadcastScannerState()
+		}
+		c.scannerLock.Unlock()
+		c.scanControlLock.Unlock()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, recovery.MaxBackoff)
+			err := c.adapter.Enable()
+			if err == nil {
+				break
+			}
+			slog.ErrorContext(ctx, "failed to re-enable bluetooth adapter", "error", err, "backoff", backoff)
+		}
+		if err := c.updateScanning(); err != nil {
+			slog.ErrorContext(ctx, "failed to update bluetooth scan", "error", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+	"tinygo.org/x/bluetooth"
+)
+
+// An adapter that fails on demand.
+type failingAdapter struct {
+	lock      sync.Mutex
+	enables   int
+	enableErr error // Returned by Enable
+	checkErr  error // Returned by Check
+	stop      chan struct{}
+	callback  func(bluetooth.ScanResult)
+	fail      chan error // Sending ends the current scan with the error
+}
+
+func (a *failingAdapter) Enable() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.enables++
+	return a.enableErr
+}
+
+func (a *failingAdapter) Address() (bluetooth.MACAddress, error) {
+	return bluetooth.MACAddress{}, nil
+}
+
+func (a *failingAdapter) Scan(callback func(bluetooth.ScanResult)) error {
+	stop := make(chan struct{})
+	a.lock.Lock()
+	a.stop, a.callback = stop, callback
+	a.lock.Unlock()
+	select {
+	case <-stop:
+		return nil
+	case err := <-a.fail:
+		return err
+	}
+}
+
+func (a *failingAdapter) StopScan() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.stop == nil {
+		return errors.New("not scanning")
+	}
+	close(a.stop)
+	a.stop = nil
+	return nil
+}
+
+func (a *failingAdapter) Connect(address bluetooth.Address) (device, error) {
+	return nil, errors.New("cannot connect")
+}
+
+func (a *failingAdapter) Check(ctx context.Context) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.checkErr
+}
+
+func (a *failingAdapter) set(fn func()) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	fn()
+}
+
+func TestSupervisor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := &failingAdapter{fail: make(chan error)}
+	var statesLock sync.Mutex
+	var states []pb.BluetoothScannerState
+	sub := &subscriber{send: func(msg proto.Message) error {
+		if resp, ok := msg.(*pb.BluetoothScannerStateResponse); ok {
+			statesLock.Lock()
+			states = append(states, resp.GetState())
+			statesLock.Unlock()
+		}
+		return nil
+	}}
+	c := &component{ctx: ctx, adapter: a, subscribers: map[int]*subscriber{1: sub}}
+	c.config.Recovery.StallTimeout = 300 * time.Millisecond
+	c.config.Recovery.MinBackoff = 10 * time.Millisecond
+	c.config.Recovery.MaxBackoff = 40 * time.Millisecond
+	assert.NilError(t, c.configureRecovery())
+
+	// Wait for the scanner to be running, after the adapter was enabled the
+	// given number of times.
+	waitForRecovery := func(enables int) {
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			c.scannerLock.Lock()
+			state := c.scannerState
+			c.scannerLock.Unlock()
+			a.lock.Lock()
+			defer a.lock.Unlock()
+			if a.enables < enables || state != pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_RUNNING {
+				return poll.Continue("enabled %d times, scanner %s", a.enables, state)
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second), poll.WithDelay(5*time.Millisecond))
+	}
+
+	assert.NilError(t, c.updateScanning())
+	go c.supervise(ctx)
+	waitForRecovery(0)
+
+	// A failed scan is restarted.
+	a.fail <- errors.New("adapter reset")
+	waitForRecovery(1)
+	statesLock.Lock()
+	assert.Assert(t, len(states) >= 2)
+	assert.Equal(t, states[len(states)-2], pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_STARTING)
+	assert.Assert(t, slices.Contains(states, pb.BluetoothScannerState_BLUETOOTH_SCANNER_STATE_FAILED))
+	statesLock.Unlock()
+
+	// A missing adapter is retried until it comes back.
+	a.set(func() {
+		a.checkErr = errors.New("adapter removed")
+		a.enableErr = errors.New("adapter removed")
+	})
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.enables < 4 {
+			return poll.Continue("enabled %d times", a.enables)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(5*time.Millisecond))
+	a.set(func() {
+		a.checkErr = nil
+		a.enableErr = nil
+	})
+	a.lock.Lock()
+	enables := a.enables
+	a.lock.Unlock()
+	waitForRecovery(enables + 1)
+
+	// Advertisements keep the scan going; without them, it is restarted.
+	for range 5 {
+		c.scanResultCallback(bluetooth.ScanResult{AdvertisementPayload: &advertisementPayload{}})
+		time.Sleep(100 * time.Millisecond)
+	}
+	a.lock.Lock()
+	assert.Equal(t, a.enables, enables+1, "restarted while advertising")
+	a.lock.Unlock()
+	waitForRecovery(enables + 2)
+}
@@ -0,0 +1,135 @@
+package bluetooth_proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// More reasons an advertisement was filtered, as used in the counters.
+const (
+	filteredDuplicate  = "filtered_duplicate"   // Same payload as recently forwarded
+	filteredDeviceRate = "filtered_device_rate" // The device is advertising too often
+	filteredRate       = "filtered_rate"        // Too many advertisements overall
+)
+
+// How often to forget devices that have not been heard from recently.
+const throttleSweepInterval = time.Minute
+
+// What was last forwarded for a device.
+type throttledDevice struct {
+	data []byte // Raw advertising data
+	rssi int16
+	sent time.Time
+}
+
+// Limits how often advertisements are forwarded, dropping duplicates and
+// keeping to per-device and overall rates.
+type advertisementThrottle struct {
+	window    time.Duration // Duplicates within this time are dropped; zero to keep duplicates
+	threshold int16         // RSSI change that makes a duplicate worth forwarding; zero for any
+	interval  time.Duration // Shortest time between advertisements from a device; zero for no limit
+	rate      float64       // Overall advertisements per second; zero for no limit
+	burst     float64       // Most advertisements to allow at once overall
+
+	lock      sync.Mutex
+	devices   map[uint64]*throttledDevice // By address, shifted left with the low bit set for scan responses
+	tokens    float64                     // Advertisements that may be forwarded now
+	refilled  time.Time                   // When tokens were last added
+	lastSweep time.Time
+}
+
+// Build the throttle from its configuration; returns nil if it would never
+// drop anything.
+func newAdvertisementThrottle(config *Configuration) (*advertisementThrottle, error) {
+	t := &config.Throttle
+	if t.DuplicateWindow < 0 {
+		return nil, fmt.Errorf("invalid duplicate window %s", t.DuplicateWindow)
+	}
+	if t.RSSIThreshold < 0 {
+		return nil, fmt.Errorf("invalid RSSI threshold %d", t.RSSIThreshold)
+	}
+	if t.DeviceRate < 0 {
+		return nil, fmt.Errorf("invalid device rate %v", t.DeviceRate)
+	}
+	if t.Rate < 0 || t.Burst < 0 {
+		return nil, fmt.Errorf("invalid rate %v with burst %d", t.Rate, t.Burst)
+	}
+	if t.DuplicateWindow == 0 && t.DeviceRate == 0 && t.Rate == 0 {
+		return nil, nil
+	}
+	throttle := &advertisementThrottle{
+		window:    t.DuplicateWindow,
+		threshold: t.RSSIThreshold,
+		rate:      t.Rate,
+		burst:     float64(t.Burst),
+		devices:   make(map[uint64]*throttledDevice),
+	}
+	if t.DeviceRate > 0 {
+		throttle.interval = time.Duration(float64(time.Second) / t.DeviceRate)
+	}
+	if throttle.burst < 1 {
+		throttle.burst = max(1, t.Rate)
+	}
+	throttle.tokens = throttle.burst
+	return throttle, nil
+}
+
+// Check a scan result received at the given time, returning the reason it
+// should be dropped, or `forwarded` if it should be sent on (in which case it
+// is remembered as the latest from its device).  Advertisements and scan
+// responses from a device are throttled separately, as they alternate.
+func (t *advertisementThrottle) check(result bluetooth.ScanResult, now time.Time) string {
+	key := bleAddressToUint64(result.Address.MAC) << 1
+	if isScanResponse(result) {
+		key |= 1
+	}
+	data := rawAdvertisementData(result)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sweep(now)
+
+	last := t.devices[key]
+	if last != nil {
+		elapsed := now.Sub(last.sent)
+		if t.window > 0 && elapsed < t.window && bytes.Equal(data, last.data) {
+			change := result.RSSI - last.rssi
+			if t.threshold == 0 || max(change, -change) < t.threshold {
+				return filteredDuplicate
+			}
+		}
+		if elapsed < t.interval {
+			return filteredDeviceRate
+		}
+	}
+	if t.rate > 0 {
+		if !t.refilled.IsZero() {
+			t.tokens = min(t.burst, t.tokens+now.Sub(t.refilled).Seconds()*t.rate)
+		}
+		t.refilled = now
+		if t.tokens < 1 {
+			return filteredRate
+		}
+		t.tokens--
+	}
+	t.devices[key] = &throttledDevice{data: data, rssi: result.RSSI, sent: now}
+	return forwarded
+}
+
+// Forget devices whose last advertisement can no longer affect what is
+// forwarded.  The lock must be held.
+func (t *advertisementThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < throttleSweepInterval {
+		return
+	}
+	t.lastSweep = now
+	keep := max(t.window, t.interval)
+	for key, device := range t.devices {
+		if now.Sub(device.sent) >= keep {
+			delete(t.devices, key)
+		}
+	}
+}
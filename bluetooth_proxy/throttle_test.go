@@ -0,0 +1,68 @@
+package bluetooth_proxy
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestAdvertisementThrottle(t *testing.T) {
+	var config Configuration
+	throttle, err := newAdvertisementThrottle(&config)
+	assert.NilError(t, err)
+	assert.Assert(t, throttle == nil, "throttle without limits")
+
+	config.Throttle.DuplicateWindow = time.Second
+	config.Throttle.RSSIThreshold = 5
+	config.Throttle.DeviceRate = 10
+	throttle, err = newAdvertisementThrottle(&config)
+	assert.NilError(t, err)
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	hello := bluetooth.AdvertisementFields{LocalName: "hello"}
+	world := bluetooth.AdvertisementFields{LocalName: "world"}
+	device := "11:22:33:44:55:66"
+	assert.Equal(t, throttle.check(filterResult(t, device, -60, hello), at(0)), forwarded)
+	// A different device is unaffected.
+	assert.Equal(t, throttle.check(filterResult(t, "11:22:33:44:55:77", -60, hello), at(0)), forwarded)
+	// Repeats are dropped, unless the RSSI changes enough.
+	assert.Equal(t, throttle.check(filterResult(t, device, -62, hello), at(200)), filteredDuplicate)
+	assert.Equal(t, throttle.check(filterResult(t, device, -66, hello), at(300)), forwarded)
+	// New data is forwarded, but not too often.
+	assert.Equal(t, throttle.check(filterResult(t, device, -66, world), at(350)), filteredDeviceRate)
+	assert.Equal(t, throttle.check(filterResult(t, device, -66, world), at(400)), forwarded)
+	// Repeats are forwarded once the window has passed.
+	assert.Equal(t, throttle.check(filterResult(t, device, -66, world), at(1300)), filteredDuplicate)
+	assert.Equal(t, throttle.check(filterResult(t, device, -66, world), at(1400)), forwarded)
+
+	// Devices are forgotten once they no longer matter.
+	assert.Equal(t, len(throttle.devices), 2)
+	throttle.check(filterResult(t, device, -66, hello), at(0).Add(throttleSweepInterval))
+	assert.Equal(t, len(throttle.devices), 1)
+}
+
+func TestAdvertisementThrottleRate(t *testing.T) {
+	var config Configuration
+	config.Throttle.Rate = 2
+	config.Throttle.Burst = 3
+	throttle, err := newAdvertisementThrottle(&config)
+	assert.NilError(t, err)
+
+	start := time.Now()
+	result := filterResult(t, "11:22:33:44:55:66", -60, bluetooth.AdvertisementFields{})
+	for range 3 {
+		assert.Equal(t, throttle.check(result, start), forwarded)
+	}
+	assert.Equal(t, throttle.check(result, start), filteredRate)
+	// Tokens come back at the configured rate.
+	assert.Equal(t, throttle.check(result, start.Add(400*time.Millisecond)), filteredRate)
+	assert.Equal(t, throttle.check(result, start.Add(500*time.Millisecond)), forwarded)
+	assert.Equal(t, throttle.check(result, start.Add(500*time.Millisecond)), filteredRate)
+
+	config.Throttle.Rate = -1
+	_, err = newAdvertisementThrottle(&config)
+	assert.ErrorContains(t, err, "invalid rate")
+}
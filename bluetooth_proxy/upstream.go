@@ -0,0 +1,127 @@
+package bluetooth_proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/api/pb"
+	"github.com/mook/mockesphome/client"
+	"tinygo.org/x/bluetooth"
+)
+
+// How long a source keeps relaying a device after it last heard it, unless
+// another source hears it more strongly.
+const sourceTimeout = 10 * time.Second
+
+// Advertisements dropped because another source heard the device more
+// strongly, as used in the counters.
+const ingestDuplicate = "ingest_duplicate"
+
+// Receives advertisements from an ESPHome bluetooth proxy over the native API,
+// reconnecting whenever the connection is lost.
+type upstreamSource struct {
+	address  string
+	password string
+	key      []byte // Encryption key, if the proxy uses encryption
+}
+
+func (s *upstreamSource) start(ctx context.Context, a *ingestAdapter) error {
+	go func() {
+		delay := retryMinBackoff
+		for ctx.Err() == nil {
+			err := s.receive(ctx, a, func() { delay = retryMinBackoff })
+			if ctx.Err() != nil {
+				return
+			}
+			slog.WarnContext(ctx, "lost connection to upstream bluetooth proxy", "address", s.address, "error", err)
+			var ok bool
+			if delay, ok = retryBackoff(ctx, delay); !ok {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Connect to the proxy and relay its raw advertisements until the connection
+// is lost or the context is done, calling connected once subscribed.
+func (s *upstreamSource) receive(ctx context.Context, a *ingestAdapter, connected func()) error {
+	c, err := client.Dial(ctx, s.address, s.password, s.key)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = c.Close() })
+	defer func() {
+		if stop() {
+			_ = c.Close()
+		}
+	}()
+	req := &pb.SubscribeBluetoothLEAdvertisementsRequest{}
+	req.SetFlags(uint32(proxySubscriptionRawAdvertisements))
+	if err := c.Send(req); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "receiving advertisements from upstream bluetooth proxy", "address", s.address, "name", c.Hello.GetName())
+	connected()
+	for {
+		resp, err := client.Receive[*pb.BluetoothLERawAdvertisementsResponse](c)
+		if err != nil {
+			return err
+		}
+		for _, adv := range resp.GetAdvertisements() {
+			result := bluetooth.ScanResult{
+				RSSI: int16(adv.GetRssi()),
+				AdvertisementPayload: &advertisementPayload{
+					AdvertisementFields: parseAdvertisingData(adv.GetData()),
+					raw:                 adv.GetData(),
+				},
+			}
+			result.Address = uint64ToBLEAddress(adv.GetAddress())
+			result.Address.SetRandom(adv.GetAddressType() == addressTypeRandom)
+			a.relay(result, s.address)
+		}
+	}
+}
+
+// The source chosen to relay a device.
+type selectedSource struct {
+	source string
+	rssi   int16
+	seen   time.Time
+}
+
+// Picks which source to relay each device from when several hear it, so that
+// each advertisement is only relayed once: the one with the strongest signal,
+// switching when another hears it more strongly, or the chosen one has not
+// heard it for a while.
+type sourceSelector struct {
+	lock      sync.Mutex
+	devices   map[uint64]*selectedSource
+	lastSweep time.Time
+}
+
+// Check whether to relay an advertisement heard by the source at the given
+// signal strength.
+func (s *sourceSelector) check(address uint64, source string, rssi int16, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.devices == nil {
+		s.devices = make(map[uint64]*selectedSource)
+	}
+	if now.Sub(s.lastSweep) >= sourceTimeout {
+		s.lastSweep = now
+		for address, selected := range s.devices {
+			if now.Sub(selected.seen) >= sourceTimeout {
+				delete(s.devices, address)
+			}
+		}
+	}
+	selected, ok := s.devices[address]
+	if ok && selected.source != source && rssi <= selected.rssi && now.Sub(selected.seen) < sourceTimeout {
+		return false
+	}
+	s.devices[address] = &selectedSource{source: source, rssi: rssi, seen: now}
+	return true
+}
@@ -0,0 +1,130 @@
+package bluetooth_proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+	"tinygo.org/x/bluetooth"
+)
+
+func TestSourceSelector(t *testing.T) {
+	var s sourceSelector
+	now := time.Now()
+	assert.Assert(t, s.check(1, "a", -70, now))
+	assert.Assert(t, s.check(1, "a", -90, now), "the chosen source is always relayed")
+	assert.Assert(t, !s.check(1, "b", -90, now), "weaker than the chosen source")
+	assert.Assert(t, s.check(1, "b", -80, now), "stronger than the chosen source")
+	assert.Assert(t, !s.check(1, "a", -85, now))
+	assert.Assert(t, s.check(2, "a", -85, now), "other devices are separate")
+	assert.Assert(t, s.check(1, "a", -99, now.Add(sourceTimeout)), "the chosen source stopped hearing it")
+	assert.Equal(t, len(s.devices), 1, "old devices are forgotten")
+}
+
+// Start a scripted ESPHome proxy that logs in one client and asks for raw
+// advertisements, then sends each batch it is given.
+func startUpstream(t *testing.T) (string, chan<- []*pb.BluetoothLERawAdvertisement) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	batches := make(chan []*pb.BluetoothLERawAdvertisement)
+	go func() {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+		conn := api.NewConn(netConn)
+		for _, expected := range []string{"HelloRequest", "ConnectRequest", "SubscribeBluetoothLEAdvertisementsRequest"} {
+			msg, err := conn.ReadMessage()
+			if !assert.Check(t, err) || !assert.Check(t, string(msg.ProtoReflect().Descriptor().Name()) == expected) {
+				return
+			}
+			switch msg := msg.(type) {
+			case *pb.HelloRequest:
+				assert.Check(t, conn.WriteMessage(&pb.HelloResponse{}))
+			case *pb.ConnectRequest:
+				assert.Check(t, conn.WriteMessage(&pb.ConnectResponse{}))
+			case *pb.SubscribeBluetoothLEAdvertisementsRequest:
+				assert.Check(t, msg.GetFlags() == uint32(proxySubscriptionRawAdvertisements))
+			}
+		}
+		for {
+			select {
+			case <-t.Context().Done():
+				return
+			case batch := <-batches:
+				resp := &pb.BluetoothLERawAdvertisementsResponse{}
+				resp.SetAdvertisements(batch)
+				assert.Check(t, conn.WriteMessage(resp))
+			}
+		}
+	}()
+	return listener.Addr().String(), batches
+}
+
+// Build a raw advertisement as sent by a proxy.
+func upstreamAdvertisement(address uint64, rssi int32) *pb.BluetoothLERawAdvertisement {
+	adv := &pb.BluetoothLERawAdvertisement{}
+	adv.SetAddress(address)
+	adv.SetAddressType(addressTypeRandom)
+	adv.SetRssi(rssi)
+	adv.SetData([]byte{0x05, 0x09, 'T', 'e', 's', 't'})
+	return adv
+}
+
+func TestUpstreamSource(t *testing.T) {
+	first, firstBatches := startUpstream(t)
+	second, secondBatches := startUpstream(t)
+	a := &ingestAdapter{ctx: t.Context(), sources: []ingestSource{
+		&upstreamSource{address: first},
+		&upstreamSource{address: second},
+	}}
+	assert.NilError(t, a.Enable())
+	results := make(chan bluetooth.ScanResult, 10)
+	go func() { assert.Check(t, a.Scan(func(result bluetooth.ScanResult) { results <- result })) }()
+	defer func() { assert.Check(t, a.StopScan()) }()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.callback == nil {
+			return poll.Continue("not scanning")
+		}
+		return poll.Success()
+	})
+	received := func() bluetooth.ScanResult {
+		select {
+		case result := <-results:
+			return result
+		case <-time.After(5 * time.Second):
+			t.Fatal("no advertisement received")
+			return bluetooth.ScanResult{}
+		}
+	}
+
+	firstBatches <- []*pb.BluetoothLERawAdvertisement{upstreamAdvertisement(0x112233445566, -80)}
+	result := received()
+	assert.Equal(t, result.Address.MAC.String(), "11:22:33:44:55:66")
+	assert.Assert(t, result.Address.IsRandom())
+	assert.Equal(t, result.RSSI, int16(-80))
+	assert.Equal(t, advertisementFields(result).LocalName, "Test")
+
+	// The second proxy hears it more strongly, so it takes over.
+	secondBatches <- []*pb.BluetoothLERawAdvertisement{upstreamAdvertisement(0x112233445566, -60)}
+	assert.Equal(t, received().RSSI, int16(-60))
+	firstBatches <- []*pb.BluetoothLERawAdvertisement{
+		upstreamAdvertisement(0x112233445566, -70),
+		upstreamAdvertisement(0x112233445577, -90),
+	}
+	result = received()
+	assert.Equal(t, result.Address.MAC.String(), "11:22:33:44:55:77")
+	select {
+	case result := <-results:
+		t.Fatalf("unexpected advertisement from %s", result.Address.MAC)
+	default:
+	}
+}
@@ -0,0 +1,202 @@
+// Package client implements a client for the ESPHome native API, suitable for
+// talking to either mockesphome or a real ESPHome device.
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultPort  = 6053
+	clientInfo   = "mockesphome"
+	loginTimeout = 10 * time.Second
+)
+
+// Client is a connection to an ESPHome device.
+type Client struct {
+	conn      *api.Conn
+	writeLock sync.Mutex // Serializes writes to the connection
+	// Information the device reported in its HelloResponse.
+	Hello *pb.HelloResponse
+}
+
+// Connect to the ESPHome device at the given address, and log in with the
+// given password (which may be empty).  If an encryption key is given, the
+// encrypted protocol is used.  If the address has no port, the default API
+// port is used.
+func Dial(ctx context.Context, address, password string, key []byte) (*Client, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, fmt.Sprintf("%d", defaultPort))
+	}
+	dialer := &net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	// Abort the handshake if the context is cancelled or the device is silent.
+	stop := context.AfterFunc(ctx, func() { _ = netConn.Close() })
+	defer stop()
+	if err := netConn.SetDeadline(time.Now().Add(loginTimeout)); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+
+	c := &Client{}
+	if key != nil {
+		c.conn, _, _, err = api.NewNoiseClientConn(netConn, key)
+		if err != nil {
+			_ = netConn.Close()
+			return nil, fmt.Errorf("failed encrypted handshake: %w", err)
+		}
+	} else {
+		c.conn = api.NewConn(netConn)
+	}
+	if err := c.login(password); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	if err := netConn.SetDeadline(time.Time{}); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	slog.DebugContext(ctx, "connected to device", "address", address, "hello", c.Hello)
+	return c, nil
+}
+
+// Do the initial handshake with the device.
+func (c *Client) login(password string) error {
+	hello := &pb.HelloRequest{}
+	hello.SetClientInfo(clientInfo)
+	hello.SetApiVersionMajor(1)
+	hello.SetApiVersionMinor(10)
+	if err := c.Send(hello); err != nil {
+		return err
+	}
+	helloResp, err := Receive[*pb.HelloResponse](c)
+	if err != nil {
+		return fmt.Errorf("failed to read hello response: %w", err)
+	}
+	c.Hello = helloResp
+
+	connect := &pb.ConnectRequest{}
+	connect.SetPassword(password)
+	if err := c.Send(connect); err != nil {
+		return err
+	}
+	connectResp, err := Receive[*pb.ConnectResponse](c)
+	if err != nil {
+		return fmt.Errorf("failed to read connect response: %w", err)
+	}
+	if connectResp.GetInvalidPassword() {
+		return fmt.Errorf("invalid password")
+	}
+	return nil
+}
+
+// Send a message to the device.  This is safe to call concurrently.
+func (c *Client) Send(msg proto.Message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.WriteMessage(msg)
+}
+
+// Read the next message from the device.  Keep-alive and time requests from
+// the device are answered automatically and not returned.
+func (c *Client) Next() (proto.Message, error) {
+	for {
+		msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("received message", "type", msg.ProtoReflect().Descriptor().FullName(), "message", msg)
+		switch msg.(type) {
+		case *pb.PingRequest:
+			if err := c.Send(&pb.PingResponse{}); err != nil {
+				return nil, err
+			}
+		case *pb.GetTimeRequest:
+			resp := &pb.GetTimeResponse{}
+			resp.SetEpochSeconds(uint32(time.Now().Unix()))
+			if err := c.Send(resp); err != nil {
+				return nil, err
+			}
+		case *pb.DisconnectRequest:
+			if err := c.Send(&pb.DisconnectResponse{}); err != nil {
+				slog.Debug("failed to acknowledge disconnect", "error", err)
+			}
+			_ = c.conn.Close()
+			return nil, fmt.Errorf("device requested disconnect")
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// Read messages from the device until one of the given type is found; other
+// messages are discarded.
+func Receive[T proto.Message](c *Client) (T, error) {
+	for {
+		msg, err := c.Next()
+		if err != nil {
+			return *new(T), err
+		}
+		if result, ok := msg.(T); ok {
+			return result, nil
+		}
+		slog.Debug("ignoring unexpected message", "type", msg.ProtoReflect().Descriptor().FullName())
+	}
+}
+
+// Request device information.
+func (c *Client) DeviceInfo() (*pb.DeviceInfoResponse, error) {
+	if err := c.Send(&pb.DeviceInfoRequest{}); err != nil {
+		return nil, err
+	}
+	return Receive[*pb.DeviceInfoResponse](c)
+}
+
+// Entity is the common interface of ListEntities*Response messages.
+type Entity interface {
+	proto.Message
+	GetKey() uint32
+	GetName() string
+}
+
+// List the entities (including user-defined services) on the device.
+func (c *Client) ListEntities() ([]Entity, error) {
+	if err := c.Send(&pb.ListEntitiesRequest{}); err != nil {
+		return nil, err
+	}
+	var entities []Entity
+	for {
+		msg, err := c.Next()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := msg.(*pb.ListEntitiesDoneResponse); ok {
+			return entities, nil
+		}
+		if entity, ok := msg.(Entity); ok {
+			entities = append(entities, entity)
+		} else {
+			slog.Debug("ignoring unexpected message", "type", msg.ProtoReflect().Descriptor().FullName())
+		}
+	}
+}
+
+// Disconnect from the device and close the connection.
+func (c *Client) Close() error {
+	if err := c.Send(&pb.DisconnectRequest{}); err != nil {
+		slog.Debug("failed to send disconnect request", "error", err)
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+// Start a scripted device that accepts one connection and runs the given
+// function on it, returning the address to connect to.
+func startDevice(t *testing.T, script func(conn *api.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+		script(api.NewConn(netConn))
+	}()
+	return listener.Addr().String()
+}
+
+// Read the next message on a scripted connection, failing the test if it does
+// not have the expected type.
+func expect[T proto.Message](t *testing.T, conn *api.Conn) T {
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Errorf("failed to read message: %v", err)
+		return *new(T)
+	}
+	result, ok := msg.(T)
+	if !ok {
+		t.Errorf("unexpected message %T, wanted %T", msg, *new(T))
+	}
+	return result
+}
+
+// Answer the login sequence on a scripted connection.
+func acceptLogin(t *testing.T, conn *api.Conn, password string) {
+	hello := expect[*pb.HelloRequest](t, conn)
+	assert.Check(t, hello.GetClientInfo() == clientInfo)
+	resp := &pb.HelloResponse{}
+	resp.SetName("scripted")
+	assert.Check(t, conn.WriteMessage(resp))
+	connect := expect[*pb.ConnectRequest](t, conn)
+	connectResp := &pb.ConnectResponse{}
+	connectResp.SetInvalidPassword(connect.GetPassword() != password)
+	assert.Check(t, conn.WriteMessage(connectResp))
+}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	t.Run("success", func(t *testing.T) {
+		address := startDevice(t, func(conn *api.Conn) {
+			acceptLogin(t, conn, "secret")
+			expect[*pb.DisconnectRequest](t, conn)
+		})
+		c, err := Dial(ctx, address, "secret", nil)
+		assert.NilError(t, err)
+		assert.Equal(t, c.Hello.GetName(), "scripted")
+		assert.NilError(t, c.Close())
+	})
+	t.Run("invalid password", func(t *testing.T) {
+		address := startDevice(t, func(conn *api.Conn) {
+			acceptLogin(t, conn, "secret")
+		})
+		_, err := Dial(ctx, address, "wrong", nil)
+		assert.ErrorContains(t, err, "invalid password")
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		done := make(chan struct{})
+		defer close(done)
+		address := startDevice(t, func(conn *api.Conn) {
+			<-done // Never answer.
+		})
+		// Cancel during login, after the connection has been made.
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		_, err := Dial(ctx, address, "", nil)
+		assert.ErrorContains(t, err, "failed to read hello response")
+	})
+}
+
+func TestNext(t *testing.T) {
+	address := startDevice(t, func(conn *api.Conn) {
+		acceptLogin(t, conn, "")
+		assert.Check(t, conn.WriteMessage(&pb.PingRequest{}))
+		expect[*pb.PingResponse](t, conn)
+		assert.Check(t, conn.WriteMessage(&pb.GetTimeRequest{}))
+		resp := expect[*pb.GetTimeResponse](t, conn)
+		assert.Check(t, resp.GetEpochSeconds() != 0)
+		assert.Check(t, conn.WriteMessage(&pb.DeviceInfoResponse{}))
+		assert.Check(t, conn.WriteMessage(&pb.DisconnectRequest{}))
+		expect[*pb.DisconnectResponse](t, conn)
+	})
+	c, err := Dial(context.Background(), address, "", nil)
+	assert.NilError(t, err)
+
+	// The ping and time requests are answered without being returned.
+	msg, err := c.Next()
+	assert.NilError(t, err)
+	_, ok := msg.(*pb.DeviceInfoResponse)
+	assert.Assert(t, ok, "unexpected message %T", msg)
+
+	_, err = c.Next()
+	assert.ErrorContains(t, err, "device requested disconnect")
+}
+
+func TestListEntities(t *testing.T) {
+	address := startDevice(t, func(conn *api.Conn) {
+		acceptLogin(t, conn, "")
+		expect[*pb.ListEntitiesRequest](t, conn)
+		button := &pb.ListEntitiesButtonResponse{}
+		button.SetKey(1)
+		button.SetName("Button")
+		sw := &pb.ListEntitiesSwitchResponse{}
+		sw.SetKey(2)
+		sw.SetName("Switch")
+		for _, msg := range []proto.Message{button, &pb.PingRequest{}, sw, &pb.ListEntitiesDoneResponse{}} {
+			assert.Check(t, conn.WriteMessage(msg))
+		}
+		expect[*pb.PingResponse](t, conn)
+		// Anything after the done message must not be consumed.
+		assert.Check(t, conn.WriteMessage(&pb.DeviceInfoResponse{}))
+		expect[*pb.DisconnectRequest](t, conn)
+	})
+	c, err := Dial(context.Background(), address, "", nil)
+	assert.NilError(t, err)
+	defer c.Close()
+
+	entities, err := c.ListEntities()
+	assert.NilError(t, err)
+	assert.Equal(t, len(entities), 2)
+	assert.Equal(t, entities[0].GetName(), "Button")
+	assert.Equal(t, entities[1].GetName(), "Switch")
+
+	msg, err := c.Next()
+	assert.NilError(t, err)
+	_, ok := msg.(*pb.DeviceInfoResponse)
+	assert.Assert(t, ok, "unexpected message %T", msg)
+}
@@ -0,0 +1,366 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+const usage = `Usage: %s [flags] <command> [arguments]
+
+Commands:
+  info                       Display device information
+  entities                   List entities and services
+  states                     Stream entity state changes
+  logs                       Stream device logs
+  ble                        Stream bluetooth advertisements
+  service <name> [arg=value] Call a user-defined service
+  button <entity>            Press a button
+  switch <entity> on|off     Turn a switch on or off
+
+Devices using encryption require the -key flag; otherwise the plaintext
+protocol is used.
+
+Flags:
+`
+
+// Run the `client` subcommand with the given command line arguments.
+func Run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	address := flags.String("address", "localhost", "address of the device to connect to")
+	password := flags.String("password", "", "API password")
+	encryptionKey := flags.String("key", "", "base64-encoded API encryption key, for encrypted devices")
+	logLevel := flags.String("level", "debug", "log level to request, for the logs command")
+	raw := flags.Bool("raw", false, "request raw advertisements, for the ble command")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), usage, flags.Name())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return fmt.Errorf("no command given")
+	}
+
+	var key []byte
+	if *encryptionKey != "" {
+		var err error
+		key, err = base64.StdEncoding.DecodeString(*encryptionKey)
+		if err != nil {
+			return fmt.Errorf("failed to decode encryption key: %w", err)
+		}
+	}
+
+	c, err := Dial(ctx, *address, *password, key)
+	if err != nil {
+		return err
+	}
+	// Closing the connection is how we interrupt a blocking read.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	out := os.Stdout
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "info":
+		err = c.runInfo(out)
+	case "entities":
+		err = c.runEntities(out)
+	case "states":
+		err = c.runStates(out)
+	case "logs":
+		err = c.runLogs(out, *logLevel)
+	case "ble":
+		err = c.runBLE(out, *raw)
+	case "service":
+		err = c.runService(commandArgs)
+	case "button":
+		err = c.runButton(commandArgs)
+	case "switch":
+		err = c.runSwitch(commandArgs)
+	default:
+		flags.Usage()
+		err = fmt.Errorf("unknown command %q", command)
+	}
+	if ctx.Err() != nil {
+		return nil // Interrupted by the user.
+	}
+	return err
+}
+
+// Format a message in compact text form for display.
+func format(msg proto.Message) string {
+	return fmt.Sprintf("%s{%s}", msg.ProtoReflect().Descriptor().Name(), prototext.MarshalOptions{}.Format(msg))
+}
+
+// Get a human-readable identifier for an entity.
+func entityID(entity Entity) string {
+	if e, ok := entity.(interface{ GetObjectId() string }); ok && e.GetObjectId() != "" {
+		return e.GetObjectId()
+	}
+	return entity.GetName()
+}
+
+// Find an entity of the given type by object ID or name.
+func findEntity[T Entity](entities []Entity, id string) (T, error) {
+	for _, entity := range entities {
+		if e, ok := entity.(T); ok && (entityID(e) == id || e.GetName() == id) {
+			return e, nil
+		}
+	}
+	return *new(T), fmt.Errorf("failed to find entity %q", id)
+}
+
+func (c *Client) runInfo(out io.Writer) error {
+	info, err := c.DeviceInfo()
+	if err != nil {
+		return err
+	}
+	text, err := prototext.MarshalOptions{Multiline: true}.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(text)
+	return err
+}
+
+func (c *Client) runEntities(out io.Writer) error {
+	entities, err := c.ListEntities()
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		fmt.Fprintln(out, format(entity))
+	}
+	return nil
+}
+
+func (c *Client) runStates(out io.Writer) error {
+	entities, err := c.ListEntities()
+	if err != nil {
+		return err
+	}
+	names := make(map[uint32]string)
+	for _, entity := range entities {
+		names[entity.GetKey()] = entityID(entity)
+	}
+	if err := c.Send(&pb.SubscribeStatesRequest{}); err != nil {
+		return err
+	}
+	for {
+		msg, err := c.Next()
+		if err != nil {
+			return err
+		}
+		if state, ok := msg.(interface{ GetKey() uint32 }); ok {
+			fmt.Fprintf(out, "%s: %s\n", names[state.GetKey()], format(msg))
+		}
+	}
+}
+
+func (c *Client) runLogs(out io.Writer, level string) error {
+	levelValue, ok := pb.LogLevel_value["LOG_LEVEL_"+strings.ToUpper(level)]
+	if !ok {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	req := &pb.SubscribeLogsRequest{}
+	req.SetLevel(pb.LogLevel(levelValue))
+	if err := c.Send(req); err != nil {
+		return err
+	}
+	for {
+		resp, err := Receive[*pb.SubscribeLogsResponse](c)
+		if err != nil {
+			return err
+		}
+		levelName := strings.TrimPrefix(resp.GetLevel().String(), "LOG_LEVEL_")
+		fmt.Fprintf(out, "[%s] %s\n", levelName, strings.TrimRight(string(resp.GetMessage()), "\r\n"))
+	}
+}
+
+func (c *Client) runBLE(out io.Writer, raw bool) error {
+	req := &pb.SubscribeBluetoothLEAdvertisementsRequest{}
+	if raw {
+		req.SetFlags(1) // BLUETOOTH_PROXY_SUBSCRIPTION_FLAG_RAW_ADVERTISEMENTS
+	}
+	if err := c.Send(req); err != nil {
+		return err
+	}
+	for {
+		msg, err := c.Next()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pb.BluetoothLEAdvertisementResponse:
+			fmt.Fprintf(out, "%s rssi=%d %s\n", api.FormatAddress(msg.GetAddress()), msg.GetRssi(), format(msg))
+		case *pb.BluetoothLERawAdvertisementsResponse:
+			for _, adv := range msg.GetAdvertisements() {
+				fmt.Fprintf(out, "%s rssi=%d type=%d data=%X\n",
+					api.FormatAddress(adv.GetAddress()), adv.GetRssi(), adv.GetAddressType(), adv.GetData())
+			}
+		}
+	}
+}
+
+func (c *Client) runService(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("no service name given")
+	}
+	entities, err := c.ListEntities()
+	if err != nil {
+		return err
+	}
+	service, err := findEntity[*pb.ListEntitiesServicesResponse](entities, args[0])
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid service argument %q, expected name=value", arg)
+		}
+		values[key] = value
+	}
+	req := &pb.ExecuteServiceRequest{}
+	req.SetKey(service.GetKey())
+	var serviceArgs []*pb.ExecuteServiceArgument
+	for _, argDef := range service.GetArgs() {
+		value, ok := values[argDef.GetName()]
+		if !ok {
+			return fmt.Errorf("missing service argument %q", argDef.GetName())
+		}
+		serviceArg, err := parseServiceArgument(argDef.GetType(), value)
+		if err != nil {
+			return fmt.Errorf("invalid value for service argument %q: %w", argDef.GetName(), err)
+		}
+		serviceArgs = append(serviceArgs, serviceArg)
+	}
+	req.SetArgs(serviceArgs)
+	return c.Send(req)
+}
+
+// Parse a command line value into a service argument of the given type.
+// Array values are comma separated.
+func parseServiceArgument(argType pb.ServiceArgType, value string) (*pb.ExecuteServiceArgument, error) {
+	result := &pb.ExecuteServiceArgument{}
+	var items []string
+	if value != "" {
+		items = strings.Split(value, ",")
+	}
+	var errs []error
+	parseBool := func(s string) bool {
+		v, err := strconv.ParseBool(s)
+		errs = append(errs, err)
+		return v
+	}
+	parseInt := func(s string) int32 {
+		v, err := strconv.ParseInt(s, 10, 32)
+		errs = append(errs, err)
+		return int32(v)
+	}
+	parseFloat := func(s string) float32 {
+		v, err := strconv.ParseFloat(s, 32)
+		errs = append(errs, err)
+		return float32(v)
+	}
+	switch argType {
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_BOOL:
+		result.SetBool_(parseBool(value))
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_INT:
+		result.SetInt_(parseInt(value))
+		result.SetLegacyInt(result.GetInt_())
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_FLOAT:
+		result.SetFloat_(parseFloat(value))
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_STRING:
+		result.SetString_(value)
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_BOOL_ARRAY:
+		var values []bool
+		for _, item := range items {
+			values = append(values, parseBool(item))
+		}
+		result.SetBoolArray(values)
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_INT_ARRAY:
+		var values []int32
+		for _, item := range items {
+			values = append(values, parseInt(item))
+		}
+		result.SetIntArray(values)
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_FLOAT_ARRAY:
+		var values []float32
+		for _, item := range items {
+			values = append(values, parseFloat(item))
+		}
+		result.SetFloatArray(values)
+	case pb.ServiceArgType_SERVICE_ARG_TYPE_STRING_ARRAY:
+		result.SetStringArray(items)
+	default:
+		return nil, fmt.Errorf("unsupported argument type %s", argType)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) runButton(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one button")
+	}
+	entities, err := c.ListEntities()
+	if err != nil {
+		return err
+	}
+	button, err := findEntity[*pb.ListEntitiesButtonResponse](entities, args[0])
+	if err != nil {
+		return err
+	}
+	req := &pb.ButtonCommandRequest{}
+	req.SetKey(button.GetKey())
+	return c.Send(req)
+}
+
+func (c *Client) runSwitch(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected a switch and a state")
+	}
+	var state bool
+	switch strings.ToLower(args[1]) {
+	case "on", "true":
+		state = true
+	case "off", "false":
+		state = false
+	default:
+		return fmt.Errorf("invalid switch state %q", args[1])
+	}
+	entities, err := c.ListEntities()
+	if err != nil {
+		return err
+	}
+	sw, err := findEntity[*pb.ListEntitiesSwitchResponse](entities, args[0])
+	if err != nil {
+		return err
+	}
+	req := &pb.SwitchCommandRequest{}
+	req.SetKey(sw.GetKey())
+	req.SetState(state)
+	return c.Send(req)
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseServiceArgument(t *testing.T) {
+	cases := []struct {
+		name     string
+		argType  pb.ServiceArgType
+		input    string
+		expected func(*pb.ExecuteServiceArgument)
+	}{
+		{"bool", pb.ServiceArgType_SERVICE_ARG_TYPE_BOOL, "true", func(a *pb.ExecuteServiceArgument) {
+			a.SetBool_(true)
+		}},
+		{"int", pb.ServiceArgType_SERVICE_ARG_TYPE_INT, "-3", func(a *pb.ExecuteServiceArgument) {
+			a.SetInt_(-3)
+			a.SetLegacyInt(-3)
+		}},
+		{"string", pb.ServiceArgType_SERVICE_ARG_TYPE_STRING, "a,b", func(a *pb.ExecuteServiceArgument) {
+			a.SetString_("a,b")
+		}},
+		{"float array", pb.ServiceArgType_SERVICE_ARG_TYPE_FLOAT_ARRAY, "1.5,2", func(a *pb.ExecuteServiceArgument) {
+			a.SetFloatArray([]float32{1.5, 2})
+		}},
+		{"empty array", pb.ServiceArgType_SERVICE_ARG_TYPE_STRING_ARRAY, "", func(a *pb.ExecuteServiceArgument) {}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expected := &pb.ExecuteServiceArgument{}
+			c.expected(expected)
+			actual, err := parseServiceArgument(c.argType, c.input)
+			assert.NilError(t, err)
+			assert.Assert(t, proto.Equal(expected, actual), "got %v", actual)
+		})
+	}
+}
+
+func TestParseServiceArgumentInvalid(t *testing.T) {
+	_, err := parseServiceArgument(pb.ServiceArgType_SERVICE_ARG_TYPE_INT_ARRAY, "1,x")
+	assert.ErrorContains(t, err, "invalid syntax")
+}
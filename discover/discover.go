@@ -0,0 +1,263 @@
+// Package discover implements the `discover` subcommand, which browses for
+// ESPHome devices on the local network via mDNS.
+package discover
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+)
+
+const (
+	serviceType = "_esphomelib._tcp.local."
+	// TXT record key advertising the encryption scheme, if any.
+	encryptionTextKey = "api_encryption"
+)
+
+// errEncrypted is returned by hello when the device responded using the
+// encrypted protocol.
+var errEncrypted = errors.New("device requires encryption")
+
+// A discovered ESPHome device.
+type Node struct {
+	Instance   string            `json:"instance"`              // mDNS service instance name
+	Host       string            `json:"host"`                  // Host name the service points to
+	Addresses  []string          `json:"addresses"`             // IP addresses of the host
+	Port       int               `json:"port"`                  // Native API port
+	Text       map[string]string `json:"txt,omitempty"`         // TXT record metadata
+	Reachable  bool              `json:"reachable"`             // Whether the native API responded
+	Encrypted  bool              `json:"encrypted"`             // Whether the native API requires encryption
+	Name       string            `json:"name,omitempty"`        // Device name from the native API
+	ServerInfo string            `json:"server_info,omitempty"` // Server info from the native API
+	Error      string            `json:"error,omitempty"`       // Reason the device is unreachable
+	Collisions []string          `json:"collisions,omitempty"`  // Other nodes claiming the same name
+}
+
+// Run the `discover` subcommand with the given command line arguments.
+func Run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to browse for devices")
+	probeTimeout := flags.Duration("probe-timeout", 2*time.Second, "how long to wait for each device to respond")
+	jsonOutput := flags.Bool("json", false, "output JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	nodes, err := Browse(ctx, *timeout)
+	if err != nil {
+		return err
+	}
+	probeAll(ctx, nodes, *probeTimeout)
+	findCollisions(nodes)
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(nodes)
+	}
+	return writeTable(os.Stdout, nodes)
+}
+
+// Browse for ESPHome devices for the given duration, returning the devices
+// found, sorted by instance name.
+func Browse(ctx context.Context, duration time.Duration) ([]*Node, error) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var lock sync.Mutex
+	found := make(map[string]*Node)
+	add := func(entry dnssd.BrowseEntry) {
+		slog.DebugContext(ctx, "found service", "entry", entry)
+		lock.Lock()
+		defer lock.Unlock()
+		key := entry.ServiceInstanceName() + "\x00" + entry.Host
+		node, ok := found[key]
+		if !ok {
+			node = &Node{
+				Instance: entry.Name,
+				Host:     entry.Host,
+				Port:     entry.Port,
+				Text:     entry.Text,
+			}
+			_, node.Encrypted = entry.Text[encryptionTextKey]
+			found[key] = node
+		}
+		for _, ip := range entry.IPs {
+			if addr := ip.String(); !slices.Contains(node.Addresses, addr) {
+				node.Addresses = append(node.Addresses, addr)
+			}
+		}
+	}
+	remove := func(entry dnssd.BrowseEntry) {
+		slog.DebugContext(ctx, "service removed", "entry", entry)
+	}
+	err := dnssd.LookupType(ctx, serviceType, add, remove)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("failed to browse for devices: %w", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	nodes := slices.Collect(maps.Values(found))
+	slices.SortFunc(nodes, func(a, b *Node) int {
+		return cmp.Or(cmp.Compare(a.Instance, b.Instance), cmp.Compare(a.Host, b.Host))
+	})
+	for _, node := range nodes {
+		slices.Sort(node.Addresses)
+	}
+	return nodes, nil
+}
+
+// Check whether each node responds to the native API, concurrently.
+func probeAll(ctx context.Context, nodes []*Node, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := node.probe(ctx, timeout); err != nil {
+				slog.DebugContext(ctx, "failed to probe node", "instance", node.Instance, "error", err)
+				node.Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Check if the node responds to a native API hello request on any address.
+// A node that answers with the encrypted protocol is reachable, but its name
+// cannot be determined without the key.
+func (n *Node) probe(ctx context.Context, timeout time.Duration) error {
+	if len(n.Addresses) == 0 {
+		return fmt.Errorf("no addresses")
+	}
+	var errs []error
+	for _, addr := range n.Addresses {
+		resp, err := hello(ctx, net.JoinHostPort(addr, strconv.Itoa(n.Port)), timeout)
+		if errors.Is(err, errEncrypted) {
+			n.Reachable = true
+			n.Encrypted = true
+			return nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n.Reachable = true
+		n.Name = resp.GetName()
+		n.ServerInfo = resp.GetServerInfo()
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// Connect to the given address and exchange hello messages.  If the device
+// responds with an encrypted frame, errEncrypted is returned.
+func hello(ctx context.Context, address string, timeout time.Duration) (*pb.HelloResponse, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer netConn.Close()
+	if err := netConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(netConn)
+	conn := api.NewConn(struct {
+		io.Reader
+		io.Writer
+	}{reader, netConn})
+	req := &pb.HelloRequest{}
+	req.SetClientInfo("mockesphome discover")
+	req.SetApiVersionMajor(1)
+	req.SetApiVersionMinor(10)
+	if err := conn.WriteMessage(req); err != nil {
+		return nil, err
+	}
+	// Encrypted devices reply to a plaintext hello with an encrypted frame
+	// (indicator byte 0x01) explaining the failure.
+	if header, err := reader.Peek(1); err == nil && header[0] == 0x01 {
+		return nil, errEncrypted
+	}
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello response: %w", err)
+	}
+	resp, ok := msg.(*pb.HelloResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s message", msg.ProtoReflect().Descriptor().Name())
+	}
+	if err := conn.WriteMessage(&pb.DisconnectRequest{}); err != nil {
+		slog.DebugContext(ctx, "failed to disconnect", "address", address, "error", err)
+	}
+	return resp, nil
+}
+
+// Mark nodes that share an instance name or device name with another node;
+// Home Assistant will not be able to tell those apart.
+func findCollisions(nodes []*Node) {
+	for _, node := range nodes {
+		for _, other := range nodes {
+			if node == other {
+				continue
+			}
+			sameInstance := strings.EqualFold(node.Instance, other.Instance)
+			sameName := node.Name != "" && strings.EqualFold(node.Name, other.Name)
+			if sameInstance || sameName {
+				node.Collisions = append(node.Collisions, other.Host)
+			}
+		}
+	}
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// Write the nodes as a human-readable table.
+func writeTable(w io.Writer, nodes []*Node) error {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "INSTANCE\tHOST\tADDRESSES\tPORT\tREACHABLE\tENCRYPTED\tTXT")
+	for _, node := range nodes {
+		var text []string
+		for _, key := range slices.Sorted(maps.Keys(node.Text)) {
+			text = append(text, fmt.Sprintf("%s=%s", key, node.Text[key]))
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			node.Instance, node.Host, strings.Join(node.Addresses, ","),
+			node.Port, yesNo(node.Reachable), yesNo(node.Encrypted), strings.Join(text, " "))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if len(node.Collisions) > 0 {
+			fmt.Fprintf(w, "warning: %s (%s) collides with %s\n",
+				node.Instance, node.Host, strings.Join(node.Collisions, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"gotest.tools/v3/assert"
+)
+
+func TestFindCollisions(t *testing.T) {
+	nodes := []*Node{
+		{Instance: "kitchen", Host: "a.local", Name: "kitchen"},
+		{Instance: "Kitchen", Host: "b.local", Name: "kitchen-2"},
+		{Instance: "garage", Host: "c.local", Name: "porch"},
+		{Instance: "porch", Host: "d.local", Name: "porch"},
+		{Instance: "attic", Host: "e.local"},
+		{Instance: "cellar", Host: "f.local"},
+	}
+	findCollisions(nodes)
+	assert.DeepEqual(t, []string{"b.local"}, nodes[0].Collisions)
+	assert.DeepEqual(t, []string{"a.local"}, nodes[1].Collisions)
+	assert.DeepEqual(t, []string{"d.local"}, nodes[2].Collisions)
+	assert.DeepEqual(t, []string{"c.local"}, nodes[3].Collisions)
+	assert.Assert(t, nodes[4].Collisions == nil)
+	assert.Assert(t, nodes[5].Collisions == nil)
+}
+
+// Start a peer that handles a single connection with the given function,
+// returning its address.
+func startPeer(t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}()
+	return listener.Addr().String()
+}
+
+func TestHello(t *testing.T) {
+	ctx := context.Background()
+	t.Run("responding", func(t *testing.T) {
+		address := startPeer(t, func(netConn net.Conn) {
+			conn := api.NewConn(netConn)
+			if _, err := conn.ReadMessage(); err != nil {
+				t.Error(err)
+				return
+			}
+			resp := &pb.HelloResponse{}
+			resp.SetName("kitchen")
+			resp.SetServerInfo("test server")
+			assert.Check(t, conn.WriteMessage(resp))
+			_, _ = conn.ReadMessage() // Disconnect request
+		})
+		resp, err := hello(ctx, address, time.Second)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.GetName(), "kitchen")
+		assert.Equal(t, resp.GetServerInfo(), "test server")
+	})
+	t.Run("timeout", func(t *testing.T) {
+		done := make(chan struct{})
+		defer close(done)
+		address := startPeer(t, func(net.Conn) { <-done })
+		_, err := hello(ctx, address, 100*time.Millisecond)
+		assert.Assert(t, errors.Is(err, os.ErrDeadlineExceeded), "unexpected error %v", err)
+	})
+	t.Run("wrong protocol", func(t *testing.T) {
+		address := startPeer(t, func(conn net.Conn) {
+			_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		})
+		_, err := hello(ctx, address, time.Second)
+		assert.ErrorContains(t, err, "invalid header byte")
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		address := startPeer(t, func(conn net.Conn) {
+			reason := []byte("\x01Bad indicator byte")
+			frame := append([]byte{0x01, 0x00, byte(len(reason))}, reason...)
+			_, _ = conn.Write(frame)
+		})
+		_, err := hello(ctx, address, time.Second)
+		assert.Assert(t, errors.Is(err, errEncrypted), "unexpected error %v", err)
+	})
+}
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+	encrypted := startPeer(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte{0x01, 0x00, 0x00})
+	})
+	host, portString, err := net.SplitHostPort(encrypted)
+	assert.NilError(t, err)
+	port, err := strconv.Atoi(portString)
+	assert.NilError(t, err)
+
+	node := &Node{Addresses: []string{host}, Port: port}
+	assert.NilError(t, node.probe(ctx, time.Second))
+	assert.Assert(t, node.Reachable)
+	assert.Assert(t, node.Encrypted)
+
+	node = &Node{}
+	assert.ErrorContains(t, node.probe(ctx, time.Second), "no addresses")
+	assert.Assert(t, !node.Reachable)
+}
@@ -163,6 +163,19 @@ func unParen(expr ast.Expr) ast.Expr {
 	}
 }
 
+// Describe the type of a configuration field, abbreviating nested structures.
+func typeName(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.StructType:
+		return "struct"
+	case *ast.ArrayType:
+		if expr.Len == nil {
+			return "[]" + typeName(unParen(expr.Elt))
+		}
+	}
+	return types.ExprString(expr)
+}
+
 // Given a StructType of configuration, return the configuration items for
 // templating.  The prefix is pre-pended to the field names, for use with nested
 // structures.
@@ -196,13 +209,20 @@ func parseConfigProperties(structType *ast.StructType, prefix []string) (map[str
 			comment = strings.TrimSpace(field.Comment.Text())
 		}
 		if field.Doc != nil {
-			comment = strings.TrimSpace(field.Doc.Text())
+			// Table cells must fit on one line.
+			comment = strings.Join(strings.Fields(field.Doc.Text()), " ")
 		}
+		fieldType := unParen(field.Type)
 		result[strings.Join(fullName, ".")] = configItem{
-			Type:        fmt.Sprintf("%s", unParen(field.Type)),
+			Type:        typeName(fieldType),
 			Description: comment,
 		}
-		if nestedStruct, ok := unParen(field.Type).(*ast.StructType); ok {
+		if arrayType, ok := fieldType.(*ast.ArrayType); ok {
+			// Document the fields of each list item.
+			fullName[len(fullName)-1] += "[]"
+			fieldType = unParen(arrayType.Elt)
+		}
+		if nestedStruct, ok := fieldType.(*ast.StructType); ok {
 			childItems, err := parseConfigProperties(nestedStruct, fullName)
 			if err != nil {
 				return nil, err
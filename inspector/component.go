@@ -0,0 +1,190 @@
+// The `inspector` component is a transparent native API proxy: it accepts
+// connections from Home Assistant (or any other client) and relays them to an
+// upstream ESPHome device, logging every message passed along unchanged.  If
+// the upstream device uses encryption, the key must be configured here so that
+// the messages can be decrypted; clients must then connect to the inspector
+// with the same key.  The `api` component of another mockesphome instance
+// (optionally with encryption) can be used as the upstream device.
+package inspector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/components"
+	"github.com/mook/mockesphome/utils"
+)
+
+const (
+	defaultPort = 6053
+)
+
+// Configuration for the component.
+type Configuration struct {
+	Port       int    // The port to listen on; defaults to 6053.
+	Upstream   string // Address (host:port) of the ESPHome device to relay to.
+	Record     string // Directory to record each connection's messages to, for use with `mockesphome replay`.
+	Encryption struct {
+		Key string // Base64-encoded encryption key of the upstream device.
+	}
+}
+
+type component struct {
+	config Configuration
+	key    []byte // Decoded encryption key, if any
+}
+
+func (c *component) ID() string {
+	return "inspector"
+}
+
+func (c *component) Dependencies() []string {
+	return nil
+}
+
+func (c *component) Configure(ctx context.Context, load func(any) error) error {
+	c.config.Port = defaultPort
+	if err := load(&c.config); err != nil {
+		return err
+	}
+	if c.config.Upstream == "" {
+		return fmt.Errorf("no upstream device configured")
+	}
+	if c.config.Encryption.Key != "" {
+		key, err := base64.StdEncoding.DecodeString(c.config.Encryption.Key)
+		if err != nil {
+			return fmt.Errorf("failed to decode encryption key: %w", err)
+		}
+		c.key = key
+	}
+	return nil
+}
+
+func (c *component) Start(ctx context.Context) error {
+	listenConfig := &net.ListenConfig{}
+	listener, err := listenConfig.Listen(ctx, "tcp", fmt.Sprintf(":%d", c.config.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for connections: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := listener.Close(); err != nil {
+			slog.ErrorContext(ctx, "failed to close listener", "error", err)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err == nil {
+				go c.relay(ctx, conn)
+			} else if errors.Is(err, net.ErrClosed) {
+				break
+			} else {
+				slog.ErrorContext(ctx, "failed to accept connection", "error", err)
+				break
+			}
+		}
+	}()
+	slog.InfoContext(ctx, "inspector listening", "port", c.config.Port, "upstream", c.config.Upstream)
+	return nil
+}
+
+// Relay a single client connection to the upstream device.
+func (c *component) relay(ctx context.Context, clientConn net.Conn) {
+	peer := clientConn.RemoteAddr().String()
+	slog.InfoContext(ctx, "starting new connection", "peer", peer)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer clientConn.Close()
+
+	dialer := &net.Dialer{}
+	upstreamConn, err := dialer.DialContext(ctx, "tcp", c.config.Upstream)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to connect to upstream", "upstream", c.config.Upstream, "error", err)
+		return
+	}
+	defer upstreamConn.Close()
+
+	var client, upstream *api.Conn
+	if c.key != nil {
+		var name, mac string
+		upstream, name, mac, err = api.NewNoiseClientConn(upstreamConn, c.key)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed encrypted handshake with upstream", "error", err)
+			return
+		}
+		client, err = api.NewNoiseServerConn(clientConn, c.key, name, mac)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed encrypted handshake with client", "peer", peer, "error", err)
+			return
+		}
+	} else {
+		upstream = api.NewConn(upstreamConn)
+		client = api.NewConn(clientConn)
+	}
+
+	if c.config.Record != "" {
+		file, err := api.CreateRecording(c.config.Record, "inspector")
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create recording", "error", err)
+		} else {
+			// Record from the point of view of the device.
+			recorder := api.NewRecorder(file)
+			defer recorder.Close()
+			client.SetRecorder(recorder)
+			slog.InfoContext(ctx, "recording connection", "peer", peer, "path", file.Name())
+		}
+	}
+
+	go pipe(ctx, cancel, client, upstream, "client", "upstream")
+	go pipe(ctx, cancel, upstream, client, "upstream", "client")
+	<-ctx.Done()
+	slog.InfoContext(ctx, "closing connection", "peer", peer)
+}
+
+// Copy messages from one connection to the other, logging them, until either
+// connection fails.  Messages are passed on exactly as received, including
+// those of types this build does not know about.
+func pipe(ctx context.Context, cancel context.CancelFunc, from, to *api.Conn, fromName, toName string) {
+	defer cancel()
+	for {
+		typeID, payload, err := from.ReadFrame()
+		if err != nil {
+			if ctx.Err() == nil && !utils.AnyError(err, io.EOF, net.ErrClosed) {
+				slog.ErrorContext(ctx, "failed to read message", "from", fromName, "error", err)
+			}
+			return
+		}
+		if msg, err := api.DecodeMessage(typeID, payload); err == nil {
+			slog.InfoContext(ctx, "relaying message",
+				"from", fromName,
+				"to", toName,
+				"type", msg.ProtoReflect().Descriptor().Name(),
+				"message", msg)
+		} else {
+			slog.InfoContext(ctx, "relaying unknown message",
+				"from", fromName,
+				"to", toName,
+				"type", typeID,
+				"payload", hex.EncodeToString(payload),
+				"error", err)
+		}
+		if err := to.WriteFrame(typeID, payload); err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "failed to relay message", "to", toName, "error", err)
+			}
+			return
+		}
+	}
+}
+
+func init() {
+	components.Register(&component{})
+}
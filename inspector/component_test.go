@@ -0,0 +1,181 @@
+package inspector
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"github.com/mook/mockesphome/components"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+// Start an inspector relaying to the given upstream, returning its address.
+func startInspector(t *testing.T, ctx context.Context, c *component) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.relay(ctx, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Send the initial messages a client would, returning the responses.
+func exchange(t *testing.T, conn *api.Conn) []proto.Message {
+	hello := &pb.HelloRequest{}
+	hello.SetClientInfo("test")
+	requests := []proto.Message{hello, &pb.ConnectRequest{}, &pb.DeviceInfoRequest{}}
+	var responses []proto.Message
+	for _, req := range requests {
+		assert.NilError(t, conn.WriteMessage(req))
+		resp, err := conn.ReadMessage()
+		assert.NilError(t, err)
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+func TestRelayPlaintext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Run a real API server as the upstream.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	assert.NilError(t, listener.Close())
+	config := fmt.Sprintf("api:\n  port: %d\n", port)
+	assert.NilError(t, components.LoadConfiguration(ctx, strings.NewReader(config)))
+	assert.NilError(t, components.StartComponents(ctx))
+	upstreamAddr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	directConn, err := net.Dial("tcp", upstreamAddr)
+	assert.NilError(t, err)
+	defer directConn.Close()
+	expected := exchange(t, api.NewConn(directConn))
+
+	c := &component{config: Configuration{Upstream: upstreamAddr, Record: t.TempDir()}}
+	relayedConn, err := net.Dial("tcp", startInspector(t, ctx, c))
+	assert.NilError(t, err)
+	defer relayedConn.Close()
+	actual := exchange(t, api.NewConn(relayedConn))
+
+	assert.Equal(t, len(actual), len(expected))
+	for i := range expected {
+		assert.Assert(t, proto.Equal(expected[i], actual[i]), "expected %v, got %v", expected[i], actual[i])
+	}
+}
+
+func TestRelayEncrypted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	// Run a scripted encrypted upstream that answers a hello request.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+	go func() {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+		conn, err := api.NewNoiseServerConn(netConn, key, "upstream", "01:02:03:04:05:06")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req, err := conn.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp := &pb.HelloResponse{}
+		resp.SetServerInfo(req.(*pb.HelloRequest).GetClientInfo())
+		if err := conn.WriteMessage(resp); err != nil {
+			t.Error(err)
+		}
+		_, _ = conn.ReadMessage() // Wait for the client to hang up.
+	}()
+
+	c := &component{key: key, config: Configuration{Upstream: listener.Addr().String()}}
+	c.config.Encryption.Key = base64.StdEncoding.EncodeToString(key)
+	netConn, err := net.Dial("tcp", startInspector(t, ctx, c))
+	assert.NilError(t, err)
+	defer netConn.Close()
+	conn, name, mac, err := api.NewNoiseClientConn(netConn, key)
+	assert.NilError(t, err)
+	assert.Equal(t, name, "upstream")
+	assert.Equal(t, mac, "01:02:03:04:05:06")
+
+	hello := &pb.HelloRequest{}
+	hello.SetClientInfo("relayed")
+	assert.NilError(t, conn.WriteMessage(hello))
+	resp, err := conn.ReadMessage()
+	assert.NilError(t, err)
+	assert.Equal(t, resp.(*pb.HelloResponse).GetServerInfo(), "relayed")
+}
+
+func TestRelayUnknownMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Run a scripted upstream that echoes back whatever it receives.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+	go func() {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+		conn := api.NewConn(netConn)
+		for {
+			typeID, payload, err := conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteFrame(typeID, payload); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	c := &component{config: Configuration{Upstream: listener.Addr().String()}}
+	netConn, err := net.Dial("tcp", startInspector(t, ctx, c))
+	assert.NilError(t, err)
+	defer netConn.Close()
+	conn := api.NewConn(netConn)
+
+	// A message type that does not exist is passed through unchanged, and
+	// the connection keeps working afterwards.
+	payload := []byte{0x0a, 0x03, 'a', 'b', 'c', 0xff}
+	assert.NilError(t, conn.WriteFrame(9999, payload))
+	typeID, echoed, err := conn.ReadFrame()
+	assert.NilError(t, err)
+	assert.Equal(t, typeID, uint64(9999))
+	assert.DeepEqual(t, echoed, payload)
+
+	hello := &pb.HelloRequest{}
+	hello.SetClientInfo("after")
+	assert.NilError(t, conn.WriteMessage(hello))
+	resp, err := conn.ReadMessage()
+	assert.NilError(t, err)
+	assert.Equal(t, resp.(*pb.HelloRequest).GetClientInfo(), "after")
+}
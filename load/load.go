@@ -3,6 +3,10 @@ package load
 
 import (
 	_ "github.com/mook/mockesphome/api"
+	_ "github.com/mook/mockesphome/ble_client"
+	_ "github.com/mook/mockesphome/ble_presence"
+	_ "github.com/mook/mockesphome/ble_sensor"
 	_ "github.com/mook/mockesphome/bluetooth_proxy"
+	_ "github.com/mook/mockesphome/inspector"
 	_ "github.com/mook/mockesphome/pprof"
 )
@@ -14,8 +14,11 @@ import (
 	"syscall"
 
 	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/mook/mockesphome/client"
 	"github.com/mook/mockesphome/components"
+	"github.com/mook/mockesphome/discover"
 	_ "github.com/mook/mockesphome/load"
+	"github.com/mook/mockesphome/replay"
 )
 
 var (
@@ -24,6 +27,12 @@ var (
 	flagVerbose = flag.Bool("verbose", false, "emit extra logging")
 	//go:embed doc/notice.txt.gz
 	licenseText []byte
+	// Subcommands; if no subcommand is given, the configured components are run.
+	commands = map[string]func(context.Context, []string) error{
+		"client":   client.Run,
+		"discover": discover.Run,
+		"replay":   replay.Run,
+	}
 )
 
 func run(ctx context.Context) error {
@@ -46,6 +55,14 @@ func run(ctx context.Context) error {
 		return err
 	}
 
+	if flag.NArg() > 0 {
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			return fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		return command(ctx, flag.Args()[1:])
+	}
+
 	configFile, err := os.Open(*flagConfig)
 	if err != nil {
 		return fmt.Errorf("failed to read config file: %w", err)
@@ -0,0 +1,316 @@
+// Package mqtt is a minimal MQTT 3.1.1 client, for components that exchange
+// data with MQTT brokers.  Only QoS 0 is supported, which is enough for
+// streaming advertisements where a lost message is soon replaced by the next.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeepAlive = time.Minute
+	writeTimeout     = 10 * time.Second
+)
+
+// Errors for CONNACK return codes, by code.
+var connectErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Options for connecting to a broker.
+type Options struct {
+	ClientID  string        // Client identifier; if empty, the broker assigns one.
+	Username  string        // User name, if the broker needs one.
+	Password  string        // Password, if the broker needs one.
+	KeepAlive time.Duration // Longest time between packets; defaults to 1m.
+	TLS       *tls.Config   // Use TLS with this configuration, if set.
+	// Called (from the goroutine reading from the broker, so it should be
+	// quick) for each message published to a subscribed topic.
+	OnMessage func(topic string, payload []byte)
+}
+
+// A connection to a broker.
+type Client struct {
+	conn      net.Conn
+	options   Options
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	nextID    uint16
+	pending   map[uint16]chan []byte // SUBACK return codes, by packet identifier
+	done      chan struct{}          // Closed when the connection is lost or closed
+	err       error                  // Why the connection was lost
+}
+
+// Connect to a broker at the given address (host and port).
+func Dial(ctx context.Context, address string, options Options) (*Client, error) {
+	if options.KeepAlive <= 0 {
+		options.KeepAlive = defaultKeepAlive
+	}
+	var conn net.Conn
+	var err error
+	if options.TLS != nil {
+		dialer := &tls.Dialer{Config: options.TLS}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:    conn,
+		options: options,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+	}
+	reader := bufio.NewReader(conn)
+	if err := c.connect(ctx, reader); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go c.read(reader)
+	go c.keepAlive()
+	return c, nil
+}
+
+// Send CONNECT and wait for CONNACK.
+func (c *Client) connect(ctx context.Context, reader *bufio.Reader) error {
+	flags := byte(0x02) // Clean session
+	body := AppendString(nil, "MQTT")
+	body = append(body, 4) // Protocol level 3.1.1
+	if c.options.Username != "" {
+		flags |= 0x80
+	}
+	if c.options.Password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(c.options.KeepAlive/time.Second))
+	body = AppendString(body, c.options.ClientID)
+	if c.options.Username != "" {
+		body = AppendString(body, c.options.Username)
+	}
+	if c.options.Password != "" {
+		body = AppendString(body, c.options.Password)
+	}
+	if err := c.write(&Packet{Type: TypeConnect, Body: body}); err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(writeTimeout)
+	}
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	p, err := ReadPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if p.Type != TypeConnAck || len(p.Body) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", p.Type)
+	}
+	if code := p.Body[1]; code != 0 {
+		if msg, ok := connectErrors[code]; ok {
+			return fmt.Errorf("connection refused: %s", msg)
+		}
+		return fmt.Errorf("connection refused with code %d", code)
+	}
+	return nil
+}
+
+// Write a packet to the broker.
+func (c *Client) write(p *Packet) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(p.Bytes())
+	return err
+}
+
+// Mark the connection as lost, if it was not already.
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	close(c.done)
+	_ = c.conn.Close()
+}
+
+// Read packets from the broker until the connection is lost.
+func (c *Client) read(reader *bufio.Reader) {
+	for {
+		// Allow the broker half a keep-alive period to answer our pings.
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.options.KeepAlive * 3 / 2)); err != nil {
+			c.fail(err)
+			return
+		}
+		p, err := ReadPacket(reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch p.Type {
+		case TypePublish:
+			topic, payload, err := ParsePublish(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if c.options.OnMessage != nil {
+				c.options.OnMessage(topic, payload)
+			}
+		case TypeSubAck:
+			if len(p.Body) < 2 {
+				c.fail(fmt.Errorf("truncated SUBACK"))
+				return
+			}
+			id := binary.BigEndian.Uint16(p.Body)
+			c.lock.Lock()
+			result, ok := c.pending[id]
+			delete(c.pending, id)
+			c.lock.Unlock()
+			if ok {
+				result <- p.Body[2:]
+			}
+		case TypePingResp:
+		default:
+			c.fail(fmt.Errorf("unexpected packet type %d", p.Type))
+			return
+		}
+	}
+}
+
+// Ping the broker, so that it knows we are still here.
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.options.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(&Packet{Type: TypePingReq}); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// Publish a message at QoS 0.
+func (c *Client) Publish(topic string, payload []byte) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	if err := c.write(PublishPacket(topic, payload)); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Subscribe to topic filters at QoS 0, waiting for the broker to accept them.
+// Messages are passed to [Options.OnMessage].
+func (c *Client) Subscribe(ctx context.Context, filters ...string) error {
+	c.lock.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID++
+	}
+	id := c.nextID
+	result := make(chan []byte, 1)
+	c.pending[id] = result
+	c.lock.Unlock()
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, filter := range filters {
+		body = AppendString(body, filter)
+		body = append(body, 0) // QoS 0
+	}
+	if err := c.write(&Packet{Type: TypeSubscribe, Flags: 0x02, Body: body}); err != nil {
+		c.fail(err)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.Err()
+	case codes := <-result:
+		for i, code := range codes {
+			if code&0x80 != 0 && i < len(filters) {
+				return fmt.Errorf("subscription to %q refused", filters[i])
+			}
+		}
+		return nil
+	}
+}
+
+// A channel closed when the connection is lost or closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Why the connection was lost, once [Client.Done] is closed.
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Disconnect from the broker.
+func (c *Client) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	err := c.write(&Packet{Type: TypeDisconnect})
+	c.fail(net.ErrClosed)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Check whether a topic matches a topic filter, which may contain `+` for any
+// single level and end in `#` for any number of levels.
+func Match(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,118 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/mqtt"
+	"github.com/mook/mockesphome/mqtt/mqtttest"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func TestPacket(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 200) // Needs a two-byte length
+	encoded := mqtt.PublishPacket("a/b", payload).Bytes()
+	assert.DeepEqual(t, encoded[:3], []byte{0x30, 0xCD, 0x01})
+	p, err := mqtt.ReadPacket(bufio.NewReader(bytes.NewReader(encoded)))
+	assert.NilError(t, err)
+	topic, got, err := mqtt.ParsePublish(p)
+	assert.NilError(t, err)
+	assert.Equal(t, topic, "a/b")
+	assert.DeepEqual(t, got, payload)
+
+	_, err = mqtt.ReadPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01})))
+	assert.ErrorContains(t, err, "invalid remaining length")
+	_, _, err = mqtt.ReadString([]byte{0, 5, 'a'})
+	assert.ErrorContains(t, err, "truncated")
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"#", "a", true},
+		{"a/b/c", "a/b", false},
+	} {
+		assert.Equal(t, mqtt.Match(tc.filter, tc.topic), tc.match, "%s %s", tc.filter, tc.topic)
+	}
+}
+
+func TestClient(t *testing.T) {
+	broker := mqtttest.NewBroker(t)
+	received := make(chan string, 1)
+	client, err := mqtt.Dial(t.Context(), broker.Addr(), mqtt.Options{
+		ClientID:  "test",
+		Username:  "user",
+		Password:  "secret",
+		KeepAlive: 100 * time.Millisecond,
+		OnMessage: func(topic string, payload []byte) {
+			received <- topic + "=" + string(payload)
+		},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, broker.Connects(), []mqtttest.Connect{{ClientID: "test", Username: "user", Password: "secret"}})
+
+	assert.NilError(t, client.Publish("out/x", []byte("hello")))
+	msg := <-broker.Messages()
+	assert.Equal(t, msg.Topic, "out/x")
+	assert.Equal(t, string(msg.Payload), "hello")
+
+	assert.NilError(t, client.Subscribe(t.Context(), "in/+"))
+	assert.Equal(t, broker.Publish("other/x", []byte("no")), 0)
+	assert.Equal(t, broker.Publish("in/x", []byte("yes")), 1)
+	assert.Equal(t, <-received, "in/x=yes")
+
+	// Pings keep the connection alive.
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-client.Done():
+		t.Fatalf("connection lost: %s", client.Err())
+	default:
+	}
+
+	assert.NilError(t, client.Close())
+	assert.ErrorIs(t, client.Publish("out/x", nil), net.ErrClosed)
+	assert.NilError(t, client.Close())
+
+	// The client notices when the broker goes away.
+	client, err = mqtt.Dial(t.Context(), broker.Addr(), mqtt.Options{})
+	assert.NilError(t, err)
+	broker.Close()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		select {
+		case <-client.Done():
+			return poll.Success()
+		default:
+			return poll.Continue("still connected")
+		}
+	})
+	assert.Assert(t, client.Err() != nil)
+}
+
+func TestRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := mqtt.ReadPacket(bufio.NewReader(conn)); err == nil {
+			_, _ = conn.Write((&mqtt.Packet{Type: mqtt.TypeConnAck, Body: []byte{0, 4}}).Bytes())
+		}
+	}()
+	_, err = mqtt.Dial(t.Context(), listener.Addr().String(), mqtt.Options{Username: "wrong"})
+	assert.ErrorContains(t, err, "bad user name or password")
+}
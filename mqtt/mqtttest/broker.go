@@ -0,0 +1,233 @@
+// Package mqtttest provides a stand-in MQTT broker for tests, in the manner of
+// net/http/httptest.
+package mqtttest
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/mook/mockesphome/mqtt"
+)
+
+// A message published to the broker.
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// The credentials a client connected with.
+type Connect struct {
+	ClientID string
+	Username string
+	Password string
+}
+
+// A broker listening on a local port, accepting QoS 0 messages from any client
+// and passing them on to subscribers.
+type Broker struct {
+	listener net.Listener
+	messages chan Message
+
+	lock     sync.Mutex
+	connects []Connect
+	clients  map[*client]struct{}
+}
+
+// A connected client.
+type client struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	filters   []string
+}
+
+// Start a broker, which is closed when the test ends.
+func NewBroker(t testing.TB) *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	b := &Broker{
+		listener: listener,
+		messages: make(chan Message, 100),
+		clients:  make(map[*client]struct{}),
+	}
+	t.Cleanup(b.Close)
+	go b.accept()
+	return b
+}
+
+// The address (host and port) the broker is listening on.
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Messages published by clients, in the order they arrived.
+func (b *Broker) Messages() <-chan Message {
+	return b.messages
+}
+
+// Every CONNECT seen so far.
+func (b *Broker) Connects() []Connect {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]Connect(nil), b.connects...)
+}
+
+// Publish a message to every client subscribed to the topic, returning the
+// number of clients it was sent to.
+func (b *Broker) Publish(topic string, payload []byte) int {
+	b.lock.Lock()
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.lock.Unlock()
+	sent := 0
+	for _, c := range clients {
+		if c.subscribed(topic) && c.write(mqtt.PublishPacket(topic, payload)) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// Stop listening and disconnect every client.
+func (b *Broker) Close() {
+	_ = b.listener.Close()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for c := range b.clients {
+		_ = c.conn.Close()
+	}
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(&client{conn: conn})
+	}
+}
+
+// Handle a client's packets until it disconnects.
+func (b *Broker) serve(c *client) {
+	defer func() {
+		_ = c.conn.Close()
+		b.lock.Lock()
+		delete(b.clients, c)
+		b.lock.Unlock()
+	}()
+	reader := bufio.NewReader(c.conn)
+	p, err := mqtt.ReadPacket(reader)
+	if err != nil || p.Type != mqtt.TypeConnect {
+		return
+	}
+	connect, ok := parseConnect(p.Body)
+	if !ok {
+		return
+	}
+	b.lock.Lock()
+	b.connects = append(b.connects, connect)
+	b.clients[c] = struct{}{}
+	b.lock.Unlock()
+	if c.write(&mqtt.Packet{Type: mqtt.TypeConnAck, Body: []byte{0, 0}}) != nil {
+		return
+	}
+	for {
+		p, err := mqtt.ReadPacket(reader)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case mqtt.TypePublish:
+			topic, payload, err := mqtt.ParsePublish(p)
+			if err != nil {
+				return
+			}
+			b.messages <- Message{Topic: topic, Payload: payload}
+		case mqtt.TypeSubscribe:
+			if len(p.Body) < 2 {
+				return
+			}
+			resp := append([]byte(nil), p.Body[:2]...)
+			rest := p.Body[2:]
+			for len(rest) > 0 {
+				filter, next, err := mqtt.ReadString(rest)
+				if err != nil || len(next) < 1 {
+					return
+				}
+				rest = next[1:]
+				c.lock.Lock()
+				c.filters = append(c.filters, filter)
+				c.lock.Unlock()
+				resp = append(resp, 0)
+			}
+			if c.write(&mqtt.Packet{Type: mqtt.TypeSubAck, Body: resp}) != nil {
+				return
+			}
+		case mqtt.TypePingReq:
+			if c.write(&mqtt.Packet{Type: mqtt.TypePingResp}) != nil {
+				return
+			}
+		case mqtt.TypeDisconnect:
+			return
+		}
+	}
+}
+
+// Parse the client ID and credentials from a CONNECT packet.
+func parseConnect(body []byte) (Connect, bool) {
+	var connect Connect
+	_, rest, err := mqtt.ReadString(body) // Protocol name
+	if err != nil || len(rest) < 4 {
+		return connect, false
+	}
+	flags := rest[1]
+	rest = rest[4:] // Protocol level, flags and keep-alive
+	if connect.ClientID, rest, err = mqtt.ReadString(rest); err != nil {
+		return connect, false
+	}
+	if flags&0x04 != 0 { // Will topic and message
+		if _, rest, err = mqtt.ReadString(rest); err != nil {
+			return connect, false
+		}
+		if _, rest, err = mqtt.ReadString(rest); err != nil {
+			return connect, false
+		}
+	}
+	if flags&0x80 != 0 {
+		if connect.Username, rest, err = mqtt.ReadString(rest); err != nil {
+			return connect, false
+		}
+	}
+	if flags&0x40 != 0 {
+		if connect.Password, _, err = mqtt.ReadString(rest); err != nil {
+			return connect, false
+		}
+	}
+	return connect, true
+}
+
+// Check whether the client is subscribed to a topic.
+func (c *client) subscribed(topic string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, filter := range c.filters {
+		if mqtt.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) write(p *mqtt.Packet) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(p.Bytes())
+	return err
+}
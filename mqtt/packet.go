@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MQTT control packet types.
+const (
+	TypeConnect    = 1
+	TypeConnAck    = 2
+	TypePublish    = 3
+	TypeSubscribe  = 8
+	TypeSubAck     = 9
+	TypePingReq    = 12
+	TypePingResp   = 13
+	TypeDisconnect = 14
+)
+
+// Largest packet accepted, to avoid allocating huge buffers for bad input.
+const maxPacketSize = 1 << 20
+
+// A control packet, split into its type, flags and the rest.
+type Packet struct {
+	Type  byte
+	Flags byte // The low four bits of the fixed header
+	Body  []byte
+}
+
+// Read a control packet.
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return nil, fmt.Errorf("invalid remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &Packet{Type: header >> 4, Flags: header & 0x0F, Body: body}, nil
+}
+
+// Encode the packet, ready to be written.
+func (p *Packet) Bytes() []byte {
+	buf := []byte{p.Type<<4 | p.Flags}
+	length := len(p.Body)
+	for {
+		b := byte(length & 0x7F)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(buf, p.Body...)
+}
+
+// Append a length-prefixed string (or binary data).
+func AppendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// Read a length-prefixed string from the start of the data, returning it and
+// the rest of the data.
+func ReadString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, fmt.Errorf("truncated string")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return "", nil, fmt.Errorf("truncated string")
+	}
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+// Build a PUBLISH packet at QoS 0.
+func PublishPacket(topic string, payload []byte) *Packet {
+	return &Packet{Type: TypePublish, Body: append(AppendString(nil, topic), payload...)}
+}
+
+// Parse the topic and payload of a PUBLISH packet.
+func ParsePublish(p *Packet) (string, []byte, error) {
+	topic, rest, err := ReadString(p.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if qos := p.Flags >> 1 & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return "", nil, fmt.Errorf("truncated packet identifier")
+		}
+		rest = rest[2:]
+	}
+	return topic, rest, nil
+}
@@ -0,0 +1,186 @@
+// Package replay implements the `replay` subcommand, which plays back a
+// recording made by the `api` component (see its `record` setting).  It can
+// either act as a client, driving a server with the messages the recorded
+// server received, or act as a server, impersonating the recorded server toward
+// a client.
+package replay
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+// Options for replaying a recording.
+type Options struct {
+	Send    api.Direction // Entries in this direction are sent; others are expected to be received.
+	Speed   float64       // Multiplier for delays between sent messages; zero to send without delay.
+	Timeout time.Duration // How long to wait for each expected message.
+}
+
+// Run the `replay` subcommand with the given command line arguments.
+func Run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	mode := flags.String("mode", "client", "client: connect to a server and replay the client side; server: listen and replay the server side")
+	address := flags.String("address", "localhost:6053", "address to connect to (client mode) or listen on (server mode)")
+	speed := flags.Float64("speed", 1, "playback speed; 0 sends messages without delay")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each expected message")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] <recording.jsonl>\n\nFlags:\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one recording")
+	}
+
+	entries, err := load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	opts := Options{Speed: *speed, Timeout: *timeout}
+
+	var netConn net.Conn
+	switch *mode {
+	case "client":
+		// The recording was made by the server, so send what it received.
+		opts.Send = api.DirectionIn
+		dialer := &net.Dialer{}
+		netConn, err = dialer.DialContext(ctx, "tcp", *address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", *address, err)
+		}
+	case "server":
+		opts.Send = api.DirectionOut
+		listenConfig := &net.ListenConfig{}
+		listener, err := listenConfig.Listen(ctx, "tcp", *address)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", *address, err)
+		}
+		slog.InfoContext(ctx, "waiting for connection", "address", listener.Addr())
+		netConn, err = listener.Accept()
+		_ = listener.Close()
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", *mode)
+	}
+	defer netConn.Close()
+
+	return Replay(ctx, api.NewConn(netConn), entries, opts)
+}
+
+// Load a recording from a file.
+func load(path string) ([]*api.RecordEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+	var entries []*api.RecordEntry
+	for entry, err := range api.ReadRecording(file) {
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Replay the recorded entries on the given connection.  Messages that were
+// recorded in the direction to send are sent (with the recorded timing, scaled
+// by the playback speed); for the remaining messages we wait for a message of
+// the same type from the peer.
+func Replay(ctx context.Context, conn *api.Conn, entries []*api.RecordEntry, opts Options) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	incoming := make(chan proto.Message)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(incoming)
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case incoming <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var lastSent time.Time
+	for i, entry := range entries {
+		if entry.Direction == opts.Send {
+			if !lastSent.IsZero() && opts.Speed > 0 {
+				delay := time.Duration(float64(entry.Time.Sub(lastSent)) / opts.Speed)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			lastSent = entry.Time
+			msg, err := entry.Decode()
+			if err != nil {
+				return fmt.Errorf("failed to decode entry %d: %w", i, err)
+			}
+			if err := conn.WriteMessage(msg); err != nil {
+				return err
+			}
+			slog.InfoContext(ctx, "sent message", "entry", i, "type", entry.Name)
+			continue
+		}
+
+		// Wait for the peer to send the expected message.
+		timer := time.NewTimer(opts.Timeout)
+	waitLoop:
+		for {
+			select {
+			case msg, ok := <-incoming:
+				if !ok {
+					if err := <-readErr; !utils.AnyError(err, net.ErrClosed) {
+						return fmt.Errorf("connection closed while waiting for %s: %w", entry.Name, err)
+					}
+					return nil
+				}
+				name := string(msg.ProtoReflect().Descriptor().Name())
+				if name == entry.Name {
+					slog.InfoContext(ctx, "received expected message", "entry", i, "type", name)
+					break waitLoop
+				}
+				slog.WarnContext(ctx, "received unexpected message", "entry", i, "expected", entry.Name, "type", name)
+			case <-timer.C:
+				slog.WarnContext(ctx, "timed out waiting for message", "entry", i, "expected", entry.Name)
+				break waitLoop
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			}
+		}
+		timer.Stop()
+		// Restart timing from when the expected message arrived.
+		lastSent = entry.Time
+	}
+
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mook/mockesphome/api"
+	"github.com/mook/mockesphome/api/pb"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+// A message received by the scripted peer, with its arrival time.
+type arrival struct {
+	name string
+	time time.Time
+}
+
+// Build a recording of a server receiving a hello and connect request.
+func recording(t *testing.T) []*api.RecordEntry {
+	var buf bytes.Buffer
+	recorder := api.NewRecorder(&buf)
+	for _, step := range []struct {
+		direction api.Direction
+		msg       proto.Message
+	}{
+		{api.DirectionIn, &pb.HelloRequest{}},
+		{api.DirectionOut, &pb.HelloResponse{}},
+		{api.DirectionIn, &pb.ConnectRequest{}},
+		{api.DirectionOut, &pb.ConnectResponse{}},
+	} {
+		assert.NilError(t, recorder.Record(step.direction, step.msg))
+	}
+	var entries []*api.RecordEntry
+	for entry, err := range api.ReadRecording(&buf) {
+		assert.NilError(t, err)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Run Replay against a scripted peer, returning a connection to write to as
+// the peer, a channel of messages the peer received, and a channel that
+// receives the result of Replay.
+func start(t *testing.T, entries []*api.RecordEntry, opts Options) (*api.Conn, <-chan arrival, <-chan error) {
+	replayConn, peerConn := net.Pipe()
+	t.Cleanup(func() { _ = peerConn.Close() })
+	peer := api.NewConn(peerConn)
+
+	arrivals := make(chan arrival, len(entries))
+	go func() {
+		defer close(arrivals)
+		for {
+			msg, err := peer.ReadMessage()
+			if err != nil {
+				return
+			}
+			arrivals <- arrival{string(msg.ProtoReflect().Descriptor().Name()), time.Now()}
+		}
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- Replay(context.Background(), api.NewConn(replayConn), entries, opts)
+	}()
+	return peer, arrivals, result
+}
+
+func TestReplayClient(t *testing.T) {
+	opts := Options{Send: api.DirectionIn, Timeout: time.Second}
+	peer, arrivals, result := start(t, recording(t), opts)
+
+	hello := <-arrivals
+	assert.Equal(t, hello.name, "HelloRequest")
+	// The connect request must not be sent until the hello response arrives.
+	time.Sleep(50 * time.Millisecond)
+	responded := time.Now()
+	assert.NilError(t, peer.WriteMessage(&pb.HelloResponse{}))
+	connect := <-arrivals
+	assert.Equal(t, connect.name, "ConnectRequest")
+	assert.Assert(t, !connect.time.Before(responded), "connect request sent before hello response")
+
+	assert.NilError(t, peer.WriteMessage(&pb.ConnectResponse{}))
+	assert.NilError(t, <-result)
+}
+
+func TestReplayServer(t *testing.T) {
+	opts := Options{Send: api.DirectionOut, Timeout: time.Second}
+	peer, arrivals, result := start(t, recording(t), opts)
+
+	assert.NilError(t, peer.WriteMessage(&pb.HelloRequest{}))
+	assert.Equal(t, (<-arrivals).name, "HelloResponse")
+	assert.NilError(t, peer.WriteMessage(&pb.ConnectRequest{}))
+	assert.Equal(t, (<-arrivals).name, "ConnectResponse")
+	assert.NilError(t, <-result)
+
+	_, ok := <-arrivals
+	assert.Assert(t, !ok, "unexpected extra message")
+}
+
+func TestReplayTimeout(t *testing.T) {
+	opts := Options{Send: api.DirectionOut, Timeout: 50 * time.Millisecond}
+	started := time.Now()
+	_, arrivals, result := start(t, recording(t), opts)
+
+	// Without any requests, each response is sent after the timeout.
+	first := <-arrivals
+	assert.Equal(t, first.name, "HelloResponse")
+	assert.Assert(t, first.time.Sub(started) >= opts.Timeout)
+	second := <-arrivals
+	assert.Equal(t, second.name, "ConnectResponse")
+	assert.Assert(t, second.time.Sub(first.time) >= opts.Timeout)
+	assert.NilError(t, <-result)
+}